@@ -2,6 +2,7 @@ package conntrack
 
 import (
 	"fmt"
+	"net/netip"
 	"time"
 
 	"github.com/mdlayher/netlink"
@@ -44,7 +45,8 @@ func (hlp *Helper) unmarshal(ad *netlink.AttributeDecoder) error {
 func (hlp Helper) marshal() netfilter.Attribute {
 	nfa := netfilter.Attribute{Type: uint16(ctaHelp), Nested: true, Children: make([]netfilter.Attribute, 1, 2)}
 
-	nfa.Children[0] = netfilter.Attribute{Type: uint16(ctaHelpName), Data: []byte(hlp.Name)}
+	// The kernel only accepts NUL-terminated helper names.
+	nfa.Children[0] = netfilter.Attribute{Type: uint16(ctaHelpName), Data: []byte(hlp.Name + "\x00")}
 
 	if len(hlp.Info) > 0 {
 		nfa.Children = append(nfa.Children, netfilter.Attribute{Type: uint16(ctaHelpInfo), Data: hlp.Info})
@@ -66,6 +68,33 @@ func (pi ProtoInfo) filled() bool {
 	return pi.TCP != nil || pi.DCCP != nil || pi.SCTP != nil
 }
 
+// State returns the kernel's name of the protocol state held by the
+// ProtoInfo, like ESTABLISHED, or UNKNOWN for states it doesn't know.
+// Returns an empty string if the ProtoInfo is empty.
+func (pi ProtoInfo) State() string {
+	var (
+		states []string
+		state  uint8
+	)
+
+	switch {
+	case pi.TCP != nil:
+		states, state = tcpStates, pi.TCP.State
+	case pi.SCTP != nil:
+		states, state = sctpStates, pi.SCTP.State
+	case pi.DCCP != nil:
+		states, state = dccpStates, pi.DCCP.State
+	default:
+		return ""
+	}
+
+	if int(state) >= len(states) {
+		return "UNKNOWN"
+	}
+
+	return states[state]
+}
+
 // unmarshal unmarshals netlink attributes into a ProtoInfo.
 // one of three ProtoInfo types; TCP, DCCP or SCTP.
 func (pi *ProtoInfo) unmarshal(ad *netlink.AttributeDecoder) error {
@@ -102,7 +131,7 @@ func (pi *ProtoInfo) unmarshal(ad *netlink.AttributeDecoder) error {
 	}
 
 	if err := ad.Err(); err != nil {
-		return fmt.Errorf("unmarshal %s: %w", t, err)
+		return decodeError(attrName(protoInfoNames, t), err)
 	}
 
 	return nil
@@ -491,6 +520,107 @@ func (sp SynProxy) marshal() netfilter.Attribute {
 	return nfa
 }
 
+// A NATRange describes the range of addresses and ports a connection is
+// translated to when it is created. When MaxAddr or MaxPort are zero, the
+// kernel uses MinAddr and MinPort respectively, mapping the connection to a
+// single address or port.
+//
+// NAT setup is only considered by the kernel when creating a Flow. It is
+// never sent in dumps or events; the translated addresses show up in the
+// Flow's TupleReply instead.
+type NATRange struct {
+	MinAddr, MaxAddr netip.Addr
+	MinPort, MaxPort uint16
+}
+
+// Filled returns true if the NATRange's minimum address is set.
+func (nr NATRange) filled() bool {
+	return nr.MinAddr.IsValid()
+}
+
+// unmarshal unmarshals netlink attributes into a NATRange.
+func (nr *NATRange) unmarshal(ad *netlink.AttributeDecoder) error {
+	if ad.Len() == 0 {
+		return errNeedSingleChild
+	}
+
+	for ad.Next() {
+		switch t := natType(ad.Type()); t {
+		case ctaNATv4MinIP, ctaNATv4MaxIP, ctaNATv6MinIP, ctaNATv6MaxIP:
+			addr, ok := netip.AddrFromSlice(ad.Bytes())
+			if !ok {
+				return errIncorrectSize
+			}
+
+			if t == ctaNATv4MinIP || t == ctaNATv6MinIP {
+				nr.MinAddr = addr
+			} else {
+				nr.MaxAddr = addr
+			}
+		case ctaNATProto:
+			ad.Nested(nr.unmarshalProto)
+			if err := ad.Err(); err != nil {
+				return decodeError(attrName(natNames, t), err)
+			}
+		default:
+			return fmt.Errorf("child type %d: %w", ad.Type(), errUnknownAttribute)
+		}
+	}
+
+	return ad.Err()
+}
+
+// unmarshalProto unmarshals the nested CTA_NAT_PROTO attribute of a NATRange.
+func (nr *NATRange) unmarshalProto(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch protoNATType(ad.Type()) {
+		case ctaProtoNATPortMin:
+			nr.MinPort = ad.Uint16()
+		case ctaProtoNATPortMax:
+			nr.MaxPort = ad.Uint16()
+		default:
+			return fmt.Errorf("child type %d: %w", ad.Type(), errUnknownAttribute)
+		}
+	}
+
+	return ad.Err()
+}
+
+// marshal marshals a NATRange into a netfilter.Attribute of type at.
+func (nr NATRange) marshal(at attributeType) (netfilter.Attribute, error) {
+	minIP, maxIP := ctaNATv4MinIP, ctaNATv4MaxIP
+	switch {
+	case nr.MinAddr.Is4() && (!nr.MaxAddr.IsValid() || nr.MaxAddr.Is4()):
+	case nr.MinAddr.Is6() && (!nr.MaxAddr.IsValid() || nr.MaxAddr.Is6()):
+		minIP, maxIP = ctaNATv6MinIP, ctaNATv6MaxIP
+	default:
+		return netfilter.Attribute{}, errBadNATRange
+	}
+
+	nfa := netfilter.Attribute{Type: uint16(at), Nested: true, Children: make([]netfilter.Attribute, 1, 3)}
+
+	nfa.Children[0] = netfilter.Attribute{Type: uint16(minIP), Data: nr.MinAddr.AsSlice()}
+
+	if nr.MaxAddr.IsValid() {
+		nfa.Children = append(nfa.Children, netfilter.Attribute{Type: uint16(maxIP), Data: nr.MaxAddr.AsSlice()})
+	}
+
+	if nr.MinPort != 0 || nr.MaxPort != 0 {
+		proto := netfilter.Attribute{Type: uint16(ctaNATProto), Nested: true, Children: make([]netfilter.Attribute, 1, 2)}
+		proto.Children[0] = netfilter.Attribute{
+			Type: uint16(ctaProtoNATPortMin), Data: netfilter.Uint16Bytes(nr.MinPort),
+		}
+		if nr.MaxPort != 0 {
+			proto.Children = append(proto.Children, netfilter.Attribute{
+				Type: uint16(ctaProtoNATPortMax), Data: netfilter.Uint16Bytes(nr.MaxPort),
+			})
+		}
+		nfa.Children = append(nfa.Children, proto)
+	}
+
+	return nfa, nil
+}
+
 // TODO: ctaStats
 // TODO: ctaStatsGlobal
 // TODO: ctaStatsExp
@@ -1,6 +1,7 @@
 package conntrack
 
 import (
+	"net/netip"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -65,7 +66,7 @@ func TestAttributeHelper(t *testing.T) {
 		Children: []netfilter.Attribute{
 			{
 				Type: uint16(ctaHelpName),
-				Data: []byte("foo"),
+				Data: []byte("foo\x00"),
 			},
 			{
 				Type: uint16(ctaHelpInfo),
@@ -88,6 +89,12 @@ func TestAttributeProtoInfo(t *testing.T) {
 	assert.Equal(t, true, ProtoInfo{TCP: &ProtoInfoTCP{}}.filled())
 	assert.Equal(t, true, ProtoInfo{SCTP: &ProtoInfoSCTP{}}.filled())
 
+	assert.Equal(t, "", pi.State())
+	assert.Equal(t, "ESTABLISHED", ProtoInfo{TCP: &ProtoInfoTCP{State: 3}}.State())
+	assert.Equal(t, "COOKIE_WAIT", ProtoInfo{SCTP: &ProtoInfoSCTP{State: 2}}.State())
+	assert.Equal(t, "OPEN", ProtoInfo{DCCP: &ProtoInfoDCCP{State: 4}}.State())
+	assert.Equal(t, "UNKNOWN", ProtoInfo{TCP: &ProtoInfoTCP{State: 255}}.State())
+
 	assert.ErrorIs(t, pi.unmarshal(adEmpty), errNeedSingleChild)
 
 	// Exhaust the AttributeDecoder before passing to unmarshal.
@@ -454,3 +461,81 @@ func TestAttributeSynProxy(t *testing.T) {
 
 	assert.EqualValues(t, nfaSynProxy, sp.marshal())
 }
+
+func TestAttributeNATRange(t *testing.T) {
+	assert.False(t, NATRange{}.filled())
+	assert.True(t, NATRange{MinAddr: netip.MustParseAddr("1.2.3.4")}.filled())
+
+	nr := NATRange{
+		MinAddr: netip.MustParseAddr("10.0.0.1"),
+		MaxAddr: netip.MustParseAddr("10.0.0.10"),
+		MinPort: 1024,
+		MaxPort: 2048,
+	}
+
+	nfaNAT := netfilter.Attribute{
+		Type:   uint16(ctaNatSrc),
+		Nested: true,
+		Children: []netfilter.Attribute{
+			{Type: uint16(ctaNATv4MinIP), Data: []byte{10, 0, 0, 1}},
+			{Type: uint16(ctaNATv4MaxIP), Data: []byte{10, 0, 0, 10}},
+			{
+				Type:   uint16(ctaNATProto),
+				Nested: true,
+				Children: []netfilter.Attribute{
+					{Type: uint16(ctaProtoNATPortMin), Data: []byte{0x04, 0x00}},
+					{Type: uint16(ctaProtoNATPortMax), Data: []byte{0x08, 0x00}},
+				},
+			},
+		},
+	}
+
+	nfa, err := nr.marshal(ctaNatSrc)
+	assert.NoError(t, err)
+	assert.Equal(t, nfaNAT, nfa)
+
+	var unr NATRange
+	assert.NoError(t, unr.unmarshal(mustDecodeAttributes(nfaNAT.Children)))
+	assert.Equal(t, nr, unr)
+
+	// Single IPv6 address without port range.
+	nr6 := NATRange{MinAddr: netip.MustParseAddr("2001:db8::1")}
+	nfa, err = nr6.marshal(ctaNatDst)
+	assert.NoError(t, err)
+	assert.Equal(t, netfilter.Attribute{
+		Type:   uint16(ctaNatDst),
+		Nested: true,
+		Children: []netfilter.Attribute{
+			{Type: uint16(ctaNATv6MinIP), Data: nr6.MinAddr.AsSlice()},
+		},
+	}, nfa)
+
+	unr = NATRange{}
+	assert.NoError(t, unr.unmarshal(mustDecodeAttributes(nfa.Children)))
+	assert.Equal(t, nr6, unr)
+
+	// Mixed address families.
+	_, err = NATRange{
+		MinAddr: netip.MustParseAddr("10.0.0.1"),
+		MaxAddr: netip.MustParseAddr("2001:db8::1"),
+	}.marshal(ctaNatSrc)
+	assert.ErrorIs(t, err, errBadNATRange)
+
+	_, err = NATRange{}.marshal(ctaNatSrc)
+	assert.ErrorIs(t, err, errBadNATRange)
+
+	assert.ErrorIs(t, unr.unmarshal(adEmpty), errNeedSingleChild)
+
+	ad := adOneUnknown
+	assert.ErrorIs(t, unr.unmarshal(&ad), errUnknownAttribute)
+
+	ad = *mustDecodeAttribute(netfilter.Attribute{Type: uint16(ctaNATv4MinIP), Data: []byte{1}})
+	assert.ErrorIs(t, unr.unmarshal(&ad), errIncorrectSize)
+
+	ad = *mustDecodeAttribute(netfilter.Attribute{
+		Type:     uint16(ctaNATProto),
+		Nested:   true,
+		Children: []netfilter.Attribute{{Type: uint16(ctaProtoNATUnspec)}},
+	})
+	assert.ErrorIs(t, unr.unmarshal(&ad), errUnknownAttribute)
+}
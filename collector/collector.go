@@ -0,0 +1,269 @@
+// Package collector implements a [prometheus.Collector] exposing the
+// statistics of the conntrack subsystem.
+//
+// On each scrape, the Collector queries the per-CPU conntrack and expectation
+// counters and the global table size. Optionally, it dumps the conntrack table
+// to count Flows by address family, protocol, state and zone. Dumping is
+// expensive on large tables, so it is disabled by default.
+package collector
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+
+	"github.com/ti-mo/conntrack"
+)
+
+const namespace = "conntrack"
+
+// DefaultTimeout is the default time a scrape is allowed to take.
+const DefaultTimeout = 10 * time.Second
+
+// Source is the source of conntrack statistics, typically a [*conntrack.Conn].
+type Source interface {
+	StatsContext(ctx context.Context) ([]conntrack.Stats, error)
+	StatsExpectContext(ctx context.Context) ([]conntrack.StatsExpect, error)
+	StatsGlobalContext(ctx context.Context) (conntrack.StatsGlobal, error)
+	DumpSeqContext(ctx context.Context, opts *conntrack.DumpOptions) iter.Seq2[conntrack.Flow, error]
+}
+
+var _ Source = (*conntrack.Conn)(nil)
+
+// Options is passed to [New] to modify the behaviour of the Collector.
+type Options struct {
+	// Flows enables the conntrack_flows metric, counting Flows by address
+	// family, protocol, state and zone. This dumps the whole conntrack table
+	// on every scrape.
+	Flows bool
+
+	// Timeout bounds the duration of a scrape. Defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// protocolNames holds the label values of the layer 4 protocols tracked by
+// conntrack. Other protocols are labeled by their number.
+var protocolNames = map[uint8]string{
+	unix.IPPROTO_TCP:     "tcp",
+	unix.IPPROTO_UDP:     "udp",
+	unix.IPPROTO_UDPLITE: "udplite",
+	unix.IPPROTO_ICMP:    "icmp",
+	unix.IPPROTO_ICMPV6:  "icmpv6",
+	unix.IPPROTO_SCTP:    "sctp",
+	unix.IPPROTO_GRE:     "gre",
+	unix.IPPROTO_DCCP:    "dccp",
+}
+
+// cpuStat describes a per-CPU conntrack counter.
+type cpuStat struct {
+	desc  *prometheus.Desc
+	value func(conntrack.Stats) uint32
+}
+
+// expectStat describes a per-CPU expectation counter.
+type expectStat struct {
+	desc  *prometheus.Desc
+	value func(conntrack.StatsExpect) uint32
+}
+
+// Collector is a [prometheus.Collector] exposing conntrack statistics.
+type Collector struct {
+	src  Source
+	opts Options
+
+	cpu    []cpuStat
+	expect []expectStat
+
+	entries     *prometheus.Desc
+	maxEntries  *prometheus.Desc
+	utilization *prometheus.Desc
+	flows       *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// New returns a Collector gathering statistics from src. opts may be nil.
+func New(src Source, opts *Options) *Collector {
+	c := &Collector{src: src}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.Timeout == 0 {
+		c.opts.Timeout = DefaultTimeout
+	}
+
+	cpu := func(name, help string, value func(conntrack.Stats) uint32) cpuStat {
+		return cpuStat{
+			desc:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "stat", name+"_total"), help, []string{"cpu"}, nil),
+			value: value,
+		}
+	}
+	c.cpu = []cpuStat{
+		cpu("found", "Number of successful lookups of existing Flows.",
+			func(s conntrack.Stats) uint32 { return s.Found }),
+		cpu("invalid", "Number of packets that could not be tracked.",
+			func(s conntrack.Stats) uint32 { return s.Invalid }),
+		cpu("insert", "Number of Flows inserted into the table.",
+			func(s conntrack.Stats) uint32 { return s.Insert }),
+		cpu("insert_failed", "Number of Flows that could not be inserted into the table.",
+			func(s conntrack.Stats) uint32 { return s.InsertFailed }),
+		cpu("drop", "Number of packets dropped due to a conntrack failure.",
+			func(s conntrack.Stats) uint32 { return s.Drop }),
+		cpu("early_drop", "Number of Flows evicted to make room for new Flows when the table was full.",
+			func(s conntrack.Stats) uint32 { return s.EarlyDrop }),
+		cpu("error", "Number of packets rejected due to protocol errors.",
+			func(s conntrack.Stats) uint32 { return s.Error }),
+		cpu("search_restart", "Number of table lookups restarted due to hash table resizes.",
+			func(s conntrack.Stats) uint32 { return s.SearchRestart }),
+	}
+
+	expect := func(name, help string, value func(conntrack.StatsExpect) uint32) expectStat {
+		return expectStat{
+			desc:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "expect", name+"_total"), help, []string{"cpu"}, nil),
+			value: value,
+		}
+	}
+	c.expect = []expectStat{
+		expect("new", "Number of expectations initialized.",
+			func(s conntrack.StatsExpect) uint32 { return s.New }),
+		expect("create", "Number of expectations created.",
+			func(s conntrack.StatsExpect) uint32 { return s.Create }),
+		expect("delete", "Number of expectations deleted.",
+			func(s conntrack.StatsExpect) uint32 { return s.Delete }),
+	}
+
+	c.entries = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "entries"),
+		"Number of Flows in the conntrack table.", nil, nil)
+	c.maxEntries = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "max_entries"),
+		"Maximum number of Flows in the conntrack table.", nil, nil)
+	c.utilization = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "utilization_ratio"),
+		"Ratio of the number of Flows in the conntrack table to its maximum size.", nil, nil)
+	c.flows = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "flows"),
+		"Number of Flows in the conntrack table by address family, protocol, state and zone.",
+		[]string{"family", "protocol", "state", "zone"}, nil)
+
+	return c
+}
+
+// Describe implements [prometheus.Collector].
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, s := range c.cpu {
+		ch <- s.desc
+	}
+	for _, s := range c.expect {
+		ch <- s.desc
+	}
+	ch <- c.entries
+	ch <- c.maxEntries
+	ch <- c.utilization
+	if c.opts.Flows {
+		ch <- c.flows
+	}
+}
+
+// Collect implements [prometheus.Collector]. Metrics of queries that fail are
+// replaced by invalid metrics carrying the error, failing the scrape.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+
+	c.collectStats(ctx, ch)
+	c.collectExpect(ctx, ch)
+	c.collectGlobal(ctx, ch)
+	if c.opts.Flows {
+		c.collectFlows(ctx, ch)
+	}
+}
+
+// collectStats collects the per-CPU conntrack counters.
+func (c *Collector) collectStats(ctx context.Context, ch chan<- prometheus.Metric) {
+	stats, err := c.src.StatsContext(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.cpu[0].desc, err)
+		return
+	}
+
+	for _, st := range stats {
+		cpu := strconv.Itoa(int(st.CPUID))
+		for _, s := range c.cpu {
+			ch <- prometheus.MustNewConstMetric(s.desc, prometheus.CounterValue, float64(s.value(st)), cpu)
+		}
+	}
+}
+
+// collectExpect collects the per-CPU expectation counters.
+func (c *Collector) collectExpect(ctx context.Context, ch chan<- prometheus.Metric) {
+	stats, err := c.src.StatsExpectContext(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.expect[0].desc, err)
+		return
+	}
+
+	for _, st := range stats {
+		cpu := strconv.Itoa(int(st.CPUID))
+		for _, s := range c.expect {
+			ch <- prometheus.MustNewConstMetric(s.desc, prometheus.CounterValue, float64(s.value(st)), cpu)
+		}
+	}
+}
+
+// collectGlobal collects the size of the conntrack table.
+func (c *Collector) collectGlobal(ctx context.Context, ch chan<- prometheus.Metric) {
+	sg, err := c.src.StatsGlobalContext(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.entries, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(sg.Entries))
+
+	// Kernels before 4.18 don't report the maximum table size.
+	if sg.MaxEntries == 0 {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.maxEntries, prometheus.GaugeValue, float64(sg.MaxEntries))
+	ch <- prometheus.MustNewConstMetric(c.utilization, prometheus.GaugeValue,
+		float64(sg.Entries)/float64(sg.MaxEntries))
+}
+
+// flowKey holds the label values of the conntrack_flows metric.
+type flowKey struct {
+	family, protocol, state, zone string
+}
+
+// collectFlows dumps the conntrack table and counts its Flows.
+func (c *Collector) collectFlows(ctx context.Context, ch chan<- prometheus.Metric) {
+	counts := make(map[flowKey]int)
+	for f, err := range c.src.DumpSeqContext(ctx, nil) {
+		// Counts of an interrupted dump are still a good approximation.
+		if errors.Is(err, conntrack.ErrDumpInterrupted) {
+			break
+		}
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.flows, err)
+			return
+		}
+
+		family := "ipv4"
+		if f.TupleOrig.IP.IsIPv6() {
+			family = "ipv6"
+		}
+
+		proto, ok := protocolNames[f.TupleOrig.Proto.Protocol]
+		if !ok {
+			proto = strconv.Itoa(int(f.TupleOrig.Proto.Protocol))
+		}
+
+		counts[flowKey{family, proto, f.ProtoInfo.State(), strconv.Itoa(int(f.Zone))}]++
+	}
+
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.flows, prometheus.GaugeValue, float64(n),
+			k.family, k.protocol, k.state, k.zone)
+	}
+}
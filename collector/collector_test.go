@@ -0,0 +1,160 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/ti-mo/conntrack"
+)
+
+// testSource is a Source returning fixed statistics.
+type testSource struct {
+	stats  []conntrack.Stats
+	expect []conntrack.StatsExpect
+	global conntrack.StatsGlobal
+	flows  []conntrack.Flow
+	err    error
+
+	// dumpErr is yielded after all flows.
+	dumpErr error
+}
+
+func (s testSource) StatsContext(context.Context) ([]conntrack.Stats, error) {
+	return s.stats, s.err
+}
+
+func (s testSource) StatsExpectContext(context.Context) ([]conntrack.StatsExpect, error) {
+	return s.expect, s.err
+}
+
+func (s testSource) StatsGlobalContext(context.Context) (conntrack.StatsGlobal, error) {
+	return s.global, s.err
+}
+
+func (s testSource) DumpSeqContext(context.Context, *conntrack.DumpOptions) iter.Seq2[conntrack.Flow, error] {
+	return func(yield func(conntrack.Flow, error) bool) {
+		if s.err != nil {
+			yield(conntrack.Flow{}, s.err)
+			return
+		}
+		for _, f := range s.flows {
+			if !yield(f, nil) {
+				return
+			}
+		}
+		if s.dumpErr != nil {
+			yield(conntrack.Flow{}, s.dumpErr)
+		}
+	}
+}
+
+func tcpFlow(src string, state uint8, zone uint16) conntrack.Flow {
+	f := conntrack.NewFlow(unix.IPPROTO_TCP, 0, netip.MustParseAddr(src), netip.MustParseAddr(src), 1, 2, 0, 0)
+	f.ProtoInfo.TCP = &conntrack.ProtoInfoTCP{State: state}
+	f.Zone = zone
+	return f
+}
+
+func TestCollector(t *testing.T) {
+	src := testSource{
+		stats: []conntrack.Stats{
+			{CPUID: 0, Found: 1, Invalid: 2, Insert: 3, InsertFailed: 4, Drop: 5, EarlyDrop: 6, Error: 7, SearchRestart: 8},
+			{CPUID: 1, Found: 10},
+		},
+		expect: []conntrack.StatsExpect{{CPUID: 0, New: 1, Create: 2, Delete: 3}},
+		global: conntrack.StatsGlobal{Entries: 64, MaxEntries: 256},
+		flows: []conntrack.Flow{
+			tcpFlow("10.0.0.1", 3, 0),
+			tcpFlow("10.0.0.2", 3, 0),
+			tcpFlow("2001:db8::1", 7, 1),
+			conntrack.NewFlow(unix.IPPROTO_UDP, 0, netip.MustParseAddr("10.0.0.1"),
+				netip.MustParseAddr("10.0.0.2"), 1, 2, 0, 0),
+			conntrack.NewFlow(4, 0, netip.MustParseAddr("10.0.0.1"),
+				netip.MustParseAddr("10.0.0.2"), 0, 0, 0, 0),
+		},
+	}
+
+	c := New(src, &Options{Flows: true})
+
+	expected := `
+# HELP conntrack_entries Number of Flows in the conntrack table.
+# TYPE conntrack_entries gauge
+conntrack_entries 64
+# HELP conntrack_expect_create_total Number of expectations created.
+# TYPE conntrack_expect_create_total counter
+conntrack_expect_create_total{cpu="0"} 2
+# HELP conntrack_flows Number of Flows in the conntrack table by address family, protocol, state and zone.
+# TYPE conntrack_flows gauge
+conntrack_flows{family="ipv4",protocol="4",state="",zone="0"} 1
+conntrack_flows{family="ipv4",protocol="tcp",state="ESTABLISHED",zone="0"} 2
+conntrack_flows{family="ipv4",protocol="udp",state="",zone="0"} 1
+conntrack_flows{family="ipv6",protocol="tcp",state="TIME_WAIT",zone="1"} 1
+# HELP conntrack_max_entries Maximum number of Flows in the conntrack table.
+# TYPE conntrack_max_entries gauge
+conntrack_max_entries 256
+# HELP conntrack_stat_early_drop_total Number of Flows evicted to make room for new Flows when the table was full.
+# TYPE conntrack_stat_early_drop_total counter
+conntrack_stat_early_drop_total{cpu="0"} 6
+conntrack_stat_early_drop_total{cpu="1"} 0
+# HELP conntrack_stat_found_total Number of successful lookups of existing Flows.
+# TYPE conntrack_stat_found_total counter
+conntrack_stat_found_total{cpu="0"} 1
+conntrack_stat_found_total{cpu="1"} 10
+# HELP conntrack_utilization_ratio Ratio of the number of Flows in the conntrack table to its maximum size.
+# TYPE conntrack_utilization_ratio gauge
+conntrack_utilization_ratio 0.25
+`
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"conntrack_entries", "conntrack_max_entries", "conntrack_utilization_ratio",
+		"conntrack_stat_found_total", "conntrack_stat_early_drop_total",
+		"conntrack_expect_create_total", "conntrack_flows"))
+
+	// 8 CPU counters for 2 CPUs, 3 expect counters, 3 global and 4 flow metrics.
+	assert.Equal(t, 8*2+3+3+4, testutil.CollectAndCount(c))
+
+	problems, err := testutil.CollectAndLint(c)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestCollectorDefaults(t *testing.T) {
+	// Flow counts are disabled by default, MaxEntries is absent on old kernels.
+	c := New(testSource{global: conntrack.StatsGlobal{Entries: 1}, flows: []conntrack.Flow{{}}}, nil)
+	assert.Equal(t, DefaultTimeout, c.opts.Timeout)
+	assert.Equal(t, 1, testutil.CollectAndCount(c))
+}
+
+func TestCollectorError(t *testing.T) {
+	errTest := errors.New("test error")
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(New(testSource{err: errTest}, &Options{Flows: true})))
+
+	_, err := reg.Gather()
+	assert.ErrorContains(t, err, errTest.Error())
+}
+
+func TestCollectorDumpInterrupted(t *testing.T) {
+	src := testSource{
+		global:  conntrack.StatsGlobal{Entries: 1},
+		flows:   []conntrack.Flow{tcpFlow("192.0.2.1", 3, 0)},
+		dumpErr: conntrack.ErrDumpInterrupted,
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(New(src, &Options{Flows: true})))
+
+	_, err := reg.Gather()
+	require.NoError(t, err)
+	assert.Equal(t, 1, testutil.CollectAndCount(New(src, &Options{Flows: true}), "conntrack_flows"))
+}
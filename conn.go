@@ -1,8 +1,13 @@
 package conntrack
 
 import (
+	"context"
 	"fmt"
+	"iter"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mdlayher/netlink"
 	"github.com/pkg/errors"
@@ -13,26 +18,93 @@ import (
 // Conn represents a Netlink connection to the Netfilter
 // subsystem and implements all Conntrack actions.
 type Conn struct {
-	conn *netfilter.Conn
+	conn *netlink.Conn
+
+	// mu serializes request/reply transactions on the socket.
+	mu sync.Mutex
+
+	// pending is the sequence number of a request whose reply was not read
+	// in its entirety, because its context was cancelled. Protected by mu.
+	pending uint32
+
+	// multicast marks the Conn as being attached to one or more multicast
+	// groups, it can no longer be used for queries for its remaining lifetime.
+	multicast atomic.Bool
 
 	workers sync.WaitGroup
+
+	// config is the configuration the Conn was dialed with, used for dialing
+	// additional sockets in the same network namespace.
+	config *netlink.Config
+
+	// netns is the network namespace the Conn was dialed in, if opened by
+	// DialNamespace and friends. It's kept open for as long as config refers
+	// to it.
+	netns *os.File
+
+	// featMu protects filterMode and features, the kernel's features probed
+	// for applying Filters according to filterMode.
+	featMu     sync.Mutex
+	filterMode FilterMode
+	features   *Features
 }
 
 // DumpOptions is passed as an option to `Dump`-related methods to modify their behaviour.
 type DumpOptions struct {
 	// ZeroCounters resets all flows' counters to zero after the dump operation.
 	ZeroCounters bool
+
+	// Retries re-issues a dump up to the given number of times when the kernel
+	// flags it as interrupted by a change to the table, until a consistent
+	// dump is received. If all attempts are interrupted, the Flows of the last
+	// attempt are returned along with [ErrDumpInterrupted].
+	//
+	// Only used by [Conn.Dump] and [Conn.DumpFilter], iterators can't retry
+	// Flows that were already yielded. Can't be combined with ZeroCounters,
+	// since every attempt would reset the counters.
+	Retries int
+}
+
+// ListenOptions is passed to [Conn.ListenWithOptions] to modify the behaviour
+// of event workers.
+type ListenOptions struct {
+	// RecoverOverrun keeps workers running when the kernel drops events because
+	// the socket's receive buffer overflowed (ENOBUFS). Instead of terminating,
+	// the worker that detects the overrun sends an [*EventsLostError] on the
+	// error channel and resumes receiving events.
+	RecoverOverrun bool
+
+	// Resync takes a snapshot of the conntrack table after an overrun was
+	// detected, so the consumer can resynchronise its state, similar to
+	// conntrackd. The table is dumped over a new socket dialed using the Conn's
+	// original configuration and returned in [EventsLostError.Flows]. Events
+	// received by other workers while the dump is in progress are still
+	// delivered and may be older or newer than the snapshot.
+	//
+	// Requires RecoverOverrun to be set.
+	Resync bool
+
+	// Filter drops events not matching the [EventFilter] in the kernel, before
+	// they are delivered to the Conn.
+	Filter EventFilter
 }
 
 // Dial opens a new Netfilter Netlink connection and returns it
 // wrapped in a Conn structure that implements the Conntrack API.
 func Dial(config *netlink.Config) (*Conn, error) {
-	c, err := netfilter.Dial(config)
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Conn{conn: c}, nil
+	// Keep a copy so later changes by the caller don't affect the Conn.
+	var cfg *netlink.Config
+	if config != nil {
+		cc := *config
+		cfg = &cc
+	}
+
+	return &Conn{conn: c, config: cfg}, nil
 }
 
 // Close closes a Conn.
@@ -46,6 +118,10 @@ func (c *Conn) Close() error {
 
 	c.workers.Wait()
 
+	if c.netns != nil {
+		return c.netns.Close()
+	}
+
 	return nil
 }
 
@@ -73,6 +149,33 @@ func (c *Conn) SetWriteBuffer(bytes int) error {
 	return c.conn.SetWriteBuffer(bytes)
 }
 
+// isMulticast returns true if the Conn was joined to multicast groups using
+// [Conn.Listen].
+func (c *Conn) isMulticast() bool {
+	return c.multicast.Load()
+}
+
+// joinGroups attaches the Conn to one or more Netfilter multicast groups and
+// marks it as multicast, meaning it can no longer be used for queries.
+func (c *Conn) joinGroups(groups []netfilter.NetlinkGroup) error {
+	if len(groups) == 0 {
+		return errNoGroups
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, group := range groups {
+		if err := c.conn.JoinGroup(uint32(group)); err != nil {
+			return err
+		}
+	}
+
+	c.multicast.Store(true)
+
+	return nil
+}
+
 // Listen joins the Netfilter connection to a multicast group and starts a given
 // amount of Flow decoders from the Conn to the Flow channel. Returns an error channel
 // the workers will return any errors on. Any error during Flow decoding is fatal and
@@ -84,38 +187,85 @@ func (c *Conn) SetWriteBuffer(bytes int) error {
 //
 // evChan consumers need to be able to keep up with the Event producers. When the channel is full,
 // messages will pile up in the Netlink socket's buffer, putting the socket at risk of being closed
-// by the kernel when it eventually fills up.
+// by the kernel when it eventually fills up. To recover from buffer overruns, use
+// [Conn.ListenWithOptions] with [ListenOptions.RecoverOverrun].
 //
 // Closing the Conn makes all workers terminate silently.
+//
+// Listen uses [context.Background] internally, use [Conn.ListenContext] to
+// specify a context.
 func (c *Conn) Listen(evChan chan<- Event, numWorkers uint8, groups []netfilter.NetlinkGroup) (chan error, error) {
+	return c.ListenContext(context.Background(), evChan, numWorkers, groups)
+}
+
+// ListenContext is like [Conn.Listen], but all workers terminate silently when
+// ctx is cancelled or its deadline expires. The Conn still needs to be closed
+// afterwards to release the underlying socket.
+func (c *Conn) ListenContext(ctx context.Context, evChan chan<- Event, numWorkers uint8,
+	groups []netfilter.NetlinkGroup) (chan error, error) {
+	return c.ListenWithOptions(ctx, evChan, numWorkers, groups, ListenOptions{})
+}
+
+// ListenWithOptions is like [Conn.ListenContext], but allows modifying the
+// behaviour of the event workers using [ListenOptions].
+func (c *Conn) ListenWithOptions(ctx context.Context, evChan chan<- Event, numWorkers uint8,
+	groups []netfilter.NetlinkGroup, opts ListenOptions) (chan error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	if numWorkers == 0 {
 		return nil, errNoWorkers
 	}
 
 	// Prevent Listen() from being called twice on the same Conn.
-	// This is checked again in JoinGroups(), but an early failure is preferred.
-	if c.conn.IsMulticast() {
+	if c.isMulticast() {
 		return nil, errConnHasListeners
 	}
 
-	err := c.conn.JoinGroups(groups)
+	// Attach the filter before joining any groups so no unwanted events are
+	// queued on the socket.
+	if opts.Filter != nil {
+		prog, err := opts.Filter.compile()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.conn.SetBPF(prog); err != nil {
+			return nil, err
+		}
+	}
+
+	err := c.joinGroups(groups)
 	if err != nil {
+		// Don't leave the filter attached to a Conn that isn't listening.
+		if opts.Filter != nil {
+			if rerr := c.conn.RemoveBPF(); rerr != nil {
+				return nil, fmt.Errorf("%w, remove event filter: %w", err, rerr)
+			}
+		}
 		return nil, err
 	}
 
+	// Wake up all workers blocked in Receive() when ctx is done.
+	context.AfterFunc(ctx, func() {
+		_ = c.conn.SetReadDeadline(time.Unix(1, 0))
+	})
+
 	errChan := make(chan error)
 
 	// Start numWorkers amount of worker goroutines
 	for id := uint8(0); id < numWorkers; id++ {
 		c.workers.Add(1)
-		go c.eventWorker(id, evChan, errChan)
+		go c.eventWorker(ctx, id, evChan, errChan, opts)
 	}
 
 	return errChan, nil
 }
 
 // eventWorker is a worker function that decodes Netlink messages into Events.
-func (c *Conn) eventWorker(workerID uint8, evChan chan<- Event, errChan chan<- error) {
+func (c *Conn) eventWorker(ctx context.Context, workerID uint8, evChan chan<- Event, errChan chan<- error,
+	opts ListenOptions) {
 	var err error
 	var recv []netlink.Message
 	var ev Event
@@ -126,6 +276,11 @@ func (c *Conn) eventWorker(workerID uint8, evChan chan<- Event, errChan chan<- e
 		// Receive data from the Netlink socket.
 		recv, err = c.conn.Receive()
 
+		// Context was cancelled, Receive() was interrupted by a socket deadline.
+		if ctx.Err() != nil {
+			return
+		}
+
 		// If the Conn gets closed while blocked in Receive(), Go's runtime poller
 		// will return an src/internal/poll.ErrFileClosing. Since we cannot match
 		// the underlying error using errors.Is(), retrieve it from the netlink.OpErr.
@@ -141,14 +296,21 @@ func (c *Conn) eventWorker(workerID uint8, evChan chan<- Event, errChan chan<- e
 			return
 		}
 
+		// The kernel dropped events because the socket buffer was full. The
+		// socket remains usable, so report the loss and keep going.
+		if opts.RecoverOverrun && errors.Is(err, unix.ENOBUFS) {
+			sendErr(ctx, errChan, c.eventsLost(ctx, workerID, opts))
+			continue
+		}
+
 		if err != nil {
-			errChan <- fmt.Errorf("Receive() netlink error, closing worker %d: %w", workerID, err)
+			sendErr(ctx, errChan, fmt.Errorf("Receive() netlink error, closing worker %d: %w", workerID, err))
 			return
 		}
 
 		// Receive() always returns a list of Netlink Messages, but multicast messages should never be multi-part
 		if len(recv) > 1 {
-			errChan <- errMultipartEvent
+			sendErr(ctx, errChan, errMultipartEvent)
 			return
 		}
 
@@ -156,79 +318,341 @@ func (c *Conn) eventWorker(workerID uint8, evChan chan<- Event, errChan chan<- e
 		ev = *new(Event)
 		err := ev.Unmarshal(recv[0])
 		if err != nil {
-			errChan <- err
+			sendErr(ctx, errChan, err)
 			return
 		}
 
-		evChan <- ev
+		select {
+		case evChan <- ev:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-// Dump gets all Conntrack connections from the kernel in the form of a list
-// of Flow objects.
-func (c *Conn) Dump(opts *DumpOptions) ([]Flow, error) {
-	msgType := ctGet
-	if opts != nil && opts.ZeroCounters {
-		msgType = ctGetCtrZero
+// eventsLost returns an EventsLostError for an overrun detected by the given
+// worker, resynchronising the conntrack table if requested in opts.
+func (c *Conn) eventsLost(ctx context.Context, workerID uint8, opts ListenOptions) *EventsLostError {
+	el := &EventsLostError{WorkerID: workerID}
+	if !opts.Resync {
+		return el
 	}
 
-	req, err := netfilter.MarshalNetlink(
-		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(msgType),
-			Family:      netfilter.ProtoUnspec, // ProtoUnspec dumps both IPv4 and IPv6
-			Flags:       netlink.Request | netlink.Dump,
-		},
-		nil)
-
+	// The Conn is attached to multicast groups and can't be used for dumps.
+	dc, err := Dial(c.config)
 	if err != nil {
-		return nil, err
+		el.ResyncErr = err
+		return el
 	}
+	defer dc.Close()
 
-	nlm, err := c.conn.Query(req)
-	if err != nil {
-		return nil, err
+	el.Flows, el.ResyncErr = dc.DumpContext(ctx, nil)
+
+	return el
+}
+
+// sendErr sends err on errChan, giving up when ctx is done.
+func sendErr(ctx context.Context, errChan chan<- error, err error) {
+	select {
+	case errChan <- err:
+	case <-ctx.Done():
 	}
+}
+
+// Dump gets all Conntrack connections from the kernel in the form of a list
+// of Flow objects.
+//
+// If the table changed during the dump and the kernel flagged it as
+// interrupted, the Flows are returned along with [ErrDumpInterrupted]. Use
+// [DumpOptions.Retries] to retry interrupted dumps.
+//
+// Dump uses [context.Background] internally, use [Conn.DumpContext] to specify
+// a context.
+func (c *Conn) Dump(opts *DumpOptions) ([]Flow, error) {
+	return c.DumpContext(context.Background(), opts)
+}
 
-	return unmarshalFlows(nlm)
+// DumpContext is like [Conn.Dump], but aborts the operation when ctx is
+// cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) DumpContext(ctx context.Context, opts *DumpOptions) ([]Flow, error) {
+	return retryDump(opts, func() ([]Flow, error) {
+		return collectFlows(c.DumpSeqContext(ctx, opts))
+	})
 }
 
 // DumpFilter gets all Conntrack connections from the kernel in the form of a
-// list of Flow objects. Only Flows matching the provided [Filter] are returned.
+// list of Flow objects. Only Flows matching the provided [Filter] are returned,
+// see [Conn.SetFilterMode] for kernels that don't support all of its fields.
+// Interrupted dumps are handled like [Conn.Dump] does.
+//
+// DumpFilter uses [context.Background] internally, use
+// [Conn.DumpFilterContext] to specify a context.
 func (c *Conn) DumpFilter(filter Filter, opts *DumpOptions) ([]Flow, error) {
+	return c.DumpFilterContext(context.Background(), filter, opts)
+}
+
+// DumpFilterContext is like [Conn.DumpFilter], but aborts the operation when
+// ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) DumpFilterContext(ctx context.Context, filter Filter, opts *DumpOptions) ([]Flow, error) {
+	return retryDump(opts, func() ([]Flow, error) {
+		return collectFlows(c.DumpFilterSeqContext(ctx, filter, opts))
+	})
+}
+
+// DumpSeq returns an iterator over all Conntrack connections in the kernel.
+// Flows are decoded one Netlink datagram at a time while the dump is being
+// received, so the full table is never held in memory.
+//
+// Breaking out of the loop stops decoding Flows. The remainder of the dump is
+// discarded from the socket before the iterator returns. If an error occurs,
+// it is yielded along with an empty Flow and iteration ends. If the kernel
+// flagged the dump as interrupted, [ErrDumpInterrupted] is yielded after the
+// last Flow.
+//
+// The Conn cannot be used for other queries until the iteration finishes.
+//
+// DumpSeq uses [context.Background] internally, use [Conn.DumpSeqContext] to
+// specify a context.
+func (c *Conn) DumpSeq(opts *DumpOptions) iter.Seq2[Flow, error] {
+	return c.DumpSeqContext(context.Background(), opts)
+}
+
+// DumpSeqContext is like [Conn.DumpSeq], but stops iterating and yields
+// ctx.Err() when ctx is cancelled or its deadline expires.
+func (c *Conn) DumpSeqContext(ctx context.Context, opts *DumpOptions) iter.Seq2[Flow, error] {
+	return c.dumpSeq(ctx, dumpType(opts), netfilter.ProtoUnspec, nil) // ProtoUnspec dumps both IPv4 and IPv6
+}
+
+// DumpFilterSeq returns an iterator over all Conntrack connections in the
+// kernel matching the provided [Filter]. See [Conn.DumpSeq] for details.
+//
+// DumpFilterSeq uses [context.Background] internally, use
+// [Conn.DumpFilterSeqContext] to specify a context.
+func (c *Conn) DumpFilterSeq(filter Filter, opts *DumpOptions) iter.Seq2[Flow, error] {
+	return c.DumpFilterSeqContext(context.Background(), filter, opts)
+}
+
+// DumpFilterSeqContext is like [Conn.DumpFilterSeq], but stops iterating and
+// yields ctx.Err() when ctx is cancelled or its deadline expires.
+func (c *Conn) DumpFilterSeqContext(ctx context.Context, filter Filter, opts *DumpOptions) iter.Seq2[Flow, error] {
 	if filter == nil {
-		return nil, fmt.Errorf("filter is nil")
+		return func(yield func(Flow, error) bool) {
+			yield(Flow{}, fmt.Errorf("filter is nil"))
+		}
+	}
+
+	return c.dumpFilterSeq(ctx, dumpType(opts), filter)
+}
+
+// dumpFilterSeq returns an iterator over all Flows returned by a dump request
+// of type msgType matching filter. Filter fields the kernel can't filter on
+// are matched in userspace, according to the Conn's FilterMode.
+func (c *Conn) dumpFilterSeq(ctx context.Context, msgType messageType, filter Filter) iter.Seq2[Flow, error] {
+	return func(yield func(Flow, error) bool) {
+		// Validate the whole Filter before probing the kernel's features.
+		if _, err := filter.marshal(); err != nil {
+			yield(Flow{}, err)
+			return
+		}
+
+		kf, match, err := c.kernelFilter(ctx, filter)
+		if err != nil {
+			yield(Flow{}, err)
+			return
+		}
+
+		attrs, err := kf.marshal()
+		if err != nil {
+			yield(Flow{}, err)
+			return
+		}
+
+		// The kernel doesn't support filtering on labels, match them here.
+		labels := filter.labelFilter()
+		for f, err := range c.dumpSeq(ctx, msgType, kf.family(), attrs) {
+			if err == nil && (!f.Labels.Contains(labels) || match != nil && !match(f)) {
+				continue
+			}
+			if !yield(f, err) {
+				return
+			}
+		}
 	}
+}
+
+// DumpDying gets all Conntrack connections on the kernel's dying list in the
+// form of a list of Flow objects, similar to `conntrack -L dying`. These are
+// connections that were removed from the table, but are still referenced by
+// packets in flight or are waiting for their destroy event to be delivered.
+//
+// Since Linux 5.19, only connections waiting for event delivery are returned,
+// and only if the kernel was built with CONFIG_NF_CONNTRACK_EVENTS.
+//
+// DumpDying uses [context.Background] internally, use [Conn.DumpDyingContext]
+// to specify a context.
+func (c *Conn) DumpDying() ([]Flow, error) {
+	return c.DumpDyingContext(context.Background())
+}
+
+// DumpDyingContext is like [Conn.DumpDying], but aborts the operation when ctx
+// is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) DumpDyingContext(ctx context.Context) ([]Flow, error) {
+	return collectFlows(c.DumpDyingSeqContext(ctx))
+}
+
+// DumpDyingSeq returns an iterator over all Conntrack connections on the
+// kernel's dying list. See [Conn.DumpDying] and [Conn.DumpSeq] for details.
+//
+// DumpDyingSeq uses [context.Background] internally, use
+// [Conn.DumpDyingSeqContext] to specify a context.
+func (c *Conn) DumpDyingSeq() iter.Seq2[Flow, error] {
+	return c.DumpDyingSeqContext(context.Background())
+}
+
+// DumpDyingSeqContext is like [Conn.DumpDyingSeq], but stops iterating and
+// yields ctx.Err() when ctx is cancelled or its deadline expires.
+func (c *Conn) DumpDyingSeqContext(ctx context.Context) iter.Seq2[Flow, error] {
+	return c.dumpSeq(ctx, ctGetDying, netfilter.ProtoUnspec, nil)
+}
+
+// DumpUnconfirmed gets all Conntrack connections on the kernel's unconfirmed
+// list in the form of a list of Flow objects, similar to `conntrack -L
+// unconfirmed`. These are connections created for packets that have not yet
+// left the network stack, for example because they are queued to userspace.
+//
+// Since Linux 5.19, the kernel no longer tracks unconfirmed connections in a
+// list and always returns an empty dump.
+//
+// DumpUnconfirmed uses [context.Background] internally, use
+// [Conn.DumpUnconfirmedContext] to specify a context.
+func (c *Conn) DumpUnconfirmed() ([]Flow, error) {
+	return c.DumpUnconfirmedContext(context.Background())
+}
+
+// DumpUnconfirmedContext is like [Conn.DumpUnconfirmed], but aborts the
+// operation when ctx is cancelled or its deadline expires, returning
+// ctx.Err().
+func (c *Conn) DumpUnconfirmedContext(ctx context.Context) ([]Flow, error) {
+	return collectFlows(c.DumpUnconfirmedSeqContext(ctx))
+}
 
-	msgType := ctGet
+// DumpUnconfirmedSeq returns an iterator over all Conntrack connections on the
+// kernel's unconfirmed list. See [Conn.DumpUnconfirmed] and [Conn.DumpSeq] for
+// details.
+//
+// DumpUnconfirmedSeq uses [context.Background] internally, use
+// [Conn.DumpUnconfirmedSeqContext] to specify a context.
+func (c *Conn) DumpUnconfirmedSeq() iter.Seq2[Flow, error] {
+	return c.DumpUnconfirmedSeqContext(context.Background())
+}
+
+// DumpUnconfirmedSeqContext is like [Conn.DumpUnconfirmedSeq], but stops
+// iterating and yields ctx.Err() when ctx is cancelled or its deadline
+// expires.
+func (c *Conn) DumpUnconfirmedSeqContext(ctx context.Context) iter.Seq2[Flow, error] {
+	return c.dumpSeq(ctx, ctGetUnconfirmed, netfilter.ProtoUnspec, nil)
+}
+
+// dumpType returns the message type to send for a dump with the given
+// options.
+func dumpType(opts *DumpOptions) messageType {
 	if opts != nil && opts.ZeroCounters {
-		msgType = ctGetCtrZero
+		return ctGetCtrZero
 	}
+	return ctGet
+}
 
-	req, err := netfilter.MarshalNetlink(
-		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(msgType),
-			Family:      filter.family(),
-			Flags:       netlink.Request | netlink.Dump,
-		},
-		filter.marshal())
+// dumpSeq returns an iterator over all Flows returned by a dump request of
+// type msgType for the given family and attributes.
+func (c *Conn) dumpSeq(ctx context.Context, msgType messageType, pf netfilter.ProtoFamily,
+	attrs []netfilter.Attribute) iter.Seq2[Flow, error] {
+	return func(yield func(Flow, error) bool) {
+		req, err := netfilter.MarshalNetlink(
+			netfilter.Header{
+				SubsystemID: netfilter.NFSubsysCTNetlink,
+				MessageType: netfilter.MessageType(msgType),
+				Family:      pf,
+				Flags:       netlink.Request | netlink.Dump,
+			},
+			attrs)
 
-	if err != nil {
-		return nil, err
+		if err != nil {
+			yield(Flow{}, err)
+			return
+		}
+
+		var stopped bool
+		err = c.stream(ctx, req, func(nlm netlink.Message) error {
+			f, err := unmarshalFlow(nlm)
+			if err != nil {
+				return err
+			}
+
+			if !yield(f, nil) {
+				stopped = true
+				return errStopDump
+			}
+
+			return nil
+		})
+
+		if err != nil && !stopped {
+			yield(Flow{}, err)
+		}
+	}
+}
+
+// collectFlows gathers all Flows produced by seq into a slice. Returns the
+// first error encountered. The Flows of interrupted dumps are returned along
+// with ErrDumpInterrupted.
+func collectFlows(seq iter.Seq2[Flow, error]) ([]Flow, error) {
+	out := make([]Flow, 0)
+	for f, err := range seq {
+		if errors.Is(err, ErrDumpInterrupted) {
+			return out, err
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, f)
 	}
 
-	nlm, err := c.conn.Query(req)
-	if err != nil {
-		return nil, err
+	return out, nil
+}
+
+// retryDump calls dump until it returns a dump that wasn't interrupted, at most
+// opts.Retries times after the first attempt.
+func retryDump(opts *DumpOptions, dump func() ([]Flow, error)) ([]Flow, error) {
+	var retries int
+	if opts != nil {
+		if opts.Retries > 0 && opts.ZeroCounters {
+			return nil, errDumpRetriesZeroCounters
+		}
+		retries = opts.Retries
 	}
 
-	return unmarshalFlows(nlm)
+	for i := 0; ; i++ {
+		flows, err := dump()
+		if i >= retries || !errors.Is(err, ErrDumpInterrupted) {
+			return flows, err
+		}
+	}
 }
 
 // DumpExpect gets all expected Conntrack expectations from the kernel in the form
-// of a list of Expect objects.
+// of a list of Expect objects. Like [Conn.Dump], the Expects of interrupted
+// dumps are returned along with [ErrDumpInterrupted].
+//
+// DumpExpect uses [context.Background] internally, use [Conn.DumpExpectContext] to specify
+// a context.
 func (c *Conn) DumpExpect() ([]Expect, error) {
+	return c.DumpExpectContext(context.Background())
+}
+
+// DumpExpectContext is like [Conn.DumpExpect], but aborts the operation when ctx is
+// cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) DumpExpectContext(ctx context.Context) ([]Expect, error) {
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
 			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
@@ -242,17 +666,30 @@ func (c *Conn) DumpExpect() ([]Expect, error) {
 		return nil, err
 	}
 
-	nlm, err := c.conn.Query(req)
-	if err != nil {
+	nlm, err := c.query(ctx, req)
+	if err != nil && !errors.Is(err, ErrDumpInterrupted) {
 		return nil, err
 	}
 
-	return unmarshalExpects(nlm)
+	exs, uerr := unmarshalExpects(nlm)
+	if uerr != nil {
+		return nil, uerr
+	}
+
+	return exs, err
 }
 
 // Flush empties the Conntrack table. Deletes all IPv4 and IPv6 entries.
+//
+// Flush uses [context.Background] internally, use [Conn.FlushContext] to specify
+// a context.
 func (c *Conn) Flush() error {
+	return c.FlushContext(context.Background())
+}
 
+// FlushContext is like [Conn.Flush], but aborts the operation when ctx is
+// cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) FlushContext(ctx context.Context) error {
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
 			SubsystemID: netfilter.NFSubsysCTNetlink,
@@ -266,7 +703,7 @@ func (c *Conn) Flush() error {
 		return err
 	}
 
-	_, err = c.conn.Query(req)
+	_, err = c.query(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -275,17 +712,55 @@ func (c *Conn) Flush() error {
 }
 
 // FlushFilter deletes all entries from the Conntrack table matching a given
-// [Filter].
+// [Filter]. Kernels that don't support some of the Filter's fields flush more
+// entries than requested, or even the whole table, unless prevented using
+// [Conn.SetFilterMode].
+//
+// FlushFilter uses [context.Background] internally, use [Conn.FlushFilterContext] to specify
+// a context.
 func (c *Conn) FlushFilter(filter Filter) error {
+	return c.FlushFilterContext(context.Background(), filter)
+}
+
+// FlushFilterContext is like [Conn.FlushFilter], but aborts the operation when ctx is
+// cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) FlushFilterContext(ctx context.Context, filter Filter) error {
 	if filter == nil {
 		return fmt.Errorf("filter is nil")
 	}
 
+	attrs, err := filter.marshal()
+	if err != nil {
+		return err
+	}
+
+	mode, ft, err := c.filterFeatures(ctx)
+	if err != nil {
+		return err
+	}
+
+	labels := !filter.labelFilter().Empty()
+	unsupported := ft.unsupported(filter.fields(), true)
+	switch {
+	case mode == FilterFallback && (labels || unsupported != 0):
+		return c.flushDump(ctx, filter)
+	case labels:
+		return errFilterLabels
+	case mode == FilterStrict && unsupported != 0:
+		return fmt.Errorf("flush filter on %s: %w", unsupported, ErrNotSupported)
+	}
+
+	return c.flushFilter(ctx, filter.family(), attrs)
+}
+
+// flushFilter sends a flush request for the marshaled Filter attrs to the
+// kernel, which flushes the whole table if it doesn't support filtered flushes.
+func (c *Conn) flushFilter(ctx context.Context, family netfilter.ProtoFamily, attrs []netfilter.Attribute) error {
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
 			SubsystemID: netfilter.NFSubsysCTNetlink,
 			MessageType: netfilter.MessageType(ctDelete),
-			Family:      filter.family(),
+			Family:      family,
 			Flags:       netlink.Request | netlink.Acknowledge,
 
 			// Request 'new' filtered flush behaviour as described in e7600865db32
@@ -296,13 +771,13 @@ func (c *Conn) FlushFilter(filter Filter) error {
 			// an empty CTA_FILTER.
 			Version: 1,
 		},
-		filter.marshal())
+		attrs)
 
 	if err != nil {
 		return err
 	}
 
-	_, err = c.conn.Query(req)
+	_, err = c.query(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -310,38 +785,84 @@ func (c *Conn) FlushFilter(filter Filter) error {
 	return nil
 }
 
-// Create creates a new Conntrack entry.
-func (c *Conn) Create(f Flow) error {
-
-	// Conntrack create requires timeout to be set.
-	if f.Timeout == 0 {
-		return errNeedTimeout
+// flushDump deletes the Flows matching filter one by one, for Filters the
+// kernel can't flush. If the dump was interrupted, the Flows it returned are
+// deleted and ErrDumpInterrupted is returned, since some may have been missed.
+func (c *Conn) flushDump(ctx context.Context, filter Filter) error {
+	flows, dumpErr := collectFlows(c.dumpFilterSeq(ctx, ctGet, filter))
+	if dumpErr != nil && !errors.Is(dumpErr, ErrDumpInterrupted) {
+		return dumpErr
 	}
 
-	attrs, err := f.marshal()
+	errs, err := c.DeleteBatchContext(ctx, flows)
 	if err != nil {
 		return err
 	}
 
-	pf := netfilter.ProtoIPv4
-	if f.TupleOrig.IP.IsIPv6() && f.TupleReply.IP.IsIPv6() {
-		pf = netfilter.ProtoIPv6
+	for _, err := range errs {
+		// Flows may have expired since they were dumped.
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
 	}
 
+	return dumpErr
+}
+
+// FlushExpect empties the Conntrack expectation table. Deletes all IPv4 and
+// IPv6 expectations.
+//
+// FlushExpect uses [context.Background] internally, use
+// [Conn.FlushExpectContext] to specify a context.
+func (c *Conn) FlushExpect() error {
+	return c.FlushExpectContext(context.Background())
+}
+
+// FlushExpectContext is like [Conn.FlushExpect], but aborts the operation
+// when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) FlushExpectContext(ctx context.Context) error {
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
-			SubsystemID: netfilter.NFSubsysCTNetlink,
-			MessageType: netfilter.MessageType(ctNew),
-			Family:      pf,
-			Flags: netlink.Request | netlink.Acknowledge |
-				netlink.Excl | netlink.Create,
-		}, attrs)
+			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
+			MessageType: netfilter.MessageType(ctExpDelete),
+			Family:      netfilter.ProtoUnspec, // Family is ignored for flush
+			Flags:       netlink.Request | netlink.Acknowledge,
+		},
+		nil)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
 
+// Create creates a new Conntrack entry.
+//
+// When NATSrc or NATDst are set on the Flow, the kernel sets up source or
+// destination NAT for the entry and derives its reply tuple accordingly. This
+// requires the nf_nat kernel module.
+//
+// Create uses [context.Background] internally, use [Conn.CreateContext] to specify
+// a context.
+func (c *Conn) Create(f Flow) error {
+	return c.CreateContext(context.Background(), f)
+}
+
+// CreateContext is like [Conn.Create], but aborts the operation when ctx is
+// cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) CreateContext(ctx context.Context, f Flow) error {
+	req, err := createRequest(f)
 	if err != nil {
 		return err
 	}
 
-	_, err = c.conn.Query(req)
+	_, err = c.query(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -349,10 +870,42 @@ func (c *Conn) Create(f Flow) error {
 	return nil
 }
 
-// CreateExpect creates a new Conntrack Expect entry. Warning: Experimental, haven't
-// got this to create an Expect correctly. Best-effort implementation based on kernel source.
+// createRequest returns the request creating Flow f.
+func createRequest(f Flow) (netlink.Message, error) {
+	// Conntrack create requires timeout to be set.
+	if f.Timeout == 0 {
+		return netlink.Message{}, errNeedTimeout
+	}
+
+	attrs, err := f.marshal()
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	return netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlink,
+			MessageType: netfilter.MessageType(ctNew),
+			Family:      f.family(),
+			Flags: netlink.Request | netlink.Acknowledge |
+				netlink.Excl | netlink.Create,
+		}, attrs)
+}
+
+// CreateExpect creates a new Conntrack Expect entry. The Expect's TupleMaster must
+// refer to an existing Flow that has a [Helper] assigned, and the Expect's HelpName
+// must name the same helper. The Class must not exceed the number of expectation
+// classes supported by the helper, which is usually 1.
+//
+// CreateExpect uses [context.Background] internally, use [Conn.CreateExpectContext] to specify
+// a context.
 func (c *Conn) CreateExpect(ex Expect) error {
+	return c.CreateExpectContext(context.Background(), ex)
+}
 
+// CreateExpectContext is like [Conn.CreateExpect], but aborts the operation when ctx is
+// cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) CreateExpectContext(ctx context.Context, ex Expect) error {
 	attrs, err := ex.marshal()
 	if err != nil {
 		return err
@@ -376,7 +929,7 @@ func (c *Conn) CreateExpect(ex Expect) error {
 		return err
 	}
 
-	_, err = c.conn.Query(req)
+	_, err = c.query(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -384,12 +937,181 @@ func (c *Conn) CreateExpect(ex Expect) error {
 	return nil
 }
 
-// Get queries the conntrack table for a connection matching some attributes of a given Flow.
-// The following attributes are considered in the query: TupleOrig or TupleReply, in that order,
-// and Zone. One of TupleOrig or TupleReply is required for a successful query.
-func (c *Conn) Get(f Flow) (Flow, error) {
+// GetExpect queries the expectation table for an expectation matching the Tuple
+// and Zone of a given Expect. When the Expect's ID field is filled, it must match
+// the ID of the expectation found, or the query will fail. If only the ID is
+// given, the expectation table is dumped to find the expectation with that ID.
+//
+// GetExpect uses [context.Background] internally, use [Conn.GetExpectContext]
+// to specify a context.
+func (c *Conn) GetExpect(ex Expect) (Expect, error) {
+	return c.GetExpectContext(context.Background(), ex)
+}
 
-	var qf Flow
+// GetExpectContext is like [Conn.GetExpect], but aborts the operation when ctx
+// is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) GetExpectContext(ctx context.Context, ex Expect) (Expect, error) {
+	if !ex.Tuple.filled() && ex.ID != 0 {
+		return c.expectByID(ctx, ex.ID)
+	}
+
+	attrs, err := ex.marshalQuery()
+	if err != nil {
+		return Expect{}, err
+	}
+
+	pf := netfilter.ProtoIPv4
+	if ex.Tuple.IP.IsIPv6() {
+		pf = netfilter.ProtoIPv6
+	}
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
+			MessageType: netfilter.MessageType(ctExpGet),
+			Family:      pf,
+			Flags:       netlink.Request | netlink.Acknowledge,
+		}, attrs)
+
+	if err != nil {
+		return Expect{}, err
+	}
+
+	nlm, err := c.query(ctx, req)
+	if err != nil {
+		return Expect{}, err
+	}
+
+	// The first message contains the Expect, followed by an acknowledgement.
+	return unmarshalExpect(nlm[0])
+}
+
+// DeleteExpect removes an expectation given an Expect. Expectations are looked
+// up in the expectation table based on their Tuple and Zone. When the Expect's
+// ID field is filled, it must match the ID of the expectation found, or the
+// delete will fail. If only the ID is given, the expectation table is dumped to
+// find the expectation with that ID.
+//
+// DeleteExpect uses [context.Background] internally, use
+// [Conn.DeleteExpectContext] to specify a context.
+func (c *Conn) DeleteExpect(ex Expect) error {
+	return c.DeleteExpectContext(context.Background(), ex)
+}
+
+// DeleteExpectContext is like [Conn.DeleteExpect], but aborts the operation
+// when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) DeleteExpectContext(ctx context.Context, ex Expect) error {
+	if !ex.Tuple.filled() && ex.ID != 0 {
+		found, err := c.expectByID(ctx, ex.ID)
+		if err != nil {
+			return err
+		}
+		ex = found
+	}
+
+	// Without a tuple, the kernel flushes the whole expectation table.
+	attrs, err := ex.marshalQuery()
+	if err != nil {
+		return err
+	}
+
+	pf := netfilter.ProtoIPv4
+	if ex.Tuple.IP.IsIPv6() {
+		pf = netfilter.ProtoIPv6
+	}
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
+			MessageType: netfilter.MessageType(ctExpDelete),
+			Family:      pf,
+			Flags:       netlink.Request | netlink.Acknowledge,
+		}, attrs)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteExpectHelper removes all expectations created by the Conntrack helper
+// with the given name, similar to `conntrack -D expect --helper <name>`.
+//
+// DeleteExpectHelper uses [context.Background] internally, use
+// [Conn.DeleteExpectHelperContext] to specify a context.
+func (c *Conn) DeleteExpectHelper(name string) error {
+	return c.DeleteExpectHelperContext(context.Background(), name)
+}
+
+// DeleteExpectHelperContext is like [Conn.DeleteExpectHelper], but aborts the
+// operation when ctx is cancelled or its deadline expires, returning
+// ctx.Err().
+func (c *Conn) DeleteExpectHelperContext(ctx context.Context, name string) error {
+	// Without a helper name, the kernel flushes the whole expectation table.
+	if name == "" {
+		return errNeedHelperName
+	}
+
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
+			MessageType: netfilter.MessageType(ctExpDelete),
+			Family:      netfilter.ProtoUnspec,
+			Flags:       netlink.Request | netlink.Acknowledge,
+		},
+		[]netfilter.Attribute{
+			{Type: uint16(ctaExpectHelpName), Data: []byte(name + "\x00")},
+		})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// expectByID finds the expectation with the given ID in the kernel's
+// expectation table. The kernel can only look up expectations by tuple.
+func (c *Conn) expectByID(ctx context.Context, id uint32) (Expect, error) {
+	exs, err := c.DumpExpectContext(ctx)
+	if err != nil {
+		return Expect{}, err
+	}
+
+	for _, ex := range exs {
+		if ex.ID == id {
+			return ex, nil
+		}
+	}
+
+	return Expect{}, fmt.Errorf("expect with id %d: %w", id, errnoError(unix.ENOENT))
+}
+
+// Get queries the conntrack table for a connection matching some attributes of a given Flow.
+// The following attributes are considered in the query: TupleOrig or TupleReply, in that order,
+// and Zone. One of TupleOrig or TupleReply is required for a successful query.
+//
+// Get uses [context.Background] internally, use [Conn.GetContext] to specify
+// a context.
+func (c *Conn) Get(f Flow) (Flow, error) {
+	return c.GetContext(context.Background(), f)
+}
+
+// GetContext is like [Conn.Get], but aborts the operation when ctx is
+// cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) GetContext(ctx context.Context, f Flow) (Flow, error) {
+	var qf Flow
 
 	attrs, err := f.marshal()
 	if err != nil {
@@ -413,7 +1135,7 @@ func (c *Conn) Get(f Flow) (Flow, error) {
 		return qf, err
 	}
 
-	nlm, err := c.conn.Query(req)
+	nlm, err := c.query(ctx, req)
 	if err != nil {
 		return qf, err
 	}
@@ -433,27 +1155,80 @@ func (c *Conn) Get(f Flow) (Flow, error) {
 // when sending a Flow update: Helper, Timeout, Status, ProtoInfo, Mark, SeqAdj (orig/reply),
 // SynProxy, Labels. All other attributes are immutable past the point of creation.
 // See the ctnetlink_change_conntrack() kernel function for exact behaviour.
+//
+// Attributes with zero values are not sent, use [Conn.UpdateFields] to set
+// attributes like Mark to zero.
+//
+// Update uses [context.Background] internally, use [Conn.UpdateContext] to specify
+// a context.
 func (c *Conn) Update(f Flow) error {
+	return c.UpdateContext(context.Background(), f)
+}
+
+// UpdateContext is like [Conn.Update], but aborts the operation when ctx is
+// cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) UpdateContext(ctx context.Context, f Flow) error {
+	req, err := updateRequest(f)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// updateRequest returns the request updating Flow f.
+func updateRequest(f Flow) (netlink.Message, error) {
 	// Kernel rejects updates with a master tuple set
 	if f.TupleMaster.filled() {
-		return errUpdateMaster
+		return netlink.Message{}, errUpdateMaster
+	}
+
+	// NAT can only be set up when creating a Flow
+	if f.NATSrc.filled() || f.NATDst.filled() {
+		return netlink.Message{}, errUpdateNAT
 	}
 
 	attrs, err := f.marshal()
 	if err != nil {
-		return err
+		return netlink.Message{}, err
 	}
 
-	pf := netfilter.ProtoIPv4
-	if f.TupleOrig.IP.IsIPv6() && f.TupleReply.IP.IsIPv6() {
-		pf = netfilter.ProtoIPv6
+	return netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlink,
+			MessageType: netfilter.MessageType(ctNew),
+			Family:      f.family(),
+			Flags:       netlink.Request | netlink.Acknowledge,
+		}, attrs)
+}
+
+// UpdateFields updates the attributes of a Conntrack entry selected in
+// u.Fields, sending them even if they hold zero values.
+//
+// UpdateFields uses [context.Background] internally, use
+// [Conn.UpdateFieldsContext] to specify a context.
+func (c *Conn) UpdateFields(u FlowUpdate) error {
+	return c.UpdateFieldsContext(context.Background(), u)
+}
+
+// UpdateFieldsContext is like [Conn.UpdateFields], but aborts the operation
+// when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) UpdateFieldsContext(ctx context.Context, u FlowUpdate) error {
+	attrs, err := u.marshal()
+	if err != nil {
+		return err
 	}
 
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
 			SubsystemID: netfilter.NFSubsysCTNetlink,
 			MessageType: netfilter.MessageType(ctNew),
-			Family:      pf,
+			Family:      u.Flow.family(),
 			Flags:       netlink.Request | netlink.Acknowledge,
 		}, attrs)
 
@@ -461,7 +1236,7 @@ func (c *Conn) Update(f Flow) error {
 		return err
 	}
 
-	_, err = c.conn.Query(req)
+	_, err = c.query(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -469,46 +1244,178 @@ func (c *Conn) Update(f Flow) error {
 	return nil
 }
 
+// UpdateLabels sets and clears connection labels on the Conntrack entry
+// matching f's tuples, leaving all other labels untouched, similar to
+// conntrack's --label-add and --label-del options. Bits set in both set and
+// clear end up being set.
+//
+// Only the tuples and Zone of f are used. Connections only carry labels if
+// the kernel has label support enabled in the network namespace, which happens
+// when a ruleset using connlabels is loaded. Otherwise, the kernel returns an
+// error.
+//
+// UpdateLabels uses [context.Background] internally, use
+// [Conn.UpdateLabelsContext] to specify a context.
+func (c *Conn) UpdateLabels(f Flow, set, clear Labels) error {
+	return c.UpdateLabelsContext(context.Background(), f, set, clear)
+}
+
+// UpdateLabelsContext is like [Conn.UpdateLabels], but aborts the operation
+// when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) UpdateLabelsContext(ctx context.Context, f Flow, set, clear Labels) error {
+	return c.UpdateFieldsContext(ctx, FlowUpdate{
+		Flow: Flow{
+			TupleOrig:  f.TupleOrig,
+			TupleReply: f.TupleReply,
+			Zone:       f.Zone,
+			Labels:     set.or(nil),
+			LabelsMask: set.or(clear),
+		},
+		Fields: FieldLabels,
+	})
+}
+
 // Delete removes a Conntrack entry given a Flow. Flows are looked up in the conntrack table
 // based on the original and reply tuple. When the Flow's ID field is filled, it must match the
 // ID on the connection returned from the tuple lookup, or the delete will fail.
+//
+// Delete uses [context.Background] internally, use [Conn.DeleteContext] to specify
+// a context.
 func (c *Conn) Delete(f Flow) error {
-	attrs, err := f.marshal()
+	return c.DeleteContext(context.Background(), f)
+}
+
+// DeleteContext is like [Conn.Delete], but aborts the operation when ctx is
+// cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) DeleteContext(ctx context.Context, f Flow) error {
+	req, err := deleteRequest(f)
 	if err != nil {
 		return err
 	}
 
-	// Default to IPv4, set netlink protocol family to IPv6 if orig/reply is IPv6.
-	pf := netfilter.ProtoIPv4
-	if f.TupleOrig.IP.IsIPv6() && f.TupleReply.IP.IsIPv6() {
-		pf = netfilter.ProtoIPv6
+	_, err = c.query(ctx, req)
+	if err != nil {
+		return err
 	}
 
-	req, err := netfilter.MarshalNetlink(
+	return nil
+}
+
+// deleteRequest returns the request deleting Flow f.
+func deleteRequest(f Flow) (netlink.Message, error) {
+	attrs, err := f.marshal()
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	return netfilter.MarshalNetlink(
 		netfilter.Header{
 			SubsystemID: netfilter.NFSubsysCTNetlink,
 			MessageType: netfilter.MessageType(ctDelete),
-			Family:      pf,
+			Family:      f.family(),
 			Flags:       netlink.Request | netlink.Acknowledge,
 		}, attrs)
+}
 
-	if err != nil {
-		return err
+// CreateBatch creates many Conntrack entries at once. Requests are packed into
+// large messages and sent without waiting for the kernel to acknowledge each
+// Flow, saving a round trip per Flow compared to [Conn.Create].
+//
+// The returned slice holds an error for every Flow in flows, nil if the Flow
+// was created. Flows rejected by the kernel don't prevent others from being
+// created. If the batch is aborted, for example because ctx is done, the error
+// is returned and set for every Flow that wasn't acknowledged by the kernel.
+// Those Flows may or may not have been created.
+//
+// CreateBatch uses [context.Background] internally, use
+// [Conn.CreateBatchContext] to specify a context.
+func (c *Conn) CreateBatch(flows []Flow) ([]error, error) {
+	return c.CreateBatchContext(context.Background(), flows)
+}
+
+// CreateBatchContext is like [Conn.CreateBatch], but aborts the operation when
+// ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) CreateBatchContext(ctx context.Context, flows []Flow) ([]error, error) {
+	return c.batchFlows(ctx, flows, createRequest)
+}
+
+// UpdateBatch updates many Conntrack entries at once, like [Conn.CreateBatch]
+// does for [Conn.Create]. See [Conn.Update] for the attributes considered.
+//
+// UpdateBatch uses [context.Background] internally, use
+// [Conn.UpdateBatchContext] to specify a context.
+func (c *Conn) UpdateBatch(flows []Flow) ([]error, error) {
+	return c.UpdateBatchContext(context.Background(), flows)
+}
+
+// UpdateBatchContext is like [Conn.UpdateBatch], but aborts the operation when
+// ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) UpdateBatchContext(ctx context.Context, flows []Flow) ([]error, error) {
+	return c.batchFlows(ctx, flows, updateRequest)
+}
+
+// DeleteBatch deletes many Conntrack entries at once, like [Conn.CreateBatch]
+// does for [Conn.Create].
+//
+// DeleteBatch uses [context.Background] internally, use
+// [Conn.DeleteBatchContext] to specify a context.
+func (c *Conn) DeleteBatch(flows []Flow) ([]error, error) {
+	return c.DeleteBatchContext(context.Background(), flows)
+}
+
+// DeleteBatchContext is like [Conn.DeleteBatch], but aborts the operation when
+// ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) DeleteBatchContext(ctx context.Context, flows []Flow) ([]error, error) {
+	return c.batchFlows(ctx, flows, deleteRequest)
+}
+
+// batchFlows builds a request for every Flow using build and sends them as a
+// batch. Flows for which no request can be built are not sent, their errors
+// are returned in place.
+func (c *Conn) batchFlows(ctx context.Context, flows []Flow,
+	build func(Flow) (netlink.Message, error)) ([]error, error) {
+	errs := make([]error, len(flows))
+
+	reqs := make([]netlink.Message, 0, len(flows))
+	idx := make([]int, 0, len(flows))
+	for i, f := range flows {
+		req, err := build(f)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		reqs = append(reqs, req)
+		idx = append(idx, i)
 	}
 
-	_, err = c.conn.Query(req)
-	if err != nil {
-		return err
+	berrs, err := c.batch(ctx, reqs)
+	for i, err := range berrs {
+		errs[idx[i]] = err
 	}
 
-	return nil
+	// The batch failed before sending any requests.
+	if berrs == nil && err != nil {
+		for _, i := range idx {
+			errs[i] = err
+		}
+	}
+
+	return errs, err
 }
 
 // Stats returns a list of Stats structures, one per CPU present in the machine.
 // Each Stats structure contains performance counters of all Conntrack actions
 // performed on that specific CPU.
+//
+// Stats uses [context.Background] internally, use [Conn.StatsContext] to specify
+// a context.
 func (c *Conn) Stats() ([]Stats, error) {
+	return c.StatsContext(context.Background())
+}
 
+// StatsContext is like [Conn.Stats], but aborts the operation when ctx is
+// cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) StatsContext(ctx context.Context) ([]Stats, error) {
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
 			SubsystemID: netfilter.NFSubsysCTNetlink,
@@ -521,7 +1428,7 @@ func (c *Conn) Stats() ([]Stats, error) {
 		return nil, err
 	}
 
-	msgs, err := c.conn.Query(req)
+	msgs, err := c.query(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -532,8 +1439,16 @@ func (c *Conn) Stats() ([]Stats, error) {
 // StatsExpect returns a list of StatsExpect structures, one per CPU present in the machine.
 // Each StatsExpect structure indicates how many Expect entries were initialized,
 // created or deleted on each CPU.
+//
+// StatsExpect uses [context.Background] internally, use [Conn.StatsExpectContext] to specify
+// a context.
 func (c *Conn) StatsExpect() ([]StatsExpect, error) {
+	return c.StatsExpectContext(context.Background())
+}
 
+// StatsExpectContext is like [Conn.StatsExpect], but aborts the operation when ctx is
+// cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) StatsExpectContext(ctx context.Context) ([]StatsExpect, error) {
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
 			SubsystemID: netfilter.NFSubsysCTNetlinkExp,
@@ -546,7 +1461,7 @@ func (c *Conn) StatsExpect() ([]StatsExpect, error) {
 		return nil, err
 	}
 
-	msgs, err := c.conn.Query(req)
+	msgs, err := c.query(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -561,8 +1476,16 @@ func (c *Conn) StatsExpect() ([]StatsExpect, error) {
 //
 // Starting from kernels 4.18 and higher, MaxEntries is returned, describing the maximum size
 // of the Conntrack table.
+//
+// StatsGlobal uses [context.Background] internally, use [Conn.StatsGlobalContext] to specify
+// a context.
 func (c *Conn) StatsGlobal() (StatsGlobal, error) {
+	return c.StatsGlobalContext(context.Background())
+}
 
+// StatsGlobalContext is like [Conn.StatsGlobal], but aborts the operation when ctx is
+// cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) StatsGlobalContext(ctx context.Context) (StatsGlobal, error) {
 	req, err := netfilter.MarshalNetlink(
 		netfilter.Header{
 			SubsystemID: netfilter.NFSubsysCTNetlink,
@@ -577,10 +1500,376 @@ func (c *Conn) StatsGlobal() (StatsGlobal, error) {
 		return sg, err
 	}
 
-	msgs, err := c.conn.Query(req)
+	msgs, err := c.query(ctx, req)
 	if err != nil {
 		return sg, err
 	}
 
 	return unmarshalStatsGlobal(msgs[0])
 }
+
+// timeoutQuery sends a request to the cttimeout subsystem and returns the
+// messages received in reply.
+func (c *Conn) timeoutQuery(ctx context.Context, mt timeoutMessageType, flags netlink.HeaderFlags,
+	attrs []netfilter.Attribute) ([]netlink.Message, error) {
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTNetlinkTimeout,
+			MessageType: netfilter.MessageType(mt),
+			Family:      netfilter.ProtoUnspec, // Family is ignored by cttimeout
+			Flags:       netlink.Request | netlink.Acknowledge | flags,
+		}, attrs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.query(ctx, req)
+}
+
+// CreateTimeout creates a new named timeout policy, similar to `nfct add
+// timeout`. Fails if a policy with the same name already exists.
+//
+// CreateTimeout uses [context.Background] internally, use
+// [Conn.CreateTimeoutContext] to specify a context.
+func (c *Conn) CreateTimeout(t Timeout) error {
+	return c.CreateTimeoutContext(context.Background(), t)
+}
+
+// CreateTimeoutContext is like [Conn.CreateTimeout], but aborts the operation
+// when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) CreateTimeoutContext(ctx context.Context, t Timeout) error {
+	attrs, err := t.marshal(true)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.timeoutQuery(ctx, ctTimeoutNew, netlink.Create|netlink.Excl, attrs)
+	return err
+}
+
+// UpdateTimeout replaces the timeouts of the named timeout policy, creating it
+// if it doesn't exist. The L4Proto of an existing policy cannot be changed.
+// Timeouts left zero in the Policy are reset to the protocol's defaults.
+//
+// UpdateTimeout uses [context.Background] internally, use
+// [Conn.UpdateTimeoutContext] to specify a context.
+func (c *Conn) UpdateTimeout(t Timeout) error {
+	return c.UpdateTimeoutContext(context.Background(), t)
+}
+
+// UpdateTimeoutContext is like [Conn.UpdateTimeout], but aborts the operation
+// when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) UpdateTimeoutContext(ctx context.Context, t Timeout) error {
+	attrs, err := t.marshal(true)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.timeoutQuery(ctx, ctTimeoutNew, netlink.Create|netlink.Replace, attrs)
+	return err
+}
+
+// GetTimeout gets the timeout policy with the given name.
+//
+// GetTimeout uses [context.Background] internally, use
+// [Conn.GetTimeoutContext] to specify a context.
+func (c *Conn) GetTimeout(name string) (Timeout, error) {
+	return c.GetTimeoutContext(context.Background(), name)
+}
+
+// GetTimeoutContext is like [Conn.GetTimeout], but aborts the operation when
+// ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) GetTimeoutContext(ctx context.Context, name string) (Timeout, error) {
+	attrs, err := marshalTimeoutName(name)
+	if err != nil {
+		return Timeout{}, err
+	}
+
+	msgs, err := c.timeoutQuery(ctx, ctTimeoutGet, 0, attrs)
+	if err != nil {
+		return Timeout{}, err
+	}
+
+	// The first message contains the Timeout, followed by an acknowledgement.
+	return unmarshalTimeout(msgs[0])
+}
+
+// DumpTimeout gets all named timeout policies, similar to `nfct list timeout`.
+//
+// DumpTimeout uses [context.Background] internally, use
+// [Conn.DumpTimeoutContext] to specify a context.
+func (c *Conn) DumpTimeout() ([]Timeout, error) {
+	return c.DumpTimeoutContext(context.Background())
+}
+
+// DumpTimeoutContext is like [Conn.DumpTimeout], but aborts the operation when
+// ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) DumpTimeoutContext(ctx context.Context) ([]Timeout, error) {
+	msgs, err := c.timeoutQuery(ctx, ctTimeoutGet, netlink.Dump, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Timeout, 0, len(msgs))
+	for _, msg := range msgs {
+		t, err := unmarshalTimeout(msg)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+
+	return out, nil
+}
+
+// DeleteTimeout deletes the timeout policy with the given name, similar to
+// `nfct delete timeout`. Policies still in use by rules or connections cannot
+// be deleted, the kernel returns [ErrBusy].
+//
+// DeleteTimeout uses [context.Background] internally, use
+// [Conn.DeleteTimeoutContext] to specify a context.
+func (c *Conn) DeleteTimeout(name string) error {
+	return c.DeleteTimeoutContext(context.Background(), name)
+}
+
+// DeleteTimeoutContext is like [Conn.DeleteTimeout], but aborts the operation
+// when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) DeleteTimeoutContext(ctx context.Context, name string) error {
+	attrs, err := marshalTimeoutName(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.timeoutQuery(ctx, ctTimeoutDelete, 0, attrs)
+	return err
+}
+
+// FlushTimeout deletes all timeout policies that are not in use, similar to
+// `nfct flush timeout`.
+//
+// FlushTimeout uses [context.Background] internally, use
+// [Conn.FlushTimeoutContext] to specify a context.
+func (c *Conn) FlushTimeout() error {
+	return c.FlushTimeoutContext(context.Background())
+}
+
+// FlushTimeoutContext is like [Conn.FlushTimeout], but aborts the operation
+// when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) FlushTimeoutContext(ctx context.Context) error {
+	_, err := c.timeoutQuery(ctx, ctTimeoutDelete, 0, nil)
+	return err
+}
+
+// SetDefaultTimeout sets the default timeouts of the Timeout's L4Proto in the
+// Conn's network namespace, similar to `nfct default-set timeout`. The Name of
+// the Timeout is ignored. Timeouts left zero in the Policy keep their current
+// value.
+//
+// SetDefaultTimeout uses [context.Background] internally, use
+// [Conn.SetDefaultTimeoutContext] to specify a context.
+func (c *Conn) SetDefaultTimeout(t Timeout) error {
+	return c.SetDefaultTimeoutContext(context.Background(), t)
+}
+
+// SetDefaultTimeoutContext is like [Conn.SetDefaultTimeout], but aborts the
+// operation when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) SetDefaultTimeoutContext(ctx context.Context, t Timeout) error {
+	attrs, err := t.marshal(false)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.timeoutQuery(ctx, ctTimeoutDefaultSet, 0, attrs)
+	return err
+}
+
+// GetDefaultTimeout gets the default timeouts of the given protocols in the
+// Conn's network namespace, similar to `nfct default-get timeout`.
+//
+// GetDefaultTimeout uses [context.Background] internally, use
+// [Conn.GetDefaultTimeoutContext] to specify a context.
+func (c *Conn) GetDefaultTimeout(l3 netfilter.ProtoFamily, l4 uint8) (Timeout, error) {
+	return c.GetDefaultTimeoutContext(context.Background(), l3, l4)
+}
+
+// GetDefaultTimeoutContext is like [Conn.GetDefaultTimeout], but aborts the
+// operation when ctx is cancelled or its deadline expires, returning
+// ctx.Err().
+func (c *Conn) GetDefaultTimeoutContext(ctx context.Context, l3 netfilter.ProtoFamily, l4 uint8) (Timeout, error) {
+	attrs := []netfilter.Attribute{
+		{Type: uint16(ctaTimeoutL3Proto), Data: netfilter.Uint16Bytes(uint16(l3))},
+		{Type: uint16(ctaTimeoutL4Proto), Data: []byte{l4}},
+	}
+
+	msgs, err := c.timeoutQuery(ctx, ctTimeoutDefaultGet, 0, attrs)
+	if err != nil {
+		return Timeout{}, err
+	}
+
+	return unmarshalTimeout(msgs[0])
+}
+
+// helperQuery sends a request to the cthelper subsystem and returns the
+// messages received in reply.
+func (c *Conn) helperQuery(ctx context.Context, mt cthelperMessageType, flags netlink.HeaderFlags,
+	attrs []netfilter.Attribute) ([]netlink.Message, error) {
+	req, err := netfilter.MarshalNetlink(
+		netfilter.Header{
+			SubsystemID: netfilter.NFSubsysCTHelper,
+			MessageType: netfilter.MessageType(mt),
+			Family:      netfilter.ProtoUnspec, // Family is ignored by cthelper
+			Flags:       netlink.Request | netlink.Acknowledge | flags,
+		}, attrs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.query(ctx, req)
+}
+
+// CreateHelper registers a new userspace helper, similar to `nfct add helper`.
+// Fails if a helper with the same name and protocols already exists.
+//
+// CreateHelper uses [context.Background] internally, use
+// [Conn.CreateHelperContext] to specify a context.
+func (c *Conn) CreateHelper(h UserspaceHelper) error {
+	return c.CreateHelperContext(context.Background(), h)
+}
+
+// CreateHelperContext is like [Conn.CreateHelper], but aborts the operation
+// when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) CreateHelperContext(ctx context.Context, h UserspaceHelper) error {
+	attrs, err := h.marshal(true)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.helperQuery(ctx, ctHelperNew, netlink.Create|netlink.Excl, attrs)
+	return err
+}
+
+// UpdateHelper updates the QueueNum, Enabled status and Policies of the
+// existing userspace helper with the same name and protocols. PrivDataLen is
+// ignored. If Policies is non-empty, it must hold as many policies as the
+// existing helper. If no such helper exists, ErrNotFound is returned.
+//
+// UpdateHelper uses [context.Background] internally, use
+// [Conn.UpdateHelperContext] to specify a context.
+func (c *Conn) UpdateHelper(h UserspaceHelper) error {
+	return c.UpdateHelperContext(context.Background(), h)
+}
+
+// UpdateHelperContext is like [Conn.UpdateHelper], but aborts the operation
+// when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) UpdateHelperContext(ctx context.Context, h UserspaceHelper) error {
+	attrs, err := h.marshal(false)
+	if err != nil {
+		return err
+	}
+
+	// The kernel creates the helper if it doesn't exist yet, even without
+	// NLM_F_CREATE. Look it up first so only existing helpers are updated.
+	if _, err := c.GetHelperContext(ctx, h.Name, h.L3Proto, h.L4Proto); err != nil {
+		return err
+	}
+
+	_, err = c.helperQuery(ctx, ctHelperNew, netlink.Replace, attrs)
+	return err
+}
+
+// GetHelper gets the userspace helper with the given name and protocols,
+// similar to `nfct get helper`. If l3 and l4 are both zero, the first helper
+// with the given name is returned.
+//
+// GetHelper uses [context.Background] internally, use
+// [Conn.GetHelperContext] to specify a context.
+func (c *Conn) GetHelper(name string, l3 netfilter.ProtoFamily, l4 uint8) (UserspaceHelper, error) {
+	return c.GetHelperContext(context.Background(), name, l3, l4)
+}
+
+// GetHelperContext is like [Conn.GetHelper], but aborts the operation when
+// ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) GetHelperContext(ctx context.Context, name string, l3 netfilter.ProtoFamily, l4 uint8) (UserspaceHelper, error) {
+	attrs, err := marshalHelperQuery(name, l3, l4)
+	if err != nil {
+		return UserspaceHelper{}, err
+	}
+
+	msgs, err := c.helperQuery(ctx, ctHelperGet, 0, attrs)
+	if err != nil {
+		return UserspaceHelper{}, err
+	}
+
+	// The first message contains the UserspaceHelper, followed by an
+	// acknowledgement.
+	return unmarshalUserspaceHelper(msgs[0])
+}
+
+// DumpHelper gets all userspace helpers, similar to `nfct list helper`.
+//
+// DumpHelper uses [context.Background] internally, use
+// [Conn.DumpHelperContext] to specify a context.
+func (c *Conn) DumpHelper() ([]UserspaceHelper, error) {
+	return c.DumpHelperContext(context.Background())
+}
+
+// DumpHelperContext is like [Conn.DumpHelper], but aborts the operation when
+// ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) DumpHelperContext(ctx context.Context) ([]UserspaceHelper, error) {
+	msgs, err := c.helperQuery(ctx, ctHelperGet, netlink.Dump, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]UserspaceHelper, 0, len(msgs))
+	for _, msg := range msgs {
+		h, err := unmarshalUserspaceHelper(msg)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+
+	return out, nil
+}
+
+// DeleteHelper deletes the userspace helper with the given name and
+// protocols, similar to `nfct delete helper`. If l3 and l4 are both zero, all
+// helpers with the given name are deleted. Helpers still attached to
+// connections cannot be deleted, the kernel returns [ErrBusy].
+//
+// DeleteHelper uses [context.Background] internally, use
+// [Conn.DeleteHelperContext] to specify a context.
+func (c *Conn) DeleteHelper(name string, l3 netfilter.ProtoFamily, l4 uint8) error {
+	return c.DeleteHelperContext(context.Background(), name, l3, l4)
+}
+
+// DeleteHelperContext is like [Conn.DeleteHelper], but aborts the operation
+// when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) DeleteHelperContext(ctx context.Context, name string, l3 netfilter.ProtoFamily, l4 uint8) error {
+	attrs, err := marshalHelperQuery(name, l3, l4)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.helperQuery(ctx, ctHelperDel, 0, attrs)
+	return err
+}
+
+// FlushHelper deletes all userspace helpers that are not in use, similar to
+// `nfct flush helper`.
+//
+// FlushHelper uses [context.Background] internally, use
+// [Conn.FlushHelperContext] to specify a context.
+func (c *Conn) FlushHelper() error {
+	return c.FlushHelperContext(context.Background())
+}
+
+// FlushHelperContext is like [Conn.FlushHelper], but aborts the operation
+// when ctx is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) FlushHelperContext(ctx context.Context) error {
+	_, err := c.helperQuery(ctx, ctHelperDel, 0, nil)
+	return err
+}
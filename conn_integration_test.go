@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"runtime"
 	"strings"
 	"testing"
 
@@ -69,7 +70,22 @@ func checkKmod() error {
 // makeNSConn creates a Conn in a new network namespace to use for testing.
 // Returns the Conn, the netns identifier and error.
 func makeNSConn() (*Conn, int, error) {
-	newns, err := netns.New()
+	// Create the namespace on a locked thread that is never unlocked, so the
+	// runtime discards the thread when the goroutine exits instead of running
+	// other goroutines in the new namespace.
+	type result struct {
+		ns  netns.NsHandle
+		err error
+	}
+	rc := make(chan result)
+	go func() {
+		runtime.LockOSThread()
+		ns, err := netns.New()
+		rc <- result{ns, err}
+	}()
+
+	res := <-rc
+	newns, err := res.ns, res.err
 	if err != nil {
 		return nil, 0, fmt.Errorf("unexpected error creating network namespace: %s", err)
 	}
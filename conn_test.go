@@ -1,10 +1,13 @@
 package conntrack_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/mdlayher/netlink"
 	"github.com/stretchr/testify/assert"
@@ -94,6 +97,50 @@ func ExampleConn_dumpFilter() {
 	log.Print(df)
 }
 
+func ExampleConn_dumpSeq() {
+	// Open a Conntrack connection.
+	c, err := conntrack.Dial(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Walk the Conntrack table without loading all of it into memory at once.
+	// Flows are decoded as they are received from the kernel.
+	for f, err := range c.DumpSeq(nil) {
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Stop walking the table after finding the first marked flow.
+		if f.Mark == 0xff00 {
+			log.Print(f)
+			break
+		}
+	}
+}
+
+func ExampleConn_dumpContext() {
+	// Open a Conntrack connection.
+	c, err := conntrack.Dial(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Give up on dumping the table if it takes longer than 5 seconds.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	df, err := c.DumpContext(ctx, nil)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Fatal("Timed out dumping conntrack table")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print(df)
+}
+
 func ExampleConn_dumpFilterZone() {
 	// Open a Conntrack connection.
 	c, err := conntrack.Dial(nil)
@@ -0,0 +1,358 @@
+package conntrack
+
+import (
+	"fmt"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/netfilter"
+)
+
+// The enums below are translated from the Linux kernel source at
+// include/uapi/linux/netfilter/nfnetlink_cthelper.h
+
+// cthelperMessageType is a cthelper-specific representation of a
+// netfilter.MessageType.
+type cthelperMessageType netfilter.MessageType
+
+// enum nfnl_cthelper_msg_types
+const (
+	ctHelperNew cthelperMessageType = iota // NFNL_MSG_CTHELPER_NEW
+	ctHelperGet                            // NFNL_MSG_CTHELPER_GET
+	ctHelperDel                            // NFNL_MSG_CTHELPER_DEL
+)
+
+// cthelperType describes the type of cthelper attribute in this container.
+type cthelperType uint8
+
+// enum nfnl_cthelper_type
+const (
+	ctHelperUnspec      cthelperType = iota // NFCTH_UNSPEC
+	ctHelperName                            // NFCTH_NAME
+	ctHelperTuple                           // NFCTH_TUPLE
+	ctHelperQueueNum                        // NFCTH_QUEUE_NUM
+	ctHelperPolicy                          // NFCTH_POLICY
+	ctHelperPrivDataLen                     // NFCTH_PRIV_DATA_LEN
+	ctHelperStatus                          // NFCTH_STATUS
+)
+
+// cthelperPolicySetType describes the type of expectation policy set attribute
+// in this container.
+type cthelperPolicySetType uint8
+
+// enum nfnl_cthelper_policy_type
+const (
+	ctHelperPolicySetUnspec cthelperPolicySetType = iota // NFCTH_POLICY_SET_UNSPEC
+	ctHelperPolicySetNum                                 // NFCTH_POLICY_SET_NUM
+	ctHelperPolicySet                                    // NFCTH_POLICY_SET, NFCTH_POLICY_SET1
+)
+
+// cthelperPolicyType describes the type of expectation policy attribute in
+// this container.
+type cthelperPolicyType uint8
+
+// enum nfnl_cthelper_pol_type
+const (
+	ctHelperPolicyUnspec        cthelperPolicyType = iota // NFCTH_POLICY_UNSPEC
+	ctHelperPolicyName                                    // NFCTH_POLICY_NAME
+	ctHelperPolicyExpectMax                               // NFCTH_POLICY_EXPECT_MAX
+	ctHelperPolicyExpectTimeout                           // NFCTH_POLICY_EXPECT_TIMEOUT
+)
+
+// cthelperTupleType describes the type of cthelper tuple attribute in this
+// container.
+type cthelperTupleType uint8
+
+// enum nfnl_cthelper_tuple_type
+const (
+	ctHelperTupleUnspec     cthelperTupleType = iota // NFCTH_TUPLE_UNSPEC
+	ctHelperTupleL3ProtoNum                          // NFCTH_TUPLE_L3PROTONUM
+	ctHelperTupleL4ProtoNum                          // NFCTH_TUPLE_L4PROTONUM
+)
+
+var _ = []uint8{
+	uint8(ctHelperUnspec), uint8(ctHelperPolicySetUnspec), uint8(ctHelperPolicyUnspec),
+	uint8(ctHelperTupleUnspec),
+}
+
+// cthelperNames holds the kernel names of nested cthelper attributes, used in
+// the Path of a DecodeError.
+var cthelperNames = map[cthelperType]string{
+	ctHelperTuple:  "NFCTH_TUPLE",
+	ctHelperPolicy: "NFCTH_POLICY",
+}
+
+const (
+	ctHelperStatusDisabled uint32 = iota // NFCT_HELPER_STATUS_DISABLED
+	ctHelperStatusEnabled                // NFCT_HELPER_STATUS_ENABLED
+)
+
+const (
+	// helperNameMax is the maximum length of a helper or expectation policy
+	// name, including the terminating NUL byte.
+	helperNameMax = 16 // NF_CT_HELPER_NAME_LEN
+
+	// helperPoliciesMax is the maximum amount of expectation policies of a
+	// helper.
+	helperPoliciesMax = 4 // NF_CT_MAX_EXPECT_CLASSES
+)
+
+// UserspaceHelper is a conntrack helper implemented in userspace, as managed by
+// `nfct helper`. Packets of connections the helper is attached to are queued to
+// userspace using NFQUEUE, where the helper can create expectations for related
+// connections. Userspace helpers are global and not bound to a network
+// namespace.
+type UserspaceHelper struct {
+	// Name is the name of the helper, at most 15 bytes long. Together with
+	// L3Proto and L4Proto, it identifies the helper.
+	Name string
+
+	// L3Proto is the address family the helper applies to, like
+	// [netfilter.ProtoIPv4] or [netfilter.ProtoIPv6].
+	L3Proto netfilter.ProtoFamily
+
+	// L4Proto is the layer 4 protocol number the helper applies to, like
+	// [unix.IPPROTO_TCP].
+	L4Proto uint8
+
+	// QueueNum is the NFQUEUE number packets are sent to.
+	QueueNum uint32
+
+	// Policies holds one to four expectation policies, one for each class of
+	// expectation the helper creates. The index of a policy is the class of
+	// the expectations it applies to, see [Expect.Class].
+	Policies []ExpectPolicy
+
+	// PrivDataLen is the size of the private data area attached to each
+	// connection the helper is attached to, used by the helper to store
+	// state. It can't be changed after the helper is created.
+	PrivDataLen uint32
+
+	// Enabled marks the helper as configured and ready to be used by rules.
+	Enabled bool
+}
+
+// ExpectPolicy limits the amount and lifetime of expectations created by a
+// helper.
+type ExpectPolicy struct {
+	// Name is the name of the policy, at most 15 bytes long.
+	Name string
+
+	// MaxExpected is the maximum amount of simultaneous expectations created
+	// by a single connection, at most 255.
+	MaxExpected uint32
+
+	// Timeout is the lifetime of an expectation in seconds.
+	Timeout uint32
+}
+
+// marshalHelperName marshals a NUL-terminated helper or policy name.
+func marshalHelperName(t uint16, name string) (netfilter.Attribute, error) {
+	if name == "" || len(name) >= helperNameMax {
+		return netfilter.Attribute{}, errHelperName
+	}
+
+	// The kernel only accepts NUL-terminated names.
+	return netfilter.Attribute{Type: t, Data: []byte(name + "\x00")}, nil
+}
+
+// marshalHelperTuple marshals the protocols of a helper into an NFCTH_TUPLE
+// attribute.
+func marshalHelperTuple(l3 netfilter.ProtoFamily, l4 uint8) netfilter.Attribute {
+	return netfilter.Attribute{
+		Type:   uint16(ctHelperTuple),
+		Nested: true,
+		Children: []netfilter.Attribute{
+			{Type: uint16(ctHelperTupleL3ProtoNum), Data: netfilter.Uint16Bytes(uint16(l3))},
+			{Type: uint16(ctHelperTupleL4ProtoNum), Data: []byte{l4}},
+		},
+	}
+}
+
+// marshal marshals an ExpectPolicy into the NFCTH_POLICY_SET attribute at the
+// given index.
+func (ep ExpectPolicy) marshal(i int) (netfilter.Attribute, error) {
+	name, err := marshalHelperName(uint16(ctHelperPolicyName), ep.Name)
+	if err != nil {
+		return netfilter.Attribute{}, fmt.Errorf("policy %d: %w", i, err)
+	}
+
+	return netfilter.Attribute{
+		Type:   uint16(ctHelperPolicySet) + uint16(i),
+		Nested: true,
+		Children: []netfilter.Attribute{
+			name,
+			{Type: uint16(ctHelperPolicyExpectMax), Data: netfilter.Uint32Bytes(ep.MaxExpected)},
+			{Type: uint16(ctHelperPolicyExpectTimeout), Data: netfilter.Uint32Bytes(ep.Timeout)},
+		},
+	}, nil
+}
+
+// unmarshal unmarshals netlink attributes into an ExpectPolicy.
+func (ep *ExpectPolicy) unmarshal(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch cthelperPolicyType(ad.Type()) {
+		case ctHelperPolicyName:
+			ep.Name = ad.String()
+		case ctHelperPolicyExpectMax:
+			ep.MaxExpected = ad.Uint32()
+		case ctHelperPolicyExpectTimeout:
+			ep.Timeout = ad.Uint32()
+		}
+	}
+
+	return ad.Err()
+}
+
+// marshal marshals a UserspaceHelper into a list of netfilter.Attributes. When
+// create is false, the attributes are marshaled for updating an existing
+// helper, omitting PrivDataLen and allowing Policies to be empty.
+func (h UserspaceHelper) marshal(create bool) ([]netfilter.Attribute, error) {
+	name, err := marshalHelperName(uint16(ctHelperName), h.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(h.Policies) > helperPoliciesMax || (create && len(h.Policies) == 0) {
+		return nil, errHelperPolicies
+	}
+
+	status := ctHelperStatusDisabled
+	if h.Enabled {
+		status = ctHelperStatusEnabled
+	}
+
+	attrs := []netfilter.Attribute{
+		name,
+		marshalHelperTuple(h.L3Proto, h.L4Proto),
+		{Type: uint16(ctHelperQueueNum), Data: netfilter.Uint32Bytes(h.QueueNum)},
+		{Type: uint16(ctHelperStatus), Data: netfilter.Uint32Bytes(status)},
+	}
+
+	if len(h.Policies) > 0 {
+		pol := netfilter.Attribute{Type: uint16(ctHelperPolicy), Nested: true}
+		pol.Children = append(pol.Children, netfilter.Attribute{
+			Type: uint16(ctHelperPolicySetNum), Data: netfilter.Uint32Bytes(uint32(len(h.Policies))),
+		})
+		for i, ep := range h.Policies {
+			a, err := ep.marshal(i)
+			if err != nil {
+				return nil, err
+			}
+			pol.Children = append(pol.Children, a)
+		}
+		attrs = append(attrs, pol)
+	}
+
+	// The kernel refuses to change the private data size of existing helpers.
+	if create {
+		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctHelperPrivDataLen), Data: netfilter.Uint32Bytes(h.PrivDataLen)})
+	}
+
+	return attrs, nil
+}
+
+// unmarshal unmarshals netlink attributes into a UserspaceHelper.
+func (h *UserspaceHelper) unmarshal(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		t := cthelperType(ad.Type())
+		switch t {
+		case ctHelperName:
+			h.Name = ad.String()
+		case ctHelperTuple:
+			ad.Nested(h.unmarshalTuple)
+		case ctHelperQueueNum:
+			h.QueueNum = ad.Uint32()
+		case ctHelperPolicy:
+			ad.Nested(h.unmarshalPolicies)
+		case ctHelperPrivDataLen:
+			h.PrivDataLen = ad.Uint32()
+		case ctHelperStatus:
+			h.Enabled = ad.Uint32() == ctHelperStatusEnabled
+		}
+
+		if t == ctHelperTuple || t == ctHelperPolicy {
+			if err := ad.Err(); err != nil {
+				return decodeError(attrName(cthelperNames, t), err)
+			}
+		}
+	}
+
+	if err := ad.Err(); err != nil {
+		return &DecodeError{Err: err}
+	}
+
+	return nil
+}
+
+// unmarshalTuple unmarshals the children of an NFCTH_TUPLE attribute.
+func (h *UserspaceHelper) unmarshalTuple(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch cthelperTupleType(ad.Type()) {
+		case ctHelperTupleL3ProtoNum:
+			h.L3Proto = netfilter.ProtoFamily(ad.Uint16())
+		case ctHelperTupleL4ProtoNum:
+			h.L4Proto = ad.Uint8()
+		}
+	}
+
+	return ad.Err()
+}
+
+// unmarshalPolicies unmarshals the children of an NFCTH_POLICY attribute.
+func (h *UserspaceHelper) unmarshalPolicies(ad *netlink.AttributeDecoder) error {
+	var num uint32
+	var policies [helperPoliciesMax]ExpectPolicy
+
+	for ad.Next() {
+		switch t := cthelperPolicySetType(ad.Type()); {
+		case t == ctHelperPolicySetNum:
+			num = ad.Uint32()
+		case t >= ctHelperPolicySet && t < ctHelperPolicySet+helperPoliciesMax:
+			ad.Nested(policies[t-ctHelperPolicySet].unmarshal)
+			if err := ad.Err(); err != nil {
+				// The policy sets are numbered from NFCTH_POLICY_SET1.
+				return decodeError(fmt.Sprintf("NFCTH_POLICY_SET%d", t-ctHelperPolicySet+1), err)
+			}
+		}
+	}
+
+	if err := ad.Err(); err != nil {
+		return err
+	}
+
+	h.Policies = policies[:min(num, helperPoliciesMax)]
+
+	return nil
+}
+
+// marshalHelperQuery marshals the attributes used to look up userspace
+// helpers. The tuple is only included if l3 or l4 are non-zero.
+func marshalHelperQuery(name string, l3 netfilter.ProtoFamily, l4 uint8) ([]netfilter.Attribute, error) {
+	na, err := marshalHelperName(uint16(ctHelperName), name)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []netfilter.Attribute{na}
+	if l3 != 0 || l4 != 0 {
+		attrs = append(attrs, marshalHelperTuple(l3, l4))
+	}
+
+	return attrs, nil
+}
+
+// unmarshalUserspaceHelper unmarshals a UserspaceHelper from a netlink.Message.
+func unmarshalUserspaceHelper(nlm netlink.Message) (UserspaceHelper, error) {
+	var h UserspaceHelper
+
+	_, ad, err := netfilter.DecodeNetlink(nlm)
+	if err != nil {
+		return h, err
+	}
+
+	if err := h.unmarshal(ad); err != nil {
+		return h, err
+	}
+
+	return h, nil
+}
@@ -0,0 +1,75 @@
+//go:build integration
+
+package conntrack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+func TestConnHelper(t *testing.T) {
+	if !findKsym("nfnl_cthelper_new") {
+		t.Skip("nfnetlink_cthelper not supported by kernel")
+	}
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	// Userspace helpers are global, use names unlikely to clash with the host.
+	h := UserspaceHelper{
+		Name:        "gotest-ftp",
+		L3Proto:     netfilter.ProtoIPv4,
+		L4Proto:     unix.IPPROTO_TCP,
+		QueueNum:    1,
+		Policies:    []ExpectPolicy{{Name: "ftp", MaxExpected: 1, Timeout: 300}},
+		PrivDataLen: 4,
+	}
+	require.NoError(t, c.CreateHelper(h))
+	t.Cleanup(func() { _ = c.DeleteHelper(h.Name, 0, 0) })
+	assert.ErrorIs(t, c.CreateHelper(h), unix.EEXIST)
+
+	got, err := c.GetHelper(h.Name, h.L3Proto, h.L4Proto)
+	require.NoError(t, err)
+	assert.Equal(t, h, got)
+
+	h.QueueNum, h.Enabled = 2, true
+	h.Policies[0].Timeout = 60
+	require.NoError(t, c.UpdateHelper(h))
+	got, err = c.GetHelper(h.Name, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, h, got)
+
+	// The amount of policies of an existing helper can't be changed.
+	h.Policies = append(h.Policies, ExpectPolicy{Name: "data", MaxExpected: 1, Timeout: 10})
+	assert.Error(t, c.UpdateHelper(h))
+
+	// Updating a helper that doesn't exist must not create it.
+	missing := h
+	missing.Name, missing.Policies = "gotest-missing", h.Policies[:1]
+	assert.ErrorIs(t, c.UpdateHelper(missing), ErrNotFound)
+	_, err = c.GetHelper(missing.Name, 0, 0)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	h6 := h
+	h6.Name, h6.L3Proto = "gotest-ftp6", netfilter.ProtoIPv6
+	require.NoError(t, c.CreateHelper(h6))
+	t.Cleanup(func() { _ = c.DeleteHelper(h6.Name, 0, 0) })
+
+	hs, err := c.DumpHelper()
+	require.NoError(t, err)
+	var names []string
+	for _, h := range hs {
+		names = append(names, h.Name)
+	}
+	assert.Contains(t, names, "gotest-ftp")
+	assert.Contains(t, names, "gotest-ftp6")
+
+	require.NoError(t, c.DeleteHelper(h6.Name, h6.L3Proto, h6.L4Proto))
+	_, err = c.GetHelper(h6.Name, 0, 0)
+	assert.ErrorIs(t, err, unix.ENOENT)
+	assert.ErrorIs(t, c.DeleteHelper(h6.Name, 0, 0), unix.ENOENT)
+}
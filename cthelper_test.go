@@ -0,0 +1,132 @@
+package conntrack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+func TestUserspaceHelperMarshal(t *testing.T) {
+	h := UserspaceHelper{
+		Name:     "ftp",
+		L3Proto:  netfilter.ProtoIPv4,
+		L4Proto:  unix.IPPROTO_TCP,
+		QueueNum: 5,
+		Policies: []ExpectPolicy{
+			{Name: "ftp", MaxExpected: 1, Timeout: 300},
+			{Name: "data", MaxExpected: 2, Timeout: 0x0102},
+		},
+		PrivDataLen: 32,
+		Enabled:     true,
+	}
+
+	attrs, err := h.marshal(true)
+	require.NoError(t, err)
+	assert.Equal(t, []netfilter.Attribute{
+		{Type: uint16(ctHelperName), Data: []byte("ftp\x00")},
+		{Type: uint16(ctHelperTuple), Nested: true, Children: []netfilter.Attribute{
+			{Type: uint16(ctHelperTupleL3ProtoNum), Data: []byte{0, 2}},
+			{Type: uint16(ctHelperTupleL4ProtoNum), Data: []byte{6}},
+		}},
+		{Type: uint16(ctHelperQueueNum), Data: []byte{0, 0, 0, 5}},
+		{Type: uint16(ctHelperStatus), Data: []byte{0, 0, 0, 1}},
+		{Type: uint16(ctHelperPolicy), Nested: true, Children: []netfilter.Attribute{
+			{Type: uint16(ctHelperPolicySetNum), Data: []byte{0, 0, 0, 2}},
+			{Type: 2, Nested: true, Children: []netfilter.Attribute{
+				{Type: uint16(ctHelperPolicyName), Data: []byte("ftp\x00")},
+				{Type: uint16(ctHelperPolicyExpectMax), Data: []byte{0, 0, 0, 1}},
+				{Type: uint16(ctHelperPolicyExpectTimeout), Data: []byte{0, 0, 1, 44}},
+			}},
+			{Type: 3, Nested: true, Children: []netfilter.Attribute{
+				{Type: uint16(ctHelperPolicyName), Data: []byte("data\x00")},
+				{Type: uint16(ctHelperPolicyExpectMax), Data: []byte{0, 0, 0, 2}},
+				{Type: uint16(ctHelperPolicyExpectTimeout), Data: []byte{0, 0, 1, 2}},
+			}},
+		}},
+		{Type: uint16(ctHelperPrivDataLen), Data: []byte{0, 0, 0, 32}},
+	}, attrs)
+
+	// Round-trip through a Netlink message.
+	nlm, err := netfilter.MarshalNetlink(netfilter.Header{SubsystemID: netfilter.NFSubsysCTHelper}, attrs)
+	require.NoError(t, err)
+
+	got, err := unmarshalUserspaceHelper(nlm)
+	require.NoError(t, err)
+	assert.Equal(t, h, got)
+
+	// Updates can't change the private data size and may omit policies.
+	h.Policies = nil
+	attrs, err = h.marshal(false)
+	require.NoError(t, err)
+	assert.Len(t, attrs, 4)
+}
+
+func TestUserspaceHelperUnmarshalDecodeError(t *testing.T) {
+	unmarshal := func(attrs ...netfilter.Attribute) error {
+		nlm, err := netfilter.MarshalNetlink(netfilter.Header{SubsystemID: netfilter.NFSubsysCTHelper}, attrs)
+		require.NoError(t, err)
+		_, err = unmarshalUserspaceHelper(nlm)
+		return err
+	}
+
+	var de *DecodeError
+	err := unmarshal(netfilter.Attribute{Type: uint16(ctHelperTuple), Nested: true, Children: []netfilter.Attribute{
+		{Type: uint16(ctHelperTupleL3ProtoNum), Data: []byte{2}},
+	}})
+	require.ErrorAs(t, err, &de)
+	assert.Equal(t, []string{"NFCTH_TUPLE"}, de.Path)
+
+	err = unmarshal(netfilter.Attribute{Type: uint16(ctHelperPolicy), Nested: true, Children: []netfilter.Attribute{
+		{Type: uint16(ctHelperPolicySetNum), Data: []byte{0, 0, 0, 2}},
+		{Type: uint16(ctHelperPolicySet), Nested: true, Children: []netfilter.Attribute{
+			{Type: uint16(ctHelperPolicyExpectMax), Data: []byte{0, 0, 0, 1}},
+		}},
+		{Type: uint16(ctHelperPolicySet) + 1, Nested: true, Children: []netfilter.Attribute{
+			{Type: uint16(ctHelperPolicyExpectMax), Data: []byte{0, 1}},
+		}},
+	}})
+	require.ErrorAs(t, err, &de)
+	assert.Equal(t, []string{"NFCTH_POLICY", "NFCTH_POLICY_SET2"}, de.Path)
+
+	// Errors in top-level attributes have an empty Path.
+	err = unmarshal(netfilter.Attribute{Type: uint16(ctHelperQueueNum), Data: []byte{0, 1}})
+	require.ErrorAs(t, err, &de)
+	assert.Empty(t, de.Path)
+}
+
+func TestUserspaceHelperMarshalError(t *testing.T) {
+	ep := []ExpectPolicy{{Name: "foo"}}
+
+	_, err := UserspaceHelper{Policies: ep}.marshal(true)
+	assert.ErrorIs(t, err, errHelperName)
+
+	_, err = UserspaceHelper{Name: strings.Repeat("a", 16), Policies: ep}.marshal(true)
+	assert.ErrorIs(t, err, errHelperName)
+
+	_, err = UserspaceHelper{Name: "foo"}.marshal(true)
+	assert.ErrorIs(t, err, errHelperPolicies)
+
+	_, err = UserspaceHelper{Name: "foo", Policies: make([]ExpectPolicy, 5)}.marshal(false)
+	assert.ErrorIs(t, err, errHelperPolicies)
+
+	_, err = UserspaceHelper{Name: "foo", Policies: []ExpectPolicy{{}}}.marshal(true)
+	assert.ErrorIs(t, err, errHelperName)
+
+	_, err = marshalHelperQuery("", 0, 0)
+	assert.ErrorIs(t, err, errHelperName)
+}
+
+func TestMarshalHelperQuery(t *testing.T) {
+	attrs, err := marshalHelperQuery("ftp", 0, 0)
+	require.NoError(t, err)
+	assert.Len(t, attrs, 1)
+
+	attrs, err = marshalHelperQuery("ftp", netfilter.ProtoIPv6, unix.IPPROTO_TCP)
+	require.NoError(t, err)
+	require.Len(t, attrs, 2)
+	assert.Equal(t, marshalHelperTuple(netfilter.ProtoIPv6, unix.IPPROTO_TCP), attrs[1])
+}
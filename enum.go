@@ -50,14 +50,14 @@ const (
 	ctaStatus                              // CTA_STATUS
 	ctaProtoInfo                           // CTA_PROTOINFO
 	ctaHelp                                // CTA_HELP
-	ctaNatSrc                              // CTA_NAT_SRC, Deprecated
+	ctaNatSrc                              // CTA_NAT_SRC
 	ctaTimeout                             // CTA_TIMEOUT
 	ctaMark                                // CTA_MARK
 	ctaCountersOrig                        // CTA_COUNTERS_ORIG
 	ctaCountersReply                       // CTA_COUNTERS_REPLY
 	ctaUse                                 // CTA_USE
 	ctaID                                  // CTA_ID
-	ctaNatDst                              // CTA_NAT_DST, Deprecated
+	ctaNatDst                              // CTA_NAT_DST
 	ctaTupleMaster                         // CTA_TUPLE_MASTER
 	ctaSeqAdjOrig                          // CTA_SEQ_ADJ_ORIG
 	ctaSeqAdjReply                         // CTA_SEQ_ADJ_REPLY
@@ -74,6 +74,33 @@ const (
 	ctaTimestampEvent                      // CTA_TIMESTAMP_EVENT
 )
 
+// filterType describes the type of CTA_FILTER attribute in this container.
+type filterType uint8
+
+// enum ctattr_filter
+const (
+	ctaFilterUnspec     filterType = iota // CTA_FILTER_UNSPEC
+	ctaFilterOrigFlags                    // CTA_FILTER_ORIG_FLAGS
+	ctaFilterReplyFlags                   // CTA_FILTER_REPLY_FLAGS
+)
+
+// Flags describing the tuple fields to match on in a CTA_FILTER. Not part of
+// the uapi, these are defined in net/netfilter/nf_conntrack_netlink.c.
+const (
+	ctaFilterFlagIPSrc           uint32 = 1 << iota // CTA_FILTER_F_CTA_IP_SRC
+	ctaFilterFlagIPDst                              // CTA_FILTER_F_CTA_IP_DST
+	ctaFilterFlagTupleZone                          // CTA_FILTER_F_CTA_TUPLE_ZONE
+	ctaFilterFlagProtoNum                           // CTA_FILTER_F_CTA_PROTO_NUM
+	ctaFilterFlagProtoSrcPort                       // CTA_FILTER_F_CTA_PROTO_SRC_PORT
+	ctaFilterFlagProtoDstPort                       // CTA_FILTER_F_CTA_PROTO_DST_PORT
+	ctaFilterFlagProtoICMPType                      // CTA_FILTER_F_CTA_PROTO_ICMP_TYPE
+	ctaFilterFlagProtoICMPCode                      // CTA_FILTER_F_CTA_PROTO_ICMP_CODE
+	ctaFilterFlagProtoICMPID                        // CTA_FILTER_F_CTA_PROTO_ICMP_ID
+	ctaFilterFlagProtoICMPv6Type                    // CTA_FILTER_F_CTA_PROTO_ICMPV6_TYPE
+	ctaFilterFlagProtoICMPv6Code                    // CTA_FILTER_F_CTA_PROTO_ICMPV6_CODE
+	ctaFilterFlagProtoICMPv6ID                      // CTA_FILTER_F_CTA_PROTO_ICMPV6_ID
+)
+
 // tupleType describes the type of tuple contained in this container.
 type tupleType uint8
 
@@ -204,6 +231,29 @@ const (
 	ctaProtoInfoSCTPVtagReply                             // CTA_PROTOINFO_SCTP_VTAG_REPLY
 )
 
+// natType describes the type of NAT setup attribute in this container.
+type natType uint8
+
+// enum ctattr_nat
+const (
+	ctaNATUnspec  natType = iota // CTA_NAT_UNSPEC
+	ctaNATv4MinIP                // CTA_NAT_V4_MINIP
+	ctaNATv4MaxIP                // CTA_NAT_V4_MAXIP
+	ctaNATProto                  // CTA_NAT_PROTO
+	ctaNATv6MinIP                // CTA_NAT_V6_MINIP
+	ctaNATv6MaxIP                // CTA_NAT_V6_MAXIP
+)
+
+// protoNATType describes the type of Layer 4 NAT setup attribute in this container.
+type protoNATType uint8
+
+// enum ctattr_protonat
+const (
+	ctaProtoNATUnspec  protoNATType = iota // CTA_PROTONAT_UNSPEC
+	ctaProtoNATPortMin                     // CTA_PROTONAT_PORT_MIN
+	ctaProtoNATPortMax                     // CTA_PROTONAT_PORT_MAX
+)
+
 // seqAdjType describes the type of sequence adjustment in this container.
 type seqAdjType uint8
 
@@ -304,4 +354,57 @@ var _ = []uint8{
 	uint8(ctaHelpUnspec), uint8(ctaCountersUnspec), uint8(ctaTimestampUnspec),
 	uint8(ctaSecCtxUnspec), uint8(ctaProtoInfoTCPUnspec), uint8(ctaProtoInfoDCCPUnspec),
 	uint8(ctaProtoInfoSCTPUnspec), uint8(ctaSeqAdjUnspec), uint8(ctaSynProxyUnspec),
+	uint8(ctaNATUnspec), uint8(ctaProtoNATUnspec), uint8(ctaFilterUnspec),
 }
+
+// Unused filter flags.
+var _ = []uint32{
+	ctaFilterFlagTupleZone, ctaFilterFlagProtoICMPID, ctaFilterFlagProtoICMPv6ID,
+}
+
+// Kernel names of nested attributes, used in the Path of a DecodeError.
+var (
+	attributeNames = map[attributeType]string{
+		ctaTupleOrig:     "CTA_TUPLE_ORIG",
+		ctaTupleReply:    "CTA_TUPLE_REPLY",
+		ctaProtoInfo:     "CTA_PROTOINFO",
+		ctaHelp:          "CTA_HELP",
+		ctaNatSrc:        "CTA_NAT_SRC",
+		ctaCountersOrig:  "CTA_COUNTERS_ORIG",
+		ctaCountersReply: "CTA_COUNTERS_REPLY",
+		ctaNatDst:        "CTA_NAT_DST",
+		ctaTupleMaster:   "CTA_TUPLE_MASTER",
+		ctaSeqAdjOrig:    "CTA_SEQ_ADJ_ORIG",
+		ctaSeqAdjReply:   "CTA_SEQ_ADJ_REPLY",
+		ctaSecCtx:        "CTA_SECCTX",
+		ctaTimestamp:     "CTA_TIMESTAMP",
+		ctaSynProxy:      "CTA_SYNPROXY",
+	}
+
+	tupleNames = map[tupleType]string{
+		ctaTupleIP:    "CTA_TUPLE_IP",
+		ctaTupleProto: "CTA_TUPLE_PROTO",
+		ctaTupleZone:  "CTA_TUPLE_ZONE",
+	}
+
+	protoInfoNames = map[protoInfoType]string{
+		ctaProtoInfoTCP:  "CTA_PROTOINFO_TCP",
+		ctaProtoInfoDCCP: "CTA_PROTOINFO_DCCP",
+		ctaProtoInfoSCTP: "CTA_PROTOINFO_SCTP",
+	}
+
+	natNames = map[natType]string{
+		ctaNATProto: "CTA_NAT_PROTO",
+	}
+
+	expectNames = map[expectType]string{
+		ctaExpectMaster: "CTA_EXPECT_MASTER",
+		ctaExpectTuple:  "CTA_EXPECT_TUPLE",
+		ctaExpectMask:   "CTA_EXPECT_MASK",
+		ctaExpectNAT:    "CTA_EXPECT_NAT",
+	}
+
+	expectNATNames = map[expectNATType]string{
+		ctaExpectNATTuple: "CTA_EXPECT_NAT_TUPLE",
+	}
+)
@@ -1,11 +1,132 @@
 package conntrack
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Errors sent by the kernel in reply to requests match one of these errors
+// when using [errors.Is], as well as the [unix.Errno] sent by the kernel.
+var (
+	// ErrNotFound is returned when the Flow, Expect or other object of a
+	// request doesn't exist.
+	ErrNotFound = errors.New("object not found")
+
+	// ErrExists is returned when creating an object that already exists.
+	ErrExists = errors.New("object already exists")
+
+	// ErrNotSupported is returned when the kernel doesn't support a request,
+	// usually because a kernel module like nf_nat or nf_conntrack_netlink's
+	// support for an address family or protocol isn't loaded.
+	ErrNotSupported = errors.New("operation not supported by the kernel")
+
+	// ErrPermission is returned when the caller lacks CAP_NET_ADMIN in the
+	// network namespace of the Conn.
+	ErrPermission = errors.New("permission denied")
+
+	// ErrTableFull is returned when the conntrack or expectation table has
+	// reached its maximum size. The kernel also returns it when it fails to
+	// allocate memory for a new entry.
+	ErrTableFull = errors.New("table full")
+
+	// ErrBusy is returned when an object is still in use, like a timeout
+	// policy or helper attached to connections.
+	ErrBusy = errors.New("object in use")
+)
+
+// ErrDumpInterrupted is returned when the kernel flagged a dump as interrupted
+// (NLM_F_DUMP_INTR) because the table changed while it was being dumped. The
+// dump may contain duplicate entries or miss some. Dumps returning it also
+// return the entries received, see [DumpOptions.Retries] to retry them.
+var ErrDumpInterrupted = errors.New("dump interrupted by a concurrent change, results may be inconsistent")
+
+// errnoErrors maps errnos sent by the kernel to exported errors.
+var errnoErrors = map[unix.Errno]error{
+	unix.ENOENT:          ErrNotFound,
+	unix.EEXIST:          ErrExists,
+	unix.EOPNOTSUPP:      ErrNotSupported,
+	unix.EAFNOSUPPORT:    ErrNotSupported,
+	unix.EPROTONOSUPPORT: ErrNotSupported,
+	unix.EPERM:           ErrPermission,
+	unix.EACCES:          ErrPermission,
+	unix.ENOMEM:          ErrTableFull,
+	unix.EMFILE:          ErrTableFull,
+	unix.EBUSY:           ErrBusy,
+}
+
+// errnoError is an errno sent by the kernel. It matches both the errno and its
+// exported error from errnoErrors when using [errors.Is].
+type errnoError unix.Errno
+
+func (e errnoError) Error() string {
+	return unix.Errno(e).Error()
+}
+
+func (e errnoError) Unwrap() []error {
+	if err, ok := errnoErrors[unix.Errno(e)]; ok {
+		return []error{unix.Errno(e), err}
+	}
+	return []error{unix.Errno(e)}
+}
+
+// DecodeError is returned when a message received from the kernel cannot be
+// decoded.
+type DecodeError struct {
+	// Path holds the kernel names of the nested attributes leading to the
+	// attribute that failed to decode, outermost first, like CTA_TUPLE_ORIG
+	// and CTA_TUPLE_IP. It is empty if the message's top-level attributes
+	// failed to decode.
+	Path []string
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	if len(e.Path) == 0 {
+		return fmt.Sprintf("decode: %v", e.Err)
+	}
+	return fmt.Sprintf("decode %s: %v", strings.Join(e.Path, "/"), e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// attrName returns the kernel name of the attribute type t, like
+// CTA_TUPLE_ORIG, as listed in names. Types missing from names are named by
+// their number.
+func attrName[T ~uint8 | ~uint16](names map[T]string, t T) string {
+	if n, ok := names[t]; ok {
+		return n
+	}
+	return strconv.Itoa(int(t))
+}
+
+// decodeError prepends the attribute name attr to the Path of the DecodeError
+// wrapped by err. If err doesn't wrap a DecodeError, it is wrapped in a new one.
+func decodeError(attr string, err error) error {
+	var de *DecodeError
+	if errors.As(err, &de) {
+		de.Path = append([]string{attr}, de.Path...)
+		return err
+	}
+	return &DecodeError{Path: []string{attr}, Err: err}
+}
 
 var (
 	errNotConntrack     = errors.New("trying to decode a non-conntrack or conntrack-exp message")
 	errConnHasListeners = errors.New("Conn has existing listeners, open another to listen on more groups")
 	errMultipartEvent   = errors.New("received multicast event with more than one Netlink message")
+	errConnIsMulticast  = errors.New("Conn attached to multicast group, re-dial for sending messages")
+	errNoGroups         = errors.New("need one or more multicast groups to join")
+
+	errShortErrorMessage = errors.New("not enough data for netlink error code")
 
 	errUnknownAttribute = errors.New("unknown attribute")
 	errUnknownEventType = errors.New("unknown event")
@@ -18,14 +139,57 @@ var (
 	errReusedEvent     = errors.New("cannot to unmarshal into existing Event")
 	errReusedProtoInfo = errors.New("cannot to unmarshal into existing ProtoInfo")
 
-	errBadIPTuple = errors.New("IPTuple source and destination must be valid addresses of the same family")
+	errBadIPTuple  = errors.New("IPTuple source and destination must be valid addresses of the same family")
+	errBadNATRange = errors.New("NATRange minimum and maximum must be valid addresses of the same family")
+
+	errFilterFamily = errors.New("Filter addresses must be valid and match the Filter's address family")
+	errFilterProto  = errors.New("Filter needs a Protocol to match on ports or ICMP fields")
+	errFilterICMP   = errors.New("Filter needs Protocol ICMP or ICMPv6 to match on ICMP fields")
 
 	errNeedTimeout = errors.New("Flow needs Timeout field set for this operation")
 	errNeedTuples  = errors.New("Flow needs Original and Reply Tuple set for this operation")
 
 	errUpdateMaster = errors.New("cannot send TupleMaster in Flow update")
+	errUpdateNAT    = errors.New("cannot send NATSrc or NATDst in Flow update")
+
+	errUpdateFields    = errors.New("FlowUpdate needs one or more mutable Fields")
+	errUpdateProtoInfo = errors.New("FlowUpdate of ProtoInfo needs one of TCP, DCCP or SCTP set")
 
 	errExpectNeedTuples = errors.New("Expect needs Tuple, Mask and TupleMaster Tuples set for this operation")
+	errExpectNeedTuple  = errors.New("Expect needs Tuple or ID set for this operation")
+	errNeedHelperName   = errors.New("need a helper name for this operation")
 
 	errNoWorkers = errors.New("number of workers to start cannot be 0")
+
+	errDumpRetriesZeroCounters = errors.New("DumpOptions Retries cannot be combined with ZeroCounters")
+
+	errBadEventFilterPrefix = errors.New("EventFilter needs valid address prefixes")
+	errEventFilterTooLarge  = errors.New("EventFilter program too large, specify fewer values")
+
+	errLabelRange        = fmt.Errorf("label bit out of range [0, %d)", LabelsMax)
+	errLabelUnknown      = errors.New("unknown label name")
+	errLabelMapSyntax    = errors.New("connlabel.conf lines must contain a bit number and a name")
+	errLabelMapDuplicate = errors.New("duplicate label name")
+	errFilterLabels      = errors.New("Filter on Labels is only supported when dumping Flows")
+	errFeaturesUnknown   = errors.New("FilterMode needs the kernel's Features, call Conn.Features first")
+
+	errTimeoutName   = fmt.Errorf("Timeout needs a Name of at most %d bytes", timeoutNameMax-1)
+	errTimeoutPolicy = errors.New("Timeout needs a Policy matching its L4Proto")
+
+	errHelperName     = fmt.Errorf("UserspaceHelper and ExpectPolicy need a Name of at most %d bytes", helperNameMax-1)
+	errHelperPolicies = fmt.Errorf("UserspaceHelper needs between 1 and %d Policies", helperPoliciesMax)
+
+	errParseFlow = errors.New("malformed conntrack text line")
+
+	errJSONVersion = fmt.Errorf("JSON schema version newer than supported version %d", JSONVersion)
+	errJSONValue   = errors.New("unknown value in JSON")
+
+	errSysctlName  = errors.New("sysctl name must be a file name in /proc/sys/net/netfilter")
+	errSysctlValue = errors.New("sysctl value out of range")
+
+	errNamespaceManagerClosed    = errors.New("NamespaceManager is closed")
+	errNamespaceManagerListening = errors.New("NamespaceManager is already listening for events")
+
+	errTableRunning = errors.New("Table is already running")
+	errTableResync  = errors.New("Table resync due")
 )
@@ -5,6 +5,7 @@ import (
 
 	"github.com/mdlayher/netlink"
 	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
 )
 
 // Event holds information about a Conntrack event.
@@ -15,6 +16,38 @@ type Event struct {
 	Expect *Expect
 }
 
+// EventsLostError is sent on a listener's error channel when the kernel dropped
+// one or more events because the socket's receive buffer overflowed. It is only
+// sent by workers started with [ListenOptions.RecoverOverrun], which keep
+// running afterwards. It matches [unix.ENOBUFS] when using [errors.Is].
+//
+// To make overruns less likely, increase the socket's receive buffer using
+// [Conn.SetReadBuffer] or consume events faster.
+type EventsLostError struct {
+	// WorkerID is the ID of the worker that detected the overrun.
+	WorkerID uint8
+
+	// Flows holds a snapshot of the conntrack table taken after the overrun
+	// was detected. Only set when [ListenOptions.Resync] is enabled.
+	Flows []Flow
+
+	// ResyncErr holds the error that occurred while taking the snapshot.
+	ResyncErr error
+}
+
+func (e *EventsLostError) Error() string {
+	msg := fmt.Sprintf("events lost due to socket receive buffer overrun, detected by worker %d", e.WorkerID)
+	if e.ResyncErr != nil {
+		msg += fmt.Sprintf(", resync failed: %v", e.ResyncErr)
+	}
+	return msg
+}
+
+// Unwrap returns [unix.ENOBUFS].
+func (e *EventsLostError) Unwrap() error {
+	return unix.ENOBUFS
+}
+
 // eventType is a custom type that describes the Conntrack event type.
 type eventType uint8
 
@@ -0,0 +1,495 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// EventFilter is an object used to drop unwanted events in the kernel before
+// they are delivered to a listening Conn, similar to libnetfilter_conntrack's
+// nfct_filter. Use [NewEventFilter] to create a new filter, then chain methods
+// to set filter fields. Methods mutate the EventFilter in place and return it
+// for chaining purposes.
+//
+// An event is delivered if it matches all fields set on the EventFilter. For
+// fields accepting multiple values, an event needs to match any one of them.
+// All fields except the event type only apply to Flow events; Expect events
+// are only subject to [EventFilter.Types].
+//
+// The filter is compiled into a classic BPF program and attached to the socket.
+// Pass an EventFilter to [Conn.ListenWithOptions] using [ListenOptions.Filter].
+type EventFilter interface {
+	// Types sets the event types to deliver, like [EventNew] or
+	// [EventDestroy].
+	Types(types ...eventType) EventFilter
+
+	// Protocols sets the layer 4 protocol numbers to deliver events for, like
+	// [unix.IPPROTO_TCP].
+	Protocols(protos ...uint8) EventFilter
+
+	// Zones sets the conntrack zones to deliver events for.
+	Zones(zones ...uint16) EventFilter
+
+	// Mark sets the connmark to filter on. Events for Flows without a
+	// connmark are treated as having a connmark of 0.
+	//
+	// When not specifying a mark mask, the mark must match exactly. To specify
+	// a mark mask, use [EventFilter.MarkMask].
+	Mark(mark uint32) EventFilter
+
+	// MarkMask sets the connmark mask to apply before filtering on connmark.
+	MarkMask(mask uint32) EventFilter
+
+	// Status sets the conntrack status bits to filter on. Since Status is a
+	// bitfield, only the given bits are matched by default. Use
+	// [EventFilter.StatusMask] to override the mask.
+	Status(status Status) EventFilter
+
+	// StatusMask overrides the mask to apply before filtering on flow status.
+	StatusMask(mask uint32) EventFilter
+
+	// OrigSource sets the address prefixes to match the source address of the
+	// original direction against.
+	OrigSource(prefixes ...netip.Prefix) EventFilter
+
+	// OrigDestination sets the address prefixes to match the destination
+	// address of the original direction against.
+	OrigDestination(prefixes ...netip.Prefix) EventFilter
+
+	// ReplySource sets the address prefixes to match the source address of the
+	// reply direction against.
+	ReplySource(prefixes ...netip.Prefix) EventFilter
+
+	// ReplyDestination sets the address prefixes to match the destination
+	// address of the reply direction against.
+	ReplyDestination(prefixes ...netip.Prefix) EventFilter
+
+	compile() ([]bpf.RawInstruction, error)
+}
+
+// NewEventFilter returns an empty EventFilter, which delivers all events.
+func NewEventFilter() EventFilter {
+	return &eventFilter{}
+}
+
+type eventFilter struct {
+	types  []eventType
+	protos []uint8
+	zones  []uint16
+
+	mark, markMask     *uint32
+	status, statusMask *uint32
+
+	origSrc, origDst   []netip.Prefix
+	replySrc, replyDst []netip.Prefix
+}
+
+func (f *eventFilter) Types(types ...eventType) EventFilter {
+	f.types = types
+	return f
+}
+
+func (f *eventFilter) Protocols(protos ...uint8) EventFilter {
+	f.protos = protos
+	return f
+}
+
+func (f *eventFilter) Zones(zones ...uint16) EventFilter {
+	f.zones = zones
+	return f
+}
+
+func (f *eventFilter) Mark(mark uint32) EventFilter {
+	f.mark = &mark
+	return f
+}
+
+func (f *eventFilter) MarkMask(mask uint32) EventFilter {
+	f.markMask = &mask
+	return f
+}
+
+func (f *eventFilter) Status(status Status) EventFilter {
+	s := uint32(status)
+	f.status = &s
+	return f
+}
+
+func (f *eventFilter) StatusMask(mask uint32) EventFilter {
+	f.statusMask = &mask
+	return f
+}
+
+func (f *eventFilter) OrigSource(prefixes ...netip.Prefix) EventFilter {
+	f.origSrc = prefixes
+	return f
+}
+
+func (f *eventFilter) OrigDestination(prefixes ...netip.Prefix) EventFilter {
+	f.origDst = prefixes
+	return f
+}
+
+func (f *eventFilter) ReplySource(prefixes ...netip.Prefix) EventFilter {
+	f.replySrc = prefixes
+	return f
+}
+
+func (f *eventFilter) ReplyDestination(prefixes ...netip.Prefix) EventFilter {
+	f.replyDst = prefixes
+	return f
+}
+
+// Offsets into a Netlink message carrying a Conntrack event.
+const (
+	offMsgType = 4                       // nlmsghdr.nlmsg_type
+	offFlags   = 6                       // nlmsghdr.nlmsg_flags
+	offAttrs   = unix.SizeofNlMsghdr + 4 // first attribute after nlmsghdr and nfgenmsg
+)
+
+const (
+	bpfAccept = 0xffffffff // deliver the whole message
+	bpfReject = 0          // drop the message
+
+	bpfMaxInstructions = 4096 // BPF_MAXINSNS
+)
+
+// compile compiles the EventFilter into a classic BPF program that can be
+// attached to a Netlink socket.
+func (f *eventFilter) compile() ([]bpf.RawInstruction, error) {
+	var p program
+	accept, reject := p.label(), p.label()
+
+	if len(f.types) > 0 {
+		if err := p.eventTypes(f.types, reject); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.flowFields() {
+		// All other fields are attributes of Flows, let Expect events through.
+		p.emit(bpf.LoadAbsolute{Off: offMsgType, Size: 2})
+		p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: hostUint16(0xff00)})
+		p.jumpIf(bpf.JumpEqual, hostUint16(uint16(netfilter.NFSubsysCTNetlinkExp)<<8), accept, next)
+	}
+
+	if len(f.protos) > 0 {
+		p.loadAttr(reject, uint16(ctaTupleOrig), uint16(ctaTupleProto), uint16(ctaProtoNum))
+		p.emit(bpf.LoadIndirect{Size: 1})
+
+		vals := make([]uint32, 0, len(f.protos))
+		for _, proto := range f.protos {
+			vals = append(vals, uint32(proto))
+		}
+		p.anyOf(vals, reject)
+	}
+
+	if len(f.zones) > 0 {
+		// CTA_ZONE is omitted from events for flows in the default zone.
+		p.loadValue(2, uint16(ctaZone))
+
+		vals := make([]uint32, 0, len(f.zones))
+		for _, zone := range f.zones {
+			vals = append(vals, uint32(zone))
+		}
+		p.anyOf(vals, reject)
+	}
+
+	if f.mark != nil {
+		mask := uint32(0xffffffff)
+		if f.markMask != nil {
+			mask = *f.markMask
+		}
+
+		// CTA_MARK is omitted from events for flows without a connmark.
+		p.loadValue(4, uint16(ctaMark))
+		p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mask})
+		p.jumpIf(bpf.JumpEqual, *f.mark&mask, next, reject)
+	}
+
+	if f.status != nil {
+		mask := *f.status
+		if f.statusMask != nil {
+			mask = *f.statusMask
+		}
+
+		p.loadValue(4, uint16(ctaStatus))
+		p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mask})
+		p.jumpIf(bpf.JumpEqual, *f.status&mask, next, reject)
+	}
+
+	for _, pf := range []struct {
+		tuple    attributeType
+		src      bool
+		prefixes []netip.Prefix
+	}{
+		{ctaTupleOrig, true, f.origSrc},
+		{ctaTupleOrig, false, f.origDst},
+		{ctaTupleReply, true, f.replySrc},
+		{ctaTupleReply, false, f.replyDst},
+	} {
+		if len(pf.prefixes) == 0 {
+			continue
+		}
+		if err := p.prefixes(pf.tuple, pf.src, pf.prefixes, reject); err != nil {
+			return nil, err
+		}
+	}
+
+	p.bind(accept)
+	p.emit(bpf.RetConstant{Val: bpfAccept})
+	p.bind(reject)
+	p.emit(bpf.RetConstant{Val: bpfReject})
+
+	return p.assemble()
+}
+
+// flowFields returns true if any fields applying only to Flows are set.
+func (f *eventFilter) flowFields() bool {
+	return len(f.protos) > 0 || len(f.zones) > 0 || f.mark != nil || f.status != nil ||
+		len(f.origSrc) > 0 || len(f.origDst) > 0 || len(f.replySrc) > 0 || len(f.replyDst) > 0
+}
+
+// hostUint16 returns the value the BPF machine loads from a 16-bit field
+// stored in host byte order. BPF loads are always big endian, while the fields
+// of a Netlink message header are in host byte order.
+func hostUint16(v uint16) uint32 {
+	return uint32(binary.BigEndian.Uint16(nlenc.Uint16Bytes(v)))
+}
+
+// A label marks a position in a program under construction. The zero label
+// refers to the next instruction.
+type label int
+
+const next label = 0
+
+// An insn is an instruction in a program under construction. For conditional
+// jumps, jt and jf hold the labels to jump to, for unconditional jumps, only
+// jt is used.
+type insn struct {
+	ins    bpf.Instruction
+	jt, jf label
+}
+
+// program is a classic BPF program under construction. Jumps refer to labels,
+// which are resolved into relative offsets by assemble.
+type program struct {
+	insns  []insn
+	labels []int
+}
+
+// label allocates a new label. It needs to be bound using bind.
+func (p *program) label() label {
+	p.labels = append(p.labels, -1)
+	return label(len(p.labels))
+}
+
+// bind binds l to the position of the next instruction.
+func (p *program) bind(l label) {
+	p.labels[l-1] = len(p.insns)
+}
+
+func (p *program) emit(ins bpf.Instruction) {
+	p.insns = append(p.insns, insn{ins: ins})
+}
+
+func (p *program) jump(l label) {
+	p.insns = append(p.insns, insn{ins: bpf.Jump{}, jt: l})
+}
+
+func (p *program) jumpIf(cond bpf.JumpTest, val uint32, jt, jf label) {
+	p.insns = append(p.insns, insn{ins: bpf.JumpIf{Cond: cond, Val: val}, jt: jt, jf: jf})
+}
+
+// loadAttr emits instructions finding the (nested) attribute described by
+// path and loading the offset of its payload into X. Jumps to missing if the
+// attribute is not present.
+func (p *program) loadAttr(missing label, path ...uint16) {
+	p.emit(bpf.LoadConstant{Dst: bpf.RegA, Val: offAttrs})
+	for i, t := range path {
+		ext := bpf.ExtNetlinkAttrNested
+		if i == 0 {
+			ext = bpf.ExtNetlinkAttr
+		}
+
+		// A holds the offset of the attribute, or 0 if it wasn't found.
+		p.emit(bpf.LoadConstant{Dst: bpf.RegX, Val: uint32(t)})
+		p.emit(bpf.LoadExtension{Num: ext})
+		p.jumpIf(bpf.JumpEqual, 0, missing, next)
+	}
+
+	p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAdd, Val: unix.SizeofNlAttr})
+	p.emit(bpf.TAX{})
+}
+
+// loadValue emits instructions loading the value of size bytes of the
+// attribute at path into A. A is set to 0 if the attribute is not present.
+func (p *program) loadValue(size int, path ...uint16) {
+	missing, done := p.label(), p.label()
+
+	p.loadAttr(missing, path...)
+	p.emit(bpf.LoadIndirect{Size: size})
+	p.jump(done)
+
+	p.bind(missing)
+	p.emit(bpf.LoadConstant{Dst: bpf.RegA, Val: 0})
+	p.bind(done)
+}
+
+// anyOf emits instructions comparing A to vals, jumping to reject if none of
+// them match.
+func (p *program) anyOf(vals []uint32, reject label) {
+	ok := p.label()
+	for _, v := range vals {
+		p.jumpIf(bpf.JumpEqual, v, ok, next)
+	}
+	p.jump(reject)
+	p.bind(ok)
+}
+
+// eventTypes emits instructions matching the message type and flags of the
+// Netlink header against the given event types, jumping to reject if none of
+// them match.
+func (p *program) eventTypes(types []eventType, reject label) error {
+	ok := p.label()
+
+	for _, et := range types {
+		var subsys netfilter.SubsystemID
+		var msgType netfilter.MessageType
+		switch et {
+		case EventNew, EventUpdate:
+			subsys, msgType = netfilter.NFSubsysCTNetlink, netfilter.MessageType(ctNew)
+		case EventDestroy:
+			subsys, msgType = netfilter.NFSubsysCTNetlink, netfilter.MessageType(ctDelete)
+		case EventExpNew:
+			subsys, msgType = netfilter.NFSubsysCTNetlinkExp, netfilter.MessageType(ctExpNew)
+		case EventExpDestroy:
+			subsys, msgType = netfilter.NFSubsysCTNetlinkExp, netfilter.MessageType(ctExpDelete)
+		default:
+			return fmt.Errorf("event type %s: %w", et, errUnknownEventType)
+		}
+
+		alt := p.label()
+		p.emit(bpf.LoadAbsolute{Off: offMsgType, Size: 2})
+		p.jumpIf(bpf.JumpEqual, hostUint16(uint16(subsys)<<8|uint16(msgType)), next, alt)
+
+		// New and update events share a message type, see eventType.unmarshal.
+		if et == EventNew || et == EventUpdate {
+			cond := bpf.JumpBitsSet
+			if et == EventUpdate {
+				cond = bpf.JumpBitsNotSet
+			}
+			p.emit(bpf.LoadAbsolute{Off: offFlags, Size: 2})
+			p.jumpIf(cond, hostUint16(uint16(netlink.Create|netlink.Excl)), next, alt)
+		}
+
+		p.jump(ok)
+		p.bind(alt)
+	}
+
+	p.jump(reject)
+	p.bind(ok)
+
+	return nil
+}
+
+// prefixes emits instructions matching the source or destination address of
+// the given tuple against prefixes, jumping to reject if none of them match.
+func (p *program) prefixes(tuple attributeType, src bool, prefixes []netip.Prefix, reject label) error {
+	ok := p.label()
+
+	for _, pfx := range prefixes {
+		if !pfx.IsValid() {
+			return fmt.Errorf("prefix %s: %w", pfx, errBadEventFilterPrefix)
+		}
+
+		var at ipTupleType
+		switch {
+		case pfx.Addr().Is4() && src:
+			at = ctaIPv4Src
+		case pfx.Addr().Is4():
+			at = ctaIPv4Dst
+		case src:
+			at = ctaIPv6Src
+		default:
+			at = ctaIPv6Dst
+		}
+
+		// Flows of the other address family don't have the attribute.
+		alt := p.label()
+		p.loadAttr(alt, uint16(tuple), uint16(ctaTupleIP), uint16(at))
+
+		// Compare the address one 32-bit word at a time.
+		addr := pfx.Masked().Addr().AsSlice()
+		for w, bits := 0, pfx.Bits(); bits > 0; w, bits = w+1, bits-32 {
+			mask := uint32(0xffffffff)
+			if bits < 32 {
+				mask <<= 32 - bits
+			}
+
+			p.emit(bpf.LoadIndirect{Off: uint32(w * 4), Size: 4})
+			if mask != 0xffffffff {
+				p.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mask})
+			}
+			p.jumpIf(bpf.JumpEqual, binary.BigEndian.Uint32(addr[w*4:]), next, alt)
+		}
+
+		p.jump(ok)
+		p.bind(alt)
+	}
+
+	p.jump(reject)
+	p.bind(ok)
+
+	return nil
+}
+
+// assemble resolves all labels in the program and assembles it into raw BPF
+// instructions.
+func (p *program) assemble() ([]bpf.RawInstruction, error) {
+	if len(p.insns) > bpfMaxInstructions {
+		return nil, errEventFilterTooLarge
+	}
+
+	// skip returns the amount of instructions to skip to get from the
+	// instruction at index i to label l.
+	skip := func(i int, l label) int {
+		if l == next {
+			return 0
+		}
+		return p.labels[l-1] - i - 1
+	}
+
+	out := make([]bpf.RawInstruction, 0, len(p.insns))
+	for i, in := range p.insns {
+		ins := in.ins
+		switch j := ins.(type) {
+		case bpf.Jump:
+			j.Skip = uint32(skip(i, in.jt))
+			ins = j
+		case bpf.JumpIf:
+			st, sf := skip(i, in.jt), skip(i, in.jf)
+			// Conditional jumps can only skip up to 255 instructions.
+			if st > 0xff || sf > 0xff {
+				return nil, errEventFilterTooLarge
+			}
+			j.SkipTrue, j.SkipFalse = uint8(st), uint8(sf)
+			ins = j
+		}
+
+		raw, err := ins.Assemble()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, raw)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,391 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+func TestEventFilterCompile(t *testing.T) {
+	f := NewEventFilter().
+		Types(EventNew, EventDestroy, EventExpNew).
+		Protocols(6, 17).
+		Zones(0, 42).
+		Mark(0xff00).MarkMask(0xff00).
+		Status(StatusAssured).
+		OrigSource(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")).
+		OrigDestination(netip.MustParsePrefix("0.0.0.0/0")).
+		ReplySource(netip.MustParsePrefix("192.168.1.1/32")).
+		ReplyDestination(netip.MustParsePrefix("10.1.2.3/32"), netip.MustParsePrefix("::1/128"))
+
+	prog, err := f.compile()
+	require.NoError(t, err)
+
+	match := NewFlow(unix.IPPROTO_TCP, StatusAssured, netip.MustParseAddr("10.1.2.3"),
+		netip.MustParseAddr("192.168.1.1"), 1234, 80, 120, 0xff00)
+	match.Zone = 42
+
+	with := func(fn func(*Flow)) Flow {
+		f := match
+		fn(&f)
+		return f
+	}
+
+	assert.True(t, runEventFilter(t, prog, flowEvent(t, ctNew, netlink.Create|netlink.Excl, match)), "new event")
+	assert.True(t, runEventFilter(t, prog, flowEvent(t, ctDelete, 0, match)), "destroy event")
+	assert.False(t, runEventFilter(t, prog, flowEvent(t, ctNew, 0, match)), "update event")
+
+	for name, f := range map[string]Flow{
+		"protocol":          with(func(f *Flow) { f.TupleOrig.Proto.Protocol = unix.IPPROTO_ICMP }),
+		"zone":              with(func(f *Flow) { f.Zone = 7 }),
+		"mark":              with(func(f *Flow) { f.Mark = 0x0f00 }),
+		"status":            with(func(f *Flow) { f.Status = StatusSeenReply }),
+		"orig source":       with(func(f *Flow) { f.TupleOrig.IP.SourceAddress = netip.MustParseAddr("11.1.2.3") }),
+		"reply source":      with(func(f *Flow) { f.TupleReply.IP.SourceAddress = netip.MustParseAddr("192.168.1.2") }),
+		"reply destination": with(func(f *Flow) { f.TupleReply.IP.DestinationAddress = netip.MustParseAddr("10.1.2.4") }),
+	} {
+		assert.False(t, runEventFilter(t, prog, flowEvent(t, ctNew, netlink.Create|netlink.Excl, f)), name)
+	}
+
+	// Expect events are only subject to the event types.
+	assert.True(t, runEventFilter(t, prog, eventMessage(t, netfilter.NFSubsysCTNetlinkExp,
+		netfilter.MessageType(ctExpNew), netlink.Create|netlink.Excl, nil)), "expect new event")
+	assert.False(t, runEventFilter(t, prog, eventMessage(t, netfilter.NFSubsysCTNetlinkExp,
+		netfilter.MessageType(ctExpDelete), 0, nil)), "expect destroy event")
+
+	// The empty filter accepts everything.
+	prog, err = NewEventFilter().compile()
+	require.NoError(t, err)
+	assert.Equal(t, []bpf.RawInstruction{{Op: 0x6, K: bpfAccept}, {Op: 0x6, K: bpfReject}}, prog)
+}
+
+func TestEventFilterFields(t *testing.T) {
+	base := NewFlow(unix.IPPROTO_TCP, StatusAssured, netip.MustParseAddr("10.1.2.3"),
+		netip.MustParseAddr("192.168.1.1"), 1234, 80, 120, 0xff00)
+	base.Zone = 42
+	v6 := NewFlow(unix.IPPROTO_UDP, 0, netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("::1"), 1234, 80, 120, 0)
+
+	with := func(fn func(*Flow)) Flow {
+		f := base
+		fn(&f)
+		return f
+	}
+
+	tests := []struct {
+		name   string
+		filter EventFilter
+		accept []Flow
+		reject []Flow
+	}{
+		{
+			name:   "protocols",
+			filter: NewEventFilter().Protocols(unix.IPPROTO_TCP, unix.IPPROTO_UDP),
+			accept: []Flow{base, v6},
+			reject: []Flow{with(func(f *Flow) { f.TupleOrig.Proto.Protocol = unix.IPPROTO_ICMP })},
+		},
+		{
+			name:   "zones",
+			filter: NewEventFilter().Zones(0, 42),
+			accept: []Flow{base, v6},
+			reject: []Flow{with(func(f *Flow) { f.Zone = 7 })},
+		},
+		{
+			name:   "mark",
+			filter: NewEventFilter().Mark(0xff00),
+			accept: []Flow{base},
+			reject: []Flow{v6, with(func(f *Flow) { f.Mark = 0xff01 })},
+		},
+		{
+			name:   "mark mask",
+			filter: NewEventFilter().Mark(0xff00).MarkMask(0xff00),
+			accept: []Flow{base, with(func(f *Flow) { f.Mark = 0xffff })},
+			reject: []Flow{v6, with(func(f *Flow) { f.Mark = 0x0f00 })},
+		},
+		{
+			name:   "mark without connmark",
+			filter: NewEventFilter().Mark(0),
+			accept: []Flow{v6},
+			reject: []Flow{base},
+		},
+		{
+			name:   "status",
+			filter: NewEventFilter().Status(StatusAssured),
+			accept: []Flow{base, with(func(f *Flow) { f.Status |= StatusSeenReply })},
+			reject: []Flow{v6, with(func(f *Flow) { f.Status = StatusSeenReply })},
+		},
+		{
+			name:   "status mask",
+			filter: NewEventFilter().Status(StatusAssured).StatusMask(uint32(StatusAssured | StatusSeenReply)),
+			accept: []Flow{base},
+			reject: []Flow{with(func(f *Flow) { f.Status |= StatusSeenReply })},
+		},
+		{
+			name:   "orig source",
+			filter: NewEventFilter().OrigSource(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")),
+			accept: []Flow{base, v6},
+			reject: []Flow{
+				with(func(f *Flow) { f.TupleOrig.IP.SourceAddress = netip.MustParseAddr("11.1.2.3") }),
+				NewFlow(unix.IPPROTO_UDP, 0, netip.MustParseAddr("2001:db9::1"), netip.MustParseAddr("::1"), 1, 2, 120, 0),
+			},
+		},
+		{
+			name:   "orig destination",
+			filter: NewEventFilter().OrigDestination(netip.MustParsePrefix("192.168.0.0/23")),
+			accept: []Flow{base},
+			reject: []Flow{v6, with(func(f *Flow) { f.TupleOrig.IP.DestinationAddress = netip.MustParseAddr("192.168.2.1") })},
+		},
+		{
+			name:   "reply source",
+			filter: NewEventFilter().ReplySource(netip.MustParsePrefix("192.168.1.1/32")),
+			accept: []Flow{base},
+			reject: []Flow{v6, with(func(f *Flow) { f.TupleReply.IP.SourceAddress = netip.MustParseAddr("192.168.1.2") })},
+		},
+		{
+			name:   "reply destination",
+			filter: NewEventFilter().ReplyDestination(netip.MustParsePrefix("2001:db8::1/128")),
+			accept: []Flow{v6},
+			reject: []Flow{base, NewFlow(unix.IPPROTO_UDP, 0, netip.MustParseAddr("2001:db8::2"), netip.MustParseAddr("::1"), 1, 2, 120, 0)},
+		},
+		{
+			name:   "any address",
+			filter: NewEventFilter().OrigDestination(netip.MustParsePrefix("0.0.0.0/0")),
+			accept: []Flow{base},
+			reject: []Flow{v6},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := tt.filter.compile()
+			require.NoError(t, err)
+
+			for i, f := range tt.accept {
+				assert.True(t, runEventFilter(t, prog, flowEvent(t, ctNew, netlink.Create|netlink.Excl, f)), "accept %d", i)
+			}
+			for i, f := range tt.reject {
+				assert.False(t, runEventFilter(t, prog, flowEvent(t, ctNew, netlink.Create|netlink.Excl, f)), "reject %d", i)
+			}
+
+			// Expect events don't carry any of the filtered attributes.
+			assert.True(t, runEventFilter(t, prog, eventMessage(t, netfilter.NFSubsysCTNetlinkExp,
+				netfilter.MessageType(ctExpNew), netlink.Create|netlink.Excl, nil)), "expect event")
+		})
+	}
+}
+
+func TestEventFilterCompileError(t *testing.T) {
+	_, err := NewEventFilter().Types(eventType(255)).compile()
+	assert.ErrorIs(t, err, errUnknownEventType)
+
+	_, err = NewEventFilter().OrigSource(netip.Prefix{}).compile()
+	assert.ErrorIs(t, err, errBadEventFilterPrefix)
+
+	pfxs := make([]netip.Prefix, 0, 1024)
+	for i := range 1024 {
+		pfxs = append(pfxs, netip.PrefixFrom(netip.AddrFrom16([16]byte{0x20, 0x01, byte(i >> 8), byte(i)}), 32))
+	}
+	_, err = NewEventFilter().ReplyDestination(pfxs...).compile()
+	assert.ErrorIs(t, err, errEventFilterTooLarge)
+}
+
+func TestEventFilterTypes(t *testing.T) {
+	// The BPF VM in x/net does not implement the Netlink attribute extensions,
+	// so only filters on the Netlink header can be evaluated here.
+	prog, err := NewEventFilter().Types(EventNew, EventExpDestroy).compile()
+	require.NoError(t, err)
+
+	ins, ok := bpf.Disassemble(prog)
+	require.True(t, ok)
+
+	vm, err := bpf.NewVM(ins)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		subsys netfilter.SubsystemID
+		mt     netfilter.MessageType
+		flags  netlink.HeaderFlags
+		accept bool
+	}{
+		{"new", netfilter.NFSubsysCTNetlink, netfilter.MessageType(ctNew), netlink.Create | netlink.Excl, true},
+		{"update", netfilter.NFSubsysCTNetlink, netfilter.MessageType(ctNew), 0, false},
+		{"destroy", netfilter.NFSubsysCTNetlink, netfilter.MessageType(ctDelete), 0, false},
+		{"expect new", netfilter.NFSubsysCTNetlinkExp, netfilter.MessageType(ctExpNew), netlink.Create | netlink.Excl, false},
+		{"expect destroy", netfilter.NFSubsysCTNetlinkExp, netfilter.MessageType(ctExpDelete), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := vm.Run(eventMessage(t, tt.subsys, tt.mt, tt.flags, nil))
+			require.NoError(t, err)
+			assert.Equal(t, tt.accept, n != 0)
+		})
+	}
+}
+
+// eventMessage returns a marshaled Netlink message carrying an event.
+func eventMessage(t *testing.T, subsys netfilter.SubsystemID, mt netfilter.MessageType,
+	flags netlink.HeaderFlags, attrs []netfilter.Attribute) []byte {
+	t.Helper()
+
+	nlm, err := netfilter.MarshalNetlink(netfilter.Header{
+		SubsystemID: subsys,
+		MessageType: mt,
+		Flags:       flags,
+	}, attrs)
+	require.NoError(t, err)
+	nlm.Header.Length = uint32(unix.SizeofNlMsghdr + len(nlm.Data))
+
+	b, err := nlm.MarshalBinary()
+	require.NoError(t, err)
+
+	return b
+}
+
+// flowEvent returns a marshaled Netlink message carrying an event for f.
+func flowEvent(t *testing.T, mt messageType, flags netlink.HeaderFlags, f Flow) []byte {
+	t.Helper()
+
+	attrs, err := f.marshal()
+	require.NoError(t, err)
+
+	return eventMessage(t, netfilter.NFSubsysCTNetlink, netfilter.MessageType(mt), flags, attrs)
+}
+
+// runEventFilter runs prog against the Netlink message b and returns true if
+// the message is delivered. The BPF VM in x/net doesn't implement the Netlink
+// attribute extensions, so this interprets the instructions emitted by
+// eventFilter.compile, following the semantics of the kernel's interpreter.
+func runEventFilter(t *testing.T, prog []bpf.RawInstruction, b []byte) bool {
+	t.Helper()
+
+	ins, ok := bpf.Disassemble(prog)
+	require.True(t, ok, "disassemble program")
+
+	// load returns false for loads beyond the end of the message, which
+	// terminate the program, dropping the message.
+	load := func(off uint32, size int) (uint32, bool) {
+		if uint64(off)+uint64(size) > uint64(len(b)) {
+			return 0, false
+		}
+		switch size {
+		case 1:
+			return uint32(b[off]), true
+		case 2:
+			return uint32(binary.BigEndian.Uint16(b[off:])), true
+		case 4:
+			return binary.BigEndian.Uint32(b[off:]), true
+		}
+		t.Fatalf("invalid load size %d", size)
+		return 0, false
+	}
+
+	var a, x uint32
+	for pc := 0; pc < len(ins); pc++ {
+		switch in := ins[pc].(type) {
+		case bpf.LoadAbsolute:
+			if a, ok = load(in.Off, in.Size); !ok {
+				return false
+			}
+		case bpf.LoadIndirect:
+			if a, ok = load(x+in.Off, in.Size); !ok {
+				return false
+			}
+		case bpf.LoadConstant:
+			if in.Dst == bpf.RegA {
+				a = in.Val
+			} else {
+				x = in.Val
+			}
+		case bpf.LoadExtension:
+			a = netlinkAttrExtension(t, b, in.Num, a, x)
+		case bpf.ALUOpConstant:
+			switch in.Op {
+			case bpf.ALUOpAnd:
+				a &= in.Val
+			case bpf.ALUOpAdd:
+				a += in.Val
+			default:
+				t.Fatalf("unsupported ALU operation %v", in.Op)
+			}
+		case bpf.TAX:
+			x = a
+		case bpf.Jump:
+			pc += int(in.Skip)
+		case bpf.JumpIf:
+			var match bool
+			switch in.Cond {
+			case bpf.JumpEqual:
+				match = a == in.Val
+			case bpf.JumpNotEqual:
+				match = a != in.Val
+			case bpf.JumpBitsSet:
+				match = a&in.Val != 0
+			case bpf.JumpBitsNotSet:
+				match = a&in.Val == 0
+			default:
+				t.Fatalf("unsupported jump condition %v", in.Cond)
+			}
+			if match {
+				pc += int(in.SkipTrue)
+			} else {
+				pc += int(in.SkipFalse)
+			}
+		case bpf.RetConstant:
+			return in.Val != 0
+		default:
+			t.Fatalf("unsupported instruction %v", in)
+		}
+	}
+
+	t.Fatal("program did not return")
+	return false
+}
+
+// netlinkAttrExtension implements the SKF_AD_NLATTR and SKF_AD_NLATTR_NEST
+// extensions, returning the offset of the attribute of type x in b, or 0 if it
+// wasn't found. a holds the offset of the attributes to search, or of the
+// attribute to search in for nested attributes.
+func netlinkAttrExtension(t *testing.T, b []byte, ext bpf.Extension, a, x uint32) uint32 {
+	t.Helper()
+
+	if int(a) > len(b)-unix.SizeofNlAttr {
+		return 0
+	}
+
+	start, end := int(a), len(b)
+	switch ext {
+	case bpf.ExtNetlinkAttr:
+	case bpf.ExtNetlinkAttrNested:
+		l := int(nlenc.Uint16(b[a : a+2]))
+		if l > len(b)-int(a) {
+			return 0
+		}
+		start, end = start+unix.SizeofNlAttr, start+l
+	default:
+		t.Fatalf("unsupported extension %v", ext)
+	}
+
+	for off := start; off+unix.SizeofNlAttr <= end; {
+		l := int(nlenc.Uint16(b[off : off+2]))
+		if l < unix.SizeofNlAttr || off+l > end {
+			return 0
+		}
+		typ := nlenc.Uint16(b[off+2:off+4]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		if uint32(typ) == x {
+			return uint32(off)
+		}
+		off += (l + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+	}
+
+	return 0
+}
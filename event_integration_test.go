@@ -3,8 +3,11 @@
 package conntrack
 
 import (
+	"context"
+	"errors"
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/mdlayher/netlink"
 	"github.com/stretchr/testify/assert"
@@ -113,3 +116,211 @@ func TestConnListenError(t *testing.T) {
 	_, err = c.Listen(make(chan Event), 1, netfilter.GroupsCT)
 	require.ErrorIs(t, err, errConnHasListeners)
 }
+
+func TestConnListenContext(t *testing.T) {
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	_, err = c.ListenContext(ctx, make(chan Event), 4, netfilter.GroupsCT)
+	require.NoError(t, err)
+
+	// Cancelling the context terminates all blocked workers.
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers did not terminate after cancelling context")
+	}
+
+	assert.NoError(t, c.Close())
+}
+
+func TestConnListenRecoverOverrun(t *testing.T) {
+	sc, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	lc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+	defer lc.Close()
+
+	// Use the smallest possible receive buffer to provoke an overrun.
+	require.NoError(t, lc.SetReadBuffer(1))
+
+	ev := make(chan Event)
+	errChan, err := lc.ListenWithOptions(context.Background(), ev, 1, []netfilter.NetlinkGroup{netfilter.GroupCTNew},
+		ListenOptions{RecoverOverrun: true, Resync: true})
+	require.NoError(t, err)
+
+	// Overruns can be detected multiple times, keep draining the error channel.
+	lost := make(chan *EventsLostError, 128)
+	go func() {
+		for err := range errChan {
+			var el *EventsLostError
+			if !errors.As(err, &el) {
+				t.Errorf("unexpected error from worker: %s", err)
+				return
+			}
+			lost <- el
+		}
+	}()
+
+	// Nobody is reading events yet, so the socket buffer overflows.
+	const numFlows = 100
+	for i := range numFlows {
+		require.NoError(t, sc.Create(NewFlow(unix.IPPROTO_TCP, 0,
+			netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), uint16(1000+i), 80, 120, 0)))
+	}
+
+	// Consume events in the background, signalling when a UDP flow created
+	// after the overrun is seen.
+	udp := make(chan struct{}, 1)
+	go func() {
+		for e := range ev {
+			if e.Flow.TupleOrig.Proto.Protocol == unix.IPPROTO_UDP {
+				select {
+				case udp <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	select {
+	case el := <-lost:
+		assert.ErrorIs(t, el, unix.ENOBUFS)
+		require.NoError(t, el.ResyncErr)
+
+		// The snapshot is taken as soon as the overrun is detected, which may
+		// be before all flows were created.
+		assert.NotEmpty(t, el.Flows)
+		assert.LessOrEqual(t, len(el.Flows), numFlows)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for overrun notification")
+	}
+
+	// The worker must still be alive and receiving events. Events for flows
+	// created while the socket buffer is still full are lost, so keep creating
+	// flows until one gets through.
+	timeout := time.After(5 * time.Second)
+	for port := uint16(1); ; port++ {
+		require.NoError(t, sc.Create(NewFlow(unix.IPPROTO_UDP, 0,
+			netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), port, 53, 120, 0)))
+
+		select {
+		case <-udp:
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timeout waiting for event after overrun")
+		}
+	}
+}
+
+func TestConnListenEventFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter EventFilter
+		// Ports of the flows created below expected to produce events.
+		want []uint16
+	}{
+		{name: "empty", filter: NewEventFilter(), want: []uint16{1, 2, 3, 4, 5}},
+		{name: "new events", filter: NewEventFilter().Types(EventNew), want: []uint16{1, 2, 3, 4, 5}},
+		{name: "destroy events", filter: NewEventFilter().Types(EventDestroy, EventUpdate)},
+		{name: "udp", filter: NewEventFilter().Protocols(unix.IPPROTO_UDP), want: []uint16{2}},
+		{name: "tcp or udp", filter: NewEventFilter().Protocols(unix.IPPROTO_TCP, unix.IPPROTO_UDP),
+			want: []uint16{1, 2, 3, 4}},
+		{name: "zone", filter: NewEventFilter().Zones(42), want: []uint16{3}},
+		{name: "default zone", filter: NewEventFilter().Zones(0), want: []uint16{1, 2, 4, 5}},
+		{name: "mark", filter: NewEventFilter().Mark(0xff00), want: []uint16{4}},
+		{name: "mark mask", filter: NewEventFilter().Mark(0xf000).MarkMask(0xf000), want: []uint16{4}},
+		{name: "no mark", filter: NewEventFilter().Mark(0), want: []uint16{1, 2, 3, 5}},
+		{name: "status", filter: NewEventFilter().Status(StatusConfirmed).StatusMask(uint32(StatusConfirmed)),
+			want: []uint16{1, 2, 3, 4, 5}},
+		{name: "status seen reply", filter: NewEventFilter().Status(StatusSeenReply).StatusMask(uint32(StatusSeenReply))},
+		{name: "orig source v4", filter: NewEventFilter().OrigSource(netip.MustParsePrefix("10.0.0.0/8")),
+			want: []uint16{1, 2, 3, 4}},
+		{name: "orig source v6", filter: NewEventFilter().OrigSource(netip.MustParsePrefix("2001:db8::/32")),
+			want: []uint16{5}},
+		{name: "reply source", filter: NewEventFilter().ReplySource(
+			netip.MustParsePrefix("192.168.1.2/32"), netip.MustParsePrefix("2001:db8::2/128")), want: []uint16{1, 5}},
+		{name: "orig destination", filter: NewEventFilter().OrigDestination(netip.MustParsePrefix("192.168.0.0/23")),
+			want: []uint16{1, 2, 3, 4}},
+		{name: "combined", filter: NewEventFilter().Types(EventNew).Protocols(unix.IPPROTO_TCP).
+			OrigSource(netip.MustParsePrefix("10.1.0.0/16")), want: []uint16{3, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, nsid, err := makeNSConn()
+			require.NoError(t, err)
+			defer sc.Close()
+
+			lc, err := Dial(&netlink.Config{NetNS: nsid})
+			require.NoError(t, err)
+			defer lc.Close()
+
+			ev := make(chan Event, 16)
+			_, err = lc.ListenWithOptions(context.Background(), ev, 1,
+				[]netfilter.NetlinkGroup{netfilter.GroupCTNew}, ListenOptions{Filter: tt.filter})
+			require.NoError(t, err)
+
+			flows := []Flow{
+				NewFlow(unix.IPPROTO_TCP, 0, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("192.168.1.2"), 1, 80, 120, 0),
+				NewFlow(unix.IPPROTO_UDP, 0, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("192.168.1.3"), 2, 80, 120, 0),
+				NewFlow(unix.IPPROTO_TCP, 0, netip.MustParseAddr("10.1.0.1"), netip.MustParseAddr("192.168.0.1"), 3, 80, 120, 0),
+				NewFlow(unix.IPPROTO_TCP, 0, netip.MustParseAddr("10.1.0.2"), netip.MustParseAddr("192.168.0.1"), 4, 80, 120, 0xff00),
+				NewFlow(unix.IPPROTO_SCTP, 0, netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2"), 5, 80, 120, 0),
+			}
+			flows[2].Zone = 42
+
+			for _, f := range flows {
+				require.NoError(t, sc.Create(f))
+			}
+
+			// Collect events until none have arrived for a while.
+			var got []uint16
+			timeout := time.After(5 * time.Second)
+			for {
+				select {
+				case e := <-ev:
+					got = append(got, e.Flow.TupleOrig.Proto.SourcePort)
+				case <-time.After(200 * time.Millisecond):
+					assert.ElementsMatch(t, tt.want, got)
+					return
+				case <-timeout:
+					t.Fatal("timeout waiting for events")
+				}
+			}
+		})
+	}
+}
+
+func TestConnListenEventFilterError(t *testing.T) {
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Create(NewFlow(unix.IPPROTO_TCP, 0,
+		netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), 1234, 80, 120, 0)))
+
+	// A filter dropping all Flow messages is removed when joining groups fails.
+	_, err = c.ListenWithOptions(context.Background(), make(chan Event), 1, nil,
+		ListenOptions{Filter: NewEventFilter().Types(EventExpDestroy)})
+	require.ErrorIs(t, err, errNoGroups)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	flows, err := c.DumpContext(ctx, nil)
+	require.NoError(t, err)
+	assert.Len(t, flows, 1)
+}
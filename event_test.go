@@ -1,12 +1,15 @@
 package conntrack
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/mdlayher/netlink"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
 )
 
 var eventTypeTests = []struct {
@@ -161,3 +164,16 @@ func TestEventUnmarshalError(t *testing.T) {
 			4, 0, 1, 0, // 4-byte (empty) netlink attribute of type 1
 		}}), errNotNested)
 }
+
+func TestEventsLostError(t *testing.T) {
+	el := &EventsLostError{WorkerID: 2}
+	assert.ErrorIs(t, el, unix.ENOBUFS)
+	assert.Equal(t, "events lost due to socket receive buffer overrun, detected by worker 2", el.Error())
+
+	el.ResyncErr = unix.EBADF
+	assert.Contains(t, el.Error(), "resync failed: bad file descriptor")
+
+	var target *EventsLostError
+	assert.True(t, errors.As(fmt.Errorf("wrapped: %w", el), &target))
+	assert.Equal(t, uint8(2), target.WorkerID)
+}
@@ -42,7 +42,7 @@ func (en *ExpectNAT) unmarshal(ad *netlink.AttributeDecoder) error {
 		case ctaExpectNATTuple:
 			ad.Nested(en.Tuple.unmarshal)
 			if err := ad.Err(); err != nil {
-				return fmt.Errorf("unmarshal %s: %w", t, err)
+				return decodeError(attrName(expectNATNames, t), err)
 			}
 		default:
 			return fmt.Errorf("child type %d: %w", ad.Type(), errUnknownAttribute)
@@ -97,7 +97,11 @@ func (ex *Expect) unmarshal(ad *netlink.AttributeDecoder) error {
 		}
 	}
 
-	return ad.Err()
+	if err := ad.Err(); err != nil {
+		return &DecodeError{Err: err}
+	}
+
+	return nil
 }
 
 func (ex *Expect) unmarshalNested(ad *netlink.AttributeDecoder) error {
@@ -119,12 +123,12 @@ func (ex *Expect) unmarshalNested(ad *netlink.AttributeDecoder) error {
 
 	// Found nested attribute, but missing nested flag.
 	if !nestedFlag(ad.TypeFlags()) {
-		return fmt.Errorf("attribute %v: %w", t, errNotNested)
+		return decodeError(attrName(expectNames, t), errNotNested)
 	}
 
 	ad.Nested(fn)
 	if err := ad.Err(); err != nil {
-		return fmt.Errorf("unmarshal %s: %w", t, err)
+		return decodeError(attrName(expectNames, t), err)
 	}
 
 	return nil
@@ -159,7 +163,8 @@ func (ex Expect) marshal() ([]netfilter.Attribute, error) {
 	attrs[3] = netfilter.Attribute{Type: uint16(ctaExpectTimeout), Data: netfilter.Uint32Bytes(ex.Timeout)}
 
 	if ex.HelpName != "" {
-		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaExpectHelpName), Data: []byte(ex.HelpName)})
+		// The kernel only accepts NUL-terminated helper and function names.
+		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaExpectHelpName), Data: []byte(ex.HelpName + "\x00")})
 	}
 
 	if ex.Zone != 0 {
@@ -175,7 +180,7 @@ func (ex Expect) marshal() ([]netfilter.Attribute, error) {
 	}
 
 	if ex.Function != "" {
-		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaExpectFN), Data: []byte(ex.Function)})
+		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaExpectFN), Data: []byte(ex.Function + "\x00")})
 	}
 
 	if ex.NAT.Tuple.filled() {
@@ -189,6 +194,32 @@ func (ex Expect) marshal() ([]netfilter.Attribute, error) {
 	return attrs, nil
 }
 
+// marshalQuery marshals the attributes of an Expect used to look up an
+// existing expectation in the kernel: Tuple, Zone and ID.
+func (ex Expect) marshalQuery() ([]netfilter.Attribute, error) {
+	if !ex.Tuple.filled() {
+		return nil, errExpectNeedTuple
+	}
+
+	attrs := make([]netfilter.Attribute, 1, 3)
+
+	tp, err := ex.Tuple.marshal(uint16(ctaExpectTuple))
+	if err != nil {
+		return nil, err
+	}
+	attrs[0] = tp
+
+	if ex.Zone != 0 {
+		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaExpectZone), Data: netfilter.Uint16Bytes(ex.Zone)})
+	}
+
+	if ex.ID != 0 {
+		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaExpectID), Data: netfilter.Uint32Bytes(ex.ID)})
+	}
+
+	return attrs, nil
+}
+
 // unmarshalExpect unmarshals an Expect from a netlink.Message.
 // The Message must contain valid attributes.
 func unmarshalExpect(nlm netlink.Message) (Expect, error) {
@@ -4,15 +4,15 @@ package conntrack
 
 import (
 	"net/netip"
+	"os"
 	"testing"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-// No meaningful integration test possible until we can figure out how
-// to create expects from userspace.
 func TestConnDumpExpect(t *testing.T) {
 
 	c, _, err := makeNSConn()
@@ -22,7 +22,7 @@ func TestConnDumpExpect(t *testing.T) {
 	require.NoError(t, err, "unexpected error dumping expect table")
 }
 
-// Attempt at creating conntrack expectation from userspace.
+// Creating an expectation for a master Flow without a helper is refused.
 func TestConnCreateExpect(t *testing.T) {
 	c, _, err := makeNSConn()
 	require.NoError(t, err)
@@ -61,5 +61,110 @@ func TestConnCreateExpect(t *testing.T) {
 		Class:    0x30,
 	}
 
-	require.ErrorIs(t, c.CreateExpect(ex), unix.EINVAL)
+	require.ErrorIs(t, c.CreateExpect(ex), unix.EOPNOTSUPP)
+}
+
+// createFTPExpect creates a master Flow to an FTP server with the ftp helper
+// attached, along with an expectation for a passive mode data connection to
+// the given port, like the one described in helpers.md.
+func createFTPExpect(t *testing.T, c *Conn, sport, dataPort uint16) Expect {
+	t.Helper()
+
+	f := NewFlow(unix.IPPROTO_TCP, 0, netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), sport, 21, 120, 0)
+	f.Helper = Helper{Name: "ftp"}
+	require.NoError(t, c.Create(f), "creating master flow")
+
+	ex := Expect{
+		Timeout:     300,
+		TupleMaster: f.TupleOrig,
+		Tuple: Tuple{
+			IP: IPTuple{
+				SourceAddress:      netip.MustParseAddr("1.2.3.4"),
+				DestinationAddress: netip.MustParseAddr("5.6.7.8"),
+			},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_TCP, DestinationPort: dataPort},
+		},
+		Mask: Tuple{
+			IP: IPTuple{
+				SourceAddress:      netip.MustParseAddr("255.255.255.255"),
+				DestinationAddress: netip.MustParseAddr("255.255.255.255"),
+			},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_TCP, DestinationPort: 0xffff},
+		},
+		HelpName: "ftp",
+	}
+	require.NoError(t, c.CreateExpect(ex), "creating expect")
+
+	return ex
+}
+
+func TestConnExpectLifecycle(t *testing.T) {
+	if _, err := os.Stat("/sys/module/nf_conntrack_ftp"); os.IsNotExist(err) {
+		t.Skip("nf_conntrack_ftp kernel module not loaded")
+	}
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	ex := createFTPExpect(t, c, 42000, 30000)
+
+	exs, err := c.DumpExpect()
+	require.NoError(t, err)
+	require.Len(t, exs, 1)
+	assert.Equal(t, "ftp", exs[0].HelpName)
+	assert.Equal(t, ex.Tuple, exs[0].Tuple)
+
+	// Get by tuple and by ID.
+	got, err := c.GetExpect(ex)
+	require.NoError(t, err)
+	assert.Equal(t, exs[0].ID, got.ID)
+	assert.Equal(t, ex.TupleMaster, got.TupleMaster)
+
+	got, err = c.GetExpect(Expect{ID: exs[0].ID})
+	require.NoError(t, err)
+	assert.Equal(t, ex.Tuple, got.Tuple)
+
+	// Mismatching IDs are rejected by the kernel.
+	_, err = c.GetExpect(Expect{Tuple: ex.Tuple, ID: exs[0].ID + 1})
+	assert.ErrorIs(t, err, unix.ENOENT)
+	_, err = c.GetExpect(Expect{ID: exs[0].ID + 1})
+	assert.ErrorIs(t, err, unix.ENOENT)
+
+	_, err = c.GetExpect(Expect{})
+	assert.ErrorIs(t, err, errExpectNeedTuple)
+	assert.ErrorIs(t, c.DeleteExpect(Expect{}), errExpectNeedTuple)
+
+	// Delete by ID.
+	require.NoError(t, c.DeleteExpect(Expect{ID: exs[0].ID}))
+	exs, err = c.DumpExpect()
+	require.NoError(t, err)
+	assert.Empty(t, exs)
+
+	// Delete by tuple.
+	ex = createFTPExpect(t, c, 42001, 30001)
+	require.NoError(t, c.DeleteExpect(ex))
+	_, err = c.GetExpect(ex)
+	assert.ErrorIs(t, err, unix.ENOENT)
+
+	// Delete by helper name.
+	createFTPExpect(t, c, 42002, 30002)
+	createFTPExpect(t, c, 42003, 30003)
+	assert.ErrorIs(t, c.DeleteExpectHelper(""), errNeedHelperName)
+	require.NoError(t, c.DeleteExpectHelper("irc"))
+	exs, err = c.DumpExpect()
+	require.NoError(t, err)
+	assert.Len(t, exs, 2)
+
+	require.NoError(t, c.DeleteExpectHelper("ftp"))
+	exs, err = c.DumpExpect()
+	require.NoError(t, err)
+	assert.Empty(t, exs)
+
+	// Flush.
+	createFTPExpect(t, c, 42004, 30004)
+	createFTPExpect(t, c, 42005, 30005)
+	require.NoError(t, c.FlushExpect())
+	exs, err = c.DumpExpect()
+	require.NoError(t, err)
+	assert.Empty(t, exs)
 }
@@ -316,7 +316,7 @@ func TestExpectMarshal(t *testing.T) {
 		},
 		{
 			Type: uint16(ctaExpectHelpName),
-			Data: []byte("ftp"),
+			Data: []byte("ftp\x00"),
 		},
 		{
 			Type: uint16(ctaExpectZone),
@@ -332,7 +332,7 @@ func TestExpectMarshal(t *testing.T) {
 		},
 		{
 			Type: uint16(ctaExpectFN),
-			Data: []byte("func"),
+			Data: []byte("func\x00"),
 		},
 		{
 			Type:   uint16(ctaExpectNAT),
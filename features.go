@@ -0,0 +1,389 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+// Features describes the ctnetlink capabilities of the running kernel, as
+// probed by [Conn.Features].
+type Features struct {
+	// FilterFamily is true if [Conn.DumpFilter] honours [Filter.Family].
+	// Added in Linux 4.20.
+	FilterFamily bool
+
+	// FilterStatus is true if [Conn.DumpFilter] honours [Filter.Status] and
+	// [Filter.StatusMask]. Added in Linux 5.15.
+	FilterStatus bool
+
+	// FilterZone is true if [Conn.DumpFilter] honours [Filter.Zone]. Added in
+	// Linux 6.8.
+	FilterZone bool
+
+	// FilterTuples is true if [Conn.DumpFilter] honours filters on addresses,
+	// ports, protocol and ICMP fields, sent in CTA_FILTER. Added in Linux 5.8.
+	FilterTuples bool
+
+	// FlushFilter is true if [Conn.FlushFilter] honours Filters instead of
+	// flushing the whole table. Flushes support the same Filter fields as
+	// dumps, except for tuples, see FlushFilterTuples. Added in Linux 5.3.
+	// Only probed if FilterFamily is true, it's false otherwise.
+	FlushFilter bool
+
+	// FlushFilterTuples is true if [Conn.FlushFilter] honours filters on
+	// addresses, ports, protocol and ICMP fields. Added in Linux 6.3.
+	FlushFilterTuples bool
+
+	// TimestampEvents is true if events carry the time they were generated
+	// at (CTA_TIMESTAMP_EVENT). Requires connection timestamps to be enabled,
+	// see [Config.Timestamp].
+	TimestampEvents bool
+
+	// MaxEntries is true if [Conn.StatsGlobal] reports the maximum size of the
+	// conntrack table.
+	MaxEntries bool
+
+	// Labels is true if labels can be attached to Flows. Requires connlabels
+	// to be in use in the Conn's network namespace, for example by a ruleset
+	// matching on them.
+	Labels bool
+}
+
+// unsupported returns the Filter fields in ff the kernel can't filter on in
+// dumps, or in flushes if flush is set.
+func (ft Features) unsupported(ff filterFields, flush bool) filterFields {
+	if flush && !ft.FlushFilter {
+		return ff
+	}
+
+	var out filterFields
+	if !ft.FilterFamily {
+		out |= filterFamily
+	}
+	if !ft.FilterStatus {
+		out |= filterStatus
+	}
+	if !ft.FilterZone {
+		out |= filterZone
+	}
+	if !ft.FilterTuples || flush && !ft.FlushFilterTuples {
+		out |= filterTuples
+	}
+
+	return ff & out
+}
+
+// probeTimeout is the Timeout of the Flows created to probe the kernel's
+// features. They are deleted once probing completes, the timeout makes sure
+// they expire if that fails.
+const probeTimeout = 30
+
+// probeEventWait is how long to wait for the events of probe Flows. Events are
+// queued on listening sockets before the kernel acknowledges the creation of a
+// Flow, so they're normally available right away.
+const probeEventWait = 100 * time.Millisecond
+
+// Features probes the ctnetlink capabilities of the running kernel.
+//
+// Kernels silently ignore attributes they don't know, so support for Filter
+// fields can't be detected from the kernel's replies. Instead, Features
+// changes the conntrack table of the Conn's network namespace: two Flows are
+// briefly created in the 192.0.2.0/24 documentation range with a random mark,
+// Features checks which of them are returned by filtered dumps and removed by
+// filtered flushes, and updates their labels. Listeners in the namespace
+// receive events for all of these changes. Kernels that ignore Filters return
+// the whole table for each of these dumps, so probing them can take a while.
+//
+// Flushes are always filtered on the probe Flows' mark, which is honoured by
+// all kernels that support filtering dumps on the address family, so they
+// never remove other Flows. Flushes aren't probed on older kernels.
+//
+// The result is cached and used for Filters passed to the Conn, see
+// [Conn.SetFilterMode].
+//
+// Features uses [context.Background] internally, use [Conn.FeaturesContext]
+// to specify a context.
+func (c *Conn) Features() (Features, error) {
+	return c.FeaturesContext(context.Background())
+}
+
+// FeaturesContext is like [Conn.Features], but aborts the operation when ctx
+// is cancelled or its deadline expires, returning ctx.Err().
+func (c *Conn) FeaturesContext(ctx context.Context) (Features, error) {
+	c.featMu.Lock()
+	defer c.featMu.Unlock()
+
+	ft, err := c.probeFeatures(ctx)
+	if err != nil {
+		return Features{}, err
+	}
+	c.features = &ft
+
+	return ft, nil
+}
+
+// SetFilterMode sets how [Conn.DumpFilter], [Conn.FlushFilter] and their
+// variants handle Filter fields the running kernel doesn't support. Unless
+// mode is [FilterKernel], the kernel's features must be probed using
+// [Conn.Features] before applying Filters, since probing changes the
+// conntrack table. Filters are refused until then.
+func (c *Conn) SetFilterMode(mode FilterMode) {
+	c.featMu.Lock()
+	defer c.featMu.Unlock()
+
+	c.filterMode = mode
+}
+
+// filterFeatures returns the Conn's FilterMode along with the kernel's
+// Features, if the mode requires them.
+func (c *Conn) filterFeatures(ctx context.Context) (FilterMode, Features, error) {
+	c.featMu.Lock()
+	defer c.featMu.Unlock()
+
+	if c.filterMode == FilterKernel {
+		return c.filterMode, Features{}, nil
+	}
+
+	if c.features == nil {
+		return 0, Features{}, errFeaturesUnknown
+	}
+
+	return c.filterMode, *c.features, nil
+}
+
+// kernelFilter returns the part of filter to send to the kernel in a dump,
+// along with a function matching Flows on the remaining fields in userspace,
+// according to the Conn's FilterMode. The function is nil if the kernel
+// supports all of the Filter's fields.
+func (c *Conn) kernelFilter(ctx context.Context, filter Filter) (Filter, func(Flow) bool, error) {
+	mode, ft, err := c.filterFeatures(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mode == FilterKernel {
+		return filter, nil, nil
+	}
+
+	unsupported := ft.unsupported(filter.fields(), false)
+	if unsupported == 0 {
+		return filter, nil, nil
+	}
+
+	if mode == FilterStrict {
+		return nil, nil, fmt.Errorf("filter on %s: %w", unsupported, ErrNotSupported)
+	}
+
+	kf, match := filter.split(unsupported)
+	return kf, match, nil
+}
+
+// probeFeatures probes the features of the running kernel.
+func (c *Conn) probeFeatures(ctx context.Context) (ft Features, err error) {
+	sg, err := c.StatsGlobalContext(ctx)
+	if err != nil {
+		return ft, err
+	}
+	ft.MaxEntries = sg.MaxEntries != 0
+
+	// Listen for the probe Flows' events to find out if they carry timestamps.
+	lc, err := Dial(c.config)
+	if err != nil {
+		return ft, err
+	}
+	defer lc.Close()
+
+	if err := lc.joinGroups([]netfilter.NetlinkGroup{netfilter.GroupCTNew}); err != nil {
+		return ft, err
+	}
+
+	// Randomize the probe Flows to avoid clashing with concurrent probes.
+	mark := rand.Uint32()
+	port := rand.N[uint16](64512) + 1024
+	zone := rand.N[uint16](0xfffe) + 1
+
+	probes := []Flow{
+		NewFlow(unix.IPPROTO_UDP, StatusConfirmed|StatusSeenReply|StatusAssured, netip.MustParseAddr("192.0.2.1"),
+			netip.MustParseAddr("192.0.2.2"), port, port, probeTimeout, mark),
+		NewFlow(unix.IPPROTO_UDP, StatusConfirmed, netip.MustParseAddr("192.0.2.3"),
+			netip.MustParseAddr("192.0.2.2"), port, port, probeTimeout, mark),
+	}
+	probes[0].Zone, probes[1].Zone = zone, zone+1
+
+	errs, err := c.CreateBatchContext(ctx, probes)
+	defer func() {
+		// Probe Flows that weren't created or were flushed are gone already.
+		errs, derr := c.DeleteBatchContext(context.WithoutCancel(ctx), probes)
+		for _, e := range errs {
+			if !errors.Is(e, ErrNotFound) {
+				derr = errors.Join(derr, e)
+			}
+		}
+		if derr != nil {
+			err = errors.Join(err, fmt.Errorf("delete probe flows: %w", derr))
+		}
+	}()
+	if err != nil {
+		return ft, err
+	}
+	if err := errors.Join(errs...); err != nil {
+		return ft, fmt.Errorf("create probe flows: %w", err)
+	}
+
+	ft.TimestampEvents, err = hasEventTimestamps(lc)
+	if err != nil {
+		return ft, err
+	}
+
+	for _, p := range []struct {
+		feature *bool
+		filter  Filter
+		want    []bool
+	}{
+		{&ft.FilterFamily, NewFilter().Mark(mark).Family(netfilter.ProtoIPv6), []bool{false, false}},
+		{&ft.FilterStatus, NewFilter().Mark(mark).Family(netfilter.ProtoIPv4).Status(StatusAssured), []bool{true, false}},
+		{&ft.FilterZone, NewFilter().Mark(mark).Zone(zone), []bool{true, false}},
+		{&ft.FilterTuples, NewFilter().Mark(mark).OrigSource(probes[0].TupleOrig.IP.SourceAddress), []bool{true, false}},
+	} {
+		*p.feature, err = c.probeFilter(ctx, p.filter, probes, p.want)
+		if err != nil {
+			return ft, err
+		}
+	}
+
+	l, err := NewLabels(0)
+	if err != nil {
+		return ft, err
+	}
+	switch err := c.UpdateLabelsContext(ctx, probes[0], l, nil); {
+	case err == nil:
+		ft.Labels = true
+	case errors.Is(err, unix.ENOSPC), errors.Is(err, ErrNotSupported):
+		// Connlabels aren't in use or supported by the kernel.
+	default:
+		return ft, err
+	}
+
+	// Flushing on the mark was added before filtering dumps on the family.
+	// Older kernels may ignore the mark and flush the whole table.
+	if ft.FilterFamily {
+		ft.FlushFilter, ft.FlushFilterTuples, err = c.probeFlush(ctx, mark, probes)
+		if err != nil {
+			return ft, err
+		}
+	}
+
+	return ft, nil
+}
+
+// probeFlush flushes the probe Flows with filters on their mark and returns
+// whether the kernel honours the remaining fields of filtered flushes. It
+// removes some or all of the probe Flows.
+func (c *Conn) probeFlush(ctx context.Context, mark uint32, probes []Flow) (flush, tuples bool, err error) {
+	probe := func(filter Filter, want []bool) (bool, error) {
+		attrs, err := filter.marshal()
+		if err != nil {
+			return false, err
+		}
+		err = c.flushFilter(ctx, filter.family(), attrs)
+		// Without tuple flushes, the kernel looks up a single Flow by the
+		// incomplete tuple and fails.
+		if errors.Is(err, ErrNotFound) || errors.Is(err, unix.EINVAL) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		return c.probeFilter(ctx, NewFilter().Mark(mark), probes, want)
+	}
+
+	// All probe Flows are IPv4 and must survive.
+	flush, err = probe(NewFilter().Mark(mark).MarkMask(math.MaxUint32).Family(netfilter.ProtoIPv6), []bool{true, true})
+	if err != nil || !flush {
+		return false, false, err
+	}
+
+	tuples, err = probe(NewFilter().Mark(mark).MarkMask(math.MaxUint32).OrigSource(probes[0].TupleOrig.IP.SourceAddress), []bool{false, true})
+	if err != nil {
+		return false, false, err
+	}
+
+	return flush, tuples, nil
+}
+
+// probeFilter dumps the Flows matching filter and returns true if the dump
+// contains exactly the probe Flows selected by want.
+func (c *Conn) probeFilter(ctx context.Context, filter Filter, probes []Flow, want []bool) (bool, error) {
+	attrs, err := filter.marshal()
+	if err != nil {
+		return false, err
+	}
+
+	got := make([]bool, len(probes))
+	for f, err := range c.dumpSeq(ctx, ctGet, filter.family(), attrs) {
+		// The probe Flows exist for the whole dump, so they're not missed even
+		// if concurrent changes interrupt it.
+		if errors.Is(err, ErrDumpInterrupted) {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		for i, p := range probes {
+			if f.Key() == p.Key() {
+				got[i] = true
+			}
+		}
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// hasEventTimestamps reads the events queued on the multicast Conn lc and
+// returns true if any of them carries an event timestamp.
+func hasEventTimestamps(lc *Conn) (bool, error) {
+	if err := lc.conn.SetReadDeadline(time.Now().Add(probeEventWait)); err != nil {
+		return false, err
+	}
+
+	for {
+		msgs, err := lc.conn.Receive()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return false, nil
+		}
+		// Events were dropped, look at the ones that follow.
+		if errors.Is(err, unix.ENOBUFS) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		for _, m := range msgs {
+			_, ad, err := netfilter.DecodeNetlink(m)
+			if err != nil {
+				return false, err
+			}
+			for ad.Next() {
+				if attributeType(ad.Type()) == ctaTimestampEvent {
+					return true, nil
+				}
+			}
+		}
+	}
+}
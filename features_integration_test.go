@@ -0,0 +1,111 @@
+//go:build integration
+
+package conntrack
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+func TestConnFeatures(t *testing.T) {
+	path := newNS(t)
+
+	c, err := DialNamespace(path, nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	f := NewFlow(unix.IPPROTO_TCP, 0, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), 1000, 80, 120, 0)
+	require.NoError(t, c.Create(f))
+
+	ft, err := c.Features()
+	require.NoError(t, err)
+
+	// The kernels tests run on support all Filter fields.
+	assert.True(t, ft.FilterFamily)
+	assert.True(t, ft.FilterStatus)
+	assert.True(t, ft.FilterZone)
+	assert.True(t, ft.FilterTuples)
+	assert.True(t, ft.FlushFilter)
+	assert.True(t, ft.FlushFilterTuples)
+	assert.True(t, ft.MaxEntries)
+	assert.False(t, ft.TimestampEvents, "connection timestamps are disabled by default")
+
+	// Probe Flows are removed, flushes leave other Flows in place.
+	flows, err := c.Dump(nil)
+	require.NoError(t, err)
+	require.Len(t, flows, 1)
+	assert.Equal(t, f.Key(), flows[0].Key())
+
+	s, err := SysctlNamespace(path)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Set("nf_conntrack_timestamp", "1"))
+
+	ft, err = c.Features()
+	require.NoError(t, err)
+	assert.True(t, ft.TimestampEvents)
+}
+
+func TestConnFilterMode(t *testing.T) {
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+	defer c.Close()
+
+	var flows []Flow
+	for i := range 4 {
+		f := NewFlow(unix.IPPROTO_TCP, 0, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"),
+			uint16(1000+i), 80, 120, 0)
+		f.Zone = uint16(i % 2)
+		flows = append(flows, f)
+	}
+	errs, err := c.CreateBatch(flows)
+	require.NoError(t, err)
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	// Filters are refused until the kernel's features are probed.
+	c.SetFilterMode(FilterStrict)
+	_, err = c.DumpFilter(NewFilter().Zone(1), nil)
+	assert.ErrorIs(t, err, errFeaturesUnknown)
+	assert.ErrorIs(t, c.FlushFilter(NewFilter().Zone(1)), errFeaturesUnknown)
+
+	// Pretend the kernel doesn't support filtering on zones or tuples.
+	c.features = &Features{FilterFamily: true, FilterStatus: true, FlushFilter: true}
+	filter := NewFilter().Family(netfilter.ProtoIPv4).Zone(1).OrigSourcePort(1001).Protocol(unix.IPPROTO_TCP)
+
+	_, err = c.DumpFilter(filter, nil)
+	assert.ErrorIs(t, err, ErrNotSupported)
+	assert.ErrorIs(t, c.FlushFilter(filter), ErrNotSupported)
+	assert.ErrorIs(t, c.FlushFilter(NewFilter().Labels(Labels{1})), errFilterLabels)
+
+	c.SetFilterMode(FilterFallback)
+	got, err := c.DumpFilter(filter, nil)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, flows[1].Key(), got[0].Key())
+
+	got, err = c.DumpFilter(NewFilter().Zone(1), nil)
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+
+	// Only the matching Flows are flushed.
+	require.NoError(t, c.FlushFilter(NewFilter().Zone(1)))
+	got, err = c.Dump(nil)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	for _, f := range got {
+		assert.Equal(t, uint16(0), f.Zone)
+	}
+
+	// The kernel can't flush on labels, nothing carries them.
+	require.NoError(t, c.FlushFilter(NewFilter().Labels(Labels{1})))
+	got, err = c.Dump(nil)
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+}
@@ -1,6 +1,14 @@
 package conntrack
 
 import (
+	"encoding/binary"
+	"maps"
+	"net/netip"
+	"strings"
+
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+
 	"github.com/ti-mo/netfilter"
 )
 
@@ -9,7 +17,8 @@ import (
 // set filter fields. Methods mutate the Filter in place and return it for
 // chaining purposes.
 //
-// Pass a filter to [Conn.DumpFilter] or [Conn.FlushFilter].
+// Pass a filter to [Conn.DumpFilter] or [Conn.FlushFilter]. Kernels ignore
+// fields they don't support, use [Conn.SetFilterMode] to detect them.
 type Filter interface {
 	// Family sets the address (L3) family to filter on, similar to conntrack's
 	// -f/--family.
@@ -57,9 +66,136 @@ type Filter interface {
 	// Requires Linux 6.8 or later.
 	Zone(zone uint16) Filter
 
+	// OrigSource sets the source address of the original direction to filter
+	// on, similar to conntrack's -s/--src/--orig-src option.
+	//
+	// Filtering on addresses, ports or protocol requires Linux 5.8 or later for
+	// [Conn.DumpFilter] and Linux 6.3 for [Conn.FlushFilter]. If not set using
+	// [Filter.Family], the Filter's address family is derived from the given
+	// addresses. If no addresses are given, the Family must be set explicitly.
+	OrigSource(addr netip.Addr) Filter
+
+	// OrigDestination sets the destination address of the original direction to
+	// filter on, similar to conntrack's -d/--dst/--orig-dst option.
+	OrigDestination(addr netip.Addr) Filter
+
+	// OrigSourcePort sets the source port of the original direction to filter
+	// on, similar to conntrack's --sport/--orig-port-src option. Requires
+	// [Filter.Protocol] to be set.
+	OrigSourcePort(port uint16) Filter
+
+	// OrigDestinationPort sets the destination port of the original direction
+	// to filter on, similar to conntrack's --dport/--orig-port-dst option.
+	// Requires [Filter.Protocol] to be set.
+	OrigDestinationPort(port uint16) Filter
+
+	// ReplySource sets the source address of the reply direction to filter on,
+	// similar to conntrack's -r/--reply-src option.
+	ReplySource(addr netip.Addr) Filter
+
+	// ReplyDestination sets the destination address of the reply direction to
+	// filter on, similar to conntrack's -q/--reply-dst option.
+	ReplyDestination(addr netip.Addr) Filter
+
+	// ReplySourcePort sets the source port of the reply direction to filter
+	// on, similar to conntrack's --reply-port-src option. Requires
+	// [Filter.Protocol] to be set.
+	ReplySourcePort(port uint16) Filter
+
+	// ReplyDestinationPort sets the destination port of the reply direction to
+	// filter on, similar to conntrack's --reply-port-dst option. Requires
+	// [Filter.Protocol] to be set.
+	ReplyDestinationPort(port uint16) Filter
+
+	// Protocol sets the layer 4 protocol number to filter on, similar to
+	// conntrack's -p/--proto option. Common values are [unix.IPPROTO_TCP],
+	// [unix.IPPROTO_UDP], [unix.IPPROTO_ICMP] and [unix.IPPROTO_ICMPV6].
+	Protocol(proto uint8) Filter
+
+	// ICMPType sets the ICMP type of the original direction to filter on,
+	// similar to conntrack's --icmp-type option. Requires [Filter.Protocol] to
+	// be set to ICMP or ICMPv6.
+	ICMPType(typ uint8) Filter
+
+	// ICMPCode sets the ICMP code of the original direction to filter on,
+	// similar to conntrack's --icmp-code option. Requires [Filter.Protocol] to
+	// be set to ICMP or ICMPv6.
+	ICMPCode(code uint8) Filter
+
+	// Labels sets the connection labels to filter on, similar to conntrack's
+	// -l/--label option. Only Flows having all of the given label bits set
+	// match.
+	//
+	// The kernel can't filter on labels, so Flows are matched after they are
+	// received from the kernel. Only supported by [Conn.DumpFilter] and its
+	// variants, [Conn.FlushFilter] returns an error unless the Conn's
+	// [FilterMode] is [FilterFallback].
+	Labels(labels Labels) Filter
+
 	family() netfilter.ProtoFamily
 
-	marshal() []netfilter.Attribute
+	labelFilter() Labels
+
+	fields() filterFields
+
+	split(unsupported filterFields) (Filter, func(Flow) bool)
+
+	marshal() ([]netfilter.Attribute, error)
+}
+
+// FilterMode determines how [Conn.DumpFilter] and [Conn.FlushFilter] handle
+// Filter fields the running kernel doesn't support, as probed by
+// [Conn.Features]. Set it using [Conn.SetFilterMode].
+type FilterMode uint8
+
+const (
+	// FilterKernel sends Filters to the kernel as is, without probing its
+	// features. Kernels silently ignore fields they don't support, returning
+	// or flushing more Flows than requested.
+	FilterKernel FilterMode = iota
+
+	// FilterStrict refuses Filters with fields the kernel doesn't support,
+	// returning an error matching [ErrNotSupported].
+	FilterStrict
+
+	// FilterFallback matches Filter fields the kernel doesn't support in
+	// userspace. Dumps request all Flows the kernel can filter on and drop the
+	// remaining mismatches. Flushes the kernel can't filter dump the matching
+	// Flows and delete them one by one instead, so Flows created during the
+	// flush may be left in place.
+	//
+	// In this mode, [Conn.FlushFilter] supports [Filter.Labels] as well.
+	FilterFallback
+)
+
+// filterFields is a bit mask of the fields set on a Filter that not all
+// kernels support.
+type filterFields uint8
+
+const (
+	filterFamily filterFields = 1 << iota
+	filterStatus
+	filterZone
+	filterTuples
+)
+
+func (ff filterFields) String() string {
+	var names []string
+	for _, f := range []struct {
+		field filterFields
+		name  string
+	}{
+		{filterFamily, "family"},
+		{filterStatus, "status"},
+		{filterZone, "zone"},
+		{filterTuples, "tuples"},
+	} {
+		if ff&f.field != 0 {
+			names = append(names, f.name)
+		}
+	}
+
+	return strings.Join(names, ", ")
 }
 
 // NewFilter returns an empty Filter.
@@ -71,6 +207,12 @@ type filter struct {
 	f map[attributeType][]byte
 
 	l3 netfilter.ProtoFamily
+
+	// Tuple fields to match on in the original and reply directions.
+	orig, reply tupleFilter
+
+	// Labels to match on in userspace.
+	labels Labels
 }
 
 func (f *filter) Family(l3 netfilter.ProtoFamily) Filter {
@@ -78,8 +220,37 @@ func (f *filter) Family(l3 netfilter.ProtoFamily) Filter {
 	return f
 }
 
+// family returns the Filter's address family. If none was set explicitly, it
+// is derived from the first address set on the Filter's tuples.
 func (f *filter) family() netfilter.ProtoFamily {
-	return f.l3
+	if f.l3 != netfilter.ProtoUnspec {
+		return f.l3
+	}
+
+	for _, addr := range f.addrs() {
+		if addr.Is4() {
+			return netfilter.ProtoIPv4
+		}
+		if addr.Is6() {
+			return netfilter.ProtoIPv6
+		}
+	}
+
+	return netfilter.ProtoUnspec
+}
+
+// addrs returns all addresses set on the Filter's tuples.
+func (f *filter) addrs() []netip.Addr {
+	var out []netip.Addr
+	for _, tf := range []tupleFilter{f.orig, f.reply} {
+		if tf.flags&ctaFilterFlagIPSrc != 0 {
+			out = append(out, tf.t.IP.SourceAddress)
+		}
+		if tf.flags&ctaFilterFlagIPDst != 0 {
+			out = append(out, tf.t.IP.DestinationAddress)
+		}
+	}
+	return out
 }
 
 func (f *filter) Mark(mark uint32) Filter {
@@ -107,12 +278,351 @@ func (f *filter) Zone(zone uint16) Filter {
 	return f
 }
 
-func (f *filter) marshal() []netfilter.Attribute {
-	attrs := make([]netfilter.Attribute, 0, len(f.f))
+func (f *filter) Labels(labels Labels) Filter {
+	f.labels = labels
+	return f
+}
+
+func (f *filter) labelFilter() Labels {
+	return f.labels
+}
+
+func (f *filter) OrigSource(addr netip.Addr) Filter {
+	f.orig.flags |= ctaFilterFlagIPSrc
+	f.orig.t.IP.SourceAddress = addr
+	return f
+}
+
+func (f *filter) OrigDestination(addr netip.Addr) Filter {
+	f.orig.flags |= ctaFilterFlagIPDst
+	f.orig.t.IP.DestinationAddress = addr
+	return f
+}
+
+func (f *filter) OrigSourcePort(port uint16) Filter {
+	f.orig.flags |= ctaFilterFlagProtoSrcPort
+	f.orig.t.Proto.SourcePort = port
+	return f
+}
+
+func (f *filter) OrigDestinationPort(port uint16) Filter {
+	f.orig.flags |= ctaFilterFlagProtoDstPort
+	f.orig.t.Proto.DestinationPort = port
+	return f
+}
+
+func (f *filter) ReplySource(addr netip.Addr) Filter {
+	f.reply.flags |= ctaFilterFlagIPSrc
+	f.reply.t.IP.SourceAddress = addr
+	return f
+}
+
+func (f *filter) ReplyDestination(addr netip.Addr) Filter {
+	f.reply.flags |= ctaFilterFlagIPDst
+	f.reply.t.IP.DestinationAddress = addr
+	return f
+}
+
+func (f *filter) ReplySourcePort(port uint16) Filter {
+	f.reply.flags |= ctaFilterFlagProtoSrcPort
+	f.reply.t.Proto.SourcePort = port
+	return f
+}
+
+func (f *filter) ReplyDestinationPort(port uint16) Filter {
+	f.reply.flags |= ctaFilterFlagProtoDstPort
+	f.reply.t.Proto.DestinationPort = port
+	return f
+}
+
+func (f *filter) Protocol(proto uint8) Filter {
+	// The protocol is identical in both directions, so match it in both.
+	// The kernel needs it in each tuple that filters on ports.
+	f.orig.flags |= ctaFilterFlagProtoNum
+	f.orig.t.Proto.Protocol = proto
+	f.reply.flags |= ctaFilterFlagProtoNum
+	f.reply.t.Proto.Protocol = proto
+	return f
+}
+
+func (f *filter) ICMPType(typ uint8) Filter {
+	f.orig.flags |= ctaFilterFlagProtoICMPType
+	f.orig.t.Proto.ICMPType = typ
+	return f
+}
+
+func (f *filter) ICMPCode(code uint8) Filter {
+	f.orig.flags |= ctaFilterFlagProtoICMPCode
+	f.orig.t.Proto.ICMPCode = code
+	return f
+}
+
+// fields returns the fields set on the Filter that not all kernels support.
+func (f *filter) fields() filterFields {
+	var ff filterFields
+	if f.family() != netfilter.ProtoUnspec {
+		ff |= filterFamily
+	}
+	if _, ok := f.f[ctaStatus]; ok {
+		ff |= filterStatus
+	}
+	if _, ok := f.f[ctaStatusMask]; ok {
+		ff |= filterStatus
+	}
+	if _, ok := f.f[ctaZone]; ok {
+		ff |= filterZone
+	}
+	if f.orig.flags != 0 || f.reply.flags != 0 {
+		ff |= filterTuples
+	}
+
+	return ff
+}
+
+// split splits the Filter into a Filter without the unsupported fields, to be
+// sent to the kernel, and a function matching Flows on the unsupported fields
+// in userspace. Labels are left in the returned Filter.
+func (f *filter) split(unsupported filterFields) (Filter, func(Flow) bool) {
+	// Keep the family in case it was derived from the tuples' addresses.
+	kf := &filter{f: maps.Clone(f.f), l3: f.family(), orig: f.orig, reply: f.reply, labels: f.labels}
+	uf := &filter{f: make(map[attributeType][]byte)}
+
+	if unsupported&filterFamily != 0 {
+		kf.l3, uf.l3 = netfilter.ProtoUnspec, f.family()
+	}
+	if unsupported&filterStatus != 0 {
+		for _, t := range []attributeType{ctaStatus, ctaStatusMask} {
+			if v, ok := f.f[t]; ok {
+				uf.f[t] = v
+				delete(kf.f, t)
+			}
+		}
+	}
+	if unsupported&filterZone != 0 {
+		if v, ok := f.f[ctaZone]; ok {
+			uf.f[ctaZone] = v
+			delete(kf.f, ctaZone)
+		}
+	}
+	if unsupported&filterTuples != 0 {
+		kf.orig, kf.reply = tupleFilter{}, tupleFilter{}
+		uf.orig, uf.reply = f.orig, f.reply
+	}
+
+	return kf, uf.match
+}
+
+// match returns true if the Flow matches the Filter's family, status, zone and
+// tuples, like the kernel's ctnetlink_filter_match.
+func (f *filter) match(flow Flow) bool {
+	switch f.l3 {
+	case netfilter.ProtoIPv4:
+		if !flow.TupleOrig.IP.SourceAddress.Is4() {
+			return false
+		}
+	case netfilter.ProtoIPv6:
+		if !flow.TupleOrig.IP.SourceAddress.Is6() {
+			return false
+		}
+	}
+
+	// Filter values are in network byte order.
+	if v, ok := f.f[ctaStatus]; ok {
+		status := binary.BigEndian.Uint32(v)
+		mask := status
+		if m, ok := f.f[ctaStatusMask]; ok {
+			mask = binary.BigEndian.Uint32(m)
+		}
+		if uint32(flow.Status)&mask != status {
+			return false
+		}
+	}
+
+	if v, ok := f.f[ctaZone]; ok && flow.Zone != binary.BigEndian.Uint16(v) {
+		return false
+	}
+
+	return f.orig.match(flow.TupleOrig) && f.reply.match(flow.TupleReply)
+}
+
+func (f *filter) marshal() ([]netfilter.Attribute, error) {
+	attrs := make([]netfilter.Attribute, 0, len(f.f)+3)
 
 	for t, v := range f.f {
 		attrs = append(attrs, netfilter.Attribute{Type: uint16(t), Data: v})
 	}
 
-	return attrs
+	// Only the protocol was set, don't emit a reply tuple that doesn't narrow
+	// down the results any further.
+	reply := f.reply
+	if reply.flags == ctaFilterFlagProtoNum {
+		reply.flags = 0
+	}
+
+	if f.orig.flags == 0 && reply.flags == 0 {
+		return attrs, nil
+	}
+
+	l3 := f.family()
+	if l3 != netfilter.ProtoIPv4 && l3 != netfilter.ProtoIPv6 {
+		return nil, errFilterFamily
+	}
+	for _, addr := range f.addrs() {
+		if !addr.IsValid() || addr.Is6() != (l3 == netfilter.ProtoIPv6) {
+			return nil, errFilterFamily
+		}
+	}
+
+	filter := netfilter.Attribute{Type: uint16(ctaFilter), Nested: true}
+
+	if f.orig.flags != 0 {
+		nfa, err := f.orig.marshal(ctaTupleOrig, l3)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, nfa)
+		filter.Children = append(filter.Children, netfilter.Attribute{
+			// CTA_FILTER flags are in host byte order.
+			Type: uint16(ctaFilterOrigFlags), Data: nlenc.Uint32Bytes(f.orig.kernelFlags()),
+		})
+	}
+
+	if reply.flags != 0 {
+		nfa, err := reply.marshal(ctaTupleReply, l3)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, nfa)
+		filter.Children = append(filter.Children, netfilter.Attribute{
+			Type: uint16(ctaFilterReplyFlags), Data: nlenc.Uint32Bytes(reply.kernelFlags()),
+		})
+	}
+
+	return append(attrs, filter), nil
+}
+
+// A tupleFilter holds the fields of a Tuple to filter on, along with flags
+// indicating which of its fields are set.
+type tupleFilter struct {
+	flags uint32
+	t     Tuple
+}
+
+// kernelFlags returns the CTA_FILTER flags to send to the kernel. ICMP fields
+// are tracked using the ICMP (v4) flags and converted to their ICMPv6
+// counterparts if the tuple's protocol is ICMPv6.
+func (tf tupleFilter) kernelFlags() uint32 {
+	flags := tf.flags
+	if tf.t.Proto.Protocol != unix.IPPROTO_ICMPV6 {
+		return flags
+	}
+
+	if flags&ctaFilterFlagProtoICMPType != 0 {
+		flags = flags&^ctaFilterFlagProtoICMPType | ctaFilterFlagProtoICMPv6Type
+	}
+	if flags&ctaFilterFlagProtoICMPCode != 0 {
+		flags = flags&^ctaFilterFlagProtoICMPCode | ctaFilterFlagProtoICMPv6Code
+	}
+
+	return flags
+}
+
+// match returns true if the fields of t selected by the tupleFilter's flags
+// are equal to those of the tupleFilter.
+func (tf tupleFilter) match(t Tuple) bool {
+	ft := tf.t
+	checks := []struct {
+		flag uint32
+		ok   bool
+	}{
+		{ctaFilterFlagIPSrc, t.IP.SourceAddress == ft.IP.SourceAddress},
+		{ctaFilterFlagIPDst, t.IP.DestinationAddress == ft.IP.DestinationAddress},
+		{ctaFilterFlagProtoNum, t.Proto.Protocol == ft.Proto.Protocol},
+		{ctaFilterFlagProtoSrcPort, t.Proto.SourcePort == ft.Proto.SourcePort},
+		{ctaFilterFlagProtoDstPort, t.Proto.DestinationPort == ft.Proto.DestinationPort},
+		{ctaFilterFlagProtoICMPType, t.Proto.ICMPType == ft.Proto.ICMPType},
+		{ctaFilterFlagProtoICMPCode, t.Proto.ICMPCode == ft.Proto.ICMPCode},
+	}
+
+	for _, c := range checks {
+		if tf.flags&c.flag != 0 && !c.ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// marshal marshals the fields of a tupleFilter selected by its flags into a
+// nested tuple attribute of type at.
+func (tf tupleFilter) marshal(at attributeType, l3 netfilter.ProtoFamily) (netfilter.Attribute, error) {
+	nfa := netfilter.Attribute{Type: uint16(at), Nested: true}
+
+	if tf.flags&(ctaFilterFlagIPSrc|ctaFilterFlagIPDst) != 0 {
+		src, dst := ctaIPv4Src, ctaIPv4Dst
+		if l3 == netfilter.ProtoIPv6 {
+			src, dst = ctaIPv6Src, ctaIPv6Dst
+		}
+
+		ipt := netfilter.Attribute{Type: uint16(ctaTupleIP), Nested: true}
+		if tf.flags&ctaFilterFlagIPSrc != 0 {
+			ipt.Children = append(ipt.Children, netfilter.Attribute{
+				Type: uint16(src), Data: tf.t.IP.SourceAddress.AsSlice(),
+			})
+		}
+		if tf.flags&ctaFilterFlagIPDst != 0 {
+			ipt.Children = append(ipt.Children, netfilter.Attribute{
+				Type: uint16(dst), Data: tf.t.IP.DestinationAddress.AsSlice(),
+			})
+		}
+
+		nfa.Children = append(nfa.Children, ipt)
+	}
+
+	icmp := tf.flags & (ctaFilterFlagProtoICMPType | ctaFilterFlagProtoICMPCode)
+	ports := tf.flags & (ctaFilterFlagProtoSrcPort | ctaFilterFlagProtoDstPort)
+
+	if tf.flags&ctaFilterFlagProtoNum == 0 {
+		if icmp != 0 || ports != 0 {
+			return netfilter.Attribute{}, errFilterProto
+		}
+		return nfa, nil
+	}
+
+	pt := netfilter.Attribute{Type: uint16(ctaTupleProto), Nested: true, Children: []netfilter.Attribute{
+		{Type: uint16(ctaProtoNum), Data: []byte{tf.t.Proto.Protocol}},
+	}}
+
+	if tf.flags&ctaFilterFlagProtoSrcPort != 0 {
+		pt.Children = append(pt.Children, netfilter.Attribute{
+			Type: uint16(ctaProtoSrcPort), Data: netfilter.Uint16Bytes(tf.t.Proto.SourcePort),
+		})
+	}
+	if tf.flags&ctaFilterFlagProtoDstPort != 0 {
+		pt.Children = append(pt.Children, netfilter.Attribute{
+			Type: uint16(ctaProtoDstPort), Data: netfilter.Uint16Bytes(tf.t.Proto.DestinationPort),
+		})
+	}
+
+	if icmp != 0 {
+		typ, code := ctaProtoICMPType, ctaProtoICMPCode
+		switch tf.t.Proto.Protocol {
+		case unix.IPPROTO_ICMP:
+		case unix.IPPROTO_ICMPV6:
+			typ, code = ctaProtoICMPv6Type, ctaProtoICMPv6Code
+		default:
+			return netfilter.Attribute{}, errFilterICMP
+		}
+
+		if tf.flags&ctaFilterFlagProtoICMPType != 0 {
+			pt.Children = append(pt.Children, netfilter.Attribute{Type: uint16(typ), Data: []byte{tf.t.Proto.ICMPType}})
+		}
+		if tf.flags&ctaFilterFlagProtoICMPCode != 0 {
+			pt.Children = append(pt.Children, netfilter.Attribute{Type: uint16(code), Data: []byte{tf.t.Proto.ICMPCode}})
+		}
+	}
+
+	nfa.Children = append(nfa.Children, pt)
+
+	return nfa, nil
 }
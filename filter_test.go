@@ -1,10 +1,14 @@
 package conntrack
 
 import (
+	"net/netip"
 	"slices"
 	"testing"
 
+	"github.com/mdlayher/netlink/nlenc"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 
 	"github.com/ti-mo/netfilter"
 )
@@ -13,7 +17,8 @@ func TestFilterMarshal(t *testing.T) {
 	f := NewFilter().
 		Mark(0xf0000000).MarkMask(0x0000000f).
 		Zone(42).
-		Status(StatusDying).StatusMask(0xdeadbeef)
+		Status(StatusDying).StatusMask(0xdeadbeef).
+		Labels(Labels{0x01})
 
 	want := []netfilter.Attribute{
 		{
@@ -38,10 +43,173 @@ func TestFilterMarshal(t *testing.T) {
 		},
 	}
 
-	got := f.marshal()
+	got, err := f.marshal()
+	require.NoError(t, err)
 	slices.SortStableFunc(got, func(a, b netfilter.Attribute) int {
 		return int(a.Type) - int(b.Type)
 	})
 
 	assert.Equal(t, want, got)
+
+	// Labels are matched in userspace and not sent to the kernel.
+	assert.Equal(t, Labels{0x01}, f.labelFilter())
+}
+
+func TestFilterMarshalTuple(t *testing.T) {
+	f := NewFilter().
+		OrigSource(netip.MustParseAddr("10.0.0.1")).
+		Protocol(unix.IPPROTO_TCP).OrigDestinationPort(443).
+		ReplyDestination(netip.MustParseAddr("10.0.0.1"))
+
+	assert.Equal(t, netfilter.ProtoIPv4, f.family())
+
+	want := []netfilter.Attribute{
+		{
+			Type:   uint16(ctaTupleOrig),
+			Nested: true,
+			Children: []netfilter.Attribute{
+				{
+					Type:     uint16(ctaTupleIP),
+					Nested:   true,
+					Children: []netfilter.Attribute{{Type: uint16(ctaIPv4Src), Data: []byte{10, 0, 0, 1}}},
+				},
+				{
+					Type:   uint16(ctaTupleProto),
+					Nested: true,
+					Children: []netfilter.Attribute{
+						{Type: uint16(ctaProtoNum), Data: []byte{unix.IPPROTO_TCP}},
+						{Type: uint16(ctaProtoDstPort), Data: []byte{0x01, 0xbb}},
+					},
+				},
+			},
+		},
+		{
+			Type:   uint16(ctaTupleReply),
+			Nested: true,
+			Children: []netfilter.Attribute{
+				{
+					Type:     uint16(ctaTupleIP),
+					Nested:   true,
+					Children: []netfilter.Attribute{{Type: uint16(ctaIPv4Dst), Data: []byte{10, 0, 0, 1}}},
+				},
+				{
+					Type:     uint16(ctaTupleProto),
+					Nested:   true,
+					Children: []netfilter.Attribute{{Type: uint16(ctaProtoNum), Data: []byte{unix.IPPROTO_TCP}}},
+				},
+			},
+		},
+		{
+			Type:   uint16(ctaFilter),
+			Nested: true,
+			Children: []netfilter.Attribute{
+				{
+					Type: uint16(ctaFilterOrigFlags),
+					Data: nlenc.Uint32Bytes(ctaFilterFlagIPSrc | ctaFilterFlagProtoNum | ctaFilterFlagProtoDstPort),
+				},
+				{
+					Type: uint16(ctaFilterReplyFlags),
+					Data: nlenc.Uint32Bytes(ctaFilterFlagIPDst | ctaFilterFlagProtoNum),
+				},
+			},
+		},
+	}
+
+	got, err := f.marshal()
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// A protocol by itself only needs to be matched in the original direction.
+	got, err = NewFilter().Family(netfilter.ProtoIPv6).Protocol(unix.IPPROTO_ICMPV6).ICMPType(128).marshal()
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, uint16(ctaTupleOrig), got[0].Type)
+	assert.Equal(t, netfilter.Attribute{Type: uint16(ctaProtoICMPv6Type), Data: []byte{128}},
+		got[0].Children[0].Children[1])
+	assert.Equal(t, nlenc.Uint32Bytes(ctaFilterFlagProtoNum|ctaFilterFlagProtoICMPv6Type), got[1].Children[0].Data)
+}
+
+func TestFilterMarshalTupleError(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		err    error
+	}{
+		{name: "no family", filter: NewFilter().Protocol(unix.IPPROTO_TCP), err: errFilterFamily},
+		{name: "invalid address", filter: NewFilter().Family(netfilter.ProtoIPv4).OrigSource(netip.Addr{}),
+			err: errFilterFamily},
+		{name: "mixed families", filter: NewFilter().
+			OrigSource(netip.MustParseAddr("10.0.0.1")).ReplySource(netip.MustParseAddr("::1")),
+			err: errFilterFamily},
+		{name: "family mismatch", filter: NewFilter().Family(netfilter.ProtoIPv6).
+			OrigSource(netip.MustParseAddr("10.0.0.1")), err: errFilterFamily},
+		{name: "port without protocol", filter: NewFilter().Family(netfilter.ProtoIPv4).OrigSourcePort(80),
+			err: errFilterProto},
+		{name: "icmp without icmp protocol", filter: NewFilter().Family(netfilter.ProtoIPv4).
+			Protocol(unix.IPPROTO_UDP).ICMPCode(1), err: errFilterICMP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.filter.marshal()
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestFilterSplit(t *testing.T) {
+	f := NewFilter().Mark(1).Status(StatusAssured).Zone(2).
+		OrigSource(netip.MustParseAddr("192.0.2.1")).
+		Protocol(unix.IPPROTO_TCP).ReplySourcePort(80)
+	assert.Equal(t, filterFamily|filterStatus|filterZone|filterTuples, f.fields())
+	assert.Zero(t, NewFilter().Mark(1).fields())
+
+	kf, match := f.split(filterStatus | filterZone | filterTuples)
+	assert.Equal(t, filterFamily, kf.fields(), "only the family is sent to the kernel")
+	assert.Equal(t, netfilter.ProtoIPv4, kf.family(), "family derived from moved tuples")
+
+	attrs, err := kf.marshal()
+	require.NoError(t, err)
+	require.Len(t, attrs, 1)
+	assert.Equal(t, uint16(ctaMark), attrs[0].Type)
+
+	flow := NewFlow(unix.IPPROTO_TCP, StatusConfirmed|StatusAssured, netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"), 1234, 80, 120, 1)
+	flow.Zone = 2
+	assert.True(t, match(flow))
+
+	for name, fn := range map[string]func(*Flow){
+		"status":      func(f *Flow) { f.Status = StatusConfirmed },
+		"zone":        func(f *Flow) { f.Zone = 3 },
+		"orig source": func(f *Flow) { f.TupleOrig.IP.SourceAddress = netip.MustParseAddr("192.0.2.3") },
+		"protocol":    func(f *Flow) { f.TupleOrig.Proto.Protocol = unix.IPPROTO_UDP },
+		"reply port":  func(f *Flow) { f.TupleReply.Proto.SourcePort = 81 },
+	} {
+		f := flow
+		fn(&f)
+		assert.False(t, match(f), name)
+	}
+
+	// Family and status mask.
+	_, match = NewFilter().Family(netfilter.ProtoIPv6).Status(StatusAssured).StatusMask(uint32(StatusAssured | StatusDying)).
+		split(filterFamily | filterStatus)
+	assert.False(t, match(flow))
+	flow6 := NewFlow(unix.IPPROTO_TCP, StatusAssured|StatusSeenReply, netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("2001:db8::2"), 1234, 80, 120, 0)
+	assert.True(t, match(flow6))
+	flow6.Status |= StatusDying
+	assert.False(t, match(flow6))
+}
+
+func TestFeaturesUnsupported(t *testing.T) {
+	all := filterFamily | filterStatus | filterZone | filterTuples
+	ft := Features{FilterFamily: true, FilterStatus: true, FilterTuples: true, FlushFilter: true}
+	assert.Equal(t, filterZone|filterTuples, ft.unsupported(all, true))
+	assert.Equal(t, filterZone, ft.unsupported(all, false))
+	assert.Zero(t, ft.unsupported(filterFamily, true))
+	assert.Equal(t, "zone, tuples", ft.unsupported(all, true).String())
+
+	ft.FlushFilter = false
+	assert.Equal(t, all, ft.unsupported(all, true))
+	assert.Zero(t, ft.unsupported(0, true))
 }
@@ -1,7 +1,6 @@
 package conntrack
 
 import (
-	"fmt"
 	"net/netip"
 
 	"github.com/mdlayher/netlink"
@@ -28,11 +27,18 @@ type Flow struct {
 
 	SeqAdjOrig, SeqAdjReply SequenceAdjust
 
-	Labels, LabelsMask []byte
+	// Labels holds the Flow's connection labels. When creating or updating a
+	// Flow, LabelsMask selects the label bits to modify, it must be as long as
+	// Labels. Use [Conn.UpdateLabels] to set or clear individual labels.
+	Labels, LabelsMask Labels
 
 	Mark, Use uint32
 
 	SynProxy SynProxy
+
+	// NATSrc and NATDst set up source and destination NAT for the Flow when
+	// it is created, similar to conntrack's --src-nat and --dst-nat options.
+	NATSrc, NATDst NATRange
 }
 
 // NewFlow returns a new Flow object with the minimum necessary attributes to
@@ -111,7 +117,11 @@ func (f *Flow) unmarshal(ad *netlink.AttributeDecoder) error {
 		}
 	}
 
-	return ad.Err()
+	if err := ad.Err(); err != nil {
+		return &DecodeError{Err: err}
+	}
+
+	return nil
 }
 
 // unmarshalNested unmarshals nested netlink attributes. Returns errNotNested if
@@ -160,6 +170,12 @@ func (f *Flow) unmarshalNested(ad *netlink.AttributeDecoder) error {
 	// CTA_SYNPROXY are the connection's SYN proxy parameters
 	case ctaSynProxy:
 		fn = f.SynProxy.unmarshal
+	// CTA_NAT_* attributes describe the NAT setup of a new connection.
+	// They are never sent by the kernel, but are decoded for completeness.
+	case ctaNatSrc:
+		fn = f.NATSrc.unmarshal
+	case ctaNatDst:
+		fn = f.NATDst.unmarshal
 	default:
 		// No nested attributes matched, nothing to do.
 		return nil
@@ -167,26 +183,27 @@ func (f *Flow) unmarshalNested(ad *netlink.AttributeDecoder) error {
 
 	// Found nested attribute, but missing nested flag.
 	if !nestedFlag(ad.TypeFlags()) {
-		return fmt.Errorf("attribute %v: %w", t, errNotNested)
+		return decodeError(attrName(attributeNames, t), errNotNested)
 	}
 
 	ad.Nested(fn)
 	if err := ad.Err(); err != nil {
-		return fmt.Errorf("unmarshal %s: %w", t, err)
+		return decodeError(attrName(attributeNames, t), err)
 	}
 
 	return nil
 }
 
-// marshal marshals a Flow object into a list of netfilter.Attributes.
-func (f Flow) marshal() ([]netfilter.Attribute, error) {
+// marshalTuples marshals the Flow's original and reply tuples, whichever are
+// filled, into a list of netfilter.Attributes.
+func (f Flow) marshalTuples() ([]netfilter.Attribute, error) {
 	// Flow updates need one of TupleOrig or TupleReply,
 	// so we enforce having either of those.
 	if !f.TupleOrig.filled() && !f.TupleReply.filled() {
 		return nil, errNeedTuples
 	}
 
-	attrs := make([]netfilter.Attribute, 0, 14)
+	attrs := make([]netfilter.Attribute, 0, 16)
 
 	if f.TupleOrig.filled() {
 		to, err := f.TupleOrig.marshal(uint16(ctaTupleOrig))
@@ -204,6 +221,26 @@ func (f Flow) marshal() ([]netfilter.Attribute, error) {
 		attrs = append(attrs, tr)
 	}
 
+	return attrs, nil
+}
+
+// family returns the protocol family of requests carrying the Flow, IPv6 if
+// both its tuples are IPv6, IPv4 otherwise.
+func (f Flow) family() netfilter.ProtoFamily {
+	if f.TupleOrig.IP.IsIPv6() && f.TupleReply.IP.IsIPv6() {
+		return netfilter.ProtoIPv6
+	}
+
+	return netfilter.ProtoIPv4
+}
+
+// marshal marshals a Flow object into a list of netfilter.Attributes.
+func (f Flow) marshal() ([]netfilter.Attribute, error) {
+	attrs, err := f.marshalTuples()
+	if err != nil {
+		return nil, err
+	}
+
 	// Optional attributes appended to the list when filled
 	if f.Timeout != 0 {
 		a := netfilter.Attribute{Type: uint16(ctaTimeout)}
@@ -243,6 +280,22 @@ func (f Flow) marshal() ([]netfilter.Attribute, error) {
 		attrs = append(attrs, tm)
 	}
 
+	if f.NATSrc.filled() {
+		ns, err := f.NATSrc.marshal(ctaNatSrc)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, ns)
+	}
+
+	if f.NATDst.filled() {
+		nd, err := f.NATDst.marshal(ctaNatDst)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, nd)
+	}
+
 	if f.SeqAdjOrig.filled() {
 		attrs = append(attrs, f.SeqAdjOrig.marshal(false))
 	}
@@ -3,11 +3,17 @@
 package conntrack
 
 import (
+	"context"
+	"errors"
 	"net/netip"
+	"os"
+	"slices"
 	"testing"
+	"time"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/mdlayher/netlink"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/ti-mo/netfilter"
@@ -196,6 +202,72 @@ func TestConnCreateDeleteFlows(t *testing.T) {
 }
 
 // Creates a flow, updates it and checks the result.
+// Create, update and delete a number of flows spanning multiple batches,
+// checking the errors returned for individual flows.
+func TestConnBatch(t *testing.T) {
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+	defer c.Close()
+
+	numFlows := 3*batchSize + 7
+
+	flows := make([]Flow, numFlows)
+	for i := range flows {
+		flows[i] = NewFlow(6, 0, netip.MustParseAddr("198.51.100.1"), netip.MustParseAddr("198.51.100.2"),
+			1234, uint16(i+1), 120, 0)
+	}
+
+	// A duplicate is rejected by the kernel, a Flow without timeout isn't sent.
+	batch := append(slices.Clone(flows), flows[10], NewFlow(6, 0, netip.MustParseAddr("198.51.100.1"),
+		netip.MustParseAddr("198.51.100.2"), 1, 1, 0, 0))
+
+	errs, err := c.CreateBatch(batch)
+	require.NoError(t, err)
+	require.Len(t, errs, numFlows+2)
+	for i := range numFlows {
+		require.NoError(t, errs[i], "creating flow", i)
+	}
+	assert.ErrorIs(t, errs[numFlows], unix.EEXIST)
+	assert.ErrorIs(t, errs[numFlows+1], errNeedTimeout)
+
+	dump, err := c.Dump(nil)
+	require.NoError(t, err)
+	assert.Len(t, dump, numFlows)
+
+	for i := range flows {
+		flows[i].Mark = uint32(i)
+	}
+	errs, err = c.UpdateBatch(flows)
+	require.NoError(t, err)
+	for i := range errs {
+		require.NoError(t, errs[i], "updating flow", i)
+	}
+
+	f, err := c.Get(flows[42])
+	require.NoError(t, err)
+	assert.Equal(t, uint32(42), f.Mark)
+
+	// Deleting the first Flow twice fails for its second occurrence.
+	errs, err = c.DeleteBatch(append(flows, flows[0]))
+	require.NoError(t, err)
+	for i := range numFlows {
+		require.NoError(t, errs[i], "deleting flow", i)
+	}
+	assert.ErrorIs(t, errs[numFlows], unix.ENOENT)
+
+	dump, err = c.Dump(nil)
+	require.NoError(t, err)
+	assert.Empty(t, dump)
+
+	// The batch is aborted when the context is cancelled, all Flows report
+	// the context's error.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	errs, err = c.CreateBatchContext(ctx, flows[:2])
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []error{context.Canceled, context.Canceled}, errs)
+}
+
 func TestConnCreateUpdateFlow(t *testing.T) {
 	c, _, err := makeNSConn()
 	require.NoError(t, err)
@@ -258,6 +330,63 @@ func TestConnCreateUpdateFlow(t *testing.T) {
 	}
 }
 
+// Clear a flow's mark, which Update can't do because it leaves out zero values.
+func TestConnUpdateFields(t *testing.T) {
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+	defer c.Close()
+
+	f := NewFlow(17, 0, netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), 1234, 5678, 120, 42)
+	f.Zone = 3
+	require.NoError(t, c.Create(f), "creating flow")
+
+	f.Mark = 0
+	require.NoError(t, c.Update(f), "updating flow")
+
+	got, err := c.Get(f)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(42), got.Mark, "Update must leave out zero Mark")
+
+	// Only the selected Mark is sent, not the Flow's Timeout.
+	f.Timeout = 300
+	require.NoError(t, c.UpdateFields(FlowUpdate{Flow: f, Fields: FieldMark}), "updating flow fields")
+
+	got, err = c.Get(f)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), got.Mark)
+	assert.LessOrEqual(t, got.Timeout, uint32(120))
+
+	assert.ErrorIs(t, c.UpdateFields(FlowUpdate{Flow: f}), errUpdateFields)
+
+	// The zone identifies the flow.
+	f.Zone = 0
+	err = c.UpdateFields(FlowUpdate{Flow: f, Fields: FieldMark})
+	assert.ErrorIs(t, err, unix.ENOENT)
+}
+
+// Errors sent by the kernel match both their errno and the exported errors.
+func TestConnErrors(t *testing.T) {
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+	defer c.Close()
+
+	f := NewFlow(17, 0, netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), 1234, 5678, 120, 0)
+
+	_, err = c.Get(f)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, err, unix.ENOENT)
+	assert.NotErrorIs(t, err, ErrExists)
+
+	require.NoError(t, c.Create(f), "creating flow")
+	err = c.Create(f)
+	assert.ErrorIs(t, err, ErrExists)
+	assert.ErrorIs(t, err, unix.EEXIST)
+
+	require.NoError(t, c.Delete(f), "deleting flow")
+	assert.ErrorIs(t, c.Delete(f), ErrNotFound)
+	assert.ErrorIs(t, c.DeleteTimeout("nonexistent"), ErrNotFound)
+}
+
 func TestConnUpdateError(t *testing.T) {
 
 	c, _, err := makeNSConn()
@@ -276,6 +405,43 @@ func TestConnUpdateError(t *testing.T) {
 	require.ErrorIs(t, err, errUpdateMaster)
 }
 
+// Creates a flow with source NAT and checks the translated reply tuple.
+func TestConnCreateNATFlow(t *testing.T) {
+	if _, err := os.Stat("/sys/module/nf_nat"); os.IsNotExist(err) {
+		t.Skip("nf_nat kernel module not loaded")
+	}
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	f := NewFlow(
+		6, 0,
+		netip.MustParseAddr("192.168.1.10"),
+		netip.MustParseAddr("1.2.3.4"),
+		40000, 443, 120, 0,
+	)
+	f.NATSrc = NATRange{MinAddr: netip.MustParseAddr("10.0.0.1"), MinPort: 50000}
+
+	require.NoError(t, c.Create(f), "creating flow with source nat")
+
+	qf, err := c.Get(Flow{TupleOrig: f.TupleOrig})
+	require.NoError(t, err, "get nat flow")
+
+	assert.True(t, qf.Status.SrcNAT(), "expected source nat status bit")
+	assert.Equal(t, netip.MustParseAddr("10.0.0.1"), qf.TupleReply.IP.DestinationAddress)
+	assert.EqualValues(t, 50000, qf.TupleReply.Proto.DestinationPort)
+}
+
+func TestConnUpdateNATError(t *testing.T) {
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	f := NewFlow(17, 0, netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), 1234, 5678, 120, 0)
+	f.NATDst = NATRange{MinAddr: netip.MustParseAddr("10.0.0.1")}
+
+	require.ErrorIs(t, c.Update(f), errUpdateNAT)
+}
+
 // Creates IPv4 and IPv6 flows and queries them using a simple get.
 func TestConnCreateGetFlow(t *testing.T) {
 
@@ -340,6 +506,96 @@ func TestDumpZero(t *testing.T) {
 	assert.Equal(t, df[0].CountersReply.Bytes, uint64(0))
 }
 
+// Creates a large amount of flows and walks them using a streaming dump,
+// stopping early to make sure the Conn remains usable afterwards.
+func TestConnDumpSeq(t *testing.T) {
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	numFlows := 1337
+
+	for i := 1; i <= numFlows; i++ {
+		f := NewFlow(6, 0, netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), 1234, uint16(i), 120, 0xff)
+		require.NoError(t, c.Create(f), "creating flow", i)
+	}
+
+	var n int
+	for f, err := range c.DumpSeq(nil) {
+		require.NoError(t, err)
+		assert.EqualValues(t, 0xff, f.Mark)
+		n++
+	}
+	assert.Equal(t, numFlows, n)
+
+	// Stop after the first Flow, the rest of the dump must be discarded.
+	n = 0
+	for _, err := range c.DumpFilterSeq(NewFilter().Mark(0xff), nil) {
+		require.NoError(t, err)
+		n++
+		break
+	}
+	assert.Equal(t, 1, n)
+
+	flows, err := c.Dump(nil)
+	require.NoError(t, err, "dumping after stopping a streaming dump")
+	assert.Len(t, flows, numFlows)
+
+	// Nil filter is yielded as an error.
+	for _, err := range c.DumpFilterSeq(nil, nil) {
+		require.Error(t, err)
+	}
+}
+
+// Cancels a context in the middle of a dump and makes sure the Conn remains
+// usable afterwards.
+func TestConnDumpContext(t *testing.T) {
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	numFlows := 1337
+
+	for i := 1; i <= numFlows; i++ {
+		f := NewFlow(6, 0, netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), 1234, uint16(i), 120, 0)
+		require.NoError(t, c.Create(f), "creating flow", i)
+	}
+
+	// Operations on a cancelled context fail without touching the socket.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = c.DumpContext(ctx, nil)
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, c.FlushContext(ctx), context.Canceled)
+
+	// Cancel the context after receiving the first Flow. The remainder of the
+	// dump is left behind in the socket.
+	ctx, cancel = context.WithCancel(context.Background())
+	var n int
+	var dumpErr error
+	for _, err := range c.DumpSeqContext(ctx, nil) {
+		if err != nil {
+			dumpErr = err
+			break
+		}
+		n++
+		cancel()
+	}
+	require.ErrorIs(t, dumpErr, context.Canceled)
+	assert.Less(t, n, numFlows)
+
+	// Leftover replies to the interrupted dump must be skipped.
+	flows, err := c.DumpContext(context.Background(), nil)
+	require.NoError(t, err, "dumping after cancelled dump")
+	assert.Len(t, flows, numFlows)
+
+	// An expired deadline yields context.DeadlineExceeded.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, err = c.GetContext(ctx, flows[0])
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
 // Creates IPv4 and IPv6 flows with connmarks and queries them using a filtered dump.
 func TestConnDumpFilter(t *testing.T) {
 	if !findKsym("ctnetlink_alloc_filter") {
@@ -414,6 +670,32 @@ func BenchmarkCreateDeleteFlow(b *testing.B) {
 	}
 }
 
+func BenchmarkCreateDeleteBatch(b *testing.B) {
+
+	b.ReportAllocs()
+
+	c, _, err := makeNSConn()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	flows := make([]Flow, batchSize)
+	for i := range flows {
+		flows[i] = NewFlow(6, 0, netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), 1234, uint16(i+1), 120, 0)
+	}
+
+	// Each iteration creates and deletes a single Flow, like BenchmarkCreateDeleteFlow.
+	for n := 0; n < b.N; n += len(flows) {
+		batch := flows[:min(len(flows), b.N-n)]
+		if _, err := c.CreateBatch(batch); err != nil {
+			b.Fatalf("creating flows: %s", err)
+		}
+		if _, err := c.DeleteBatch(batch); err != nil {
+			b.Fatalf("deleting flows: %s", err)
+		}
+	}
+}
+
 func TestZoneFilter(t *testing.T) {
 	c, _, err := makeNSConn()
 	require.NoError(t, err)
@@ -523,3 +805,159 @@ func TestFamilyFilter(t *testing.T) {
 	assert.Len(t, flows, 1)
 	assert.Equal(t, flows[0].TupleOrig.IP.SourceAddress, netip.MustParseAddr("2a00:1450:400e:804::200e"))
 }
+
+func TestTupleFilter(t *testing.T) {
+	if !findKsym("ctnetlink_parse_tuple_filter") {
+		t.Skip("tuple filters not supported in this kernel")
+	}
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	src, dst := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	require.NoError(t, c.Create(NewFlow(unix.IPPROTO_TCP, 0, src, dst, 1234, 443, 120, 0)))
+	require.NoError(t, c.Create(NewFlow(unix.IPPROTO_TCP, 0, src, dst, 1234, 80, 120, 0)))
+	require.NoError(t, c.Create(NewFlow(unix.IPPROTO_UDP, 0, src, dst, 1234, 443, 120, 0)))
+	require.NoError(t, c.Create(NewFlow(unix.IPPROTO_TCP, 0, dst, src, 1234, 443, 120, 0)))
+	require.NoError(t, c.Create(NewFlow(unix.IPPROTO_TCP, 0,
+		netip.MustParseAddr("2a00:1450:400e:804::200e"), netip.MustParseAddr("2a00:1450:400e:804::200f"), 1234, 443, 120, 0)))
+
+	// conntrack -L -s 10.0.0.1 -p tcp --dport 443
+	flows, err := c.DumpFilter(NewFilter().OrigSource(src).Protocol(unix.IPPROTO_TCP).OrigDestinationPort(443), nil)
+	require.NoError(t, err)
+	require.Len(t, flows, 1)
+	assert.Equal(t, uint8(unix.IPPROTO_TCP), flows[0].TupleOrig.Proto.Protocol)
+	assert.Equal(t, uint16(443), flows[0].TupleOrig.Proto.DestinationPort)
+
+	flows, err = c.DumpFilter(NewFilter().OrigSource(src), nil)
+	require.NoError(t, err)
+	assert.Len(t, flows, 3)
+
+	flows, err = c.DumpFilter(NewFilter().ReplySource(src), nil)
+	require.NoError(t, err)
+	require.Len(t, flows, 1)
+	assert.Equal(t, dst, flows[0].TupleOrig.IP.SourceAddress)
+
+	flows, err = c.DumpFilter(NewFilter().Family(netfilter.ProtoIPv6).Protocol(unix.IPPROTO_TCP).ReplySourcePort(443), nil)
+	require.NoError(t, err)
+	assert.Len(t, flows, 1)
+
+	_, err = c.DumpFilter(NewFilter().OrigSourcePort(1234), nil)
+	assert.ErrorIs(t, err, errFilterFamily)
+
+	// Requires Linux 6.3, older kernels ignore CTA_FILTER and flush the whole table.
+	require.NoError(t, c.FlushFilter(NewFilter().Family(netfilter.ProtoIPv4).Protocol(unix.IPPROTO_UDP)))
+
+	flows, err = c.Dump(nil)
+	require.NoError(t, err)
+	assert.Len(t, flows, 4)
+	for _, f := range flows {
+		assert.Equal(t, uint8(unix.IPPROTO_TCP), f.TupleOrig.Proto.Protocol)
+	}
+}
+
+func TestConnDumpDyingUnconfirmed(t *testing.T) {
+	c, nsid, err := makeNSConn()
+	require.NoError(t, err)
+
+	// Flows created over Netlink are confirmed immediately and don't appear on
+	// the unconfirmed list.
+	for _, err := range c.DumpUnconfirmedSeq() {
+		require.NoError(t, err)
+	}
+
+	// Flows whose destroy event can't be delivered to a listener requesting
+	// broadcast errors are kept on the dying list until redelivery succeeds.
+	// Listeners must be subscribed when Flows are created for the kernel to
+	// track their events.
+	lc, err := Dial(&netlink.Config{NetNS: nsid})
+	require.NoError(t, err)
+	defer lc.Close()
+	require.NoError(t, lc.conn.SetOption(netlink.BroadcastError, true))
+	require.NoError(t, lc.SetReadBuffer(1))
+	require.NoError(t, lc.joinGroups([]netfilter.NetlinkGroup{netfilter.GroupCTDestroy}))
+
+	const numFlows = 64
+	var flows []Flow
+	for i := range numFlows {
+		f := NewFlow(unix.IPPROTO_TCP, 0, netip.MustParseAddr("1.2.3.4"),
+			netip.MustParseAddr("5.6.7.8"), uint16(1000+i), 80, 120, 0)
+		require.NoError(t, c.Create(f))
+		flows = append(flows, f)
+	}
+
+	// Nobody reads the listener's events, so its buffer fills up and later
+	// destroy events fail.
+	for _, f := range flows {
+		require.NoError(t, c.Delete(f))
+	}
+
+	dying, err := c.DumpDying()
+	require.NoError(t, err)
+	require.NotEmpty(t, dying)
+	for _, d := range dying {
+		i := int(d.TupleOrig.Proto.SourcePort) - 1000
+		require.True(t, i >= 0 && i < numFlows, "unexpected dying Flow with source port %d", d.TupleOrig.Proto.SourcePort)
+		assert.Equal(t, flows[i].TupleOrig, d.TupleOrig)
+		assert.Equal(t, flows[i].TupleReply, d.TupleReply)
+	}
+
+	var n int
+	for _, err := range c.DumpDyingSeq() {
+		require.NoError(t, err)
+		n++
+	}
+	assert.Equal(t, len(dying), n)
+
+	// The Conn remains usable for regular dumps.
+	regular, err := c.Dump(nil)
+	require.NoError(t, err)
+	assert.Empty(t, regular)
+}
+
+func TestConnUpdateLabels(t *testing.T) {
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	f := NewFlow(unix.IPPROTO_TCP, 0, netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), 1234, 80, 120, 0)
+	require.NoError(t, c.Create(f))
+
+	l, err := NewLabels(1, 100)
+	require.NoError(t, err)
+
+	// Labels can't be filtered on in the kernel.
+	assert.ErrorIs(t, c.FlushFilter(NewFilter().Labels(l)), errFilterLabels)
+
+	// Without a ruleset using connlabels, connections don't carry labels.
+	err = c.UpdateLabels(f, l, nil)
+	if errors.Is(err, unix.ENOSPC) {
+		flows, err := c.DumpFilter(NewFilter().Labels(l), nil)
+		require.NoError(t, err)
+		assert.Empty(t, flows)
+
+		t.Skip("connlabels not in use in network namespace")
+	}
+	require.NoError(t, err)
+
+	other, err := NewLabels(2)
+	require.NoError(t, err)
+	require.NoError(t, c.UpdateLabels(f, other, nil))
+
+	qf, err := c.Get(f)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 100}, slices.Collect(qf.Labels.All()))
+
+	// Clearing a label leaves the others untouched.
+	require.NoError(t, c.UpdateLabels(f, nil, other))
+	qf, err = c.Get(f)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 100}, slices.Collect(qf.Labels.All()))
+
+	flows, err := c.DumpFilter(NewFilter().Labels(l), nil)
+	require.NoError(t, err)
+	assert.Len(t, flows, 1)
+
+	flows, err = c.DumpFilter(NewFilter().Labels(other), nil)
+	require.NoError(t, err)
+	assert.Empty(t, flows)
+}
@@ -394,6 +394,14 @@ var (
 			name: "error unmarshal synproxy",
 			nfa:  netfilter.Attribute{Type: uint16(ctaSynProxy)},
 		},
+		{
+			name: "error unmarshal source nat",
+			nfa:  netfilter.Attribute{Type: uint16(ctaNatSrc)},
+		},
+		{
+			name: "error unmarshal destination nat",
+			nfa:  netfilter.Attribute{Type: uint16(ctaNatDst)},
+		},
 	}
 )
 
@@ -415,6 +423,33 @@ func TestFlowUnmarshal(t *testing.T) {
 	}
 }
 
+func TestFlowUnmarshalDecodeError(t *testing.T) {
+	var f Flow
+	err := f.unmarshal(mustDecodeAttributes([]netfilter.Attribute{{
+		Type:   uint16(ctaTupleOrig),
+		Nested: true,
+		Children: []netfilter.Attribute{
+			{
+				Type:     uint16(ctaTupleIP),
+				Nested:   true,
+				Children: []netfilter.Attribute{{Type: 255}, {Type: 254}},
+			},
+			{Type: uint16(ctaTupleZone), Data: []byte{0, 1}},
+		},
+	}}))
+
+	var de *DecodeError
+	require.ErrorAs(t, err, &de)
+	assert.Equal(t, []string{"CTA_TUPLE_ORIG", "CTA_TUPLE_IP"}, de.Path)
+	assert.ErrorIs(t, err, errIncorrectSize)
+	assert.Equal(t, "decode CTA_TUPLE_ORIG/CTA_TUPLE_IP: binary attribute data has incorrect size", err.Error())
+
+	// Errors in top-level attributes have an empty Path.
+	err = f.unmarshal(mustDecodeAttributes([]netfilter.Attribute{{Type: uint16(ctaMark), Data: []byte{1}}}))
+	require.ErrorAs(t, err, &de)
+	assert.Empty(t, de.Path)
+}
+
 func TestFlowMarshal(t *testing.T) {
 	// Expect a marshal without errors
 	attrs, err := Flow{
@@ -459,7 +494,7 @@ func TestFlowMarshal(t *testing.T) {
 				{Type: uint16(ctaProtoInfoTCPWScaleOriginal), Data: []byte{0x0}},
 				{Type: uint16(ctaProtoInfoTCPWScaleReply), Data: []byte{0x0}}}}}},
 		{Type: uint16(ctaHelp), Nested: true, Children: []netfilter.Attribute{
-			{Type: uint16(ctaHelpName), Data: []byte{0x66, 0x74, 0x70}}}},
+			{Type: uint16(ctaHelpName), Data: []byte{0x66, 0x74, 0x70, 0x00}}}},
 		{Type: uint16(ctaTupleMaster), Nested: true, Children: []netfilter.Attribute{
 			{Type: uint16(ctaTupleIP), Nested: true, Children: []netfilter.Attribute{
 				{Type: uint16(ctaIPv4Src), Data: []byte{0x1, 0x2, 0x3, 0x4}},
@@ -504,6 +539,33 @@ func TestFlowMarshal(t *testing.T) {
 	assert.ErrorIs(t, err, errBadIPTuple)
 }
 
+func TestFlowMarshalNAT(t *testing.T) {
+	f := Flow{
+		TupleOrig: flowIPPT, TupleReply: flowIPPT,
+		NATSrc: NATRange{
+			MinAddr: netip.MustParseAddr("10.0.0.1"), MaxAddr: netip.MustParseAddr("10.0.0.2"),
+			MinPort: 1024, MaxPort: 65535,
+		},
+		NATDst: NATRange{MinAddr: netip.MustParseAddr("192.168.0.1"), MinPort: 8080},
+	}
+
+	attrs, err := f.marshal()
+	require.NoError(t, err)
+
+	// NAT setup round-trips through the Flow's attributes.
+	var uf Flow
+	require.NoError(t, uf.unmarshal(mustDecodeAttributes(attrs)))
+	assert.Equal(t, f, uf)
+
+	f.NATDst.MaxAddr = netip.MustParseAddr("::1")
+	_, err = f.marshal()
+	assert.ErrorIs(t, err, errBadNATRange)
+
+	f.NATSrc.MinAddr = netip.MustParseAddr("::1")
+	_, err = f.marshal()
+	assert.ErrorIs(t, err, errBadNATRange)
+}
+
 func TestUnmarshalFlowsError(t *testing.T) {
 	// Use netfilter.MarshalNetlink to assemble a Netlink message with a single attribute with empty data.
 	// Cause a random error in unmarshalFlows to cover error return.
@@ -0,0 +1,14 @@
+// Package flowexport exports conntrack Flows as IPFIX (RFC 7011) or NetFlow v9
+// (RFC 3954) flow records over UDP.
+//
+// Each Flow is exported as one record for its original direction and, once
+// the connection has seen a reply, one record for its reply direction. Records
+// carry the Flow's addresses, ports, protocol, packet and byte counters and
+// start and end times, as well as the addresses and ports after NAT, derived
+// from the tuple of the opposite direction. Packet and byte counters require
+// conntrack accounting to be enabled (nf_conntrack_acct), start and end times
+// require conntrack timestamps (nf_conntrack_timestamp).
+//
+// The typical source of Flows are the destroy events received by
+// [conntrack.Conn.Listen], see [Exporter.ExportEvents].
+package flowexport
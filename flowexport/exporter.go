@@ -0,0 +1,377 @@
+package flowexport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ti-mo/conntrack"
+)
+
+// Version is the export protocol version, as sent in message headers.
+type Version uint16
+
+const (
+	// NetFlowV9 is Cisco NetFlow version 9, RFC 3954.
+	NetFlowV9 Version = 9
+	// IPFIX is the IP Flow Information Export protocol, RFC 7011.
+	IPFIX Version = 10
+)
+
+const (
+	// DefaultTemplateRefresh is the default interval at which templates are
+	// resent.
+	DefaultTemplateRefresh = time.Minute
+
+	// DefaultMaxMessageSize is the default maximum size of an export message,
+	// fitting into a single unfragmented UDP datagram on common links.
+	DefaultMaxMessageSize = 1400
+
+	// minMessageSize is the smallest message able to hold the templates and
+	// a data record.
+	minMessageSize = 512
+)
+
+// Set IDs of template sets.
+const (
+	setIDTemplateV9    = 0
+	setIDTemplateIPFIX = 2
+)
+
+var (
+	errVersion     = errors.New("Config needs Version IPFIX or NetFlowV9")
+	errMessageSize = fmt.Errorf("Config needs a MaxMessageSize of at least %d bytes", minMessageSize)
+)
+
+// Config configures an Exporter. The zero value exports IPFIX using the
+// defaults of all fields.
+type Config struct {
+	// Version is the export protocol, IPFIX if zero.
+	Version Version
+
+	// ObservationDomainID identifies the exporter to the collector, it is
+	// sent as the Source ID in NetFlow v9.
+	ObservationDomainID uint32
+
+	// TemplateRefresh is the interval at which templates are resent, since
+	// collectors may miss them over UDP. Defaults to
+	// [DefaultTemplateRefresh].
+	TemplateRefresh time.Duration
+
+	// MaxMessageSize is the maximum size of an export message in bytes.
+	// Defaults to [DefaultMaxMessageSize].
+	MaxMessageSize int
+}
+
+// Exporter sends Flows as IPFIX or NetFlow v9 records to a collector. It is
+// safe for concurrent use.
+type Exporter struct {
+	conn net.Conn
+	cfg  Config
+	tpls [2]template
+
+	// now returns the current time, overridden in tests.
+	now func() time.Time
+
+	mu sync.Mutex
+	// boot is the time the Exporter was created, the reference for NetFlow
+	// v9's system uptime.
+	boot time.Time
+	// seq is the sequence number of the next message: the amount of data
+	// records sent for IPFIX, the amount of messages sent for NetFlow v9.
+	seq uint32
+	// lastTemplates is when templates were last sent.
+	lastTemplates time.Time
+}
+
+// Dial returns an Exporter sending records to the collector at the UDP address
+// addr, like `192.0.2.1:4739`. cfg may be nil to use the defaults.
+func Dial(addr string, cfg *Config) (*Exporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := NewExporter(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// NewExporter returns an Exporter sending records over conn, which must
+// preserve message boundaries, like a connected UDP socket. The Exporter takes
+// ownership of conn. cfg may be nil to use the defaults.
+func NewExporter(conn net.Conn, cfg *Config) (*Exporter, error) {
+	var c Config
+	if cfg != nil {
+		c = *cfg
+	}
+
+	if c.Version == 0 {
+		c.Version = IPFIX
+	}
+	if c.Version != IPFIX && c.Version != NetFlowV9 {
+		return nil, errVersion
+	}
+	if c.TemplateRefresh <= 0 {
+		c.TemplateRefresh = DefaultTemplateRefresh
+	}
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if c.MaxMessageSize < minMessageSize {
+		return nil, errMessageSize
+	}
+
+	return &Exporter{
+		conn: conn,
+		cfg:  c,
+		tpls: templates(c.Version),
+		now:  time.Now,
+		boot: time.Now(),
+	}, nil
+}
+
+// Close closes the Exporter's connection.
+func (e *Exporter) Close() error {
+	return e.conn.Close()
+}
+
+// Export sends the records of the given Flows to the collector, split over as
+// many messages as needed. Templates are sent along if they haven't been sent
+// within the configured TemplateRefresh interval.
+func (e *Exporter) Export(flows ...conntrack.Flow) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+
+	m := e.newMessage(now)
+	for _, f := range flows {
+		for _, r := range records(f, now) {
+			t := e.tpls[0]
+			if r.ipv6 {
+				t = e.tpls[1]
+			}
+
+			if !m.fits(t) {
+				if err := e.send(m); err != nil {
+					return err
+				}
+				m = e.newMessage(now)
+			}
+			m.addRecord(t, r, e.boot)
+		}
+	}
+
+	if m.records == 0 && !m.templates {
+		return nil
+	}
+
+	return e.send(m)
+}
+
+// SendTemplates sends the templates to the collector, regardless of when they
+// were last sent.
+func (e *Exporter) SendTemplates() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.lastTemplates = time.Time{}
+	return e.send(e.newMessage(e.now()))
+}
+
+// refreshTemplates sends the templates if they are due.
+func (e *Exporter) refreshTemplates() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	m := e.newMessage(e.now())
+	if !m.templates {
+		return nil
+	}
+
+	return e.send(m)
+}
+
+// ExportEvents exports the Flows of destroy events received on events, as
+// sent by [conntrack.Conn.Listen] when subscribed to
+// [github.com/ti-mo/netfilter.GroupCTDestroy]. Other events are ignored.
+// Templates are refreshed periodically, even while no events are received.
+//
+// ExportEvents blocks until events is closed, returning nil, ctx is cancelled,
+// returning ctx.Err(), or a message can't be sent.
+func (e *Exporter) ExportEvents(ctx context.Context, events <-chan conntrack.Event) error {
+	t := time.NewTicker(e.cfg.TemplateRefresh)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			if err := e.refreshTemplates(); err != nil {
+				return err
+			}
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if ev.Type != conntrack.EventDestroy || ev.Flow == nil {
+				continue
+			}
+			if err := e.Export(*ev.Flow); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// message is an export message being built.
+type message struct {
+	version Version
+	buf     []byte
+	max     int
+
+	// set is the offset of the current data set's header in buf, or 0 if no
+	// data set is open.
+	set   int
+	setID uint16
+
+	// records counts the data records in the message, count all records
+	// including templates for NetFlow v9's header.
+	records, count int
+	templates      bool
+}
+
+// headerSize returns the size of a message header.
+func (v Version) headerSize() int {
+	if v == NetFlowV9 {
+		return 20
+	}
+
+	return 16
+}
+
+// newMessage starts a new message, including the templates if they are due.
+func (e *Exporter) newMessage(now time.Time) *message {
+	v := e.cfg.Version
+	m := &message{version: v, max: e.cfg.MaxMessageSize, buf: make([]byte, v.headerSize(), e.cfg.MaxMessageSize)}
+
+	if e.lastTemplates.IsZero() || now.Sub(e.lastTemplates) >= e.cfg.TemplateRefresh {
+		m.addTemplates(e.tpls[:])
+	}
+
+	return m
+}
+
+// addTemplates appends a template set holding tpls.
+func (m *message) addTemplates(tpls []template) {
+	id := uint16(setIDTemplateIPFIX)
+	if m.version == NetFlowV9 {
+		id = setIDTemplateV9
+	}
+
+	start := len(m.buf)
+	m.buf = binary.BigEndian.AppendUint16(m.buf, id)
+	m.buf = binary.BigEndian.AppendUint16(m.buf, 0)
+	for _, t := range tpls {
+		m.buf = binary.BigEndian.AppendUint16(m.buf, t.id)
+		m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(len(t.fields)))
+		for _, f := range t.fields {
+			m.buf = binary.BigEndian.AppendUint16(m.buf, f.id)
+			m.buf = binary.BigEndian.AppendUint16(m.buf, f.length)
+		}
+		m.count++
+	}
+	binary.BigEndian.PutUint16(m.buf[start+2:], uint16(len(m.buf)-start))
+
+	m.templates = true
+}
+
+// fits returns true if a data record of template t fits into the message.
+func (m *message) fits(t template) bool {
+	n := len(m.buf) + t.size()
+	if m.set == 0 || m.setID != t.id {
+		n += 4
+	}
+	// NetFlow v9 sets are padded to 4 bytes.
+	if m.version == NetFlowV9 {
+		n += 3
+	}
+
+	return n <= m.max
+}
+
+// addRecord appends a data record of template t, opening a new data set if
+// needed.
+func (m *message) addRecord(t template, r record, boot time.Time) {
+	if m.set == 0 || m.setID != t.id {
+		m.closeSet()
+		m.set, m.setID = len(m.buf), t.id
+		m.buf = binary.BigEndian.AppendUint16(m.buf, t.id)
+		m.buf = binary.BigEndian.AppendUint16(m.buf, 0)
+	}
+
+	m.buf = appendRecord(m.buf, t, r, boot)
+	m.records++
+	m.count++
+}
+
+// closeSet finishes the current data set, if any.
+func (m *message) closeSet() {
+	if m.set == 0 {
+		return
+	}
+
+	if m.version == NetFlowV9 {
+		for (len(m.buf)-m.set)%4 != 0 {
+			m.buf = append(m.buf, 0)
+		}
+	}
+	binary.BigEndian.PutUint16(m.buf[m.set+2:], uint16(len(m.buf)-m.set))
+	m.set = 0
+}
+
+// send finishes the message's header and sends it.
+func (e *Exporter) send(m *message) error {
+	m.closeSet()
+
+	now := e.now()
+	h := m.buf
+	binary.BigEndian.PutUint16(h[0:], uint16(m.version))
+	if m.version == NetFlowV9 {
+		binary.BigEndian.PutUint16(h[2:], uint16(m.count))
+		binary.BigEndian.PutUint32(h[4:], uint32(max(now.Sub(e.boot).Milliseconds(), 0)))
+		binary.BigEndian.PutUint32(h[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(h[12:], e.seq)
+		binary.BigEndian.PutUint32(h[16:], e.cfg.ObservationDomainID)
+	} else {
+		binary.BigEndian.PutUint16(h[2:], uint16(len(m.buf)))
+		binary.BigEndian.PutUint32(h[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(h[8:], e.seq)
+		binary.BigEndian.PutUint32(h[12:], e.cfg.ObservationDomainID)
+	}
+
+	if _, err := e.conn.Write(m.buf); err != nil {
+		return fmt.Errorf("send export message: %w", err)
+	}
+
+	if m.version == NetFlowV9 {
+		e.seq++
+	} else {
+		e.seq += uint32(m.records)
+	}
+	if m.templates {
+		e.lastTemplates = now
+	}
+
+	return nil
+}
@@ -0,0 +1,306 @@
+package flowexport
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/ti-mo/conntrack"
+)
+
+// testMessage is a decoded export message.
+type testMessage struct {
+	version   uint16
+	count     uint16
+	uptime    uint32
+	seq       uint32
+	domain    uint32
+	templates map[uint16][]field
+	// records holds the fields of all data records keyed by Information
+	// Element, in the order they were received.
+	records []map[uint16][]byte
+	setIDs  []uint16
+}
+
+// decodeMessage decodes an export message, using the templates in tpls to
+// decode data sets. Templates found in the message are added to tpls.
+func decodeMessage(t *testing.T, b []byte, tpls map[uint16][]field) testMessage {
+	t.Helper()
+
+	m := testMessage{version: binary.BigEndian.Uint16(b), templates: map[uint16][]field{}}
+
+	var sets []byte
+	switch m.version {
+	case uint16(IPFIX):
+		require.Equal(t, len(b), int(binary.BigEndian.Uint16(b[2:])), "message length")
+		m.seq = binary.BigEndian.Uint32(b[8:])
+		m.domain = binary.BigEndian.Uint32(b[12:])
+		sets = b[16:]
+	case uint16(NetFlowV9):
+		m.count = binary.BigEndian.Uint16(b[2:])
+		m.uptime = binary.BigEndian.Uint32(b[4:])
+		m.seq = binary.BigEndian.Uint32(b[12:])
+		m.domain = binary.BigEndian.Uint32(b[16:])
+		sets = b[20:]
+	default:
+		t.Fatalf("unknown version %d", m.version)
+	}
+
+	for len(sets) > 0 {
+		require.GreaterOrEqual(t, len(sets), 4)
+		id, length := binary.BigEndian.Uint16(sets), int(binary.BigEndian.Uint16(sets[2:]))
+		require.LessOrEqual(t, length, len(sets))
+		body := sets[4:length]
+		sets = sets[length:]
+		m.setIDs = append(m.setIDs, id)
+
+		if id == setIDTemplateIPFIX || id == setIDTemplateV9 {
+			for len(body) > 0 {
+				tid, n := binary.BigEndian.Uint16(body), int(binary.BigEndian.Uint16(body[2:]))
+				body = body[4:]
+				var fs []field
+				for range n {
+					fs = append(fs, field{binary.BigEndian.Uint16(body), binary.BigEndian.Uint16(body[2:])})
+					body = body[4:]
+				}
+				m.templates[tid] = fs
+				tpls[tid] = fs
+			}
+			continue
+		}
+
+		fs, ok := tpls[id]
+		require.True(t, ok, "data set %d without template", id)
+		size := template{fields: fs}.size()
+		for len(body) >= size {
+			rec := map[uint16][]byte{}
+			for _, f := range fs {
+				rec[f.id] = body[:f.length]
+				body = body[f.length:]
+			}
+			m.records = append(m.records, rec)
+		}
+		// Only padding may remain.
+		assert.Equal(t, make([]byte, len(body)), body)
+	}
+
+	return m
+}
+
+// listen returns a UDP listener and an Exporter sending to it.
+func listen(t *testing.T, cfg *Config) (net.PacketConn, *Exporter) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+
+	e, err := Dial(pc.LocalAddr().String(), cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { e.Close() })
+
+	return pc, e
+}
+
+// receive reads a single message from pc.
+func receive(t *testing.T, pc net.PacketConn) []byte {
+	t.Helper()
+
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(5*time.Second)))
+	b := make([]byte, 65535)
+	n, _, err := pc.ReadFrom(b)
+	require.NoError(t, err)
+
+	return b[:n]
+}
+
+// natFlow returns a TCP Flow from 10.0.0.1:1234 to 198.51.100.1:80, source
+// NATed to 192.0.2.1:40000.
+func natFlow() conntrack.Flow {
+	f := conntrack.NewFlow(unix.IPPROTO_TCP, conntrack.StatusConfirmed|conntrack.StatusSeenReply,
+		netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("198.51.100.1"), 1234, 80, 0, 0)
+	f.TupleReply.IP.DestinationAddress = netip.MustParseAddr("192.0.2.1")
+	f.TupleReply.Proto.DestinationPort = 40000
+	f.CountersOrig = conntrack.Counter{Packets: 10, Bytes: 1000}
+	f.CountersReply = conntrack.Counter{Direction: true, Packets: 8, Bytes: 2000}
+	f.Timestamp = conntrack.Timestamp{Start: time.UnixMilli(1700000000000), Stop: time.UnixMilli(1700000005000)}
+
+	return f
+}
+
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+func TestExportIPFIX(t *testing.T) {
+	pc, e := listen(t, &Config{ObservationDomainID: 42})
+
+	now := time.Unix(1700000010, 0)
+	e.now = func() time.Time { return now }
+
+	icmp := conntrack.NewFlow(unix.IPPROTO_ICMPV6, conntrack.StatusConfirmed,
+		netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2"), 0, 0, 0, 0)
+	icmp.TupleOrig.Proto.ICMPType, icmp.TupleOrig.Proto.ICMPCode = 128, 1
+
+	require.NoError(t, e.Export(natFlow(), icmp))
+
+	tpls := map[uint16][]field{}
+	m := decodeMessage(t, receive(t, pc), tpls)
+	assert.Equal(t, uint16(IPFIX), m.version)
+	assert.Equal(t, uint32(0), m.seq)
+	assert.Equal(t, uint32(42), m.domain)
+	assert.Equal(t, []uint16{setIDTemplateIPFIX, templateIDv4, templateIDv6}, m.setIDs)
+	require.Len(t, m.templates, 2)
+	assert.Len(t, m.templates[templateIDv4], 15)
+	assert.Contains(t, m.templates[templateIDv4], field{ieFlowStartMilliseconds, 8})
+	assert.Contains(t, m.templates[templateIDv6], field{iePostNATSourceIPv6Address, 16})
+	require.Len(t, m.records, 3)
+
+	orig, reply, v6 := m.records[0], m.records[1], m.records[2]
+	assert.Equal(t, []byte{10, 0, 0, 1}, orig[ieSourceIPv4Address])
+	assert.Equal(t, []byte{198, 51, 100, 1}, orig[ieDestinationIPv4Address])
+	assert.Equal(t, be16(1234), orig[ieSourceTransportPort])
+	assert.Equal(t, be16(80), orig[ieDestinationTransportPort])
+	assert.Equal(t, []byte{unix.IPPROTO_TCP}, orig[ieProtocolIdentifier])
+	assert.Equal(t, []byte{192, 0, 2, 1}, orig[iePostNATSourceIPv4Address])
+	assert.Equal(t, []byte{198, 51, 100, 1}, orig[iePostNATDestinationIPv4Address])
+	assert.Equal(t, be16(40000), orig[iePostNAPTSourceTransportPort])
+	assert.Equal(t, be16(80), orig[iePostNAPTDestinationTransportPort])
+	assert.Equal(t, be64(1000), orig[ieOctetDeltaCount])
+	assert.Equal(t, be64(10), orig[iePacketDeltaCount])
+	assert.Equal(t, be64(1700000000000), orig[ieFlowStartMilliseconds])
+	assert.Equal(t, be64(1700000005000), orig[ieFlowEndMilliseconds])
+	assert.Equal(t, []byte{biflowInitiator}, orig[ieBiflowDirection])
+
+	// The reply direction is translated back to the original tuple.
+	assert.Equal(t, []byte{198, 51, 100, 1}, reply[ieSourceIPv4Address])
+	assert.Equal(t, []byte{192, 0, 2, 1}, reply[ieDestinationIPv4Address])
+	assert.Equal(t, be16(40000), reply[ieDestinationTransportPort])
+	assert.Equal(t, []byte{10, 0, 0, 1}, reply[iePostNATDestinationIPv4Address])
+	assert.Equal(t, be16(1234), reply[iePostNAPTDestinationTransportPort])
+	assert.Equal(t, be64(2000), reply[ieOctetDeltaCount])
+	assert.Equal(t, []byte{biflowReverseInitiator}, reply[ieBiflowDirection])
+
+	// Unreplied Flows only export their original direction, Flows without
+	// timestamps are given the export time.
+	assert.Equal(t, netip.MustParseAddr("2001:db8::1").AsSlice(), v6[ieSourceIPv6Address])
+	assert.Equal(t, be16(128<<8|1), v6[ieICMPTypeCodeIPv6])
+	assert.Equal(t, be16(0), v6[ieSourceTransportPort])
+	assert.Equal(t, be64(uint64(now.UnixMilli())), v6[ieFlowStartMilliseconds])
+
+	// Templates are only resent after the refresh interval, the sequence
+	// number counts data records.
+	require.NoError(t, e.Export(natFlow()))
+	m = decodeMessage(t, receive(t, pc), tpls)
+	assert.Equal(t, []uint16{templateIDv4}, m.setIDs)
+	assert.Equal(t, uint32(3), m.seq)
+
+	now = now.Add(DefaultTemplateRefresh)
+	require.NoError(t, e.Export(natFlow()))
+	m = decodeMessage(t, receive(t, pc), tpls)
+	assert.Equal(t, []uint16{setIDTemplateIPFIX, templateIDv4}, m.setIDs)
+	assert.Equal(t, uint32(5), m.seq)
+
+	// Nothing is sent without Flows if templates aren't due.
+	require.NoError(t, e.Export())
+	require.NoError(t, e.SendTemplates())
+	m = decodeMessage(t, receive(t, pc), tpls)
+	assert.Equal(t, []uint16{setIDTemplateIPFIX}, m.setIDs)
+}
+
+func TestExportNetFlowV9(t *testing.T) {
+	pc, e := listen(t, &Config{Version: NetFlowV9, ObservationDomainID: 7})
+
+	boot := e.boot
+	e.now = func() time.Time { return boot.Add(10 * time.Second) }
+
+	f := natFlow()
+	f.Timestamp = conntrack.Timestamp{Start: boot.Add(time.Second), Stop: boot.Add(2 * time.Second)}
+	require.NoError(t, e.Export(f))
+
+	tpls := map[uint16][]field{}
+	m := decodeMessage(t, receive(t, pc), tpls)
+	assert.Equal(t, uint16(NetFlowV9), m.version)
+	assert.Equal(t, uint16(4), m.count, "two templates and two records")
+	assert.Equal(t, uint32(10000), m.uptime)
+	assert.Equal(t, uint32(0), m.seq)
+	assert.Equal(t, uint32(7), m.domain)
+	assert.Equal(t, []uint16{setIDTemplateV9, templateIDv4}, m.setIDs)
+	assert.Contains(t, m.templates[templateIDv4], field{ieFirstSwitched, 4})
+	require.Len(t, m.records, 2)
+	assert.Equal(t, []byte{0, 0, 0x03, 0xe8}, m.records[0][ieFirstSwitched])
+	assert.Equal(t, []byte{0, 0, 0x07, 0xd0}, m.records[0][ieLastSwitched])
+
+	// The sequence number counts messages.
+	require.NoError(t, e.Export(f))
+	m = decodeMessage(t, receive(t, pc), tpls)
+	assert.Equal(t, uint32(1), m.seq)
+	assert.Equal(t, uint16(2), m.count)
+}
+
+func TestExportSplit(t *testing.T) {
+	pc, e := listen(t, &Config{MaxMessageSize: minMessageSize})
+
+	flows := make([]conntrack.Flow, 20)
+	for i := range flows {
+		flows[i] = natFlow()
+	}
+	require.NoError(t, e.Export(flows...))
+
+	tpls := map[uint16][]field{}
+	var records int
+	for records < 40 {
+		b := receive(t, pc)
+		assert.LessOrEqual(t, len(b), minMessageSize)
+		records += len(decodeMessage(t, b, tpls).records)
+	}
+	assert.Equal(t, 40, records)
+}
+
+func TestExportEvents(t *testing.T) {
+	pc, e := listen(t, nil)
+
+	f := natFlow()
+	events := make(chan conntrack.Event, 2)
+	events <- conntrack.Event{Type: conntrack.EventNew, Flow: &f}
+	events <- conntrack.Event{Type: conntrack.EventDestroy, Flow: &f}
+	close(events)
+
+	require.NoError(t, e.ExportEvents(context.Background(), events))
+
+	m := decodeMessage(t, receive(t, pc), map[uint16][]field{})
+	assert.Len(t, m.records, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, e.ExportEvents(ctx, make(chan conntrack.Event)), context.Canceled)
+}
+
+func TestExportEventsTemplateRefresh(t *testing.T) {
+	pc, e := listen(t, &Config{TemplateRefresh: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = e.ExportEvents(ctx, make(chan conntrack.Event)) }()
+
+	// Templates are sent without any events.
+	m := decodeMessage(t, receive(t, pc), map[uint16][]field{})
+	assert.Equal(t, []uint16{setIDTemplateIPFIX}, m.setIDs)
+}
+
+func TestNewExporterError(t *testing.T) {
+	_, err := NewExporter(nil, &Config{Version: 5})
+	assert.ErrorIs(t, err, errVersion)
+
+	_, err = NewExporter(nil, &Config{MaxMessageSize: 100})
+	assert.ErrorIs(t, err, errMessageSize)
+
+	_, err = Dial("127.0.0.1:0", &Config{Version: 5})
+	assert.ErrorIs(t, err, errVersion)
+}
@@ -0,0 +1,240 @@
+package flowexport
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/ti-mo/conntrack"
+)
+
+// Information Elements used in templates, see the IANA IPFIX Information
+// Elements registry. NetFlow v9 uses the same field type numbers, except for
+// the flow start and end times.
+const (
+	ieOctetDeltaCount                  = 1
+	iePacketDeltaCount                 = 2
+	ieProtocolIdentifier               = 4
+	ieSourceTransportPort              = 7
+	ieSourceIPv4Address                = 8
+	ieDestinationTransportPort         = 11
+	ieDestinationIPv4Address           = 12
+	ieLastSwitched                     = 21 // NetFlow v9 LAST_SWITCHED
+	ieFirstSwitched                    = 22 // NetFlow v9 FIRST_SWITCHED
+	ieSourceIPv6Address                = 27
+	ieDestinationIPv6Address           = 28
+	ieICMPTypeCodeIPv4                 = 32
+	ieICMPTypeCodeIPv6                 = 139
+	ieFlowStartMilliseconds            = 152
+	ieFlowEndMilliseconds              = 153
+	iePostNATSourceIPv4Address         = 225
+	iePostNATDestinationIPv4Address    = 226
+	iePostNAPTSourceTransportPort      = 227
+	iePostNAPTDestinationTransportPort = 228
+	ieBiflowDirection                  = 239
+	iePostNATSourceIPv6Address         = 281
+	iePostNATDestinationIPv6Address    = 282
+)
+
+// Values of the biflowDirection Information Element.
+const (
+	biflowInitiator        = 1
+	biflowReverseInitiator = 2
+)
+
+// Template IDs of the IPv4 and IPv6 templates. IDs below 256 are reserved for
+// set IDs.
+const (
+	templateIDv4 = 256
+	templateIDv6 = 257
+)
+
+// field is a template field, an Information Element and its length in bytes.
+type field struct {
+	id, length uint16
+}
+
+// template describes the layout of data records.
+type template struct {
+	id     uint16
+	fields []field
+}
+
+// size returns the size of a data record of the template in bytes.
+func (t template) size() int {
+	var n int
+	for _, f := range t.fields {
+		n += int(f.length)
+	}
+
+	return n
+}
+
+// templates returns the IPv4 and IPv6 templates used by the given protocol
+// version.
+func templates(v Version) [2]template {
+	start, end := field{ieFlowStartMilliseconds, 8}, field{ieFlowEndMilliseconds, 8}
+	if v == NetFlowV9 {
+		start, end = field{ieFirstSwitched, 4}, field{ieLastSwitched, 4}
+	}
+
+	fields := func(src, dst, postSrc, postDst, addrLen, icmp uint16) []field {
+		return []field{
+			{src, addrLen},
+			{dst, addrLen},
+			{ieSourceTransportPort, 2},
+			{ieDestinationTransportPort, 2},
+			{ieProtocolIdentifier, 1},
+			{icmp, 2},
+			{ieOctetDeltaCount, 8},
+			{iePacketDeltaCount, 8},
+			start,
+			end,
+			{postSrc, addrLen},
+			{postDst, addrLen},
+			{iePostNAPTSourceTransportPort, 2},
+			{iePostNAPTDestinationTransportPort, 2},
+			{ieBiflowDirection, 1},
+		}
+	}
+
+	v4 := fields(ieSourceIPv4Address, ieDestinationIPv4Address,
+		iePostNATSourceIPv4Address, iePostNATDestinationIPv4Address, 4, ieICMPTypeCodeIPv4)
+	v6 := fields(ieSourceIPv6Address, ieDestinationIPv6Address,
+		iePostNATSourceIPv6Address, iePostNATDestinationIPv6Address, 16, ieICMPTypeCodeIPv6)
+
+	return [2]template{{templateIDv4, v4}, {templateIDv6, v6}}
+}
+
+// record holds the values of a single unidirectional flow record.
+type record struct {
+	ipv6 bool
+
+	src, dst         netip.Addr
+	postSrc, postDst netip.Addr
+
+	sport, dport         uint16
+	postSport, postDport uint16
+
+	proto        uint8
+	icmpTypeCode uint16
+
+	octets, packets uint64
+	start, end      time.Time
+
+	direction uint8
+}
+
+// records converts a Flow into flow records: one for the original direction
+// and, if the Flow has seen a reply, one for the reply direction. NAT
+// information is derived from the tuple of the opposite direction. Flows
+// without timestamps are given the time now.
+func records(f conntrack.Flow, now time.Time) []record {
+	start, end := f.Timestamp.Start, f.Timestamp.Stop
+	if start.IsZero() {
+		start = now
+	}
+	if end.IsZero() {
+		end = now
+	}
+
+	dir := func(t, opposite conntrack.Tuple, c conntrack.Counter, direction uint8) record {
+		r := record{
+			ipv6:      t.IP.IsIPv6(),
+			src:       t.IP.SourceAddress,
+			dst:       t.IP.DestinationAddress,
+			postSrc:   opposite.IP.DestinationAddress,
+			postDst:   opposite.IP.SourceAddress,
+			proto:     t.Proto.Protocol,
+			octets:    c.Bytes,
+			packets:   c.Packets,
+			start:     start,
+			end:       end,
+			direction: direction,
+		}
+
+		switch t.Proto.Protocol {
+		case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+			r.icmpTypeCode = uint16(t.Proto.ICMPType)<<8 | uint16(t.Proto.ICMPCode)
+		default:
+			r.sport, r.dport = t.Proto.SourcePort, t.Proto.DestinationPort
+			r.postSport, r.postDport = opposite.Proto.DestinationPort, opposite.Proto.SourcePort
+		}
+
+		return r
+	}
+
+	out := []record{dir(f.TupleOrig, f.TupleReply, f.CountersOrig, biflowInitiator)}
+	if f.Status.SeenReply() {
+		out = append(out, dir(f.TupleReply, f.TupleOrig, f.CountersReply, biflowReverseInitiator))
+	}
+
+	return out
+}
+
+// appendAddr appends the address a, which is zeroed if it isn't of the
+// expected length.
+func appendAddr(b []byte, a netip.Addr, length uint16) []byte {
+	if length == 4 && a.Is4() {
+		ip := a.As4()
+		return append(b, ip[:]...)
+	}
+	if length == 16 && a.Is6() {
+		ip := a.As16()
+		return append(b, ip[:]...)
+	}
+
+	return append(b, make([]byte, length)...)
+}
+
+// appendRecord appends the data record r laid out according to t. Flow start
+// and end times of NetFlow v9 are encoded relative to boot, the time the
+// Exporter was created.
+func appendRecord(b []byte, t template, r record, boot time.Time) []byte {
+	uptime := func(ts time.Time) uint32 {
+		return uint32(max(ts.Sub(boot).Milliseconds(), 0))
+	}
+
+	for _, f := range t.fields {
+		switch f.id {
+		case ieSourceIPv4Address, ieSourceIPv6Address:
+			b = appendAddr(b, r.src, f.length)
+		case ieDestinationIPv4Address, ieDestinationIPv6Address:
+			b = appendAddr(b, r.dst, f.length)
+		case iePostNATSourceIPv4Address, iePostNATSourceIPv6Address:
+			b = appendAddr(b, r.postSrc, f.length)
+		case iePostNATDestinationIPv4Address, iePostNATDestinationIPv6Address:
+			b = appendAddr(b, r.postDst, f.length)
+		case ieSourceTransportPort:
+			b = binary.BigEndian.AppendUint16(b, r.sport)
+		case ieDestinationTransportPort:
+			b = binary.BigEndian.AppendUint16(b, r.dport)
+		case iePostNAPTSourceTransportPort:
+			b = binary.BigEndian.AppendUint16(b, r.postSport)
+		case iePostNAPTDestinationTransportPort:
+			b = binary.BigEndian.AppendUint16(b, r.postDport)
+		case ieProtocolIdentifier:
+			b = append(b, r.proto)
+		case ieICMPTypeCodeIPv4, ieICMPTypeCodeIPv6:
+			b = binary.BigEndian.AppendUint16(b, r.icmpTypeCode)
+		case ieOctetDeltaCount:
+			b = binary.BigEndian.AppendUint64(b, r.octets)
+		case iePacketDeltaCount:
+			b = binary.BigEndian.AppendUint64(b, r.packets)
+		case ieFlowStartMilliseconds:
+			b = binary.BigEndian.AppendUint64(b, uint64(r.start.UnixMilli()))
+		case ieFlowEndMilliseconds:
+			b = binary.BigEndian.AppendUint64(b, uint64(r.end.UnixMilli()))
+		case ieFirstSwitched:
+			b = binary.BigEndian.AppendUint32(b, uptime(r.start))
+		case ieLastSwitched:
+			b = binary.BigEndian.AppendUint32(b, uptime(r.end))
+		case ieBiflowDirection:
+			b = append(b, r.direction)
+		}
+	}
+
+	return b
+}
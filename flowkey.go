@@ -0,0 +1,149 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+// icmpRequestTypes maps ICMP and ICMPv6 reply types to their request types,
+// like the kernel's invmap tables in nf_conntrack_proto_icmp(v6).c.
+var icmpRequestTypes = map[uint8]map[uint8]uint8{
+	unix.IPPROTO_ICMP: {
+		0:  8,  // ICMP_ECHOREPLY
+		14: 13, // ICMP_TIMESTAMPREPLY
+		16: 15, // ICMP_INFO_REPLY
+		18: 17, // ICMP_ADDRESSREPLY
+	},
+	unix.IPPROTO_ICMPV6: {
+		129: 128, // ICMPV6_ECHO_REPLY
+		140: 139, // ICMPV6_NI_REPLY
+	},
+}
+
+// flowEndpoint is an address and port of a connection.
+type flowEndpoint struct {
+	addr netip.Addr
+	port uint16
+}
+
+// less returns true if e sorts before o.
+func (e flowEndpoint) less(o flowEndpoint) bool {
+	if c := e.addr.Compare(o.addr); c != 0 {
+		return c < 0
+	}
+	return e.port < o.port
+}
+
+// FlowKey identifies a connection independently of the direction of its
+// packets. Keys of a tuple and of its inverse are equal, so the key of a
+// packet's 5-tuple matches the key of the Flow it belongs to, regardless of
+// the direction it travels in.
+//
+// For Flows without NAT, the keys of the original and reply tuples are equal.
+// NATed Flows have different keys in each direction, see [Flow.Key] and
+// [Flow.ReplyKey].
+//
+// FlowKeys are comparable and can be used as map keys.
+type FlowKey struct {
+	proto uint8
+	zone  uint16
+
+	// lo and hi are the connection's endpoints in ascending order.
+	lo, hi flowEndpoint
+
+	// ICMP and ICMPv6 connections are identified by their ID, request type
+	// and code instead of ports.
+	icmpID   uint16
+	icmpType uint8
+	icmpCode uint8
+}
+
+// NewFlowKey returns the FlowKey of a connection between the given addresses
+// and ports of layer 4 protocol proto in the given conntrack zone. Use
+// [Tuple.Key] for ICMP connections.
+func NewFlowKey(proto uint8, srcAddr, dstAddr netip.Addr, srcPort, dstPort uint16, zone uint16) FlowKey {
+	k := FlowKey{proto: proto, zone: zone}
+	k.lo = flowEndpoint{srcAddr.Unmap(), srcPort}
+	k.hi = flowEndpoint{dstAddr.Unmap(), dstPort}
+	if k.hi.less(k.lo) {
+		k.lo, k.hi = k.hi, k.lo
+	}
+
+	return k
+}
+
+// Key returns the FlowKey of the Tuple in the given conntrack zone. The
+// Tuple's own Zone field is ignored.
+func (t Tuple) Key(zone uint16) FlowKey {
+	switch t.Proto.Protocol {
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		k := NewFlowKey(t.Proto.Protocol, t.IP.SourceAddress, t.IP.DestinationAddress, 0, 0, zone)
+		k.icmpID, k.icmpType, k.icmpCode = t.Proto.ICMPID, t.Proto.ICMPType, t.Proto.ICMPCode
+		if req, ok := icmpRequestTypes[t.Proto.Protocol][k.icmpType]; ok {
+			k.icmpType = req
+		}
+		return k
+	}
+
+	return NewFlowKey(t.Proto.Protocol, t.IP.SourceAddress, t.IP.DestinationAddress,
+		t.Proto.SourcePort, t.Proto.DestinationPort, zone)
+}
+
+// Key returns the FlowKey of the Flow's original tuple in the Flow's zone.
+func (f Flow) Key() FlowKey {
+	return f.TupleOrig.Key(f.Zone)
+}
+
+// ReplyKey returns the FlowKey of the Flow's reply tuple in the Flow's zone.
+// It differs from [Flow.Key] only if the Flow is NATed.
+func (f Flow) ReplyKey() FlowKey {
+	return f.TupleReply.Key(f.Zone)
+}
+
+// Zone returns the conntrack zone of the FlowKey.
+func (k FlowKey) Zone() uint16 {
+	return k.zone
+}
+
+// Protocol returns the layer 4 protocol of the FlowKey.
+func (k FlowKey) Protocol() uint8 {
+	return k.proto
+}
+
+// Hash returns a 64-bit FNV-1a hash of the FlowKey, for example to shard
+// Flows across workers. Like the FlowKey itself, it doesn't depend on the
+// direction of the connection, and it's stable across processes.
+func (k FlowKey) Hash() uint64 {
+	b := make([]byte, 0, 48)
+	b = append(b, k.proto)
+	b = binary.BigEndian.AppendUint16(b, k.zone)
+	for _, e := range []flowEndpoint{k.lo, k.hi} {
+		addr := e.addr.As16()
+		b = append(b, addr[:]...)
+		b = binary.BigEndian.AppendUint16(b, e.port)
+	}
+	b = binary.BigEndian.AppendUint16(b, k.icmpID)
+	b = append(b, k.icmpType, k.icmpCode)
+
+	h := fnv.New64a()
+	h.Write(b)
+
+	return h.Sum64()
+}
+
+// String returns a string representation of the FlowKey, listing the
+// connection's endpoints in ascending order.
+func (k FlowKey) String() string {
+	switch k.proto {
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		return fmt.Sprintf("<%s, %s <-> %s, Type: %d, Code: %d, ID: %d, Zone: %d>",
+			protoLookup(k.proto), k.lo.addr, k.hi.addr, k.icmpType, k.icmpCode, k.icmpID, k.zone)
+	}
+
+	return fmt.Sprintf("<%s, %s <-> %s, Zone: %d>", protoLookup(k.proto),
+		netip.AddrPortFrom(k.lo.addr, k.lo.port), netip.AddrPortFrom(k.hi.addr, k.hi.port), k.zone)
+}
@@ -0,0 +1,81 @@
+package conntrack
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestFlowKey(t *testing.T) {
+	a, b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+
+	k := NewFlowKey(unix.IPPROTO_TCP, a, b, 1234, 80, 0)
+	assert.Equal(t, k, NewFlowKey(unix.IPPROTO_TCP, b, a, 80, 1234, 0), "inverse tuple")
+	assert.Equal(t, k.Hash(), NewFlowKey(unix.IPPROTO_TCP, b, a, 80, 1234, 0).Hash())
+	assert.Equal(t, k, NewFlowKey(unix.IPPROTO_TCP, netip.MustParseAddr("::ffff:10.0.0.1"), b, 1234, 80, 0),
+		"IPv4-mapped IPv6 address")
+
+	assert.NotEqual(t, k, NewFlowKey(unix.IPPROTO_TCP, a, b, 1234, 80, 1), "zone")
+	assert.NotEqual(t, k.Hash(), NewFlowKey(unix.IPPROTO_TCP, a, b, 1234, 80, 1).Hash())
+	assert.NotEqual(t, k, NewFlowKey(unix.IPPROTO_UDP, a, b, 1234, 80, 0), "protocol")
+	assert.NotEqual(t, k, NewFlowKey(unix.IPPROTO_TCP, a, b, 80, 1234, 0), "swapped ports")
+
+	assert.Equal(t, uint8(unix.IPPROTO_TCP), k.Protocol())
+	assert.Equal(t, uint16(0), k.Zone())
+	assert.Equal(t, "<tcp, 10.0.0.1:1234 <-> 10.0.0.2:80, Zone: 0>", k.String())
+
+	// Usable as a map key.
+	m := map[FlowKey]int{k: 1}
+	assert.Equal(t, 1, m[NewFlowKey(unix.IPPROTO_TCP, b, a, 80, 1234, 0)])
+}
+
+func TestFlowKeyFlow(t *testing.T) {
+	f := NewFlow(unix.IPPROTO_UDP, 0, netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2"),
+		5353, 53, 120, 0)
+	f.Zone = 3
+	assert.Equal(t, f.Key(), f.ReplyKey(), "Flow without NAT")
+	assert.Equal(t, uint16(3), f.Key().Zone())
+
+	// Source NAT changes the reply tuple's destination.
+	f.TupleReply.IP.DestinationAddress = netip.MustParseAddr("2001:db8::ff")
+	assert.NotEqual(t, f.Key(), f.ReplyKey())
+	assert.Equal(t, f.ReplyKey(), NewFlowKey(unix.IPPROTO_UDP, netip.MustParseAddr("2001:db8::2"),
+		netip.MustParseAddr("2001:db8::ff"), 53, 5353, 3))
+}
+
+func TestFlowKeyICMP(t *testing.T) {
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+
+	req := Tuple{IP: IPTuple{a, b}, Proto: ProtoTuple{Protocol: unix.IPPROTO_ICMP, ICMPv4: true, ICMPType: 8, ICMPID: 42}}
+	rep := Tuple{IP: IPTuple{b, a}, Proto: ProtoTuple{Protocol: unix.IPPROTO_ICMP, ICMPv4: true, ICMPType: 0, ICMPID: 42}}
+	assert.Equal(t, req.Key(0), rep.Key(0))
+	assert.Equal(t, "<icmp, 192.0.2.1 <-> 192.0.2.2, Type: 8, Code: 0, ID: 42, Zone: 0>", req.Key(0).String())
+
+	// The Tuple's own zone and the ICMP flags are ignored.
+	rep.Zone = 7
+	rep.Proto.ICMPv4 = false
+	assert.Equal(t, req.Key(0), rep.Key(0))
+
+	other := req
+	other.Proto.ICMPID = 43
+	assert.NotEqual(t, req.Key(0), other.Key(0))
+
+	req6 := Tuple{IP: IPTuple{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2")},
+		Proto: ProtoTuple{Protocol: unix.IPPROTO_ICMPV6, ICMPv6: true, ICMPType: 128, ICMPID: 1}}
+	rep6 := Tuple{IP: IPTuple{req6.IP.DestinationAddress, req6.IP.SourceAddress},
+		Proto: ProtoTuple{Protocol: unix.IPPROTO_ICMPV6, ICMPv6: true, ICMPType: 129, ICMPID: 1}}
+	assert.Equal(t, req6.Key(0), rep6.Key(0))
+}
+
+func BenchmarkFlowKeyHash(b *testing.B) {
+	k := NewFlowKey(unix.IPPROTO_TCP, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), 1234, 80, 0)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		_ = k.Hash()
+	}
+}
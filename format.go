@@ -0,0 +1,286 @@
+package conntrack
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// formatProtoNames holds the protocol names used by conntrack-tools, which
+// differ from the names returned by protoLookup.
+var formatProtoNames = map[uint8]string{
+	unix.IPPROTO_TCP:     "tcp",
+	unix.IPPROTO_UDP:     "udp",
+	unix.IPPROTO_UDPLITE: "udplite",
+	unix.IPPROTO_ICMP:    "icmp",
+	unix.IPPROTO_ICMPV6:  "icmpv6",
+	unix.IPPROTO_SCTP:    "sctp",
+	unix.IPPROTO_GRE:     "gre",
+	unix.IPPROTO_DCCP:    "dccp",
+}
+
+// Expectation flags, see include/uapi/linux/netfilter/nf_conntrack_common.h.
+const (
+	expectFlagPermanent = 1 << iota // NF_CT_EXPECT_PERMANENT
+	expectFlagInactive              // NF_CT_EXPECT_INACTIVE
+	expectFlagUserspace             // NF_CT_EXPECT_USERSPACE
+)
+
+// Formatter renders Flows, Expects and Events in the text format of
+// conntrack-tools, as printed by `conntrack -L` and `conntrack -E`. The zero
+// value produces conntrack's default output, the fields enable the
+// corresponding `-o` output options.
+type Formatter struct {
+	// Extended prefixes the layer 3 protocol name and number (`-o extended`).
+	Extended bool
+
+	// Timestamp prefixes Events with the time they were formatted at
+	// (`-o timestamp`).
+	Timestamp bool
+
+	// ID appends the ID of Flows (`-o id`).
+	ID bool
+
+	// Labels appends the names of the connection labels of Flows using the
+	// given LabelMap (`-o labels`). Labels without a name are shown as
+	// their bit number.
+	Labels *LabelMap
+}
+
+// formatBuilder accumulates space-separated fields.
+type formatBuilder struct {
+	strings.Builder
+}
+
+// field appends a formatted field followed by a space.
+func (b *formatBuilder) field(format string, args ...any) {
+	fmt.Fprintf(b, format, args...)
+	b.WriteByte(' ')
+}
+
+// String returns the fields written so far without the trailing space.
+func (b *formatBuilder) String() string {
+	return strings.TrimSuffix(b.Builder.String(), " ")
+}
+
+// Flow returns the Flow in the format of `conntrack -L`, like:
+//
+//	tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=51234 dport=22 src=10.0.0.2 dst=10.0.0.1 sport=22 dport=51234 [ASSURED] mark=0 use=1
+func (ft Formatter) Flow(f Flow) string {
+	var b formatBuilder
+	ft.flow(&b, f, time.Now())
+	return b.String()
+}
+
+// Expect returns the Expect in the format of `conntrack -L expect`.
+func (ft Formatter) Expect(ex Expect) string {
+	var b formatBuilder
+	ft.expect(&b, ex)
+	return b.String()
+}
+
+// Event returns the Event in the format of `conntrack -E`, prefixed by the
+// event type like `[NEW]`, `[UPDATE]` or `[DESTROY]`.
+func (ft Formatter) Event(ev Event) string {
+	return ft.event(ev, time.Now())
+}
+
+// event formats ev, using now as the time of the event.
+func (ft Formatter) event(ev Event, now time.Time) string {
+	var b formatBuilder
+
+	if ft.Timestamp {
+		// conntrack left-aligns the microseconds.
+		fmt.Fprintf(&b, "[%d.%-6d]\t", now.Unix(), now.Nanosecond()/1000)
+	}
+
+	var name string
+	switch ev.Type {
+	case EventNew, EventExpNew:
+		name = "[NEW]"
+	case EventUpdate:
+		name = "[UPDATE]"
+	case EventDestroy, EventExpDestroy:
+		name = "[DESTROY]"
+	}
+	if name != "" {
+		b.field("%9s", name)
+	}
+
+	switch {
+	case ev.Flow != nil:
+		ft.flow(&b, *ev.Flow, now)
+	case ev.Expect != nil:
+		ft.expect(&b, *ev.Expect)
+	}
+
+	return b.String()
+}
+
+// protocol writes the layer 3 protocol if enabled and the layer 4 protocol of
+// t.
+func (ft Formatter) protocol(b *formatBuilder, t Tuple) {
+	if ft.Extended {
+		switch {
+		case t.IP.IsIPv6():
+			b.field("%-8s %d", "ipv6", unix.AF_INET6)
+		case t.IP.SourceAddress.Is4():
+			b.field("%-8s %d", "ipv4", unix.AF_INET)
+		default:
+			b.field("%-8s %d", "unknown", 0)
+		}
+	}
+
+	name, ok := formatProtoNames[t.Proto.Protocol]
+	if !ok {
+		name = "unknown"
+	}
+	b.field("%-8s %d", name, t.Proto.Protocol)
+}
+
+// tuple writes the addresses and protocol fields of t, with the address keys
+// prefixed by prefix.
+func (ft Formatter) tuple(b *formatBuilder, prefix string, t Tuple) {
+	b.field("%ssrc=%s", prefix, t.IP.SourceAddress)
+	b.field("%sdst=%s", prefix, t.IP.DestinationAddress)
+
+	switch t.Proto.Protocol {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_UDPLITE, unix.IPPROTO_SCTP, unix.IPPROTO_DCCP:
+		b.field("sport=%d", t.Proto.SourcePort)
+		b.field("dport=%d", t.Proto.DestinationPort)
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		b.field("type=%d", t.Proto.ICMPType)
+		b.field("code=%d", t.Proto.ICMPCode)
+		b.field("id=%d", t.Proto.ICMPID)
+	}
+}
+
+// counter writes the packet and byte counters of c if they are filled.
+func (ft Formatter) counter(b *formatBuilder, c Counter) {
+	if c.filled() {
+		b.field("packets=%d", c.Packets)
+		b.field("bytes=%d", c.Bytes)
+	}
+}
+
+// state returns the name of the protocol state of f, if any.
+func (ft Formatter) state(f Flow) (string, bool) {
+	state := f.ProtoInfo.State()
+	if state == "" {
+		return "", false
+	}
+
+	// conntrack-tools calls SYN_SENT2 by its former name.
+	if f.ProtoInfo.TCP != nil && state == "SYN_SENT2" {
+		return "LISTEN", true
+	}
+
+	return state, true
+}
+
+// flow writes the fields of f, using now to calculate the age of Flows
+// without a stop timestamp.
+func (ft Formatter) flow(b *formatBuilder, f Flow, now time.Time) {
+	ft.protocol(b, f.TupleOrig)
+
+	// Destroy events don't carry a timeout or protocol state.
+	if f.Timeout != 0 {
+		b.field("%d", f.Timeout)
+	}
+	if state, ok := ft.state(f); ok {
+		b.field("%s", state)
+	}
+
+	ft.tuple(b, "", f.TupleOrig)
+	if f.TupleOrig.Zone != 0 {
+		b.field("zone-orig=%d", f.TupleOrig.Zone)
+	}
+	ft.counter(b, f.CountersOrig)
+	if !f.Status.SeenReply() {
+		b.field("[UNREPLIED]")
+	}
+
+	ft.tuple(b, "", f.TupleReply)
+	if f.TupleReply.Zone != 0 {
+		b.field("zone-reply=%d", f.TupleReply.Zone)
+	}
+	ft.counter(b, f.CountersReply)
+
+	switch {
+	case f.Status.Offload():
+		b.field("[OFFLOAD]")
+	case f.Status.Assured():
+		b.field("[ASSURED]")
+	}
+
+	b.field("mark=%d", f.Mark)
+	if f.SecurityContext != "" {
+		b.field("secctx=%s", f.SecurityContext)
+	}
+	if f.Zone != 0 {
+		b.field("zone=%d", f.Zone)
+	}
+
+	if !f.Timestamp.Start.IsZero() {
+		stop := f.Timestamp.Stop
+		if stop.IsZero() {
+			stop = now
+		}
+		b.field("delta-time=%d", int64(stop.Sub(f.Timestamp.Start).Seconds()))
+	}
+
+	if f.Helper.Name != "" {
+		b.field("helper=%s", f.Helper.Name)
+	}
+
+	// Events don't carry a reference count.
+	if f.Use != 0 {
+		b.field("use=%d", f.Use)
+	}
+	if ft.ID && f.ID != 0 {
+		b.field("id=%d", f.ID)
+	}
+	if ft.Labels != nil && !f.Labels.Empty() {
+		b.field("labels=%s", strings.Join(ft.Labels.Names(f.Labels), ","))
+	}
+}
+
+// expect writes the fields of ex.
+func (ft Formatter) expect(b *formatBuilder, ex Expect) {
+	if ex.Timeout != 0 {
+		b.field("%d", ex.Timeout)
+	}
+	b.field("proto=%d", ex.Tuple.Proto.Protocol)
+
+	ft.tuple(b, "", ex.Tuple)
+	ft.tuple(b, "mask-", ex.Mask)
+	ft.tuple(b, "master-", ex.TupleMaster)
+
+	if ex.Zone != 0 {
+		b.field("zone=%d", ex.Zone)
+	}
+
+	var flags []string
+	if ex.Flags&expectFlagPermanent != 0 {
+		flags = append(flags, "PERMANENT")
+	}
+	if ex.Flags&expectFlagInactive != 0 {
+		flags = append(flags, "INACTIVE")
+	}
+	if ex.Flags&expectFlagUserspace != 0 {
+		flags = append(flags, "USERSPACE")
+	}
+	if len(flags) > 0 {
+		b.field("%s", strings.Join(flags, ","))
+	}
+
+	b.field("class=%d", ex.Class)
+	if ex.HelpName != "" {
+		b.field("helper=%s", ex.HelpName)
+	}
+	if ft.ID && ex.ID != 0 {
+		b.field("id=%d", ex.ID)
+	}
+}
@@ -0,0 +1,113 @@
+package conntrack
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestFormatterFlow(t *testing.T) {
+	f := NewFlow(unix.IPPROTO_TCP, StatusConfirmed|StatusSeenReply|StatusAssured,
+		netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), 51234, 22, 431999, 0)
+	f.ProtoInfo.TCP = &ProtoInfoTCP{State: 3}
+	f.Use = 1
+
+	assert.Equal(t, "tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=51234 dport=22 "+
+		"src=10.0.0.2 dst=10.0.0.1 sport=22 dport=51234 [ASSURED] mark=0 use=1", Formatter{}.Flow(f))
+
+	lm, err := ParseLabelMap(strings.NewReader("0 blocked\n"))
+	require.NoError(t, err)
+
+	f.Status = StatusConfirmed
+	f.CountersOrig = Counter{Packets: 1, Bytes: 60}
+	f.Mark, f.Zone, f.ID = 5, 1, 1234
+	f.Labels, err = NewLabels(0, 3)
+	require.NoError(t, err)
+	f.Helper.Name = "ftp"
+	f.SecurityContext = "system_u:object_r:unlabeled_t:s0"
+	f.Timestamp.Start = time.Unix(100, 0)
+	f.Timestamp.Stop = time.Unix(130, 0)
+	f.ProtoInfo.TCP.State = 9
+
+	assert.Equal(t, "ipv4     2 tcp      6 431999 LISTEN src=10.0.0.1 dst=10.0.0.2 sport=51234 dport=22 packets=1 bytes=60 [UNREPLIED] "+
+		"src=10.0.0.2 dst=10.0.0.1 sport=22 dport=51234 mark=5 secctx=system_u:object_r:unlabeled_t:s0 zone=1 "+
+		"delta-time=30 helper=ftp use=1 id=1234 labels=blocked,3",
+		Formatter{Extended: true, ID: true, Labels: lm}.Flow(f))
+
+	icmp := Flow{
+		Status: StatusConfirmed | StatusSeenReply | StatusOffload,
+		TupleOrig: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("2001:db8::1"), DestinationAddress: netip.MustParseAddr("2001:db8::2")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_ICMPV6, ICMPType: 128, ICMPID: 7},
+			Zone:  2,
+		},
+		TupleReply: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("2001:db8::2"), DestinationAddress: netip.MustParseAddr("2001:db8::1")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_ICMPV6, ICMPType: 129, ICMPID: 7},
+		},
+	}
+	assert.Equal(t, "ipv6     10 icmpv6   58 src=2001:db8::1 dst=2001:db8::2 type=128 code=0 id=7 zone-orig=2 "+
+		"src=2001:db8::2 dst=2001:db8::1 type=129 code=0 id=7 [OFFLOAD] mark=0",
+		Formatter{Extended: true}.Flow(icmp))
+}
+
+func TestFormatterFlowRoundTrip(t *testing.T) {
+	f := NewFlow(unix.IPPROTO_SCTP, StatusConfirmed|StatusSeenReply|StatusAssured,
+		netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2"), 1, 2, 10, 3)
+	f.ProtoInfo.SCTP = &ProtoInfoSCTP{State: 4}
+	f.CountersOrig = Counter{Packets: 1, Bytes: 2}
+	f.CountersReply = Counter{Direction: true, Packets: 3, Bytes: 4}
+	f.Zone, f.Use, f.ID = 1, 2, 3
+
+	got, err := ParseFlow(Formatter{Extended: true, ID: true}.Flow(f))
+	require.NoError(t, err)
+	assert.Equal(t, f, got)
+}
+
+func TestFormatterExpect(t *testing.T) {
+	ex := Expect{
+		Timeout: 300,
+		TupleMaster: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("10.0.0.1"), DestinationAddress: netip.MustParseAddr("10.0.0.2")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_TCP, SourcePort: 46948, DestinationPort: 21},
+		},
+		Tuple: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("10.0.0.1"), DestinationAddress: netip.MustParseAddr("10.0.0.2")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_TCP, DestinationPort: 41739},
+		},
+		Mask: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("255.255.255.255"), DestinationAddress: netip.MustParseAddr("255.255.255.255")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_TCP, DestinationPort: 65535},
+		},
+		Flags:    expectFlagPermanent | expectFlagUserspace,
+		HelpName: "ftp",
+	}
+
+	assert.Equal(t, "300 proto=6 src=10.0.0.1 dst=10.0.0.2 sport=0 dport=41739 "+
+		"mask-src=255.255.255.255 mask-dst=255.255.255.255 sport=0 dport=65535 "+
+		"master-src=10.0.0.1 master-dst=10.0.0.2 sport=46948 dport=21 PERMANENT,USERSPACE class=0 helper=ftp",
+		Formatter{}.Expect(ex))
+}
+
+func TestFormatterEvent(t *testing.T) {
+	f := NewFlow(unix.IPPROTO_UDP, StatusConfirmed,
+		netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), 1, 2, 30, 0)
+
+	now := time.Unix(1700000000, 5000)
+	assert.Equal(t, "    [NEW] udp      17 30 src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 [UNREPLIED] "+
+		"src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1 mark=0",
+		Formatter{}.event(Event{Type: EventNew, Flow: &f}, now))
+
+	f.Timeout = 0
+	assert.Equal(t, "[1700000000.5     ]\t[DESTROY] udp      17 src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 [UNREPLIED] "+
+		"src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1 mark=0",
+		Formatter{Timestamp: true}.event(Event{Type: EventDestroy, Flow: &f}, now))
+
+	assert.True(t, strings.HasPrefix(Formatter{}.Event(Event{Type: EventUpdate, Flow: &f}), " [UPDATE] udp"))
+	assert.True(t, strings.HasPrefix(Formatter{}.Event(Event{Type: EventExpNew, Expect: &Expect{Timeout: 1}}), "    [NEW] 1 "))
+}
@@ -0,0 +1,866 @@
+package conntrack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// JSONVersion is the version of the JSON schema used to encode Flows, Expects,
+// Events and Stats. Every top-level JSON object carries it in its `version`
+// field. It is incremented when fields are renamed, removed or change meaning;
+// new fields may be added without changing the version.
+//
+// Decoding accepts objects of this or an earlier version, as well as objects
+// without a version.
+const JSONVersion = 1
+
+// expectFlagNames holds the names of the Expect flags, indexed by bit
+// position.
+var expectFlagNames = []string{"PERMANENT", "INACTIVE", "USERSPACE"}
+
+// eventTypeNames holds the JSON names of the event types.
+var eventTypeNames = map[eventType]string{
+	EventUnknown:    "UNKNOWN",
+	EventNew:        "NEW",
+	EventUpdate:     "UPDATE",
+	EventDestroy:    "DESTROY",
+	EventExpNew:     "EXP_NEW",
+	EventExpDestroy: "EXP_DESTROY",
+}
+
+// checkJSONVersion returns an error if v is a newer schema version than
+// supported.
+func checkJSONVersion(v int) error {
+	if v > JSONVersion {
+		return fmt.Errorf("version %d: %w", v, errJSONVersion)
+	}
+
+	return nil
+}
+
+// flagsToJSON returns the names of the bits set in v. Bits without a name are
+// returned as hexadecimal numbers.
+func flagsToJSON(v uint32, names []string) []string {
+	out := []string{}
+	for i := range 32 {
+		bit := uint32(1) << i
+		if v&bit == 0 {
+			continue
+		}
+
+		if i < len(names) {
+			out = append(out, names[i])
+		} else {
+			out = append(out, fmt.Sprintf("%#x", bit))
+		}
+	}
+
+	return out
+}
+
+// flagsFromJSON is the inverse of flagsToJSON.
+func flagsFromJSON(ss []string, names []string) (uint32, error) {
+	var v uint32
+	for _, s := range ss {
+		if i := slices.Index(names, s); i >= 0 {
+			v |= 1 << i
+			continue
+		}
+
+		n, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("flag %q: %w", s, errJSONValue)
+		}
+		v |= uint32(n)
+	}
+
+	return v, nil
+}
+
+// nameToJSON returns the name at index v, or v as a decimal number if there is
+// no such name.
+func nameToJSON(v uint8, names []string) string {
+	if int(v) < len(names) {
+		return names[v]
+	}
+
+	return strconv.Itoa(int(v))
+}
+
+// nameFromJSON is the inverse of nameToJSON.
+func nameFromJSON(s string, names []string) (uint8, error) {
+	if i := slices.Index(names, s); i >= 0 {
+		return uint8(i), nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("name %q: %w", s, errJSONValue)
+	}
+
+	return uint8(n), nil
+}
+
+// protoToJSON returns the name of protocol p as used by conntrack-tools, or p
+// as a decimal number if it has no name.
+func protoToJSON(p uint8) string {
+	if name, ok := formatProtoNames[p]; ok {
+		return name
+	}
+
+	return strconv.Itoa(int(p))
+}
+
+// protoFromJSON is the inverse of protoToJSON. An empty string is decoded as
+// protocol 0, the protocol of an unset Tuple.
+func protoFromJSON(s string) (uint8, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	for p, name := range formatProtoNames {
+		if name == s {
+			return p, nil
+		}
+	}
+
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("protocol %q: %w", s, errJSONValue)
+	}
+
+	return uint8(n), nil
+}
+
+// labelsToJSON returns the label bits set in l.
+func labelsToJSON(l Labels) []int {
+	return slices.Collect(l.All())
+}
+
+// jsonPair holds a value for each direction of a connection.
+type jsonPair[T any] struct {
+	Orig  *T `json:"orig,omitempty"`
+	Reply *T `json:"reply,omitempty"`
+}
+
+type jsonTuple struct {
+	Src      netip.Addr `json:"src"`
+	Dst      netip.Addr `json:"dst"`
+	Proto    string     `json:"proto"`
+	SrcPort  uint16     `json:"sport,omitempty"`
+	DstPort  uint16     `json:"dport,omitempty"`
+	ICMPType *uint8     `json:"icmp_type,omitempty"`
+	ICMPCode *uint8     `json:"icmp_code,omitempty"`
+	ICMPID   *uint16    `json:"icmp_id,omitempty"`
+	Zone     uint16     `json:"zone,omitempty"`
+}
+
+func tupleToJSON(t Tuple) jsonTuple {
+	jt := jsonTuple{
+		Src:     t.IP.SourceAddress,
+		Dst:     t.IP.DestinationAddress,
+		Proto:   protoToJSON(t.Proto.Protocol),
+		SrcPort: t.Proto.SourcePort,
+		DstPort: t.Proto.DestinationPort,
+		Zone:    t.Zone,
+	}
+
+	if t.Proto.Protocol == unix.IPPROTO_ICMP || t.Proto.Protocol == unix.IPPROTO_ICMPV6 {
+		jt.ICMPType, jt.ICMPCode, jt.ICMPID = &t.Proto.ICMPType, &t.Proto.ICMPCode, &t.Proto.ICMPID
+	}
+
+	return jt
+}
+
+func (jt jsonTuple) tuple() (Tuple, error) {
+	p, err := protoFromJSON(jt.Proto)
+	if err != nil {
+		return Tuple{}, err
+	}
+
+	t := Tuple{
+		IP: IPTuple{SourceAddress: jt.Src, DestinationAddress: jt.Dst},
+		Proto: ProtoTuple{
+			Protocol:        p,
+			SourcePort:      jt.SrcPort,
+			DestinationPort: jt.DstPort,
+			ICMPv4:          p == unix.IPPROTO_ICMP,
+			ICMPv6:          p == unix.IPPROTO_ICMPV6,
+		},
+		Zone: jt.Zone,
+	}
+	if jt.ICMPType != nil {
+		t.Proto.ICMPType = *jt.ICMPType
+	}
+	if jt.ICMPCode != nil {
+		t.Proto.ICMPCode = *jt.ICMPCode
+	}
+	if jt.ICMPID != nil {
+		t.Proto.ICMPID = *jt.ICMPID
+	}
+
+	return t, nil
+}
+
+type jsonProtoInfo struct {
+	TCP  *jsonProtoInfoTCP  `json:"tcp,omitempty"`
+	DCCP *jsonProtoInfoDCCP `json:"dccp,omitempty"`
+	SCTP *jsonProtoInfoSCTP `json:"sctp,omitempty"`
+}
+
+type jsonProtoInfoTCP struct {
+	State       string `json:"state"`
+	WScaleOrig  uint8  `json:"wscale_orig,omitempty"`
+	WScaleReply uint8  `json:"wscale_reply,omitempty"`
+	FlagsOrig   uint16 `json:"flags_orig,omitempty"`
+	FlagsReply  uint16 `json:"flags_reply,omitempty"`
+}
+
+type jsonProtoInfoDCCP struct {
+	State        string `json:"state"`
+	Role         uint8  `json:"role"`
+	HandshakeSeq uint64 `json:"handshake_seq,omitempty"`
+}
+
+type jsonProtoInfoSCTP struct {
+	State     string `json:"state"`
+	VTagOrig  uint32 `json:"vtag_orig,omitempty"`
+	VTagReply uint32 `json:"vtag_reply,omitempty"`
+}
+
+type jsonCounter struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+type jsonTimestamp struct {
+	Start *time.Time `json:"start,omitempty"`
+	Stop  *time.Time `json:"stop,omitempty"`
+}
+
+type jsonSeqAdj struct {
+	Position     uint32 `json:"position"`
+	OffsetBefore uint32 `json:"offset_before"`
+	OffsetAfter  uint32 `json:"offset_after"`
+}
+
+type jsonHelper struct {
+	Name string `json:"name"`
+	Info []byte `json:"info,omitempty"`
+}
+
+type jsonSynProxy struct {
+	ISN   uint32 `json:"isn"`
+	ITS   uint32 `json:"its"`
+	TSOff uint32 `json:"tsoff"`
+}
+
+type jsonNATRange struct {
+	MinAddr netip.Addr `json:"min_addr"`
+	MaxAddr netip.Addr `json:"max_addr"`
+	MinPort uint16     `json:"min_port,omitempty"`
+	MaxPort uint16     `json:"max_port,omitempty"`
+}
+
+type jsonFlow struct {
+	Version    int                    `json:"version,omitempty"`
+	ID         uint32                 `json:"id,omitempty"`
+	Timeout    uint32                 `json:"timeout,omitempty"`
+	Status     []string               `json:"status"`
+	Original   jsonTuple              `json:"original"`
+	Reply      jsonTuple              `json:"reply"`
+	Master     *jsonTuple             `json:"master,omitempty"`
+	ProtoInfo  *jsonProtoInfo         `json:"protoinfo,omitempty"`
+	Counters   *jsonPair[jsonCounter] `json:"counters,omitempty"`
+	Timestamp  *jsonTimestamp         `json:"timestamp,omitempty"`
+	Mark       uint32                 `json:"mark,omitempty"`
+	Zone       uint16                 `json:"zone,omitempty"`
+	Use        uint32                 `json:"use,omitempty"`
+	SecCtx     string                 `json:"secctx,omitempty"`
+	Helper     *jsonHelper            `json:"helper,omitempty"`
+	Labels     []int                  `json:"labels,omitempty"`
+	LabelsMask []int                  `json:"labels_mask,omitempty"`
+	SeqAdj     *jsonPair[jsonSeqAdj]  `json:"seqadj,omitempty"`
+	SynProxy   *jsonSynProxy          `json:"synproxy,omitempty"`
+	NATSrc     *jsonNATRange          `json:"nat_src,omitempty"`
+	NATDst     *jsonNATRange          `json:"nat_dst,omitempty"`
+}
+
+// toJSON converts f into its JSON representation without a version.
+func (f Flow) toJSON() jsonFlow {
+	jf := jsonFlow{
+		ID:       f.ID,
+		Timeout:  f.Timeout,
+		Status:   flagsToJSON(uint32(f.Status), statusNames),
+		Original: tupleToJSON(f.TupleOrig),
+		Reply:    tupleToJSON(f.TupleReply),
+		Mark:     f.Mark,
+		Zone:     f.Zone,
+		Use:      f.Use,
+		SecCtx:   string(f.SecurityContext),
+	}
+
+	if f.TupleMaster.filled() {
+		jt := tupleToJSON(f.TupleMaster)
+		jf.Master = &jt
+	}
+
+	if f.ProtoInfo.filled() {
+		pi := &jsonProtoInfo{}
+		if tcp := f.ProtoInfo.TCP; tcp != nil {
+			pi.TCP = &jsonProtoInfoTCP{
+				State:       nameToJSON(tcp.State, tcpStates),
+				WScaleOrig:  tcp.OriginalWindowScale,
+				WScaleReply: tcp.ReplyWindowScale,
+				FlagsOrig:   tcp.OriginalFlags,
+				FlagsReply:  tcp.ReplyFlags,
+			}
+		}
+		if dccp := f.ProtoInfo.DCCP; dccp != nil {
+			pi.DCCP = &jsonProtoInfoDCCP{
+				State:        nameToJSON(dccp.State, dccpStates),
+				Role:         dccp.Role,
+				HandshakeSeq: dccp.HandshakeSeq,
+			}
+		}
+		if sctp := f.ProtoInfo.SCTP; sctp != nil {
+			pi.SCTP = &jsonProtoInfoSCTP{
+				State:     nameToJSON(sctp.State, sctpStates),
+				VTagOrig:  sctp.VTagOriginal,
+				VTagReply: sctp.VTagReply,
+			}
+		}
+		jf.ProtoInfo = pi
+	}
+
+	var ctrs jsonPair[jsonCounter]
+	if c := f.CountersOrig; c.Packets != 0 || c.Bytes != 0 {
+		ctrs.Orig = &jsonCounter{Packets: c.Packets, Bytes: c.Bytes}
+	}
+	if c := f.CountersReply; c.Packets != 0 || c.Bytes != 0 {
+		ctrs.Reply = &jsonCounter{Packets: c.Packets, Bytes: c.Bytes}
+	}
+	if ctrs.Orig != nil || ctrs.Reply != nil {
+		jf.Counters = &ctrs
+	}
+
+	var ts jsonTimestamp
+	if !f.Timestamp.Start.IsZero() {
+		ts.Start = &f.Timestamp.Start
+	}
+	if !f.Timestamp.Stop.IsZero() {
+		ts.Stop = &f.Timestamp.Stop
+	}
+	if ts.Start != nil || ts.Stop != nil {
+		jf.Timestamp = &ts
+	}
+
+	if f.Helper.filled() {
+		jf.Helper = &jsonHelper{Name: f.Helper.Name, Info: f.Helper.Info}
+	}
+
+	jf.Labels = labelsToJSON(f.Labels)
+	jf.LabelsMask = labelsToJSON(f.LabelsMask)
+
+	var seq jsonPair[jsonSeqAdj]
+	if s := f.SeqAdjOrig; s.Position != 0 || s.OffsetBefore != 0 || s.OffsetAfter != 0 {
+		seq.Orig = &jsonSeqAdj{Position: s.Position, OffsetBefore: s.OffsetBefore, OffsetAfter: s.OffsetAfter}
+	}
+	if s := f.SeqAdjReply; s.Position != 0 || s.OffsetBefore != 0 || s.OffsetAfter != 0 {
+		seq.Reply = &jsonSeqAdj{Position: s.Position, OffsetBefore: s.OffsetBefore, OffsetAfter: s.OffsetAfter}
+	}
+	if seq.Orig != nil || seq.Reply != nil {
+		jf.SeqAdj = &seq
+	}
+
+	if f.SynProxy.filled() {
+		jf.SynProxy = &jsonSynProxy{ISN: f.SynProxy.ISN, ITS: f.SynProxy.ITS, TSOff: f.SynProxy.TSOff}
+	}
+
+	if f.NATSrc.filled() {
+		jf.NATSrc = &jsonNATRange{f.NATSrc.MinAddr, f.NATSrc.MaxAddr, f.NATSrc.MinPort, f.NATSrc.MaxPort}
+	}
+	if f.NATDst.filled() {
+		jf.NATDst = &jsonNATRange{f.NATDst.MinAddr, f.NATDst.MaxAddr, f.NATDst.MinPort, f.NATDst.MaxPort}
+	}
+
+	return jf
+}
+
+// flow converts the JSON representation of a Flow back into a Flow.
+func (jf jsonFlow) flow() (Flow, error) {
+	if err := checkJSONVersion(jf.Version); err != nil {
+		return Flow{}, err
+	}
+
+	f := Flow{
+		ID:              jf.ID,
+		Timeout:         jf.Timeout,
+		Mark:            jf.Mark,
+		Zone:            jf.Zone,
+		Use:             jf.Use,
+		SecurityContext: Security(jf.SecCtx),
+	}
+
+	status, err := flagsFromJSON(jf.Status, statusNames)
+	if err != nil {
+		return Flow{}, fmt.Errorf("status: %w", err)
+	}
+	f.Status = Status(status)
+
+	if f.TupleOrig, err = jf.Original.tuple(); err != nil {
+		return Flow{}, fmt.Errorf("original: %w", err)
+	}
+	if f.TupleReply, err = jf.Reply.tuple(); err != nil {
+		return Flow{}, fmt.Errorf("reply: %w", err)
+	}
+	if jf.Master != nil {
+		if f.TupleMaster, err = jf.Master.tuple(); err != nil {
+			return Flow{}, fmt.Errorf("master: %w", err)
+		}
+	}
+
+	if pi := jf.ProtoInfo; pi != nil {
+		if tcp := pi.TCP; tcp != nil {
+			state, err := nameFromJSON(tcp.State, tcpStates)
+			if err != nil {
+				return Flow{}, fmt.Errorf("tcp state: %w", err)
+			}
+			f.ProtoInfo.TCP = &ProtoInfoTCP{
+				State:               state,
+				OriginalWindowScale: tcp.WScaleOrig,
+				ReplyWindowScale:    tcp.WScaleReply,
+				OriginalFlags:       tcp.FlagsOrig,
+				ReplyFlags:          tcp.FlagsReply,
+			}
+		}
+		if dccp := pi.DCCP; dccp != nil {
+			state, err := nameFromJSON(dccp.State, dccpStates)
+			if err != nil {
+				return Flow{}, fmt.Errorf("dccp state: %w", err)
+			}
+			f.ProtoInfo.DCCP = &ProtoInfoDCCP{State: state, Role: dccp.Role, HandshakeSeq: dccp.HandshakeSeq}
+		}
+		if sctp := pi.SCTP; sctp != nil {
+			state, err := nameFromJSON(sctp.State, sctpStates)
+			if err != nil {
+				return Flow{}, fmt.Errorf("sctp state: %w", err)
+			}
+			f.ProtoInfo.SCTP = &ProtoInfoSCTP{State: state, VTagOriginal: sctp.VTagOrig, VTagReply: sctp.VTagReply}
+		}
+	}
+
+	if c := jf.Counters; c != nil {
+		if c.Orig != nil {
+			f.CountersOrig = Counter{Packets: c.Orig.Packets, Bytes: c.Orig.Bytes}
+		}
+		if c.Reply != nil {
+			f.CountersReply = Counter{Direction: true, Packets: c.Reply.Packets, Bytes: c.Reply.Bytes}
+		}
+	}
+
+	if ts := jf.Timestamp; ts != nil {
+		// The kernel's timestamps are in the local time zone like the ones
+		// returned by time.Unix.
+		if ts.Start != nil {
+			f.Timestamp.Start = ts.Start.Local()
+		}
+		if ts.Stop != nil {
+			f.Timestamp.Stop = ts.Stop.Local()
+		}
+	}
+
+	if h := jf.Helper; h != nil {
+		f.Helper = Helper{Name: h.Name, Info: h.Info}
+	}
+
+	if f.Labels, err = NewLabels(jf.Labels...); err != nil {
+		return Flow{}, fmt.Errorf("labels: %w", err)
+	}
+	if f.LabelsMask, err = NewLabels(jf.LabelsMask...); err != nil {
+		return Flow{}, fmt.Errorf("labels mask: %w", err)
+	}
+
+	if s := jf.SeqAdj; s != nil {
+		if s.Orig != nil {
+			f.SeqAdjOrig = SequenceAdjust{Position: s.Orig.Position, OffsetBefore: s.Orig.OffsetBefore, OffsetAfter: s.Orig.OffsetAfter}
+		}
+		if s.Reply != nil {
+			f.SeqAdjReply = SequenceAdjust{Direction: true, Position: s.Reply.Position,
+				OffsetBefore: s.Reply.OffsetBefore, OffsetAfter: s.Reply.OffsetAfter}
+		}
+	}
+
+	if sp := jf.SynProxy; sp != nil {
+		f.SynProxy = SynProxy{ISN: sp.ISN, ITS: sp.ITS, TSOff: sp.TSOff}
+	}
+
+	if nr := jf.NATSrc; nr != nil {
+		f.NATSrc = NATRange{nr.MinAddr, nr.MaxAddr, nr.MinPort, nr.MaxPort}
+	}
+	if nr := jf.NATDst; nr != nil {
+		f.NATDst = NATRange{nr.MinAddr, nr.MaxAddr, nr.MinPort, nr.MaxPort}
+	}
+
+	return f, nil
+}
+
+// MarshalJSON implements [json.Marshaler]. Flows are encoded as objects with
+// snake_case keys, like:
+//
+//	{
+//	  "version": 1,
+//	  "timeout": 431999,
+//	  "status": ["SEEN_REPLY", "ASSURED", "CONFIRMED"],
+//	  "original": {"src": "10.0.0.1", "dst": "10.0.0.2", "proto": "tcp", "sport": 51234, "dport": 22},
+//	  "reply": {"src": "10.0.0.2", "dst": "10.0.0.1", "proto": "tcp", "sport": 22, "dport": 51234},
+//	  "protoinfo": {"tcp": {"state": "ESTABLISHED"}},
+//	  "counters": {"orig": {"packets": 10, "bytes": 1000}, "reply": {"packets": 8, "bytes": 2000}},
+//	  "use": 1
+//	}
+//
+// Status flags, protocols and protocol states are encoded by name, using
+// conntrack-tools' names. Values without a name are encoded as numbers in a
+// string. Labels are encoded as a list of bit numbers. Fields holding zero
+// values are omitted.
+func (f Flow) MarshalJSON() ([]byte, error) {
+	jf := f.toJSON()
+	jf.Version = JSONVersion
+
+	return json.Marshal(jf)
+}
+
+// UnmarshalJSON implements [json.Unmarshaler], decoding Flows encoded by
+// [Flow.MarshalJSON]. Labels decoded from a non-empty list hold all
+// [LabelsMax] bits.
+func (f *Flow) UnmarshalJSON(b []byte) error {
+	var jf jsonFlow
+	if err := json.Unmarshal(b, &jf); err != nil {
+		return err
+	}
+
+	out, err := jf.flow()
+	if err != nil {
+		return err
+	}
+	*f = out
+
+	return nil
+}
+
+type jsonExpectNAT struct {
+	Direction string    `json:"dir"`
+	Tuple     jsonTuple `json:"tuple"`
+}
+
+type jsonExpect struct {
+	Version  int            `json:"version,omitempty"`
+	ID       uint32         `json:"id,omitempty"`
+	Timeout  uint32         `json:"timeout,omitempty"`
+	Master   jsonTuple      `json:"master"`
+	Tuple    jsonTuple      `json:"tuple"`
+	Mask     jsonTuple      `json:"mask"`
+	Zone     uint16         `json:"zone,omitempty"`
+	Helper   string         `json:"helper,omitempty"`
+	Function string         `json:"function,omitempty"`
+	Flags    []string       `json:"flags,omitempty"`
+	Class    uint32         `json:"class,omitempty"`
+	NAT      *jsonExpectNAT `json:"nat,omitempty"`
+}
+
+// toJSON converts ex into its JSON representation without a version.
+func (ex Expect) toJSON() jsonExpect {
+	je := jsonExpect{
+		ID:       ex.ID,
+		Timeout:  ex.Timeout,
+		Master:   tupleToJSON(ex.TupleMaster),
+		Tuple:    tupleToJSON(ex.Tuple),
+		Mask:     tupleToJSON(ex.Mask),
+		Zone:     ex.Zone,
+		Helper:   ex.HelpName,
+		Function: ex.Function,
+		Flags:    flagsToJSON(ex.Flags, expectFlagNames),
+		Class:    ex.Class,
+	}
+
+	if ex.NAT.Tuple.filled() {
+		dir := "orig"
+		if ex.NAT.Direction {
+			dir = "reply"
+		}
+		je.NAT = &jsonExpectNAT{Direction: dir, Tuple: tupleToJSON(ex.NAT.Tuple)}
+	}
+
+	return je
+}
+
+// expect converts the JSON representation of an Expect back into an Expect.
+func (je jsonExpect) expect() (Expect, error) {
+	if err := checkJSONVersion(je.Version); err != nil {
+		return Expect{}, err
+	}
+
+	ex := Expect{
+		ID:       je.ID,
+		Timeout:  je.Timeout,
+		Zone:     je.Zone,
+		HelpName: je.Helper,
+		Function: je.Function,
+		Class:    je.Class,
+	}
+
+	var err error
+	if ex.TupleMaster, err = je.Master.tuple(); err != nil {
+		return Expect{}, fmt.Errorf("master: %w", err)
+	}
+	if ex.Tuple, err = je.Tuple.tuple(); err != nil {
+		return Expect{}, fmt.Errorf("tuple: %w", err)
+	}
+	if ex.Mask, err = je.Mask.tuple(); err != nil {
+		return Expect{}, fmt.Errorf("mask: %w", err)
+	}
+	if ex.Flags, err = flagsFromJSON(je.Flags, expectFlagNames); err != nil {
+		return Expect{}, fmt.Errorf("flags: %w", err)
+	}
+
+	if n := je.NAT; n != nil {
+		switch n.Direction {
+		case "orig":
+		case "reply":
+			ex.NAT.Direction = true
+		default:
+			return Expect{}, fmt.Errorf("nat direction %q: %w", n.Direction, errJSONValue)
+		}
+		if ex.NAT.Tuple, err = n.Tuple.tuple(); err != nil {
+			return Expect{}, fmt.Errorf("nat: %w", err)
+		}
+	}
+
+	return ex, nil
+}
+
+// MarshalJSON implements [json.Marshaler]. Expects are encoded like Flows, see
+// [Flow.MarshalJSON], with their tuples in the `master`, `tuple` and `mask`
+// keys and their flags by name.
+func (ex Expect) MarshalJSON() ([]byte, error) {
+	je := ex.toJSON()
+	je.Version = JSONVersion
+
+	return json.Marshal(je)
+}
+
+// UnmarshalJSON implements [json.Unmarshaler], decoding Expects encoded by
+// [Expect.MarshalJSON].
+func (ex *Expect) UnmarshalJSON(b []byte) error {
+	var je jsonExpect
+	if err := json.Unmarshal(b, &je); err != nil {
+		return err
+	}
+
+	out, err := je.expect()
+	if err != nil {
+		return err
+	}
+	*ex = out
+
+	return nil
+}
+
+type jsonEvent struct {
+	Version int         `json:"version"`
+	Type    string      `json:"type"`
+	Flow    *jsonFlow   `json:"flow,omitempty"`
+	Expect  *jsonExpect `json:"expect,omitempty"`
+}
+
+// MarshalJSON implements [json.Marshaler]. Events are encoded as an object
+// holding the event type, one of NEW, UPDATE, DESTROY, EXP_NEW or
+// EXP_DESTROY, and the Flow or Expect of the event, like:
+//
+//	{"version": 1, "type": "NEW", "flow": {"status": ["CONFIRMED"], ...}}
+//
+// See [Flow.MarshalJSON] for the encoding of Flows and Expects. Only the Event
+// carries a version.
+func (e Event) MarshalJSON() ([]byte, error) {
+	je := jsonEvent{Version: JSONVersion, Type: eventTypeNames[e.Type]}
+	if je.Type == "" {
+		je.Type = strconv.Itoa(int(e.Type))
+	}
+
+	if e.Flow != nil {
+		jf := e.Flow.toJSON()
+		je.Flow = &jf
+	}
+	if e.Expect != nil {
+		jx := e.Expect.toJSON()
+		je.Expect = &jx
+	}
+
+	return json.Marshal(je)
+}
+
+// UnmarshalJSON implements [json.Unmarshaler], decoding Events encoded by
+// [Event.MarshalJSON].
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var je jsonEvent
+	if err := json.Unmarshal(b, &je); err != nil {
+		return err
+	}
+	if err := checkJSONVersion(je.Version); err != nil {
+		return err
+	}
+
+	var out Event
+	var found bool
+	for t, name := range eventTypeNames {
+		if name == je.Type {
+			out.Type, found = t, true
+			break
+		}
+	}
+	if !found {
+		n, err := strconv.ParseUint(je.Type, 10, 8)
+		if err != nil {
+			return fmt.Errorf("event type %q: %w", je.Type, errJSONValue)
+		}
+		out.Type = eventType(n)
+	}
+
+	if je.Flow != nil {
+		f, err := je.Flow.flow()
+		if err != nil {
+			return fmt.Errorf("flow: %w", err)
+		}
+		out.Flow = &f
+	}
+	if je.Expect != nil {
+		ex, err := je.Expect.expect()
+		if err != nil {
+			return fmt.Errorf("expect: %w", err)
+		}
+		out.Expect = &ex
+	}
+
+	*e = out
+
+	return nil
+}
+
+// jsonStats has the same fields as Stats, allowing conversion between both.
+type jsonStats struct {
+	CPUID         uint16 `json:"cpu"`
+	Found         uint32 `json:"found"`
+	Invalid       uint32 `json:"invalid"`
+	Ignore        uint32 `json:"ignore"`
+	Insert        uint32 `json:"insert"`
+	InsertFailed  uint32 `json:"insert_failed"`
+	Drop          uint32 `json:"drop"`
+	EarlyDrop     uint32 `json:"early_drop"`
+	Error         uint32 `json:"error"`
+	SearchRestart uint32 `json:"search_restart"`
+}
+
+// MarshalJSON implements [json.Marshaler]. Stats are encoded as an object with
+// the version and a snake_case key for every counter, the CPU ID is encoded in
+// the `cpu` key.
+func (s Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Version int `json:"version"`
+		jsonStats
+	}{JSONVersion, jsonStats(s)})
+}
+
+// UnmarshalJSON implements [json.Unmarshaler], decoding Stats encoded by
+// [Stats.MarshalJSON].
+func (s *Stats) UnmarshalJSON(b []byte) error {
+	var js struct {
+		Version int `json:"version"`
+		jsonStats
+	}
+	if err := json.Unmarshal(b, &js); err != nil {
+		return err
+	}
+	if err := checkJSONVersion(js.Version); err != nil {
+		return err
+	}
+
+	*s = Stats(js.jsonStats)
+
+	return nil
+}
+
+// jsonStatsExpect has the same fields as StatsExpect, allowing conversion
+// between both.
+type jsonStatsExpect struct {
+	CPUID  uint16 `json:"cpu"`
+	New    uint32 `json:"new"`
+	Create uint32 `json:"create"`
+	Delete uint32 `json:"delete"`
+}
+
+// MarshalJSON implements [json.Marshaler], see [Stats.MarshalJSON].
+func (se StatsExpect) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Version int `json:"version"`
+		jsonStatsExpect
+	}{JSONVersion, jsonStatsExpect(se)})
+}
+
+// UnmarshalJSON implements [json.Unmarshaler], decoding StatsExpect encoded
+// by [StatsExpect.MarshalJSON].
+func (se *StatsExpect) UnmarshalJSON(b []byte) error {
+	var js struct {
+		Version int `json:"version"`
+		jsonStatsExpect
+	}
+	if err := json.Unmarshal(b, &js); err != nil {
+		return err
+	}
+	if err := checkJSONVersion(js.Version); err != nil {
+		return err
+	}
+
+	*se = StatsExpect(js.jsonStatsExpect)
+
+	return nil
+}
+
+// jsonStatsGlobal has the same fields as StatsGlobal, allowing conversion
+// between both.
+type jsonStatsGlobal struct {
+	Entries    uint32 `json:"entries"`
+	MaxEntries uint32 `json:"max_entries"`
+}
+
+// MarshalJSON implements [json.Marshaler], see [Stats.MarshalJSON].
+func (sg StatsGlobal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Version int `json:"version"`
+		jsonStatsGlobal
+	}{JSONVersion, jsonStatsGlobal(sg)})
+}
+
+// UnmarshalJSON implements [json.Unmarshaler], decoding StatsGlobal encoded
+// by [StatsGlobal.MarshalJSON].
+func (sg *StatsGlobal) UnmarshalJSON(b []byte) error {
+	var js struct {
+		Version int `json:"version"`
+		jsonStatsGlobal
+	}
+	if err := json.Unmarshal(b, &js); err != nil {
+		return err
+	}
+	if err := checkJSONVersion(js.Version); err != nil {
+		return err
+	}
+
+	*sg = StatsGlobal(js.jsonStatsGlobal)
+
+	return nil
+}
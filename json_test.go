@@ -0,0 +1,213 @@
+package conntrack
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestFlowJSON(t *testing.T) {
+	f := NewFlow(unix.IPPROTO_TCP, StatusConfirmed|StatusSeenReply|StatusAssured,
+		netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), 51234, 22, 431999, 0)
+	f.ProtoInfo.TCP = &ProtoInfoTCP{State: 3}
+	f.CountersOrig = Counter{Packets: 10, Bytes: 1000}
+	f.CountersReply = Counter{Direction: true, Packets: 8, Bytes: 2000}
+	f.Use = 1
+
+	b, err := json.Marshal(f)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"version": 1,
+		"timeout": 431999,
+		"status": ["SEEN_REPLY", "ASSURED", "CONFIRMED"],
+		"original": {"src": "10.0.0.1", "dst": "10.0.0.2", "proto": "tcp", "sport": 51234, "dport": 22},
+		"reply": {"src": "10.0.0.2", "dst": "10.0.0.1", "proto": "tcp", "sport": 22, "dport": 51234},
+		"protoinfo": {"tcp": {"state": "ESTABLISHED"}},
+		"counters": {"orig": {"packets": 10, "bytes": 1000}, "reply": {"packets": 8, "bytes": 2000}},
+		"use": 1
+	}`, string(b))
+
+	var got Flow
+	require.NoError(t, json.Unmarshal(b, &got))
+	assert.Equal(t, f, got)
+}
+
+func TestFlowJSONRoundTrip(t *testing.T) {
+	labels, err := NewLabels(1, 127)
+	require.NoError(t, err)
+
+	icmp := ProtoTuple{Protocol: unix.IPPROTO_ICMPV6, ICMPv6: true, ICMPType: 128, ICMPID: 7}
+	f := Flow{
+		ID:        1,
+		Timeout:   2,
+		Timestamp: Timestamp{Start: time.Unix(0, 1700000000123456789), Stop: time.Unix(1700000001, 0)},
+		Status:    StatusConfirmed | 1<<20,
+		ProtoInfo: ProtoInfo{
+			DCCP: &ProtoInfoDCCP{State: 4, Role: 1, HandshakeSeq: 5},
+			SCTP: &ProtoInfoSCTP{State: 200, VTagOriginal: 1, VTagReply: 2},
+		},
+		Helper:          Helper{Name: "ftp", Info: []byte{1, 2}},
+		Zone:            3,
+		CountersReply:   Counter{Direction: true, Packets: 1},
+		SecurityContext: "foo",
+		TupleOrig: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("2001:db8::1"), DestinationAddress: netip.MustParseAddr("2001:db8::2")},
+			Proto: icmp,
+			Zone:  4,
+		},
+		TupleReply: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("2001:db8::2"), DestinationAddress: netip.MustParseAddr("2001:db8::1")},
+			Proto: icmp,
+		},
+		TupleMaster: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("10.0.0.1"), DestinationAddress: netip.MustParseAddr("10.0.0.2")},
+			Proto: ProtoTuple{Protocol: 250, SourcePort: 1},
+		},
+		SeqAdjOrig:  SequenceAdjust{Position: 1, OffsetBefore: 2, OffsetAfter: 3},
+		SeqAdjReply: SequenceAdjust{Direction: true, Position: 4},
+		Labels:      labels,
+		LabelsMask:  labels,
+		Mark:        5,
+		Use:         6,
+		SynProxy:    SynProxy{ISN: 1, ITS: 2, TSOff: 3},
+		NATSrc:      NATRange{MinAddr: netip.MustParseAddr("192.0.2.1"), MinPort: 1000, MaxPort: 2000},
+		NATDst:      NATRange{MinAddr: netip.MustParseAddr("192.0.2.2"), MaxAddr: netip.MustParseAddr("192.0.2.3")},
+	}
+
+	b, err := json.Marshal(f)
+	require.NoError(t, err)
+
+	var got Flow
+	require.NoError(t, json.Unmarshal(b, &got))
+	assert.Equal(t, f, got)
+}
+
+func TestFlowJSONError(t *testing.T) {
+	for _, in := range []string{
+		`{"version": 2}`,
+		`{"status": ["BOGUS"]}`,
+		`{"original": {"proto": "bogus"}}`,
+		`{"reply": {"proto": "bogus"}}`,
+		`{"master": {"proto": "bogus"}}`,
+		`{"protoinfo": {"tcp": {"state": "BOGUS"}}}`,
+		`{"protoinfo": {"dccp": {"state": "BOGUS"}}}`,
+		`{"protoinfo": {"sctp": {"state": "BOGUS"}}}`,
+	} {
+		var f Flow
+		err := json.Unmarshal([]byte(in), &f)
+		assert.Error(t, err, in)
+	}
+
+	var f Flow
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"version": 2}`), &f), errJSONVersion)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"labels": [128]}`), &f), errLabelRange)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"original": {"proto": "bogus"}}`), &f), errJSONValue)
+}
+
+func TestExpectJSON(t *testing.T) {
+	ex := Expect{
+		ID:      1,
+		Timeout: 300,
+		TupleMaster: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("10.0.0.1"), DestinationAddress: netip.MustParseAddr("10.0.0.2")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_TCP, SourcePort: 46948, DestinationPort: 21},
+		},
+		Tuple: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("10.0.0.1"), DestinationAddress: netip.MustParseAddr("10.0.0.2")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_TCP, DestinationPort: 41739},
+		},
+		Mask: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("255.255.255.255"), DestinationAddress: netip.MustParseAddr("255.255.255.255")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_TCP, DestinationPort: 65535},
+		},
+		Zone:     2,
+		HelpName: "ftp",
+		Function: "foo",
+		Flags:    expectFlagPermanent | expectFlagInactive,
+		Class:    1,
+		NAT: ExpectNAT{Direction: true, Tuple: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("192.0.2.1"), DestinationAddress: netip.MustParseAddr("192.0.2.2")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_TCP, SourcePort: 1},
+		}},
+	}
+
+	b, err := json.Marshal(ex)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"flags":["PERMANENT","INACTIVE"]`)
+	assert.Contains(t, string(b), `"nat":{"dir":"reply"`)
+
+	var got Expect
+	require.NoError(t, json.Unmarshal(b, &got))
+	assert.Equal(t, ex, got)
+
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"nat": {"dir": "sideways"}}`), &got), errJSONValue)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"flags": ["BOGUS"]}`), &got), errJSONValue)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"version": 2}`), &got), errJSONVersion)
+}
+
+func TestEventJSON(t *testing.T) {
+	f := NewFlow(unix.IPPROTO_UDP, StatusConfirmed,
+		netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), 1, 2, 30, 0)
+
+	for _, ev := range []Event{
+		{Type: EventNew, Flow: &f},
+		{Type: EventDestroy, Flow: &f},
+		{Type: EventExpNew, Expect: &Expect{Timeout: 1}},
+		{Type: eventType(42)},
+	} {
+		b, err := json.Marshal(ev)
+		require.NoError(t, err)
+
+		var got Event
+		require.NoError(t, json.Unmarshal(b, &got))
+		assert.Equal(t, ev, got)
+	}
+
+	b, err := json.Marshal(Event{Type: EventUpdate, Flow: &f})
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `{"version":1,"type":"UPDATE","flow":{"timeout":30,`)
+
+	var got Event
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"type": "BOGUS"}`), &got), errJSONValue)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"version": 2}`), &got), errJSONVersion)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"type": "NEW", "flow": {"status": ["BOGUS"]}}`), &got), errJSONValue)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"type": "EXP_NEW", "expect": {"flags": ["BOGUS"]}}`), &got), errJSONValue)
+}
+
+func TestStatsJSON(t *testing.T) {
+	s := Stats{CPUID: 1, Found: 2, Invalid: 3, Ignore: 4, Insert: 5, InsertFailed: 6, Drop: 7, EarlyDrop: 8, Error: 9, SearchRestart: 10}
+	b, err := json.Marshal(s)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version": 1, "cpu": 1, "found": 2, "invalid": 3, "ignore": 4, "insert": 5,
+		"insert_failed": 6, "drop": 7, "early_drop": 8, "error": 9, "search_restart": 10}`, string(b))
+
+	var gs Stats
+	require.NoError(t, json.Unmarshal(b, &gs))
+	assert.Equal(t, s, gs)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"version": 2}`), &gs), errJSONVersion)
+
+	se := StatsExpect{CPUID: 1, New: 2, Create: 3, Delete: 4}
+	b, err = json.Marshal(se)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version": 1, "cpu": 1, "new": 2, "create": 3, "delete": 4}`, string(b))
+
+	var gse StatsExpect
+	require.NoError(t, json.Unmarshal(b, &gse))
+	assert.Equal(t, se, gse)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"version": 2}`), &gse), errJSONVersion)
+
+	sg := StatsGlobal{Entries: 1, MaxEntries: 2}
+	b, err = json.Marshal(sg)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version": 1, "entries": 1, "max_entries": 2}`, string(b))
+
+	var gsg StatsGlobal
+	require.NoError(t, json.Unmarshal(b, &gsg))
+	assert.Equal(t, sg, gsg)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"version": 2}`), &gsg), errJSONVersion)
+}
@@ -0,0 +1,261 @@
+package conntrack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LabelsMax is the amount of connection labels supported by the kernel.
+const LabelsMax = 128 // NF_CT_LABELS_MAX_SIZE * 8
+
+// labelsSize is the size of a Labels bitmap in bytes as sent by the kernel.
+const labelsSize = LabelsMax / 8
+
+// DefaultLabelMapPath is the default location of connlabel.conf, the file
+// mapping connection label names to bits used by iptables' connlabel match and
+// the conntrack tool.
+const DefaultLabelMapPath = "/etc/xtables/connlabel.conf"
+
+// Labels is a bitmap of connection labels (connlabels) attached to a Flow,
+// similar to a connmark, but holding up to [LabelsMax] independent bits. Labels
+// are typically set by iptables' connlabel target or nftables' ct label
+// statement.
+//
+// Like the kernel and libnetfilter_conntrack, the bitmap is made up of 32-bit
+// words in host byte order, with bit n stored in word n/32. The zero value is
+// an empty bitmap, use [Labels.Set] to set bits.
+type Labels []byte
+
+// NewLabels returns Labels with the given bits set.
+func NewLabels(bits ...int) (Labels, error) {
+	var l Labels
+	for _, bit := range bits {
+		if err := l.Set(bit); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// labelPosition returns the byte index and mask of the given label bit.
+func labelPosition(bit int) (int, byte, error) {
+	if bit < 0 || bit >= LabelsMax {
+		return 0, 0, fmt.Errorf("label bit %d: %w", bit, errLabelRange)
+	}
+
+	// Bytes of a 32-bit word are reversed on big endian machines.
+	b := bit % 32
+	i := b / 8
+	if binary.NativeEndian.Uint16([]byte{0, 1}) == 1 {
+		i = 3 - i
+	}
+
+	return bit/32*4 + i, 1 << (b % 8), nil
+}
+
+// Set sets the given label bit, growing the bitmap to its full size if needed.
+// Returns an error if bit is not in the range [0, LabelsMax).
+func (l *Labels) Set(bit int) error {
+	i, m, err := labelPosition(bit)
+	if err != nil {
+		return err
+	}
+
+	if len(*l) < labelsSize {
+		*l = append(*l, make([]byte, labelsSize-len(*l))...)
+	}
+	(*l)[i] |= m
+
+	return nil
+}
+
+// Clear clears the given label bit. Returns an error if bit is not in the
+// range [0, LabelsMax).
+func (l *Labels) Clear(bit int) error {
+	i, m, err := labelPosition(bit)
+	if err != nil {
+		return err
+	}
+
+	if i < len(*l) {
+		(*l)[i] &^= m
+	}
+
+	return nil
+}
+
+// Has returns true if the given label bit is set.
+func (l Labels) Has(bit int) bool {
+	i, m, err := labelPosition(bit)
+	if err != nil || i >= len(l) {
+		return false
+	}
+
+	return l[i]&m != 0
+}
+
+// Contains returns true if all bits set in other are also set in l.
+func (l Labels) Contains(other Labels) bool {
+	for bit := range other.All() {
+		if !l.Has(bit) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Empty returns true if no label bits are set.
+func (l Labels) Empty() bool {
+	for _, b := range l {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// All returns an iterator over all label bits set, in ascending order.
+func (l Labels) All() iter.Seq[int] {
+	return func(yield func(int) bool) {
+		for bit := range LabelsMax {
+			if l.Has(bit) && !yield(bit) {
+				return
+			}
+		}
+	}
+}
+
+// or returns the union of l and other, sized to hold all label bits.
+func (l Labels) or(other Labels) Labels {
+	out := make(Labels, labelsSize)
+	for i := range out {
+		if i < len(l) {
+			out[i] |= l[i]
+		}
+		if i < len(other) {
+			out[i] |= other[i]
+		}
+	}
+
+	return out
+}
+
+// LabelMap maps connection label names to bits, as configured in
+// connlabel.conf. Use [LoadLabelMap] or [ParseLabelMap] to create one.
+type LabelMap struct {
+	names [LabelsMax]string
+	bits  map[string]int
+}
+
+// LoadLabelMap reads a LabelMap from the connlabel.conf file at path. Use
+// [DefaultLabelMapPath] for the system-wide configuration.
+func LoadLabelMap(path string) (*LabelMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseLabelMap(f)
+}
+
+// ParseLabelMap reads a LabelMap in connlabel.conf format from r. Each line
+// holds a bit number followed by the label's name, for example `1 blocked`.
+// Empty lines and lines starting with '#' are ignored. If multiple names are
+// given for the same bit, the first one is used when looking up names.
+func ParseLabelMap(r io.Reader) (*LabelMap, error) {
+	m := &LabelMap{bits: make(map[string]int)}
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: %w", n, errLabelMapSyntax)
+		}
+
+		bit, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, errLabelMapSyntax)
+		}
+		if bit < 0 || bit >= LabelsMax {
+			return nil, fmt.Errorf("line %d: label bit %d: %w", n, bit, errLabelRange)
+		}
+
+		name := fields[1]
+		if _, ok := m.bits[name]; ok {
+			return nil, fmt.Errorf("line %d: label %q: %w", n, name, errLabelMapDuplicate)
+		}
+
+		m.bits[name] = bit
+		if m.names[bit] == "" {
+			m.names[bit] = name
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Bit returns the bit of the label with the given name.
+func (m *LabelMap) Bit(name string) (int, bool) {
+	bit, ok := m.bits[name]
+	return bit, ok
+}
+
+// Name returns the name of the given label bit.
+func (m *LabelMap) Name(bit int) (string, bool) {
+	if bit < 0 || bit >= LabelsMax || m.names[bit] == "" {
+		return "", false
+	}
+
+	return m.names[bit], true
+}
+
+// Labels returns Labels with the bits of the given label names set. Returns an
+// error if any of the names is unknown.
+func (m *LabelMap) Labels(names ...string) (Labels, error) {
+	var l Labels
+	for _, name := range names {
+		bit, ok := m.bits[name]
+		if !ok {
+			return nil, fmt.Errorf("label %q: %w", name, errLabelUnknown)
+		}
+		if err := l.Set(bit); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Names returns the names of all bits set in l. Bits without a name in the
+// LabelMap are returned as their decimal bit number.
+func (m *LabelMap) Names(l Labels) []string {
+	var out []string
+	for bit := range l.All() {
+		name, ok := m.Name(bit)
+		if !ok {
+			name = strconv.Itoa(bit)
+		}
+		out = append(out, name)
+	}
+
+	return out
+}
@@ -0,0 +1,121 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabels(t *testing.T) {
+	var l Labels
+	assert.True(t, l.Empty())
+	assert.False(t, l.Has(0))
+
+	require.NoError(t, l.Set(0))
+	require.NoError(t, l.Set(33))
+	require.NoError(t, l.Set(127))
+	assert.Len(t, l, labelsSize)
+	assert.False(t, l.Empty())
+	assert.True(t, l.Has(0))
+	assert.True(t, l.Has(33))
+	assert.True(t, l.Has(127))
+	assert.False(t, l.Has(1))
+	assert.Equal(t, []int{0, 33, 127}, slices.Collect(l.All()))
+
+	// Label bits are stored in 32-bit words in host byte order.
+	assert.Equal(t, uint32(1), binary.NativeEndian.Uint32(l[0:4]))
+	assert.Equal(t, uint32(1<<1), binary.NativeEndian.Uint32(l[4:8]))
+	assert.Equal(t, uint32(1<<31), binary.NativeEndian.Uint32(l[12:16]))
+
+	sub, err := NewLabels(0, 127)
+	require.NoError(t, err)
+	assert.True(t, l.Contains(sub))
+	assert.True(t, l.Contains(nil))
+	assert.False(t, sub.Contains(l))
+
+	require.NoError(t, l.Clear(33))
+	assert.False(t, l.Has(33))
+	assert.Equal(t, sub, l)
+
+	// Clearing bits beyond the end of a short bitmap is a no-op.
+	short := Labels{0x01}
+	require.NoError(t, short.Clear(100))
+	assert.Equal(t, Labels{0x01}, short)
+
+	assert.ErrorIs(t, l.Set(128), errLabelRange)
+	assert.ErrorIs(t, l.Set(-1), errLabelRange)
+	assert.ErrorIs(t, l.Clear(128), errLabelRange)
+	assert.False(t, l.Has(128))
+	_, err = NewLabels(1, 200)
+	assert.ErrorIs(t, err, errLabelRange)
+
+	or := sub.or(Labels{0x00})
+	assert.Equal(t, sub, or)
+	assert.Len(t, Labels(nil).or(nil), labelsSize)
+}
+
+const connlabelConf = `
+# Example connlabel.conf
+0	eth0-in
+1	eth0-out
+1	eth0-out-alias
+
+127 last
+`
+
+func TestLabelMap(t *testing.T) {
+	m, err := ParseLabelMap(strings.NewReader(connlabelConf))
+	require.NoError(t, err)
+
+	bit, ok := m.Bit("eth0-out")
+	assert.True(t, ok)
+	assert.Equal(t, 1, bit)
+	bit, ok = m.Bit("eth0-out-alias")
+	assert.True(t, ok)
+	assert.Equal(t, 1, bit)
+	_, ok = m.Bit("nope")
+	assert.False(t, ok)
+
+	name, ok := m.Name(1)
+	assert.True(t, ok)
+	assert.Equal(t, "eth0-out", name)
+	_, ok = m.Name(2)
+	assert.False(t, ok)
+	_, ok = m.Name(128)
+	assert.False(t, ok)
+
+	l, err := m.Labels("eth0-in", "last")
+	require.NoError(t, err)
+	want, err := NewLabels(0, 127)
+	require.NoError(t, err)
+	assert.Equal(t, want, l)
+
+	_, err = m.Labels("eth0-in", "nope")
+	assert.ErrorIs(t, err, errLabelUnknown)
+
+	require.NoError(t, l.Set(5))
+	assert.Equal(t, []string{"eth0-in", "5", "last"}, m.Names(l))
+}
+
+func TestLabelMapError(t *testing.T) {
+	for _, tt := range []struct {
+		conf string
+		err  error
+	}{
+		{"1", errLabelMapSyntax},
+		{"1 foo bar", errLabelMapSyntax},
+		{"one foo", errLabelMapSyntax},
+		{"128 foo", errLabelRange},
+		{"1 foo\n2 foo", errLabelMapDuplicate},
+	} {
+		_, err := ParseLabelMap(strings.NewReader(tt.conf))
+		assert.ErrorIs(t, err, tt.err, tt.conf)
+	}
+
+	_, err := LoadLabelMap("/nonexistent/connlabel.conf")
+	assert.Error(t, err)
+}
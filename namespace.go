@@ -0,0 +1,544 @@
+package conntrack
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+// Namespace identifies a network namespace by the device and inode numbers of
+// its nsfs file, like lsns(8) and `ip netns identify` do. Unlike Netlink
+// namespace IDs (NSIDs), which are relative to the namespace they are queried
+// from, it uniquely identifies a namespace on the host for as long as the
+// namespace exists.
+type Namespace struct {
+	Dev   uint64
+	Inode uint64
+}
+
+// String returns the Namespace in the format used by the /proc/<pid>/ns/net
+// symlink, e.g. `net:[4026531840]`.
+func (ns Namespace) String() string {
+	return fmt.Sprintf("net:[%d]", ns.Inode)
+}
+
+// namespaceOf returns the identity of the network namespace referred to by f.
+func namespaceOf(f *os.File) (Namespace, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return Namespace{}, fmt.Errorf("stat namespace %s: %w", f.Name(), err)
+	}
+
+	return Namespace{Dev: st.Dev, Inode: st.Ino}, nil
+}
+
+// pidNamespacePath returns the path to the network namespace of process pid.
+func pidNamespacePath(pid int) string {
+	return "/proc/" + strconv.Itoa(pid) + "/ns/net"
+}
+
+// DialNamespace opens a Conn in the network namespace referred to by path, like
+// /var/run/netns/<name> or /proc/<pid>/ns/net. The NetNS field of config is
+// ignored, config may be nil. Joining another network namespace requires
+// CAP_SYS_ADMIN.
+//
+// The Conn keeps a reference to the namespace until it is closed.
+func DialNamespace(path string, config *netlink.Config) (*Conn, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := dialNamespace(f, config)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// DialNamespaceFD is like [DialNamespace], but takes an open file descriptor
+// referring to a network namespace. The Conn operates on a duplicate of fd, so
+// the caller remains responsible for closing fd.
+func DialNamespaceFD(fd int, config *netlink.Config) (*Conn, error) {
+	nfd, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("duplicate namespace fd %d: %w", fd, err)
+	}
+	f := os.NewFile(uintptr(nfd), "netns-fd-"+strconv.Itoa(fd))
+
+	c, err := dialNamespace(f, config)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// DialPid is like [DialNamespace], but opens a Conn in the network namespace
+// of the process with the given pid.
+func DialPid(pid int, config *netlink.Config) (*Conn, error) {
+	return DialNamespace(pidNamespacePath(pid), config)
+}
+
+// dialNamespace dials a Conn in the network namespace referred to by f. The
+// Conn takes ownership of f, keeping it open so additional sockets can be
+// dialed in the same namespace later on.
+func dialNamespace(f *os.File, config *netlink.Config) (*Conn, error) {
+	var cfg netlink.Config
+	if config != nil {
+		cfg = *config
+	}
+	cfg.NetNS = int(f.Fd())
+
+	c, err := Dial(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.netns = f
+
+	return c, nil
+}
+
+// NamespaceError wraps an error that occurred while operating on a network
+// namespace tracked by a [NamespaceManager].
+type NamespaceError struct {
+	Namespace Namespace
+	Err       error
+}
+
+func (e *NamespaceError) Error() string {
+	return fmt.Sprintf("namespace %s: %v", e.Namespace, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *NamespaceError) Unwrap() error {
+	return e.Err
+}
+
+// NamespacedFlow is a Flow tagged with the network namespace it was read from.
+type NamespacedFlow struct {
+	Namespace Namespace
+	Flow
+}
+
+// NamespacedEvent is an Event tagged with the network namespace it was
+// received from.
+type NamespacedEvent struct {
+	Namespace Namespace
+	Event
+}
+
+// NamespaceManager opens and tracks one Conn per network namespace, for
+// example to collect conntrack information from all pods or containers on a
+// host. Namespaces can be added and removed at any time, also while the
+// NamespaceManager is listening for events.
+//
+// A NamespaceManager is safe for concurrent use.
+type NamespaceManager struct {
+	config *netlink.Config
+
+	mu         sync.RWMutex
+	namespaces map[Namespace]*managedNamespace
+	listen     *managerListen
+	closed     bool
+}
+
+// managedNamespace holds the state of a namespace tracked by a
+// NamespaceManager.
+type managedNamespace struct {
+	path string
+	file *os.File
+
+	// conn is used for queries.
+	conn *Conn
+
+	// listener, cancel and fwd are set when the NamespaceManager is listening
+	// for events.
+	listener *Conn
+	cancel   context.CancelFunc
+	fwd      sync.WaitGroup
+}
+
+// managerListen holds the arguments to [NamespaceManager.Listen], used for
+// listening on namespaces added afterwards.
+type managerListen struct {
+	ctx        context.Context
+	evChan     chan<- NamespacedEvent
+	errChan    chan error
+	numWorkers uint8
+	groups     []netfilter.NetlinkGroup
+	opts       ListenOptions
+}
+
+// NewNamespaceManager returns a NamespaceManager that dials its Conns using
+// config. The NetNS field of config is ignored, config may be nil.
+func NewNamespaceManager(config *netlink.Config) *NamespaceManager {
+	var cfg *netlink.Config
+	if config != nil {
+		cc := *config
+		cfg = &cc
+	}
+
+	return &NamespaceManager{
+		config:     cfg,
+		namespaces: make(map[Namespace]*managedNamespace),
+	}
+}
+
+// Add opens a Conn in the network namespace referred to by path, like
+// /var/run/netns/<name> or /proc/<pid>/ns/net, and returns the namespace's
+// identity. If the NamespaceManager is listening for events, it starts
+// listening in the namespace as well.
+//
+// Adding a namespace that is already tracked, for example through another path
+// or process, is a no-op.
+func (m *NamespaceManager) Add(path string) (Namespace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Namespace{}, err
+	}
+
+	ns, err := namespaceOf(f)
+	if err != nil {
+		f.Close()
+		return Namespace{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		f.Close()
+		return Namespace{}, errNamespaceManagerClosed
+	}
+
+	if _, ok := m.namespaces[ns]; ok {
+		f.Close()
+		return ns, nil
+	}
+
+	mn := &managedNamespace{path: path, file: f}
+	mn.conn, err = DialNamespaceFD(int(f.Fd()), m.config)
+	if err != nil {
+		f.Close()
+		return Namespace{}, &NamespaceError{ns, err}
+	}
+
+	if m.listening() {
+		if err := m.listenNamespace(ns, mn); err != nil {
+			mn.close()
+			return Namespace{}, &NamespaceError{ns, err}
+		}
+	}
+
+	m.namespaces[ns] = mn
+
+	return ns, nil
+}
+
+// AddPid is like [NamespaceManager.Add], but adds the network namespace of the
+// process with the given pid.
+func (m *NamespaceManager) AddPid(pid int) (Namespace, error) {
+	return m.Add(pidNamespacePath(pid))
+}
+
+// Remove stops tracking the given namespace, closing its Conns and stopping
+// any event listeners in the namespace.
+func (m *NamespaceManager) Remove(ns Namespace) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mn, ok := m.namespaces[ns]
+	if !ok {
+		return &NamespaceError{ns, errnoError(unix.ENOENT)}
+	}
+	delete(m.namespaces, ns)
+
+	if err := mn.close(); err != nil {
+		return &NamespaceError{ns, err}
+	}
+
+	return nil
+}
+
+// Namespaces returns all namespaces tracked by the NamespaceManager.
+func (m *NamespaceManager) Namespaces() []Namespace {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.sorted()
+}
+
+// Path returns the path the namespace was added with.
+func (m *NamespaceManager) Path(ns Namespace) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	mn, ok := m.namespaces[ns]
+	if !ok {
+		return "", false
+	}
+
+	return mn.path, true
+}
+
+// Conn returns the Conn used for queries in the given namespace. The Conn is
+// owned by the NamespaceManager and must not be closed by the caller.
+func (m *NamespaceManager) Conn(ns Namespace) (*Conn, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	mn, ok := m.namespaces[ns]
+	if !ok {
+		return nil, false
+	}
+
+	return mn.conn, true
+}
+
+// sorted returns the tracked namespaces in a stable order. m.mu must be held.
+func (m *NamespaceManager) sorted() []Namespace {
+	out := make([]Namespace, 0, len(m.namespaces))
+	for ns := range m.namespaces {
+		out = append(out, ns)
+	}
+
+	slices.SortFunc(out, func(a, b Namespace) int {
+		if a.Dev != b.Dev {
+			return cmp.Compare(a.Dev, b.Dev)
+		}
+		return cmp.Compare(a.Inode, b.Inode)
+	})
+
+	return out
+}
+
+// Dump gets all Conntrack connections from all tracked namespaces, tagged with
+// the namespace they were read from.
+//
+// Namespaces that fail to be dumped don't prevent others from being dumped.
+// Their errors are returned as [*NamespaceError]s joined together, along with
+// the Flows from all other namespaces.
+//
+// Dump uses [context.Background] internally, use
+// [NamespaceManager.DumpContext] to specify a context.
+func (m *NamespaceManager) Dump(opts *DumpOptions) ([]NamespacedFlow, error) {
+	return m.DumpContext(context.Background(), opts)
+}
+
+// DumpContext is like [NamespaceManager.Dump], but aborts the operation when
+// ctx is cancelled or its deadline expires.
+func (m *NamespaceManager) DumpContext(ctx context.Context, opts *DumpOptions) ([]NamespacedFlow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var out []NamespacedFlow
+	var errs []error
+	for _, ns := range m.sorted() {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+
+		for f, err := range m.namespaces[ns].conn.DumpSeqContext(ctx, opts) {
+			if err != nil {
+				errs = append(errs, &NamespaceError{ns, err})
+				break
+			}
+			out = append(out, NamespacedFlow{Namespace: ns, Flow: f})
+		}
+	}
+
+	return out, errors.Join(errs...)
+}
+
+// Listen starts listening for events in all tracked namespaces, as well as in
+// namespaces added later on. Events are tagged with the namespace they were
+// received from and sent on evChan. In each namespace, a separate Conn is
+// dialed and numWorkers workers are started, see [Conn.ListenWithOptions].
+//
+// Worker errors are sent on the returned error channel as [*NamespaceError]s.
+// Removing a namespace stops its workers silently. All workers terminate
+// silently when ctx is cancelled or the NamespaceManager is closed.
+//
+// Listen can't be called again until ctx is cancelled.
+func (m *NamespaceManager) Listen(ctx context.Context, evChan chan<- NamespacedEvent, numWorkers uint8,
+	groups []netfilter.NetlinkGroup, opts ListenOptions) (chan error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if numWorkers == 0 {
+		return nil, errNoWorkers
+	}
+
+	if len(groups) == 0 {
+		return nil, errNoGroups
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, errNamespaceManagerClosed
+	}
+
+	if m.listening() {
+		return nil, errNamespaceManagerListening
+	}
+
+	l := &managerListen{
+		ctx:        ctx,
+		evChan:     evChan,
+		errChan:    make(chan error),
+		numWorkers: numWorkers,
+		groups:     slices.Clone(groups),
+		opts:       opts,
+	}
+	m.listen = l
+
+	for _, ns := range m.sorted() {
+		mn := m.namespaces[ns]
+		if err := m.listenNamespace(ns, mn); err != nil {
+			// Roll back listeners started so far.
+			m.stopListen(l)
+			return nil, &NamespaceError{ns, err}
+		}
+	}
+
+	// Release the listeners once ctx is cancelled, so namespaces can be added
+	// and Listen can be called again.
+	context.AfterFunc(ctx, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.stopListen(l)
+	})
+
+	return l.errChan, nil
+}
+
+// listening returns true if the NamespaceManager is listening for events. The
+// listeners of a Listen call whose ctx was cancelled are stopped, in case
+// that didn't happen yet. m.mu must be held.
+func (m *NamespaceManager) listening() bool {
+	if m.listen != nil && m.listen.ctx.Err() != nil {
+		m.stopListen(m.listen)
+	}
+
+	return m.listen != nil
+}
+
+// stopListen stops the event workers in all namespaces, if the
+// NamespaceManager is still listening using the arguments l. m.mu must be
+// held.
+func (m *NamespaceManager) stopListen(l *managerListen) {
+	if m.listen != l {
+		return
+	}
+
+	for _, mn := range m.namespaces {
+		mn.stopListening()
+	}
+	m.listen = nil
+}
+
+// listenNamespace starts event workers in the given namespace, forwarding
+// their events and errors to the NamespaceManager's channels. m.mu must be
+// held.
+func (m *NamespaceManager) listenNamespace(ns Namespace, mn *managedNamespace) error {
+	l := m.listen
+
+	lc, err := DialNamespaceFD(int(mn.file.Fd()), m.config)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(l.ctx)
+	events := make(chan Event)
+	errs, err := lc.ListenWithOptions(ctx, events, l.numWorkers, l.groups, l.opts)
+	if err != nil {
+		cancel()
+		lc.Close()
+		return err
+	}
+
+	mn.listener, mn.cancel = lc, cancel
+
+	mn.fwd.Add(1)
+	go func() {
+		defer mn.fwd.Done()
+
+		for {
+			select {
+			case ev := <-events:
+				select {
+				case l.evChan <- NamespacedEvent{Namespace: ns, Event: ev}:
+				case <-ctx.Done():
+					return
+				}
+			case err := <-errs:
+				sendErr(ctx, l.errChan, &NamespaceError{ns, err})
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// stopListening stops the namespace's event workers, if any.
+func (mn *managedNamespace) stopListening() error {
+	if mn.listener == nil {
+		return nil
+	}
+
+	mn.cancel()
+	mn.fwd.Wait()
+
+	err := mn.listener.Close()
+	mn.listener, mn.cancel = nil, nil
+
+	return err
+}
+
+// close stops all event workers and closes all resources held for the
+// namespace.
+func (mn *managedNamespace) close() error {
+	return errors.Join(mn.stopListening(), mn.conn.Close(), mn.file.Close())
+}
+
+// Close stops all event workers and closes all Conns and namespace references
+// held by the NamespaceManager.
+func (m *NamespaceManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
+	var errs []error
+	for _, ns := range m.sorted() {
+		if err := m.namespaces[ns].close(); err != nil {
+			errs = append(errs, &NamespaceError{ns, err})
+		}
+		delete(m.namespaces, ns)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,205 @@
+//go:build integration
+
+package conntrack
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// newNS creates a new network namespace without moving the calling goroutine
+// into it and returns a path referring to it.
+func newNS(t *testing.T) string {
+	t.Helper()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	require.NoError(t, err)
+	defer orig.Close()
+
+	ns, err := netns.New()
+	require.NoError(t, err)
+	require.NoError(t, netns.Set(orig))
+	t.Cleanup(func() { ns.Close() })
+
+	return fmt.Sprintf("/proc/self/fd/%d", ns)
+}
+
+func TestDialNamespace(t *testing.T) {
+	path := newNS(t)
+
+	c, err := DialNamespace(path, nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	f := NewFlow(unix.IPPROTO_TCP, 0, netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), 1234, 80, 120, 0)
+	require.NoError(t, c.Create(f))
+
+	// A Conn dialed through a file descriptor sees the same table.
+	nsf, err := os.Open(path)
+	require.NoError(t, err)
+	fc, err := DialNamespaceFD(int(nsf.Fd()), nil)
+	require.NoError(t, err)
+	require.NoError(t, nsf.Close())
+	defer fc.Close()
+
+	flows, err := fc.Dump(nil)
+	require.NoError(t, err)
+	assert.Len(t, flows, 1)
+
+	// The namespace of this process doesn't contain the Flow.
+	pc, err := DialPid(os.Getpid(), nil)
+	require.NoError(t, err)
+	defer pc.Close()
+
+	_, err = pc.Get(f)
+	assert.ErrorIs(t, err, unix.ENOENT)
+
+	_, err = DialNamespace("/nonexistent", nil)
+	assert.ErrorIs(t, err, unix.ENOENT)
+}
+
+func TestNamespaceManager(t *testing.T) {
+	m := NewNamespaceManager(nil)
+	defer m.Close()
+
+	p1, p2 := newNS(t), newNS(t)
+
+	ns1, err := m.Add(p1)
+	require.NoError(t, err)
+	ns2, err := m.Add(p2)
+	require.NoError(t, err)
+	assert.NotEqual(t, ns1, ns2)
+
+	// Adding the same namespace twice is a no-op.
+	ns, err := m.Add(p1)
+	require.NoError(t, err)
+	assert.Equal(t, ns1, ns)
+	assert.ElementsMatch(t, []Namespace{ns1, ns2}, m.Namespaces())
+
+	path, ok := m.Path(ns2)
+	require.True(t, ok)
+	assert.Equal(t, p2, path)
+
+	ev := make(chan NamespacedEvent, 16)
+	errChan, err := m.Listen(context.Background(), ev, 1,
+		[]netfilter.NetlinkGroup{netfilter.GroupCTNew}, ListenOptions{})
+	require.NoError(t, err)
+	go func() {
+		for err := range errChan {
+			t.Error(err)
+		}
+	}()
+
+	create := func(ns Namespace, sport uint16) {
+		t.Helper()
+		c, ok := m.Conn(ns)
+		require.True(t, ok)
+		require.NoError(t, c.Create(NewFlow(unix.IPPROTO_TCP, 0,
+			netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), sport, 80, 120, 0)))
+	}
+
+	recv := func() NamespacedEvent {
+		t.Helper()
+		select {
+		case e := <-ev:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+		return NamespacedEvent{}
+	}
+
+	create(ns1, 1)
+	e := recv()
+	assert.Equal(t, ns1, e.Namespace)
+	assert.Equal(t, uint16(1), e.Flow.TupleOrig.Proto.SourcePort)
+
+	create(ns2, 2)
+	e = recv()
+	assert.Equal(t, ns2, e.Namespace)
+	assert.Equal(t, uint16(2), e.Flow.TupleOrig.Proto.SourcePort)
+
+	// Namespaces added while listening get listeners as well.
+	ns3, err := m.Add(newNS(t))
+	require.NoError(t, err)
+	create(ns3, 3)
+	e = recv()
+	assert.Equal(t, ns3, e.Namespace)
+
+	flows, err := m.Dump(nil)
+	require.NoError(t, err)
+	require.Len(t, flows, 3)
+	got := map[Namespace]uint16{}
+	for _, f := range flows {
+		got[f.Namespace] = f.TupleOrig.Proto.SourcePort
+	}
+	assert.Equal(t, map[Namespace]uint16{ns1: 1, ns2: 2, ns3: 3}, got)
+
+	// Removed namespaces no longer produce events or Flows.
+	c2, _ := m.Conn(ns2)
+	require.NoError(t, m.Remove(ns2))
+	assert.ErrorIs(t, m.Remove(ns2), unix.ENOENT)
+	assert.ErrorIs(t, c2.Create(NewFlow(unix.IPPROTO_TCP, 0,
+		netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), 4, 80, 120, 0)), unix.EBADF)
+
+	flows, err = m.Dump(nil)
+	require.NoError(t, err)
+	assert.Len(t, flows, 2)
+
+	require.NoError(t, m.Close())
+	assert.Empty(t, m.Namespaces())
+}
+
+func TestNamespaceManagerListenCancel(t *testing.T) {
+	m := NewNamespaceManager(nil)
+	defer m.Close()
+
+	ns1, err := m.Add(newNS(t))
+	require.NoError(t, err)
+
+	groups := []netfilter.NetlinkGroup{netfilter.GroupCTNew}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = m.Listen(ctx, make(chan NamespacedEvent), 1, groups, ListenOptions{})
+	require.NoError(t, err)
+
+	_, err = m.Listen(context.Background(), make(chan NamespacedEvent), 1, groups, ListenOptions{})
+	assert.ErrorIs(t, err, errNamespaceManagerListening)
+
+	// Namespaces can still be added after cancelling Listen's ctx.
+	cancel()
+	ns2, err := m.Add(newNS(t))
+	require.NoError(t, err)
+
+	// Listen can be called again, covering all namespaces.
+	ev := make(chan NamespacedEvent, 16)
+	_, err = m.Listen(context.Background(), ev, 1, groups, ListenOptions{})
+	require.NoError(t, err)
+
+	for i, ns := range []Namespace{ns1, ns2} {
+		c, ok := m.Conn(ns)
+		require.True(t, ok)
+		require.NoError(t, c.Create(NewFlow(unix.IPPROTO_TCP, 0,
+			netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), uint16(i+1), 80, 120, 0)))
+
+		select {
+		case e := <-ev:
+			assert.Equal(t, ns, e.Namespace)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}
+}
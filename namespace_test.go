@@ -0,0 +1,62 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+func TestNamespaceString(t *testing.T) {
+	assert.Equal(t, "net:[4026531840]", Namespace{Dev: 4, Inode: 4026531840}.String())
+}
+
+func TestNamespaceError(t *testing.T) {
+	err := &NamespaceError{Namespace{Inode: 1}, unix.ENOENT}
+	assert.Equal(t, "namespace net:[1]: no such file or directory", err.Error())
+	assert.ErrorIs(t, err, unix.ENOENT)
+
+	var nse *NamespaceError
+	require.True(t, errors.As(errors.Join(unix.EINVAL, err), &nse))
+	assert.Equal(t, uint64(1), nse.Namespace.Inode)
+}
+
+func TestNamespaceManagerErrors(t *testing.T) {
+	m := NewNamespaceManager(nil)
+
+	_, err := m.Add("/nonexistent")
+	assert.ErrorIs(t, err, unix.ENOENT)
+
+	assert.ErrorIs(t, m.Remove(Namespace{Inode: 1}), unix.ENOENT)
+	assert.ErrorIs(t, m.Remove(Namespace{Inode: 1}), ErrNotFound)
+
+	_, ok := m.Conn(Namespace{Inode: 1})
+	assert.False(t, ok)
+
+	ev := make(chan NamespacedEvent)
+	groups := []netfilter.NetlinkGroup{netfilter.GroupCTNew}
+	_, err = m.Listen(context.Background(), ev, 0, groups, ListenOptions{})
+	assert.ErrorIs(t, err, errNoWorkers)
+	_, err = m.Listen(context.Background(), ev, 1, nil, ListenOptions{})
+	assert.ErrorIs(t, err, errNoGroups)
+
+	// Listening without any namespaces succeeds, namespaces can be added later.
+	_, err = m.Listen(context.Background(), ev, 1, groups, ListenOptions{})
+	require.NoError(t, err)
+	_, err = m.Listen(context.Background(), ev, 1, groups, ListenOptions{})
+	assert.ErrorIs(t, err, errNamespaceManagerListening)
+
+	flows, err := m.Dump(nil)
+	require.NoError(t, err)
+	assert.Empty(t, flows)
+
+	require.NoError(t, m.Close())
+	require.NoError(t, m.Close())
+
+	_, err = m.Add("/proc/self/ns/net")
+	assert.ErrorIs(t, err, errNamespaceManagerClosed)
+}
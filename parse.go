@@ -0,0 +1,316 @@
+package conntrack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpStates holds the names of the TCP conntrack states, indexed by
+// [ProtoInfoTCP.State].
+var tcpStates = []string{
+	"NONE",
+	"SYN_SENT",
+	"SYN_RECV",
+	"ESTABLISHED",
+	"FIN_WAIT",
+	"CLOSE_WAIT",
+	"LAST_ACK",
+	"TIME_WAIT",
+	"CLOSE",
+	"SYN_SENT2",
+}
+
+// sctpStates holds the names of the SCTP conntrack states, indexed by
+// [ProtoInfoSCTP.State].
+var sctpStates = []string{
+	"NONE",
+	"CLOSED",
+	"COOKIE_WAIT",
+	"COOKIE_ECHOED",
+	"ESTABLISHED",
+	"SHUTDOWN_SENT",
+	"SHUTDOWN_RECD",
+	"SHUTDOWN_ACK_SENT",
+	"HEARTBEAT_SENT",
+	"HEARTBEAT_ACKED",
+}
+
+// dccpStates holds the names of the DCCP conntrack states, indexed by
+// [ProtoInfoDCCP.State].
+var dccpStates = []string{
+	"NONE",
+	"REQUEST",
+	"RESPOND",
+	"PARTOPEN",
+	"OPEN",
+	"CLOSEREQ",
+	"CLOSING",
+	"TIMEWAIT",
+	"IGNORE",
+	"INVALID",
+}
+
+// ParseFlows parses connections listed in the text format of
+// /proc/net/nf_conntrack or the output of `conntrack -L` into Flows, one Flow
+// per non-empty line. The summary line printed by conntrack is ignored. See
+// [ParseFlow] for the fields populated.
+func ParseFlows(r io.Reader) ([]Flow, error) {
+	var out []Flow
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "conntrack v") {
+			continue
+		}
+
+		f, err := ParseFlow(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		out = append(out, f)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// ParseFlow parses a single connection in the text format of
+// /proc/net/nf_conntrack or `conntrack -L`, like:
+//
+//	ipv4     2 tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=51234 dport=22 ...
+//	tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=51234 dport=22 ...
+//
+// It populates the Flow's tuples, Timeout, TCP, SCTP and DCCP state, counters,
+// Mark, Zone, Use, ID, SecurityContext and Helper name, as far as they are
+// present in the line. The text formats don't carry the full connection
+// status, so Status is derived from the flags shown: all listed connections
+// are confirmed, seen reply unless marked [UNREPLIED], and assured or
+// offloaded when marked as such. Unknown fields are ignored.
+func ParseFlow(line string) (Flow, error) {
+	var f Flow
+
+	fields := strings.Fields(line)
+
+	// Skip event types and timestamps printed by `conntrack -E`.
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "[") {
+		fields = fields[1:]
+	}
+
+	// /proc/net/nf_conntrack and `conntrack -o extended` prefix the layer 3
+	// protocol name and number.
+	if len(fields) > 4 && isNumber(fields[1]) && isNumber(fields[3]) && isNumber(fields[4]) {
+		fields = fields[2:]
+	}
+
+	if len(fields) < 3 {
+		return Flow{}, fmt.Errorf("%q: %w", line, errParseFlow)
+	}
+
+	proto, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return Flow{}, fmt.Errorf("protocol %q: %w", fields[1], errParseFlow)
+	}
+	timeout, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return Flow{}, fmt.Errorf("timeout %q: %w", fields[2], errParseFlow)
+	}
+	f.Timeout = uint32(timeout)
+	fields = fields[3:]
+
+	// Stateful protocols print their state before the tuples.
+	if len(fields) > 0 && !strings.ContainsAny(fields[0], "=[") {
+		if err := f.parseState(uint8(proto), fields[0]); err != nil {
+			return Flow{}, err
+		}
+		fields = fields[1:]
+	}
+
+	p := flowParser{flow: &f, proto: uint8(proto), dir: -1}
+	for _, field := range fields {
+		if err := p.parseField(field); err != nil {
+			return Flow{}, err
+		}
+	}
+
+	if p.dir != 1 {
+		return Flow{}, fmt.Errorf("%q: need original and reply tuples: %w", line, errParseFlow)
+	}
+
+	f.Status |= StatusConfirmed
+	if !p.unreplied {
+		f.Status |= StatusSeenReply
+	}
+
+	return f, nil
+}
+
+// isNumber returns true if s is a non-empty string of decimal digits.
+func isNumber(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// parseState sets the protocol state of f from its name.
+func (f *Flow) parseState(proto uint8, name string) error {
+	var states []string
+	switch proto {
+	case unix.IPPROTO_TCP:
+		states = tcpStates
+		// conntrack-tools calls SYN_SENT2 by its former name.
+		if name == "LISTEN" {
+			name = "SYN_SENT2"
+		}
+	case unix.IPPROTO_SCTP:
+		states = sctpStates
+	case unix.IPPROTO_DCCP:
+		states = dccpStates
+	}
+
+	i := slices.Index(states, name)
+	if i < 0 {
+		return fmt.Errorf("state %q of protocol %d: %w", name, proto, errParseFlow)
+	}
+
+	switch proto {
+	case unix.IPPROTO_TCP:
+		f.ProtoInfo.TCP = &ProtoInfoTCP{State: uint8(i)}
+	case unix.IPPROTO_SCTP:
+		f.ProtoInfo.SCTP = &ProtoInfoSCTP{State: uint8(i)}
+	case unix.IPPROTO_DCCP:
+		f.ProtoInfo.DCCP = &ProtoInfoDCCP{State: uint8(i)}
+	}
+
+	return nil
+}
+
+// flowParser holds the state of parsing the fields of a Flow following its
+// protocol state.
+type flowParser struct {
+	flow  *Flow
+	proto uint8
+
+	// dir is the direction of the tuple currently being parsed, 0 for
+	// original and 1 for reply, or -1 before the first tuple.
+	dir int
+
+	// last is the key of the previous field.
+	last string
+
+	unreplied bool
+}
+
+// tuple returns the tuple currently being parsed.
+func (p *flowParser) tuple() *Tuple {
+	if p.dir == 0 {
+		return &p.flow.TupleOrig
+	}
+
+	return &p.flow.TupleReply
+}
+
+// counter returns the counter of the tuple currently being parsed.
+func (p *flowParser) counter() *Counter {
+	if p.dir == 0 {
+		return &p.flow.CountersOrig
+	}
+
+	p.flow.CountersReply.Direction = true
+	return &p.flow.CountersReply
+}
+
+// parseField parses a single `key=value` or `[FLAG]` field.
+func (p *flowParser) parseField(field string) error {
+	switch field {
+	case "[UNREPLIED]":
+		p.unreplied = true
+		return nil
+	case "[ASSURED]":
+		p.flow.Status |= StatusAssured
+		return nil
+	case "[OFFLOAD]", "[HW_OFFLOAD]":
+		p.flow.Status |= StatusOffload
+		return nil
+	}
+
+	key, value, ok := strings.Cut(field, "=")
+	if !ok {
+		// Other flags, like timestamps printed by `conntrack -o timestamp`.
+		return nil
+	}
+	last := p.last
+	p.last = key
+
+	inTuple := p.dir >= 0
+	icmp := p.proto == unix.IPPROTO_ICMP || p.proto == unix.IPPROTO_ICMPV6
+
+	var err error
+	switch {
+	case key == "src":
+		if p.dir == 1 {
+			return fmt.Errorf("more than two tuples: %w", errParseFlow)
+		}
+		p.dir++
+
+		t := p.tuple()
+		t.Proto.Protocol = p.proto
+		t.Proto.ICMPv4 = p.proto == unix.IPPROTO_ICMP
+		t.Proto.ICMPv6 = p.proto == unix.IPPROTO_ICMPV6
+		t.IP.SourceAddress, err = netip.ParseAddr(value)
+	case key == "dst" && inTuple:
+		p.tuple().IP.DestinationAddress, err = netip.ParseAddr(value)
+	case key == "sport" && inTuple:
+		p.tuple().Proto.SourcePort, err = parseUint[uint16](value, 16)
+	case key == "dport" && inTuple:
+		p.tuple().Proto.DestinationPort, err = parseUint[uint16](value, 16)
+	case key == "type" && inTuple && icmp:
+		p.tuple().Proto.ICMPType, err = parseUint[uint8](value, 8)
+	case key == "code" && inTuple && icmp:
+		p.tuple().Proto.ICMPCode, err = parseUint[uint8](value, 8)
+	// `conntrack -o id` prints the Flow's ID with the same key as the ICMP ID
+	// following the ICMP code.
+	case key == "id" && inTuple && icmp && last == "code":
+		p.tuple().Proto.ICMPID, err = parseUint[uint16](value, 16)
+	case key == "id":
+		p.flow.ID, err = parseUint[uint32](value, 32)
+	case key == "packets" && inTuple:
+		p.counter().Packets, err = parseUint[uint64](value, 64)
+	case key == "bytes" && inTuple:
+		p.counter().Bytes, err = parseUint[uint64](value, 64)
+	case key == "mark":
+		p.flow.Mark, err = parseUint[uint32](value, 32)
+	case key == "zone":
+		p.flow.Zone, err = parseUint[uint16](value, 16)
+	case key == "zone-orig":
+		p.flow.TupleOrig.Zone, err = parseUint[uint16](value, 16)
+	case key == "zone-reply":
+		p.flow.TupleReply.Zone, err = parseUint[uint16](value, 16)
+	case key == "use":
+		p.flow.Use, err = parseUint[uint32](value, 32)
+	case key == "secctx":
+		p.flow.SecurityContext = Security(value)
+	case key == "helper":
+		p.flow.Helper.Name = value
+	}
+
+	if err != nil {
+		return fmt.Errorf("field %q: %w", field, errParseFlow)
+	}
+
+	return nil
+}
+
+// parseUint parses a decimal unsigned integer of the given bit size.
+func parseUint[T uint8 | uint16 | uint32 | uint64](s string, bits int) (T, error) {
+	n, err := strconv.ParseUint(s, 10, bits)
+	return T(n), err
+}
@@ -0,0 +1,88 @@
+//go:build integration
+
+package conntrack
+
+import (
+	"net/netip"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseProcConntrack(t *testing.T) {
+	path := newNS(t)
+
+	c, err := DialNamespace(path, nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	tcp := NewFlow(unix.IPPROTO_TCP, 0, netip.MustParseAddr("10.44.0.1"), netip.MustParseAddr("10.44.0.2"), 1, 2, 120, 0xff)
+	tcp.ProtoInfo.TCP = &ProtoInfoTCP{State: 3}
+	require.NoError(t, c.Create(tcp))
+	udp := NewFlow(unix.IPPROTO_UDP, 0, netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2"), 3, 4, 120, 0)
+	require.NoError(t, c.Create(udp))
+
+	want, err := c.Dump(nil)
+	require.NoError(t, err)
+
+	// /proc/thread-self/net refers to the network namespace of the calling
+	// thread, read it from a thread that joined the test namespace.
+	ns, err := os.Open(path)
+	require.NoError(t, err)
+	defer ns.Close()
+
+	type result struct {
+		flows []Flow
+		err   error
+	}
+	resC := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			resC <- result{err: err}
+			return
+		}
+
+		f, err := os.Open("/proc/thread-self/net/nf_conntrack")
+		if err != nil {
+			resC <- result{err: err}
+			return
+		}
+		defer f.Close()
+
+		fs, err := ParseFlows(f)
+		resC <- result{fs, err}
+	}()
+
+	res := <-resC
+	if os.IsNotExist(res.err) {
+		t.Skip("/proc/net/nf_conntrack not supported by kernel")
+	}
+	require.NoError(t, res.err)
+	require.Len(t, res.flows, len(want))
+
+	for _, w := range want {
+		var found bool
+		for _, got := range res.flows {
+			if got.TupleOrig != w.TupleOrig {
+				continue
+			}
+			found = true
+
+			assert.Equal(t, w.TupleReply, got.TupleReply)
+			assert.Equal(t, w.Mark, got.Mark)
+			assert.Equal(t, w.Zone, got.Zone)
+			assert.Equal(t, w.Status.SeenReply(), got.Status.SeenReply())
+			assert.InDelta(t, w.Timeout, got.Timeout, 2)
+			if w.ProtoInfo.TCP != nil {
+				require.NotNil(t, got.ProtoInfo.TCP)
+				assert.Equal(t, w.ProtoInfo.TCP.State, got.ProtoInfo.TCP.State)
+			}
+		}
+		assert.True(t, found, "flow %s not found", w.TupleOrig)
+	}
+}
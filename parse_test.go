@@ -0,0 +1,154 @@
+package conntrack
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseFlow(t *testing.T) {
+	tcp := Flow{
+		Timeout:       431999,
+		Status:        StatusConfirmed | StatusSeenReply | StatusAssured,
+		ProtoInfo:     ProtoInfo{TCP: &ProtoInfoTCP{State: 3}},
+		CountersOrig:  Counter{Packets: 10, Bytes: 1000},
+		CountersReply: Counter{Direction: true, Packets: 8, Bytes: 2000},
+		TupleOrig: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("10.0.0.1"), DestinationAddress: netip.MustParseAddr("10.0.0.2")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_TCP, SourcePort: 51234, DestinationPort: 22},
+		},
+		TupleReply: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("10.0.0.2"), DestinationAddress: netip.MustParseAddr("10.0.0.1")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_TCP, SourcePort: 22, DestinationPort: 51234},
+		},
+		Mark: 5,
+		Zone: 1,
+		Use:  2,
+	}
+
+	icmp := Flow{
+		Timeout: 29,
+		Status:  StatusConfirmed,
+		TupleOrig: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("2001:db8::1"), DestinationAddress: netip.MustParseAddr("2001:db8::2")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_ICMPV6, ICMPv6: true, ICMPType: 128, ICMPID: 1234},
+		},
+		TupleReply: Tuple{
+			IP:    IPTuple{SourceAddress: netip.MustParseAddr("2001:db8::2"), DestinationAddress: netip.MustParseAddr("2001:db8::1")},
+			Proto: ProtoTuple{Protocol: unix.IPPROTO_ICMPV6, ICMPv6: true, ICMPType: 129, ICMPID: 1234},
+		},
+		ID:  0xdeadbeef,
+		Use: 1,
+	}
+
+	tests := []struct {
+		name string
+		line string
+		want Flow
+	}{
+		{
+			name: "proc tcp",
+			line: "ipv4     2 tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=51234 dport=22 packets=10 bytes=1000 " +
+				"src=10.0.0.2 dst=10.0.0.1 sport=22 dport=51234 packets=8 bytes=2000 [ASSURED] mark=5 zone=1 use=2",
+			want: tcp,
+		},
+		{
+			name: "conntrack tcp",
+			line: "tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=51234 dport=22 packets=10 bytes=1000 " +
+				"src=10.0.0.2 dst=10.0.0.1 sport=22 dport=51234 packets=8 bytes=2000 [ASSURED] mark=5 zone=1 use=2",
+			want: tcp,
+		},
+		{
+			name: "conntrack icmpv6 with id",
+			line: "icmpv6   58 29 src=2001:db8::1 dst=2001:db8::2 type=128 code=0 id=1234 [UNREPLIED] " +
+				"src=2001:db8::2 dst=2001:db8::1 type=129 code=0 id=1234 mark=0 use=1 id=3735928559",
+			want: icmp,
+		},
+		{
+			name: "proc icmpv6 expanded addresses",
+			line: "ipv6     10 icmpv6   58 29 src=2001:0db8:0000:0000:0000:0000:0000:0001 dst=2001:0db8:0000:0000:0000:0000:0000:0002 " +
+				"type=128 code=0 id=1234 [UNREPLIED] src=2001:0db8:0000:0000:0000:0000:0000:0002 " +
+				"dst=2001:0db8:0000:0000:0000:0000:0000:0001 type=129 code=0 id=1234 mark=0 zone=0 use=1 id=3735928559",
+			want: icmp,
+		},
+		{
+			name: "conntrack event",
+			line: "[1700000000.123456]\t [DESTROY] sctp     132 10 CLOSED src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 " +
+				"src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1 [OFFLOAD] zone-orig=3 secctx=system_u:object_r:unlabeled_t:s0 helper=foo delta-time=5",
+			want: Flow{
+				Timeout:   10,
+				Status:    StatusConfirmed | StatusSeenReply | StatusOffload,
+				ProtoInfo: ProtoInfo{SCTP: &ProtoInfoSCTP{State: 1}},
+				TupleOrig: Tuple{
+					IP:    IPTuple{SourceAddress: netip.MustParseAddr("10.0.0.1"), DestinationAddress: netip.MustParseAddr("10.0.0.2")},
+					Proto: ProtoTuple{Protocol: unix.IPPROTO_SCTP, SourcePort: 1, DestinationPort: 2},
+					Zone:  3,
+				},
+				TupleReply: Tuple{
+					IP:    IPTuple{SourceAddress: netip.MustParseAddr("10.0.0.2"), DestinationAddress: netip.MustParseAddr("10.0.0.1")},
+					Proto: ProtoTuple{Protocol: unix.IPPROTO_SCTP, SourcePort: 2, DestinationPort: 1},
+				},
+				SecurityContext: "system_u:object_r:unlabeled_t:s0",
+				Helper:          Helper{Name: "foo"},
+			},
+		},
+		{
+			name: "conntrack listen",
+			line: "tcp 6 10 LISTEN src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1",
+			want: func() Flow {
+				f := NewFlow(unix.IPPROTO_TCP, StatusConfirmed|StatusSeenReply,
+					netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), 1, 2, 10, 0)
+				f.ProtoInfo.TCP = &ProtoInfoTCP{State: 9}
+				return f
+			}(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseFlow(tt.line)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, f)
+		})
+	}
+}
+
+func TestParseFlowError(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"tcp 6",
+		"tcp foo 10 src=10.0.0.1",
+		"tcp 6 -1 src=10.0.0.1",
+		"tcp 6 10 BOGUS src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1",
+		"tcp 6 10 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2",
+		"udp 17 10 src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1 src=10.0.0.3",
+		"udp 17 10 src=10.0.0.1 dst=10.0.0.2 sport=1 dport=70000 src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1",
+		"udp 17 10 src=10.0.0.1 dst=foo sport=1 dport=2 src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1",
+	} {
+		_, err := ParseFlow(line)
+		assert.ErrorIs(t, err, errParseFlow, line)
+	}
+}
+
+func TestParseFlows(t *testing.T) {
+	in := `tcp      6 117 SYN_SENT src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 [UNREPLIED] src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1 mark=0 use=1
+
+udp      17 29 src=10.0.0.1 dst=10.0.0.2 sport=3 dport=4 src=10.0.0.2 dst=10.0.0.1 sport=4 dport=3 mark=0 use=1
+conntrack v1.4.8 (conntrack-tools): 2 flow entries have been shown.
+`
+
+	fs, err := ParseFlows(strings.NewReader(in))
+	require.NoError(t, err)
+	require.Len(t, fs, 2)
+	assert.Equal(t, uint8(1), fs[0].ProtoInfo.TCP.State)
+	assert.False(t, fs[0].Status.SeenReply())
+	assert.Equal(t, uint16(4), fs[1].TupleOrig.Proto.DestinationPort)
+
+	_, err = ParseFlows(strings.NewReader("tcp 6 1 src=foo\n"))
+	assert.ErrorIs(t, err, errParseFlow)
+	assert.ErrorContains(t, err, "line 1")
+}
@@ -0,0 +1,374 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// errStopDump is returned by a stream callback to stop decoding the remainder
+// of a dump. It is never returned to the caller.
+var errStopDump = errors.New("dump stopped by consumer")
+
+// query sends a request over the Conn's Netlink socket and returns all reply
+// messages. The request must ask for either an acknowledgement or a dump, so
+// the end of the reply can be detected. Any errors sent by the kernel are
+// returned as a netlink.OpError. Messages of interrupted dumps are returned
+// along with ErrDumpInterrupted.
+func (c *Conn) query(ctx context.Context, req netlink.Message) ([]netlink.Message, error) {
+	var out []netlink.Message
+	err := c.stream(ctx, req, func(m netlink.Message) error {
+		out = append(out, m)
+		return nil
+	})
+	if errors.Is(err, ErrDumpInterrupted) {
+		return out, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// stream sends a request over the Conn's Netlink socket and calls fn for every
+// reply message as soon as the datagram containing it is read from the socket.
+// Only a single datagram is held in memory at any time.
+//
+// When fn returns an error, fn is no longer called, but the remainder of the
+// reply is still drained from the socket so the Conn can be reused for other
+// queries. The error returned by fn is returned from stream, unless it is
+// errStopDump.
+//
+// If the kernel flagged the reply as interrupted, ErrDumpInterrupted is
+// returned after all messages were passed to fn.
+//
+// If the reply to an earlier request was not read completely because its
+// context was cancelled, it is drained before sending the new request. The
+// kernel refuses to start a new dump until the previous one was consumed.
+func (c *Conn) stream(ctx context.Context, req netlink.Message, fn func(netlink.Message) error) error {
+	if c.isMulticast() {
+		return errConnIsMulticast
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.withContext(ctx, func() error {
+		rc, err := c.conn.SyscallConn()
+		if err != nil {
+			return err
+		}
+
+		if c.pending != 0 {
+			complete, err := readReply(ctx, rc, c.pending, func(netlink.Message) error { return nil })
+			if !complete {
+				return err
+			}
+			c.pending = 0
+		}
+
+		req, err = c.conn.Send(req)
+		if err != nil {
+			return err
+		}
+
+		complete, err := readReply(ctx, rc, req.Header.Sequence, fn)
+		if !complete {
+			c.pending = req.Header.Sequence
+		}
+
+		return err
+	})
+}
+
+// batchSize is the maximum number of requests sent in a single batch. The
+// kernel drops acknowledgements that don't fit in the socket's receive buffer,
+// so the acknowledgements of a batch are read before sending the next one.
+const batchSize = 128
+
+// batch sends requests over the Conn's Netlink socket, packing up to batchSize
+// requests in a single datagram, and returns the error the kernel replied with
+// to each of them. All requests must ask for an acknowledgement.
+//
+// If sending or receiving fails, the error is returned and set for every
+// request that wasn't acknowledged. Their acknowledgements may still arrive
+// later, they are discarded by subsequent queries.
+func (c *Conn) batch(ctx context.Context, reqs []netlink.Message) ([]error, error) {
+	if c.isMulticast() {
+		return nil, errConnIsMulticast
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	errs := make([]error, len(reqs))
+	acked := make([]bool, len(reqs))
+
+	err := c.withContext(ctx, func() error {
+		rc, err := c.conn.SyscallConn()
+		if err != nil {
+			return err
+		}
+
+		if c.pending != 0 {
+			complete, err := readReply(ctx, rc, c.pending, func(netlink.Message) error { return nil })
+			if !complete {
+				return err
+			}
+			c.pending = 0
+		}
+
+		for off := 0; off < len(reqs); off += batchSize {
+			sent, err := c.conn.SendMessages(reqs[off:min(off+batchSize, len(reqs))])
+			if err != nil {
+				return err
+			}
+
+			// Map the sequence numbers assigned to the requests to their index.
+			seqs := make(map[uint32]int, len(sent))
+			for i, m := range sent {
+				seqs[m.Header.Sequence] = off + i
+			}
+
+			for len(seqs) > 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				msgs, err := receive(rc)
+				if err != nil {
+					return err
+				}
+
+				for _, m := range msgs {
+					i, ok := seqs[m.Header.Sequence]
+					if !ok {
+						continue
+					}
+
+					done, err := checkMessage(m)
+					if !done {
+						continue
+					}
+
+					errs[i], acked[i] = err, true
+					delete(seqs, m.Header.Sequence)
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		for i := range errs {
+			if !acked[i] {
+				errs[i] = err
+			}
+		}
+	}
+
+	return errs, err
+}
+
+// readReply reads messages with sequence number seq from the socket behind rc
+// until the end of the reply, calling fn for every message. Messages with
+// other sequence numbers are discarded. Returns true if the reply was read in
+// its entirety, even if the kernel or fn returned an error. If any of the
+// reply's messages is flagged as interrupted, ErrDumpInterrupted is returned
+// unless another error occurred.
+func readReply(ctx context.Context, rc syscall.RawConn, seq uint32, fn func(netlink.Message) error) (bool, error) {
+	var fnErr error
+	var interrupted bool
+	for {
+		// Stop reading as soon as the context is done, even if more
+		// datagrams are readily available on the socket.
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		msgs, err := receive(rc)
+		if err != nil {
+			return false, err
+		}
+
+		for _, m := range msgs {
+			if m.Header.Sequence != seq {
+				continue
+			}
+
+			// The kernel flags the message during which it detected the
+			// change, or the final Done message.
+			if m.Header.Flags&netlink.DumpInterrupted != 0 {
+				interrupted = true
+			}
+
+			done, err := checkMessage(m)
+			if err != nil {
+				return true, err
+			}
+			if done {
+				if errors.Is(fnErr, errStopDump) {
+					return true, nil
+				}
+				if fnErr == nil && interrupted {
+					return true, ErrDumpInterrupted
+				}
+				return true, fnErr
+			}
+
+			if fnErr != nil {
+				continue
+			}
+
+			fnErr = fn(m)
+		}
+	}
+}
+
+// withContext executes fn, interrupting any blocking socket operations when
+// ctx is cancelled or its deadline expires. If fn fails because of ctx, the
+// context's error is returned.
+func (c *Conn) withContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Contexts that can never be cancelled don't need to touch the socket.
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	// Guard against the AfterFunc setting a deadline after fn has returned.
+	var mu sync.Mutex
+	var finished bool
+	stop := context.AfterFunc(ctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !finished {
+			// Wake up all blocked reads and writes on the socket.
+			_ = c.conn.SetDeadline(time.Unix(1, 0))
+		}
+	})
+
+	err := fn()
+
+	stop()
+	mu.Lock()
+	finished = true
+	mu.Unlock()
+
+	_ = c.conn.SetDeadline(time.Time{})
+
+	if err == nil {
+		return nil
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	// The socket deadline can expire slightly before the context's timer fires.
+	if hasDeadline && errors.Is(err, os.ErrDeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
+
+// receive reads a single datagram from the Netlink socket behind rc and
+// splits it into netlink.Messages. The socket is peeked first to determine
+// the exact size of the pending datagram.
+func receive(rc syscall.RawConn) ([]netlink.Message, error) {
+	var b []byte
+	var n int
+	var rerr error
+
+	read := func(fd uintptr) bool {
+		n, _, rerr = unix.Recvfrom(int(fd), b, unix.MSG_PEEK|unix.MSG_TRUNC)
+		if rerr == nil && n > len(b) {
+			// Grow the buffer to fit the whole datagram and read it out.
+			b = make([]byte, n)
+		}
+		if rerr == nil {
+			n, _, rerr = unix.Recvfrom(int(fd), b, 0)
+		}
+
+		// Block in the runtime poller until the socket becomes readable.
+		return rerr != unix.EAGAIN && rerr != unix.EWOULDBLOCK
+	}
+
+	if err := rc.Read(read); err != nil {
+		return nil, &netlink.OpError{Op: "receive", Err: err}
+	}
+	if rerr != nil {
+		return nil, &netlink.OpError{Op: "receive", Err: os.NewSyscallError("recvfrom", rerr)}
+	}
+
+	return parseMessages(b[:n])
+}
+
+// parseMessages parses the contents of a Netlink datagram into a list of
+// netlink.Messages.
+func parseMessages(b []byte) ([]netlink.Message, error) {
+	raw, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, &netlink.OpError{Op: "receive", Err: err}
+	}
+
+	msgs := make([]netlink.Message, 0, len(raw))
+	for _, r := range raw {
+		msgs = append(msgs, netlink.Message{
+			Header: netlink.Header{
+				Length:   r.Header.Len,
+				Type:     netlink.HeaderType(r.Header.Type),
+				Flags:    netlink.HeaderFlags(r.Header.Flags),
+				Sequence: r.Header.Seq,
+				PID:      r.Header.Pid,
+			},
+			Data: r.Data,
+		})
+	}
+
+	return msgs, nil
+}
+
+// checkMessage checks if m terminates a multi-part reply and returns the
+// error carried in the message, if any.
+func checkMessage(m netlink.Message) (bool, error) {
+	switch m.Header.Type {
+	case netlink.Error:
+	case netlink.Done:
+		// Done messages don't necessarily carry an error code.
+		if len(m.Data) == 0 {
+			return true, nil
+		}
+	default:
+		return false, nil
+	}
+
+	if len(m.Data) < 4 {
+		return true, &netlink.OpError{Op: "receive", Err: errShortErrorMessage}
+	}
+
+	// A zero error code is an acknowledgement.
+	if c := nlenc.Int32(m.Data[:4]); c != 0 {
+		return true, &netlink.OpError{Op: "receive", Err: errnoError(-c)}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,219 @@
+package conntrack
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMessages(t *testing.T) {
+	m1 := netlink.Message{
+		Header: netlink.Header{Length: 20, Type: 0x101, Flags: netlink.Multi, Sequence: 1, PID: 2},
+		Data:   []byte{1, 2, 3, 4},
+	}
+	m2 := netlink.Message{
+		Header: netlink.Header{Length: 20, Type: netlink.Done, Flags: netlink.Multi, Sequence: 1, PID: 2},
+		Data:   []byte{0, 0, 0, 0},
+	}
+
+	var b []byte
+	for _, m := range []netlink.Message{m1, m2} {
+		mb, err := m.MarshalBinary()
+		require.NoError(t, err)
+		b = append(b, mb...)
+	}
+
+	msgs, err := parseMessages(b)
+	require.NoError(t, err)
+	assert.Equal(t, []netlink.Message{m1, m2}, msgs)
+
+	// Header claims a length beyond the end of the datagram.
+	_, err = parseMessages(b[:len(b)-4])
+	assert.Error(t, err)
+}
+
+func TestCheckMessage(t *testing.T) {
+	errno := func(e int32) []byte {
+		b := make([]byte, 4)
+		nlenc.PutInt32(b, e)
+		return b
+	}
+
+	tests := []struct {
+		name string
+		msg  netlink.Message
+		done bool
+		err  error
+	}{
+		{
+			name: "data",
+			msg:  netlink.Message{Header: netlink.Header{Type: 0x101, Flags: netlink.Multi}},
+		},
+		{
+			name: "done without error code",
+			msg:  netlink.Message{Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi}},
+			done: true,
+		},
+		{
+			name: "done with zero error code",
+			msg:  netlink.Message{Header: netlink.Header{Type: netlink.Done}, Data: errno(0)},
+			done: true,
+		},
+		{
+			name: "ack",
+			msg:  netlink.Message{Header: netlink.Header{Type: netlink.Error}, Data: errno(0)},
+			done: true,
+		},
+		{
+			name: "error",
+			msg:  netlink.Message{Header: netlink.Header{Type: netlink.Error}, Data: errno(-int32(unix.ENOENT))},
+			done: true,
+			err:  unix.ENOENT,
+		},
+		{
+			name: "error not found",
+			msg:  netlink.Message{Header: netlink.Header{Type: netlink.Error}, Data: errno(-int32(unix.ENOENT))},
+			done: true,
+			err:  ErrNotFound,
+		},
+		{
+			name: "error busy",
+			msg:  netlink.Message{Header: netlink.Header{Type: netlink.Error}, Data: errno(-int32(unix.EBUSY))},
+			done: true,
+			err:  ErrBusy,
+		},
+		{
+			name: "short error",
+			msg:  netlink.Message{Header: netlink.Header{Type: netlink.Error}, Data: []byte{1}},
+			done: true,
+			err:  errShortErrorMessage,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done, err := checkMessage(tt.msg)
+			assert.Equal(t, tt.done, done)
+			if tt.err == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestReadReplyInterrupted(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	require.NoError(t, err)
+	r, w := os.NewFile(uintptr(fds[0]), "r"), os.NewFile(uintptr(fds[1]), "w")
+	defer r.Close()
+	defer w.Close()
+
+	rc, err := r.SyscallConn()
+	require.NoError(t, err)
+
+	send := func(msgs ...netlink.Message) {
+		var b []byte
+		for _, m := range msgs {
+			m.Header.Length = uint32(16 + len(m.Data))
+			mb, err := m.MarshalBinary()
+			require.NoError(t, err)
+			b = append(b, mb...)
+		}
+		_, err := w.Write(b)
+		require.NoError(t, err)
+	}
+
+	data := netlink.Message{Header: netlink.Header{Type: 0x101, Flags: netlink.Multi, Sequence: 1}, Data: []byte{1, 2, 3, 4}}
+	done := netlink.Message{Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi, Sequence: 1}, Data: []byte{0, 0, 0, 0}}
+
+	var n int
+	count := func(netlink.Message) error { n++; return nil }
+
+	send(data, data, done)
+	complete, err := readReply(context.Background(), rc, 1, count)
+	assert.True(t, complete)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// The Done message is flagged.
+	intr := done
+	intr.Header.Flags |= netlink.DumpInterrupted
+	send(data)
+	send(data, intr)
+	complete, err = readReply(context.Background(), rc, 1, count)
+	assert.True(t, complete)
+	assert.ErrorIs(t, err, ErrDumpInterrupted)
+	assert.Equal(t, 4, n, "all messages are passed to fn")
+
+	// A message of another reply is flagged.
+	other := data
+	other.Header.Sequence = 2
+	other.Header.Flags |= netlink.DumpInterrupted
+	send(other, data, done)
+	_, err = readReply(context.Background(), rc, 1, count)
+	assert.NoError(t, err)
+
+	// Errors of fn take precedence.
+	errTest := errors.New("test")
+	send(data, intr)
+	_, err = readReply(context.Background(), rc, 1, func(netlink.Message) error { return errTest })
+	assert.ErrorIs(t, err, errTest)
+}
+
+func TestRetryDump(t *testing.T) {
+	var calls int
+	dump := func(interrupted int) func() ([]Flow, error) {
+		calls = 0
+		return func() ([]Flow, error) {
+			calls++
+			if calls <= interrupted {
+				return []Flow{{ID: uint32(calls)}}, ErrDumpInterrupted
+			}
+			return []Flow{{ID: uint32(calls)}}, nil
+		}
+	}
+
+	flows, err := retryDump(nil, dump(1))
+	assert.ErrorIs(t, err, ErrDumpInterrupted)
+	assert.Equal(t, []Flow{{ID: 1}}, flows, "flows of interrupted dumps are returned")
+	assert.Equal(t, 1, calls)
+
+	flows, err = retryDump(&DumpOptions{Retries: 2}, dump(2))
+	assert.NoError(t, err)
+	assert.Equal(t, []Flow{{ID: 3}}, flows)
+	assert.Equal(t, 3, calls)
+
+	_, err = retryDump(&DumpOptions{Retries: 2}, dump(5))
+	assert.ErrorIs(t, err, ErrDumpInterrupted)
+	assert.Equal(t, 3, calls)
+
+	_, err = retryDump(&DumpOptions{Retries: 1, ZeroCounters: true}, dump(0))
+	assert.ErrorIs(t, err, errDumpRetriesZeroCounters)
+}
+
+func TestBatchFlowsMulticast(t *testing.T) {
+	var c Conn
+	c.multicast.Store(true)
+
+	flows := []Flow{
+		NewFlow(unix.IPPROTO_TCP, 0, netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("5.6.7.8"), 1234, 80, 120, 0),
+		{},
+	}
+
+	// Flows that were built but not sent carry the batch's error.
+	errs, err := c.CreateBatch(flows)
+	assert.ErrorIs(t, err, errConnIsMulticast)
+	require.Len(t, errs, 2)
+	assert.ErrorIs(t, errs[0], errConnIsMulticast)
+	assert.ErrorIs(t, errs[1], errNeedTimeout)
+}
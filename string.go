@@ -28,29 +28,30 @@ func protoLookup(p uint8) string {
 	return strconv.FormatUint(uint64(p), 10)
 }
 
-func (s Status) String() string {
-	names := []string{
-		"EXPECTED",
-		"SEEN_REPLY",
-		"ASSURED",
-		"CONFIRMED",
-		"SRC_NAT",
-		"DST_NAT",
-		"SEQ_ADJUST",
-		"SRC_NAT_DONE",
-		"DST_NAT_DONE",
-		"DYING",
-		"FIXED_TIMEOUT",
-		"TEMPLATE",
-		"UNTRACKED",
-		"HELPER",
-		"OFFLOAD",
-	}
+// statusNames holds the names of the Status bits, indexed by bit position.
+var statusNames = []string{
+	"EXPECTED",
+	"SEEN_REPLY",
+	"ASSURED",
+	"CONFIRMED",
+	"SRC_NAT",
+	"DST_NAT",
+	"SEQ_ADJUST",
+	"SRC_NAT_DONE",
+	"DST_NAT_DONE",
+	"DYING",
+	"FIXED_TIMEOUT",
+	"TEMPLATE",
+	"UNTRACKED",
+	"HELPER",
+	"OFFLOAD",
+}
 
+func (s Status) String() string {
 	var rs string
 
 	// Loop over the field's bits
-	for i, name := range names {
+	for i, name := range statusNames {
 		if s&(1<<uint32(i)) != 0 {
 			if rs != "" {
 				rs += "|"
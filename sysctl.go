@@ -0,0 +1,450 @@
+package conntrack
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysctlRoot is the directory holding the netfilter sysctls of the network
+// namespace of the calling thread.
+const sysctlRoot = "/proc/sys/net/netfilter"
+
+// EventsMode is the value of the nf_conntrack_events sysctl, controlling
+// whether the kernel generates conntrack events.
+type EventsMode uint8
+
+const (
+	// EventsModeOff disables conntrack events.
+	EventsModeOff EventsMode = iota
+	// EventsModeOn enables conntrack events for all connections.
+	EventsModeOn
+	// EventsModeAuto only generates events while there are listeners,
+	// the default since Linux 6.0.
+	EventsModeAuto
+)
+
+// Config holds the conntrack sysctls of a network namespace found under
+// /proc/sys/net/netfilter. Use [Sysctl.Config] to read and [Sysctl.SetConfig]
+// to write it.
+//
+// Sysctls not supported by the running kernel, like nf_conntrack_helper on
+// Linux 6.0 and later or the DCCP timeouts when DCCP support is not built,
+// are left at their zero values.
+type Config struct {
+	// Max is the maximum amount of tracked connections (nf_conntrack_max).
+	// It can only be changed from the initial network namespace.
+	Max uint32
+
+	// Buckets is the size of the connection hash table
+	// (nf_conntrack_buckets). It can only be changed from the initial
+	// network namespace.
+	Buckets uint32
+
+	// Count is the amount of connections currently tracked
+	// (nf_conntrack_count). It is read-only and ignored by
+	// [Sysctl.SetConfig].
+	Count uint32
+
+	// ExpectMax is the maximum amount of expectations
+	// (nf_conntrack_expect_max).
+	ExpectMax uint32
+
+	// Acct enables per-connection packet and byte counters
+	// (nf_conntrack_acct), exposed in [Flow.CountersOrig] and
+	// [Flow.CountersReply].
+	Acct bool
+
+	// Timestamp enables connection start and stop timestamps
+	// (nf_conntrack_timestamp), exposed in [Flow.Timestamp].
+	Timestamp bool
+
+	// Events controls the generation of conntrack events
+	// (nf_conntrack_events).
+	Events EventsMode
+
+	// Helper enables automatic assignment of helpers based on port numbers
+	// (nf_conntrack_helper).
+	Helper bool
+
+	// Checksum enables checksum verification of incoming packets
+	// (nf_conntrack_checksum).
+	Checksum bool
+
+	// TCPLoose enables picking up already established TCP connections
+	// (nf_conntrack_tcp_loose).
+	TCPLoose bool
+
+	// TCPBeLiberal disables marking out-of-window TCP packets as invalid
+	// (nf_conntrack_tcp_be_liberal).
+	TCPBeLiberal bool
+
+	// TCPMaxRetrans is the amount of retransmissions after which the
+	// TCP Retrans timeout applies (nf_conntrack_tcp_max_retrans).
+	TCPMaxRetrans uint32
+
+	// Default timeouts of each protocol in seconds. The SynSent2 timeout of
+	// TCP and the HeartbeatAcked timeout of SCTP have no sysctl and are
+	// always zero.
+	TCP     TimeoutPolicyTCP
+	UDP     TimeoutPolicyUDP
+	ICMP    TimeoutPolicyICMP
+	ICMPv6  TimeoutPolicyICMP
+	SCTP    TimeoutPolicySCTP
+	DCCP    TimeoutPolicyDCCP
+	GRE     TimeoutPolicyGRE
+	Generic TimeoutPolicyGeneric
+}
+
+// sysctlKnob is a single sysctl and the Config field it is stored in. value is
+// a *uint32, *bool or *EventsMode.
+type sysctlKnob struct {
+	name     string
+	value    any
+	readOnly bool
+}
+
+// nonZero returns true if the sysctl must not be set to zero. Zero timeouts
+// expire connections immediately, and a zero nf_conntrack_max lifts the limit
+// on the table size.
+func (k sysctlKnob) nonZero() bool {
+	return k.name == "nf_conntrack_max" || strings.Contains(k.name, "_timeout")
+}
+
+// knobs returns the sysctls making up the Config, pointing into c.
+func (c *Config) knobs() []sysctlKnob {
+	return []sysctlKnob{
+		{name: "nf_conntrack_max", value: &c.Max},
+		{name: "nf_conntrack_buckets", value: &c.Buckets},
+		{name: "nf_conntrack_count", value: &c.Count, readOnly: true},
+		{name: "nf_conntrack_expect_max", value: &c.ExpectMax},
+		{name: "nf_conntrack_acct", value: &c.Acct},
+		{name: "nf_conntrack_timestamp", value: &c.Timestamp},
+		{name: "nf_conntrack_events", value: &c.Events},
+		{name: "nf_conntrack_helper", value: &c.Helper},
+		{name: "nf_conntrack_checksum", value: &c.Checksum},
+		{name: "nf_conntrack_tcp_loose", value: &c.TCPLoose},
+		{name: "nf_conntrack_tcp_be_liberal", value: &c.TCPBeLiberal},
+		{name: "nf_conntrack_tcp_max_retrans", value: &c.TCPMaxRetrans},
+
+		{name: "nf_conntrack_tcp_timeout_syn_sent", value: &c.TCP.SynSent},
+		{name: "nf_conntrack_tcp_timeout_syn_recv", value: &c.TCP.SynRecv},
+		{name: "nf_conntrack_tcp_timeout_established", value: &c.TCP.Established},
+		{name: "nf_conntrack_tcp_timeout_fin_wait", value: &c.TCP.FinWait},
+		{name: "nf_conntrack_tcp_timeout_close_wait", value: &c.TCP.CloseWait},
+		{name: "nf_conntrack_tcp_timeout_last_ack", value: &c.TCP.LastAck},
+		{name: "nf_conntrack_tcp_timeout_time_wait", value: &c.TCP.TimeWait},
+		{name: "nf_conntrack_tcp_timeout_close", value: &c.TCP.Close},
+		{name: "nf_conntrack_tcp_timeout_max_retrans", value: &c.TCP.Retrans},
+		{name: "nf_conntrack_tcp_timeout_unacknowledged", value: &c.TCP.Unacknowledged},
+
+		{name: "nf_conntrack_udp_timeout", value: &c.UDP.Unreplied},
+		{name: "nf_conntrack_udp_timeout_stream", value: &c.UDP.Replied},
+
+		{name: "nf_conntrack_icmp_timeout", value: &c.ICMP.Timeout},
+		{name: "nf_conntrack_icmpv6_timeout", value: &c.ICMPv6.Timeout},
+
+		{name: "nf_conntrack_sctp_timeout_closed", value: &c.SCTP.Closed},
+		{name: "nf_conntrack_sctp_timeout_cookie_wait", value: &c.SCTP.CookieWait},
+		{name: "nf_conntrack_sctp_timeout_cookie_echoed", value: &c.SCTP.CookieEchoed},
+		{name: "nf_conntrack_sctp_timeout_established", value: &c.SCTP.Established},
+		{name: "nf_conntrack_sctp_timeout_shutdown_sent", value: &c.SCTP.ShutdownSent},
+		{name: "nf_conntrack_sctp_timeout_shutdown_recd", value: &c.SCTP.ShutdownRecd},
+		{name: "nf_conntrack_sctp_timeout_shutdown_ack_sent", value: &c.SCTP.ShutdownAckSent},
+		{name: "nf_conntrack_sctp_timeout_heartbeat_sent", value: &c.SCTP.HeartbeatSent},
+
+		{name: "nf_conntrack_dccp_timeout_request", value: &c.DCCP.Request},
+		{name: "nf_conntrack_dccp_timeout_respond", value: &c.DCCP.Respond},
+		{name: "nf_conntrack_dccp_timeout_partopen", value: &c.DCCP.PartOpen},
+		{name: "nf_conntrack_dccp_timeout_open", value: &c.DCCP.Open},
+		{name: "nf_conntrack_dccp_timeout_closereq", value: &c.DCCP.CloseReq},
+		{name: "nf_conntrack_dccp_timeout_closing", value: &c.DCCP.Closing},
+		{name: "nf_conntrack_dccp_timeout_timewait", value: &c.DCCP.TimeWait},
+
+		{name: "nf_conntrack_gre_timeout", value: &c.GRE.Unreplied},
+		{name: "nf_conntrack_gre_timeout_stream", value: &c.GRE.Replied},
+
+		{name: "nf_conntrack_generic_timeout", value: &c.Generic.Timeout},
+	}
+}
+
+// validate returns an error if any value of the Config would be rejected by
+// the kernel.
+func (c *Config) validate() error {
+	if c.Buckets == 0 {
+		return fmt.Errorf("nf_conntrack_buckets: %w", errSysctlValue)
+	}
+	if c.Events > EventsModeAuto {
+		return fmt.Errorf("nf_conntrack_events: %w", errSysctlValue)
+	}
+
+	// All numeric conntrack sysctls are signed integers in the kernel.
+	for _, k := range c.knobs() {
+		if v, ok := k.value.(*uint32); ok && *v > math.MaxInt32 {
+			return fmt.Errorf("%s: %w", k.name, errSysctlValue)
+		}
+	}
+
+	return nil
+}
+
+// validateChanges returns an error if c would set a sysctl to zero that must
+// not be zero, which is usually a sign of a partially filled Config. Sysctls
+// that are zero in cur, like the ones not supported by the kernel, may remain
+// zero.
+func (c *Config) validateChanges(cur *Config) error {
+	want, have := c.knobs(), cur.knobs()
+	for i, k := range want {
+		v, ok := k.value.(*uint32)
+		if !ok || !k.nonZero() || *v != 0 || *have[i].value.(*uint32) == 0 {
+			continue
+		}
+		return fmt.Errorf("%s: %w", k.name, errSysctlValue)
+	}
+
+	return nil
+}
+
+// Sysctl reads and writes the netfilter sysctls of a network namespace. The
+// zero value operates on the network namespace of the calling thread, use
+// [SysctlNamespace] to operate on another namespace.
+type Sysctl struct {
+	// netns refers to the network namespace to operate in. If nil, sysctls
+	// are accessed from the calling thread.
+	netns *os.File
+
+	// root overrides sysctlRoot for testing.
+	root string
+}
+
+// SysctlNamespace returns a Sysctl operating on the network namespace referred
+// to by path, like /var/run/netns/<name> or /proc/<pid>/ns/net. Accessing
+// sysctls of another network namespace requires CAP_SYS_ADMIN.
+//
+// The Sysctl keeps a reference to the namespace until it is closed.
+func SysctlNamespace(path string) (*Sysctl, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sysctl{netns: f}, nil
+}
+
+// SysctlPid is like [SysctlNamespace], but operates on the network namespace
+// of the process with the given pid.
+func SysctlPid(pid int) (*Sysctl, error) {
+	return SysctlNamespace(pidNamespacePath(pid))
+}
+
+// Close releases the Sysctl's reference to its network namespace, if any.
+func (s *Sysctl) Close() error {
+	if s.netns == nil {
+		return nil
+	}
+
+	return s.netns.Close()
+}
+
+// do runs fn in the Sysctl's network namespace. Sysctls under /proc/sys/net
+// are resolved using the namespace of the thread opening them.
+func (s *Sysctl) do(fn func() error) error {
+	if s.netns == nil {
+		return fn()
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so the runtime terminates it when the
+		// goroutine exits instead of reusing it in the wrong namespace.
+		runtime.LockOSThread()
+
+		if err := unix.Setns(int(s.netns.Fd()), unix.CLONE_NEWNET); err != nil {
+			errC <- fmt.Errorf("join network namespace %s: %w", s.netns.Name(), err)
+			return
+		}
+
+		errC <- fn()
+	}()
+
+	return <-errC
+}
+
+// path returns the path to the sysctl with the given name.
+func (s *Sysctl) path(name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, '/') || name == "." || name == ".." {
+		return "", fmt.Errorf("sysctl %q: %w", name, errSysctlName)
+	}
+
+	root := s.root
+	if root == "" {
+		root = sysctlRoot
+	}
+
+	return filepath.Join(root, name), nil
+}
+
+// read reads the raw value of the named sysctl.
+func (s *Sysctl) read(name string) (string, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// write writes the raw value of the named sysctl.
+func (s *Sysctl) write(name, value string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	// Sysctls can't be created, don't pass O_CREATE.
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(value); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Get returns the raw value of the netfilter sysctl with the given name, like
+// `nf_conntrack_max` or `nf_log_all_netns`. Use [Sysctl.Config] for typed
+// access to the conntrack sysctls.
+func (s *Sysctl) Get(name string) (string, error) {
+	var v string
+	err := s.do(func() (err error) {
+		v, err = s.read(name)
+		return
+	})
+
+	return v, err
+}
+
+// Set sets the netfilter sysctl with the given name to the raw value. Use
+// [Sysctl.SetConfig] for typed, validated access to the conntrack sysctls.
+func (s *Sysctl) Set(name, value string) error {
+	return s.do(func() error {
+		return s.write(name, value)
+	})
+}
+
+// Config reads the conntrack sysctls into a Config.
+func (s *Sysctl) Config() (Config, error) {
+	var c Config
+	err := s.do(func() error {
+		return s.readConfig(&c)
+	})
+
+	return c, err
+}
+
+// readConfig reads the conntrack sysctls into c, skipping sysctls that don't
+// exist.
+func (s *Sysctl) readConfig(c *Config) error {
+	for _, k := range c.knobs() {
+		raw, err := s.read(k.name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		n, err := strconv.ParseUint(raw, 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k.name, err)
+		}
+
+		switch v := k.value.(type) {
+		case *uint32:
+			*v = uint32(n)
+		case *bool:
+			*v = n != 0
+		case *EventsMode:
+			*v = EventsMode(n)
+		}
+	}
+
+	return nil
+}
+
+// SetConfig writes c to the conntrack sysctls. The Config is validated before
+// writing any sysctl, and only sysctls whose values differ from the current
+// configuration are written, so a Config obtained from [Sysctl.Config] can be
+// modified and written back, even in namespaces where some sysctls are
+// read-only.
+//
+// Timeouts and Max can't be set to zero, so a Config that was only partially
+// filled in is rejected instead of expiring all connections. Start from a
+// Config obtained from [Sysctl.Config] instead, or use [Sysctl.Set] to set
+// individual sysctls.
+func (s *Sysctl) SetConfig(c Config) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	return s.do(func() error {
+		var cur Config
+		if err := s.readConfig(&cur); err != nil {
+			return err
+		}
+		if err := c.validateChanges(&cur); err != nil {
+			return err
+		}
+
+		want, have := c.knobs(), cur.knobs()
+		for i, k := range want {
+			if k.readOnly {
+				continue
+			}
+
+			var raw string
+			switch v := k.value.(type) {
+			case *uint32:
+				if *v == *have[i].value.(*uint32) {
+					continue
+				}
+				raw = strconv.FormatUint(uint64(*v), 10)
+			case *bool:
+				if *v == *have[i].value.(*bool) {
+					continue
+				}
+				raw = "0"
+				if *v {
+					raw = "1"
+				}
+			case *EventsMode:
+				if *v == *have[i].value.(*EventsMode) {
+					continue
+				}
+				raw = strconv.Itoa(int(*v))
+			}
+
+			if err := s.write(k.name, raw); err != nil {
+				return fmt.Errorf("%s: %w", k.name, err)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,57 @@
+//go:build integration
+
+package conntrack
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSysctlNamespace(t *testing.T) {
+	path := newNS(t)
+
+	// Dialing a Conn loads conntrack in the namespace, making its sysctls
+	// appear.
+	c, err := DialNamespace(path, nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	s, err := SysctlNamespace(path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	cfg, err := s.Config()
+	require.NoError(t, err)
+	assert.NotZero(t, cfg.Max)
+	assert.NotZero(t, cfg.Buckets)
+	assert.NotZero(t, cfg.TCP.Established)
+
+	cfg.Acct, cfg.Timestamp = true, true
+	cfg.UDP.Unreplied = 42
+	require.NoError(t, s.SetConfig(cfg))
+
+	got, err := s.Config()
+	require.NoError(t, err)
+	assert.True(t, got.Acct)
+	assert.True(t, got.Timestamp)
+	assert.Equal(t, uint32(42), got.UDP.Unreplied)
+
+	// Flows created after enabling accounting and timestamps carry them.
+	f := NewFlow(unix.IPPROTO_UDP, 0, netip.MustParseAddr("10.43.0.1"), netip.MustParseAddr("10.43.0.2"), 4242, 4343, 120, 0)
+	require.NoError(t, c.Create(f))
+	fg, err := c.Get(f)
+	require.NoError(t, err)
+	assert.False(t, fg.Timestamp.Start.IsZero())
+
+	// The namespace's sysctls are independent of the host's.
+	other, err := SysctlNamespace(newNS(t))
+	require.NoError(t, err)
+	defer other.Close()
+	v, err := other.Get("nf_conntrack_udp_timeout")
+	require.NoError(t, err)
+	assert.NotEqual(t, "42", v)
+}
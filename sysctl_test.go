@@ -0,0 +1,139 @@
+package conntrack
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSysctl returns a Sysctl operating on a temporary directory holding the
+// given sysctls.
+func testSysctl(t *testing.T, values map[string]string) *Sysctl {
+	t.Helper()
+
+	root := t.TempDir()
+	for name, v := range values {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(v+"\n"), 0o644))
+	}
+
+	return &Sysctl{root: root}
+}
+
+func TestSysctlConfig(t *testing.T) {
+	s := testSysctl(t, map[string]string{
+		"nf_conntrack_max":                     "262144",
+		"nf_conntrack_buckets":                 "65536",
+		"nf_conntrack_count":                   "12",
+		"nf_conntrack_acct":                    "0",
+		"nf_conntrack_timestamp":               "1",
+		"nf_conntrack_events":                  "2",
+		"nf_conntrack_tcp_timeout_established": "432000",
+		"nf_conntrack_udp_timeout_stream":      "120",
+		"nf_conntrack_icmpv6_timeout":          "30",
+	})
+
+	c, err := s.Config()
+	require.NoError(t, err)
+	assert.Equal(t, Config{
+		Max:       262144,
+		Buckets:   65536,
+		Count:     12,
+		Timestamp: true,
+		Events:    EventsModeAuto,
+		TCP:       TimeoutPolicyTCP{Established: 432000},
+		UDP:       TimeoutPolicyUDP{Replied: 120},
+		ICMPv6:    TimeoutPolicyICMP{Timeout: 30},
+	}, c)
+
+	c.Acct = true
+	c.Count = 1
+	c.TCP.Established = 3600
+	require.NoError(t, s.SetConfig(c))
+
+	v, err := s.Get("nf_conntrack_acct")
+	require.NoError(t, err)
+	assert.Equal(t, "1", v)
+
+	v, err = s.Get("nf_conntrack_tcp_timeout_established")
+	require.NoError(t, err)
+	assert.Equal(t, "3600", v)
+
+	// Read-only sysctls are never written.
+	v, err = s.Get("nf_conntrack_count")
+	require.NoError(t, err)
+	assert.Equal(t, "12", v)
+
+	// Sysctls missing from the kernel can't be set.
+	c.Helper = true
+	assert.ErrorIs(t, s.SetConfig(c), os.ErrNotExist)
+}
+
+func TestSysctlConfigMalformed(t *testing.T) {
+	s := testSysctl(t, map[string]string{"nf_conntrack_max": "lots"})
+
+	_, err := s.Config()
+	assert.Error(t, err)
+}
+
+func TestSysctlSetConfigError(t *testing.T) {
+	s := testSysctl(t, nil)
+
+	assert.ErrorIs(t, s.SetConfig(Config{}), errSysctlValue)
+	assert.ErrorIs(t, s.SetConfig(Config{Buckets: 1, Events: EventsModeAuto + 1}), errSysctlValue)
+	assert.ErrorIs(t, s.SetConfig(Config{Buckets: 1, TCP: TimeoutPolicyTCP{Close: math.MaxInt32 + 1}}), errSysctlValue)
+}
+
+func TestSysctlSetConfigPartial(t *testing.T) {
+	values := map[string]string{
+		"nf_conntrack_max":                     "262144",
+		"nf_conntrack_buckets":                 "65536",
+		"nf_conntrack_acct":                    "0",
+		"nf_conntrack_tcp_timeout_established": "432000",
+		"nf_conntrack_udp_timeout":             "30",
+	}
+	s := testSysctl(t, values)
+
+	// A partial Config would zero the timeouts and the table size limit.
+	err := s.SetConfig(Config{Buckets: 65536, Acct: true})
+	assert.ErrorIs(t, err, errSysctlValue)
+	assert.ErrorContains(t, err, "nf_conntrack_max")
+
+	err = s.SetConfig(Config{Max: 262144, Buckets: 65536, Acct: true})
+	assert.ErrorIs(t, err, errSysctlValue)
+	assert.ErrorContains(t, err, "nf_conntrack_tcp_timeout_established")
+
+	// Nothing was written.
+	for name, want := range values {
+		v, err := s.Get(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, v, name)
+	}
+
+	// Sysctls that are already zero, like the ones missing from the kernel,
+	// may remain zero.
+	c, err := s.Config()
+	require.NoError(t, err)
+	c.Acct = true
+	require.NoError(t, s.SetConfig(c))
+
+	v, err := s.Get("nf_conntrack_acct")
+	require.NoError(t, err)
+	assert.Equal(t, "1", v)
+}
+
+func TestSysctlName(t *testing.T) {
+	s := testSysctl(t, nil)
+
+	for _, name := range []string{"", ".", "..", "../ipv4/ip_forward", "nf_conntrack/max"} {
+		_, err := s.Get(name)
+		assert.ErrorIs(t, err, errSysctlName, name)
+		assert.ErrorIs(t, s.Set(name, "1"), errSysctlName, name)
+	}
+
+	// Sysctls can't be created.
+	assert.ErrorIs(t, s.Set("nf_conntrack_foo", "1"), os.ErrNotExist)
+}
@@ -0,0 +1,564 @@
+package conntrack
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+// TableOptions is passed to [NewTable] to modify the behaviour of a Table.
+type TableOptions struct {
+	// Changes receives an Event for every change made to the Table: EventNew
+	// for added Flows, EventUpdate for modified Flows and EventDestroy for
+	// removed Flows. This includes changes made while synchronising with the
+	// kernel. Sends block, so the channel must be drained to keep the Table
+	// from falling behind the kernel.
+	Changes chan<- Event
+
+	// ResyncInterval periodically dumps the conntrack table and reconciles the
+	// Table with it, picking up changes that didn't generate events. Disabled
+	// when zero.
+	ResyncInterval time.Duration
+
+	// ReadBuffer sets the receive buffer size of the socket listening for
+	// events, see [Conn.SetReadBuffer]. Larger buffers make resyncs caused by
+	// overruns less likely.
+	ReadBuffer int
+}
+
+// Table is an in-memory mirror of the conntrack table, kept up to date using
+// conntrack events. Flows can be looked up by ID, [FlowKey], address and zone.
+//
+// When the nf_conntrack_events sysctl is set to [EventsModeAuto], the kernel
+// doesn't generate events for Flows created before the first event listener
+// subscribed. Changes to those Flows are only picked up by resyncs, see
+// [TableOptions.ResyncInterval].
+//
+// A Table is safe for concurrent use.
+type Table struct {
+	config *netlink.Config
+	opts   TableOptions
+
+	running atomic.Bool
+	synced  chan struct{}
+
+	mu    sync.RWMutex
+	flows map[uint32]Flow
+	keys  map[FlowKey]uint32
+	addrs map[netip.Addr]map[uint32]struct{}
+	zones map[uint16]map[uint32]struct{}
+}
+
+// NewTable returns a Table mirroring the conntrack table of the network
+// namespace selected by config, which may be nil. The Table is empty until
+// [Table.Run] is called.
+func NewTable(config *netlink.Config, opts *TableOptions) *Table {
+	var cfg *netlink.Config
+	if config != nil {
+		cc := *config
+		cfg = &cc
+	}
+
+	t := &Table{
+		config: cfg,
+		synced: make(chan struct{}),
+		flows:  make(map[uint32]Flow),
+		keys:   make(map[FlowKey]uint32),
+		addrs:  make(map[netip.Addr]map[uint32]struct{}),
+		zones:  make(map[uint16]map[uint32]struct{}),
+	}
+	if opts != nil {
+		t.opts = *opts
+	}
+
+	return t
+}
+
+// Run synchronises the Table with the kernel and keeps it up to date until ctx
+// is cancelled, returning ctx.Err(), or an error occurs.
+//
+// Run subscribes to conntrack events before dumping the conntrack table, so no
+// changes are missed. Events received during the dump are applied on top of
+// the dumped Flows. When events are lost because the socket's receive buffer
+// overflowed or a periodic resync is due, the table is dumped again and the
+// Table is reconciled with the dump.
+//
+// Dumps are retried when they're interrupted or events are lost while they're
+// running. If that keeps happening, Run gives up and returns an error matching
+// [ErrDumpInterrupted] or [unix.ENOBUFS]. In the latter case, a larger
+// [TableOptions.ReadBuffer] may help.
+//
+// Run can only be called once on a Table.
+func (t *Table) Run(ctx context.Context) error {
+	if !t.running.CompareAndSwap(false, true) {
+		return errTableRunning
+	}
+
+	lc, err := Dial(t.config)
+	if err != nil {
+		return err
+	}
+	defer lc.Close()
+
+	if t.opts.ReadBuffer != 0 {
+		if err := lc.SetReadBuffer(t.opts.ReadBuffer); err != nil {
+			return err
+		}
+	}
+
+	// Stop the listener's workers before closing it.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// A single worker delivers events in the order they were sent.
+	events := make(chan Event)
+	errs, err := lc.ListenWithOptions(ctx, events, 1, netfilter.GroupsCT, ListenOptions{RecoverOverrun: true})
+	if err != nil {
+		return err
+	}
+
+	dc, err := Dial(t.config)
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	var resync <-chan time.Time
+	if t.opts.ResyncInterval > 0 {
+		tick := time.NewTicker(t.opts.ResyncInterval)
+		defer tick.Stop()
+		resync = tick.C
+	}
+
+	dump := func(ctx context.Context) ([]Flow, error) {
+		return dc.DumpContext(ctx, nil)
+	}
+
+	for {
+		if err := t.sync(ctx, dump, events, errs); err != nil {
+			return err
+		}
+
+		select {
+		case <-t.synced:
+		default:
+			close(t.synced)
+		}
+
+		err := t.follow(ctx, events, errs, resync)
+		if errors.Is(err, unix.ENOBUFS) || errors.Is(err, errTableResync) {
+			continue
+		}
+		return err
+	}
+}
+
+// Synced returns a channel that is closed once the Table has been populated
+// with the contents of the conntrack table for the first time.
+func (t *Table) Synced() <-chan struct{} {
+	return t.synced
+}
+
+// tableSyncAttempts is the amount of times the conntrack table is dumped to
+// synchronise a Table before giving up.
+const tableSyncAttempts = 10
+
+// sync dumps the conntrack table using dump and replaces the Table's contents
+// with the dump. Events received during the dump are applied afterwards. If
+// the dump is interrupted or events are lost while it's running, the Table
+// can't be reconciled with it and the dump is retried, up to
+// tableSyncAttempts times.
+func (t *Table) sync(ctx context.Context, dump func(context.Context) ([]Flow, error),
+	events <-chan Event, errs <-chan error) error {
+	type result struct {
+		flows []Flow
+		err   error
+	}
+
+	var err error
+	for range tableSyncAttempts {
+		res := make(chan result, 1)
+		go func() {
+			flows, err := dump(ctx)
+			res <- result{flows, err}
+		}()
+
+		var pending []Event
+		var lost error
+
+	wait:
+		for {
+			select {
+			case ev := <-events:
+				pending = append(pending, ev)
+			case err := <-errs:
+				if !errors.Is(err, unix.ENOBUFS) {
+					return err
+				}
+				lost = err
+			case r := <-res:
+				if r.err != nil && !errors.Is(r.err, ErrDumpInterrupted) {
+					return r.err
+				}
+				// Interrupted dumps may miss Flows, which would be removed
+				// from the Table.
+				if err = cmp.Or(r.err, lost); err != nil {
+					break wait
+				}
+
+				if err := t.notify(ctx, t.replace(r.flows)); err != nil {
+					return err
+				}
+				for _, ev := range pending {
+					if err := t.notify(ctx, t.apply(ev)); err != nil {
+						return err
+					}
+				}
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	return fmt.Errorf("sync table: gave up after %d attempts: %w", tableSyncAttempts, err)
+}
+
+// follow applies events to the Table until ctx is cancelled, the listener
+// reports an error or a periodic resync is due. Lost events are reported as an
+// error matching [unix.ENOBUFS], due resyncs as errTableResync.
+func (t *Table) follow(ctx context.Context, events <-chan Event, errs <-chan error,
+	resync <-chan time.Time) error {
+	for {
+		select {
+		case <-resync:
+			return errTableResync
+		case ev := <-events:
+			if err := t.notify(ctx, t.apply(ev)); err != nil {
+				return err
+			}
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notify sends changes on the Changes channel, if any.
+func (t *Table) notify(ctx context.Context, changes []Event) error {
+	if t.opts.Changes == nil {
+		return nil
+	}
+
+	for _, ev := range changes {
+		select {
+		case t.opts.Changes <- ev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// apply applies a conntrack event to the Table and returns the resulting
+// changes.
+func (t *Table) apply(ev Event) []Event {
+	if ev.Flow == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch ev.Type {
+	case EventNew, EventUpdate:
+		return t.upsert(*ev.Flow)
+	case EventDestroy:
+		id, ok := t.lookup(ev.Flow)
+		if !ok {
+			return nil
+		}
+		t.remove(id)
+		return []Event{{Type: EventDestroy, Flow: ev.Flow}}
+	}
+
+	return nil
+}
+
+// replace reconciles the Table with a dump of the conntrack table and returns
+// the resulting changes. Flows missing from the dump are removed.
+func (t *Table) replace(flows []Flow) []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seen := make(map[uint32]struct{}, len(flows))
+	var changes []Event
+	for _, f := range flows {
+		seen[f.ID] = struct{}{}
+		changes = append(changes, t.upsert(f)...)
+	}
+
+	for _, id := range t.sortedIDs() {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		f := t.flows[id]
+		t.remove(id)
+		changes = append(changes, Event{Type: EventDestroy, Flow: &f})
+	}
+
+	return changes
+}
+
+// lookup returns the ID under which a Flow matching f is stored, by ID or by
+// its original tuple. t.mu must be held.
+func (t *Table) lookup(f *Flow) (uint32, bool) {
+	if _, ok := t.flows[f.ID]; ok {
+		return f.ID, true
+	}
+
+	id, ok := t.keys[f.Key()]
+	return id, ok
+}
+
+// upsert stores f, merging it with the stored Flow with the same ID, and
+// returns the resulting changes. A stored Flow with the same tuple but another
+// ID belongs to a connection that was replaced and is removed. t.mu must be
+// held.
+func (t *Table) upsert(f Flow) []Event {
+	var changes []Event
+
+	for _, key := range []FlowKey{f.Key(), f.ReplyKey()} {
+		id, ok := t.keys[key]
+		if !ok || id == f.ID {
+			continue
+		}
+		old := t.flows[id]
+		t.remove(id)
+		changes = append(changes, Event{Type: EventDestroy, Flow: &old})
+	}
+
+	typ := EventNew
+	if old, ok := t.flows[f.ID]; ok {
+		f = mergeFlow(old, f)
+		if !flowChanged(old, f) {
+			// Store the latest Timeout and Use regardless.
+			t.flows[f.ID] = f
+			return changes
+		}
+		t.remove(f.ID)
+		typ = EventUpdate
+	}
+
+	t.insert(f)
+
+	return append(changes, Event{Type: typ, Flow: &f})
+}
+
+// mergeFlow returns f with the attributes that are absent from f taken from
+// old. Update events only carry some of a Flow's attributes.
+func mergeFlow(old, f Flow) Flow {
+	if f.Timestamp.Start.IsZero() {
+		f.Timestamp.Start = old.Timestamp.Start
+	}
+	if !f.ProtoInfo.filled() {
+		f.ProtoInfo = old.ProtoInfo
+	}
+	if !f.Helper.filled() {
+		f.Helper = old.Helper
+	}
+	if !f.CountersOrig.filled() {
+		f.CountersOrig = old.CountersOrig
+	}
+	if !f.CountersReply.filled() {
+		f.CountersReply = old.CountersReply
+	}
+	if f.SecurityContext == "" {
+		f.SecurityContext = old.SecurityContext
+	}
+	if !f.TupleMaster.filled() {
+		f.TupleMaster = old.TupleMaster
+	}
+	if !f.SeqAdjOrig.filled() {
+		f.SeqAdjOrig = old.SeqAdjOrig
+	}
+	if !f.SeqAdjReply.filled() {
+		f.SeqAdjReply = old.SeqAdjReply
+	}
+	if f.Labels == nil {
+		f.Labels, f.LabelsMask = old.Labels, old.LabelsMask
+	}
+	if f.Use == 0 {
+		f.Use = old.Use
+	}
+	if !f.SynProxy.filled() {
+		f.SynProxy = old.SynProxy
+	}
+
+	return f
+}
+
+// flowChanged returns true if f differs from old. Timeout and Use change
+// continuously and are not considered.
+func flowChanged(old, f Flow) bool {
+	old.Timeout, old.Use = 0, 0
+	f.Timeout, f.Use = 0, 0
+	return !reflect.DeepEqual(old, f)
+}
+
+// addrsOf returns the distinct addresses of the tuples of f.
+func addrsOf(f Flow) []netip.Addr {
+	addrs := []netip.Addr{
+		f.TupleOrig.IP.SourceAddress, f.TupleOrig.IP.DestinationAddress,
+		f.TupleReply.IP.SourceAddress, f.TupleReply.IP.DestinationAddress,
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+
+	return slices.Compact(addrs)
+}
+
+// insert stores f and adds it to the indexes. t.mu must be held.
+func (t *Table) insert(f Flow) {
+	t.flows[f.ID] = f
+	t.keys[f.Key()] = f.ID
+	t.keys[f.ReplyKey()] = f.ID
+
+	for _, a := range addrsOf(f) {
+		if t.addrs[a] == nil {
+			t.addrs[a] = make(map[uint32]struct{})
+		}
+		t.addrs[a][f.ID] = struct{}{}
+	}
+
+	if t.zones[f.Zone] == nil {
+		t.zones[f.Zone] = make(map[uint32]struct{})
+	}
+	t.zones[f.Zone][f.ID] = struct{}{}
+}
+
+// remove deletes the Flow with the given ID and removes it from the indexes.
+// t.mu must be held.
+func (t *Table) remove(id uint32) {
+	f, ok := t.flows[id]
+	if !ok {
+		return
+	}
+	delete(t.flows, id)
+
+	for _, key := range []FlowKey{f.Key(), f.ReplyKey()} {
+		if t.keys[key] == id {
+			delete(t.keys, key)
+		}
+	}
+
+	for _, a := range addrsOf(f) {
+		delete(t.addrs[a], id)
+		if len(t.addrs[a]) == 0 {
+			delete(t.addrs, a)
+		}
+	}
+
+	delete(t.zones[f.Zone], id)
+	if len(t.zones[f.Zone]) == 0 {
+		delete(t.zones, f.Zone)
+	}
+}
+
+// sortedIDs returns the IDs of all stored Flows in ascending order. t.mu must
+// be held.
+func (t *Table) sortedIDs() []uint32 {
+	ids := make([]uint32, 0, len(t.flows))
+	for id := range t.flows {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	return ids
+}
+
+// collect returns the Flows with the given IDs ordered by ID. t.mu must be
+// held.
+func (t *Table) collect(ids map[uint32]struct{}) []Flow {
+	out := make([]Flow, 0, len(ids))
+	for id := range ids {
+		out = append(out, t.flows[id])
+	}
+	slices.SortFunc(out, func(a, b Flow) int { return cmp.Compare(a.ID, b.ID) })
+
+	return out
+}
+
+// Len returns the number of Flows in the Table.
+func (t *Table) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.flows)
+}
+
+// Flows returns all Flows in the Table, ordered by ID.
+func (t *Table) Flows() []Flow {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	out := make([]Flow, 0, len(t.flows))
+	for _, id := range t.sortedIDs() {
+		out = append(out, t.flows[id])
+	}
+
+	return out
+}
+
+// Get returns the Flow with the given ID.
+func (t *Table) Get(id uint32) (Flow, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	f, ok := t.flows[id]
+	return f, ok
+}
+
+// Lookup returns the Flow with the given FlowKey, derived from either its
+// original or reply tuple. Use [Tuple.Key] or [NewFlowKey] to look up the Flow
+// of a packet travelling in either direction.
+func (t *Table) Lookup(key FlowKey) (Flow, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	id, ok := t.keys[key]
+	if !ok {
+		return Flow{}, false
+	}
+
+	return t.flows[id], true
+}
+
+// FlowsByAddr returns the Flows with addr as the source or destination of
+// either of their tuples, ordered by ID.
+func (t *Table) FlowsByAddr(addr netip.Addr) []Flow {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.collect(t.addrs[addr])
+}
+
+// FlowsByZone returns the Flows in the given zone, ordered by ID.
+func (t *Table) FlowsByZone(zone uint16) []Flow {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.collect(t.zones[zone])
+}
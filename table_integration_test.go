@@ -0,0 +1,89 @@
+//go:build integration
+
+package conntrack
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableRun(t *testing.T) {
+	c, nsfd, err := makeNSConn()
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Flows present before the Table is started are picked up by the dump.
+	f1 := NewFlow(6, 0, netip.MustParseAddr("203.0.113.1"), netip.MustParseAddr("203.0.113.2"), 1234, 80, 120, 0)
+	require.NoError(t, c.Create(f1))
+
+	changes := make(chan Event, 16)
+	// f1 doesn't generate events when nf_conntrack_events is 2, its removal is
+	// picked up by a resync.
+	tbl := NewTable(&netlink.Config{NetNS: nsfd}, &TableOptions{
+		Changes:        changes,
+		ResyncInterval: 100 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- tbl.Run(ctx) }()
+
+	select {
+	case <-tbl.Synced():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for Table to sync")
+	}
+
+	next := func() Event {
+		t.Helper()
+		select {
+		case ev := <-changes:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for Table change")
+		}
+		return Event{}
+	}
+
+	ev := next()
+	assert.Equal(t, EventNew, ev.Type)
+	assert.Equal(t, f1.TupleOrig.IP, ev.Flow.TupleOrig.IP)
+	assert.Equal(t, 1, tbl.Len())
+
+	got, ok := tbl.Lookup(f1.TupleReply.Key(0))
+	require.True(t, ok)
+	assert.NotZero(t, got.ID)
+
+	// Flows created afterwards are picked up by events.
+	f2 := NewFlow(17, 0, netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2"), 1234, 53, 120, 0)
+	require.NoError(t, c.Create(f2))
+	ev = next()
+	assert.Equal(t, EventNew, ev.Type)
+	assert.Len(t, tbl.FlowsByAddr(netip.MustParseAddr("2001:db8::2")), 1)
+
+	f2.Mark = 42
+	require.NoError(t, c.Update(f2))
+	ev = next()
+	assert.Equal(t, EventUpdate, ev.Type)
+	assert.Equal(t, uint32(42), ev.Flow.Mark)
+
+	require.NoError(t, c.Delete(f1))
+	ev = next()
+	assert.Equal(t, EventDestroy, ev.Type)
+	assert.Equal(t, got.ID, ev.Flow.ID)
+
+	flows := tbl.Flows()
+	require.Len(t, flows, 1)
+	assert.Equal(t, uint32(42), flows[0].Mark)
+
+	assert.ErrorIs(t, tbl.Run(ctx), errTableRunning)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
@@ -0,0 +1,168 @@
+package conntrack
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func tableFlow(id uint32, src string, sport uint16) Flow {
+	f := NewFlow(unix.IPPROTO_TCP, StatusConfirmed, netip.MustParseAddr(src), netip.MustParseAddr("10.0.0.1"),
+		sport, 80, 120, 0)
+	f.ID = id
+	return f
+}
+
+func eventTypes(evs []Event) []eventType {
+	var out []eventType
+	for _, ev := range evs {
+		out = append(out, ev.Type)
+	}
+	return out
+}
+
+func TestTableApply(t *testing.T) {
+	tbl := NewTable(nil, nil)
+
+	f1 := tableFlow(1, "192.0.2.1", 1000)
+	f1.CountersOrig = Counter{Packets: 1, Bytes: 60}
+	f1.Labels = Labels{1}
+	f2 := tableFlow(2, "192.0.2.2", 2000)
+	f2.Zone = 5
+
+	assert.Equal(t, []eventType{EventNew}, eventTypes(tbl.apply(Event{Type: EventNew, Flow: &f1})))
+	assert.Equal(t, []eventType{EventNew}, eventTypes(tbl.apply(Event{Type: EventNew, Flow: &f2})))
+	assert.Nil(t, tbl.apply(Event{Type: EventNew}), "events without Flow are ignored")
+	assert.Equal(t, 2, tbl.Len())
+
+	// Repeating a Flow or changing its Timeout doesn't cause a change.
+	assert.Empty(t, tbl.apply(Event{Type: EventUpdate, Flow: &f1}))
+	f1.Timeout = 100
+	assert.Empty(t, tbl.apply(Event{Type: EventUpdate, Flow: &f1}))
+	got, _ := tbl.Get(1)
+	assert.Equal(t, uint32(100), got.Timeout)
+
+	// Attributes missing from update events are retained.
+	u := tableFlow(1, "192.0.2.1", 1000)
+	u.Timeout = 60
+	u.Mark = 1
+	changes := tbl.apply(Event{Type: EventUpdate, Flow: &u})
+	require.Equal(t, []eventType{EventUpdate}, eventTypes(changes))
+	got, ok := tbl.Get(1)
+	require.True(t, ok)
+	assert.Equal(t, uint32(60), got.Timeout)
+	assert.Equal(t, f1.CountersOrig, got.CountersOrig)
+	assert.Equal(t, f1.Labels, got.Labels)
+	assert.Equal(t, got, *changes[0].Flow)
+
+	// Lookups by either tuple, in the Flow's zone only.
+	got, ok = tbl.Lookup(f1.TupleReply.Key(0))
+	require.True(t, ok)
+	assert.Equal(t, uint32(1), got.ID)
+	_, ok = tbl.Lookup(f2.TupleOrig.Key(0))
+	assert.False(t, ok)
+	got, ok = tbl.Lookup(f2.Key())
+	require.True(t, ok)
+	assert.Equal(t, uint32(2), got.ID)
+
+	assert.Len(t, tbl.FlowsByAddr(netip.MustParseAddr("10.0.0.1")), 2)
+	assert.Len(t, tbl.FlowsByAddr(netip.MustParseAddr("192.0.2.2")), 1)
+	assert.Empty(t, tbl.FlowsByAddr(netip.MustParseAddr("192.0.2.3")))
+	assert.Len(t, tbl.FlowsByZone(5), 1)
+	assert.Len(t, tbl.FlowsByZone(0), 1)
+
+	// A new Flow with the tuple of a stored Flow replaces it.
+	f3 := tableFlow(3, "192.0.2.1", 1000)
+	assert.Equal(t, []eventType{EventDestroy, EventNew}, eventTypes(tbl.apply(Event{Type: EventNew, Flow: &f3})))
+	_, ok = tbl.Get(1)
+	assert.False(t, ok)
+
+	// Destroy events are matched by ID or tuple.
+	d := tableFlow(0, "192.0.2.1", 1000)
+	assert.Equal(t, []eventType{EventDestroy}, eventTypes(tbl.apply(Event{Type: EventDestroy, Flow: &d})))
+	assert.Empty(t, tbl.apply(Event{Type: EventDestroy, Flow: &d}))
+	assert.Equal(t, []eventType{EventDestroy}, eventTypes(tbl.apply(Event{Type: EventDestroy, Flow: &f2})))
+
+	assert.Equal(t, 0, tbl.Len())
+	assert.Empty(t, tbl.keys)
+	assert.Empty(t, tbl.addrs)
+	assert.Empty(t, tbl.zones)
+}
+
+func TestTableReplace(t *testing.T) {
+	tbl := NewTable(nil, nil)
+
+	f1, f2, f3 := tableFlow(1, "192.0.2.1", 1), tableFlow(2, "192.0.2.2", 2), tableFlow(3, "192.0.2.3", 3)
+	assert.Equal(t, []eventType{EventNew, EventNew}, eventTypes(tbl.replace([]Flow{f1, f2})))
+
+	f2.Mark = 1
+	changes := tbl.replace([]Flow{f2, f3})
+	assert.Equal(t, []eventType{EventUpdate, EventNew, EventDestroy}, eventTypes(changes))
+	assert.Equal(t, uint32(1), changes[2].Flow.ID)
+
+	flows := tbl.Flows()
+	require.Len(t, flows, 2)
+	assert.Equal(t, uint32(2), flows[0].ID)
+	assert.Equal(t, uint32(3), flows[1].ID)
+}
+
+func TestTableNotify(t *testing.T) {
+	changes := make(chan Event, 1)
+	tbl := NewTable(nil, &TableOptions{Changes: changes})
+
+	f := tableFlow(1, "192.0.2.1", 1)
+	require.NoError(t, tbl.notify(context.Background(), []Event{{Type: EventNew, Flow: &f}}))
+	assert.Equal(t, EventNew, (<-changes).Type)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	evs := []Event{{Type: EventNew, Flow: &f}, {Type: EventDestroy, Flow: &f}}
+	assert.ErrorIs(t, tbl.notify(ctx, evs), context.DeadlineExceeded)
+
+	assert.NoError(t, NewTable(nil, nil).notify(ctx, evs))
+}
+
+func TestTableSync(t *testing.T) {
+	ctx := context.Background()
+	tbl := NewTable(nil, nil)
+
+	f1, f2 := tableFlow(1, "192.0.2.1", 1), tableFlow(2, "192.0.2.2", 2)
+	tbl.replace([]Flow{f1, f2})
+
+	// Interrupted dumps are retried instead of removing the Flows they miss.
+	var attempts int
+	interrupted := func(n int) func(context.Context) ([]Flow, error) {
+		return func(context.Context) ([]Flow, error) {
+			attempts++
+			if attempts <= n {
+				return []Flow{f2}, ErrDumpInterrupted
+			}
+			return []Flow{f1, f2}, nil
+		}
+	}
+	require.NoError(t, tbl.sync(ctx, interrupted(1), nil, nil))
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 2, tbl.Len())
+
+	attempts = 0
+	assert.ErrorIs(t, tbl.sync(ctx, interrupted(tableSyncAttempts), nil, nil), ErrDumpInterrupted)
+	assert.Equal(t, tableSyncAttempts, attempts)
+	assert.Equal(t, 2, tbl.Len())
+
+	// Dumps during which events are lost are retried as well.
+	errs := make(chan error)
+	attempts = 0
+	lost := func(context.Context) ([]Flow, error) {
+		attempts++
+		errs <- unix.ENOBUFS
+		return []Flow{f2}, nil
+	}
+	assert.ErrorIs(t, tbl.sync(ctx, lost, nil, errs), unix.ENOBUFS)
+	assert.Equal(t, tableSyncAttempts, attempts)
+	assert.Equal(t, 2, tbl.Len())
+}
@@ -0,0 +1,347 @@
+package conntrack
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+// The enums below are translated from the Linux kernel source at
+// include/uapi/linux/netfilter/nfnetlink_cttimeout.h
+
+// timeoutMessageType is a cttimeout-specific representation of a
+// netfilter.MessageType.
+type timeoutMessageType netfilter.MessageType
+
+// enum ctnl_timeout_msg_types
+const (
+	ctTimeoutNew        timeoutMessageType = iota // IPCTNL_MSG_TIMEOUT_NEW
+	ctTimeoutGet                                  // IPCTNL_MSG_TIMEOUT_GET
+	ctTimeoutDelete                               // IPCTNL_MSG_TIMEOUT_DELETE
+	ctTimeoutDefaultSet                           // IPCTNL_MSG_TIMEOUT_DEFAULT_SET
+	ctTimeoutDefaultGet                           // IPCTNL_MSG_TIMEOUT_DEFAULT_GET
+)
+
+// timeoutType describes the type of cttimeout attribute in this container.
+type timeoutType uint8
+
+// enum ctattr_timeout
+const (
+	ctaTimeoutUnspec  timeoutType = iota // CTA_TIMEOUT_UNSPEC
+	ctaTimeoutName                       // CTA_TIMEOUT_NAME
+	ctaTimeoutL3Proto                    // CTA_TIMEOUT_L3PROTO
+	ctaTimeoutL4Proto                    // CTA_TIMEOUT_L4PROTO
+	ctaTimeoutData                       // CTA_TIMEOUT_DATA
+	ctaTimeoutUse                        // CTA_TIMEOUT_USE
+	ctaTimeoutPad                        // CTA_TIMEOUT_PAD
+)
+
+var _ = []uint8{uint8(ctaTimeoutUnspec), uint8(ctaTimeoutPad)}
+
+// timeoutNames holds the kernel names of nested cttimeout attributes, used in
+// the Path of a DecodeError.
+var timeoutNames = map[timeoutType]string{
+	ctaTimeoutData: "CTA_TIMEOUT_DATA",
+}
+
+// timeoutNameMax is the maximum length of a timeout policy name, including
+// the terminating NUL byte.
+const timeoutNameMax = 32 // CTNL_TIMEOUT_NAME_MAX
+
+// L4ProtoGeneric is the layer 4 protocol number of the kernel's generic
+// connection tracker, used for protocols without a dedicated tracker.
+const L4ProtoGeneric = 255
+
+// Timeout is a conntrack timeout policy, as managed by `nfct timeout`. Named
+// policies can be attached to connections using the CT target in iptables or
+// the ct timeout object in nftables, overriding the default timeouts of the
+// connection's protocol.
+//
+// Timeout values in a TimeoutPolicy are expressed in seconds.
+type Timeout struct {
+	// Name is the unique name of the policy, at most 31 bytes long. It is not
+	// used when getting or setting default timeouts.
+	Name string
+
+	// L3Proto is the address family the policy applies to, like
+	// [netfilter.ProtoIPv4] or [netfilter.ProtoIPv6].
+	L3Proto netfilter.ProtoFamily
+
+	// L4Proto is the layer 4 protocol number the policy applies to, like
+	// [unix.IPPROTO_TCP]. Use [L4ProtoGeneric] for protocols that don't have
+	// their own connection tracker.
+	L4Proto uint8
+
+	// Policy holds the timeouts for each state of the protocol. Its type must
+	// match L4Proto, see [TimeoutPolicy].
+	Policy TimeoutPolicy
+
+	// Use is the amount of references held to the policy by rules and
+	// connections. Read-only.
+	Use uint32
+}
+
+// TimeoutPolicy holds the timeouts of a layer 4 protocol's states. It is
+// implemented by:
+//
+//   - [*TimeoutPolicyTCP] for [unix.IPPROTO_TCP]
+//   - [*TimeoutPolicyUDP] for [unix.IPPROTO_UDP] and [unix.IPPROTO_UDPLITE]
+//   - [*TimeoutPolicyICMP] for [unix.IPPROTO_ICMP] and [unix.IPPROTO_ICMPV6]
+//   - [*TimeoutPolicySCTP] for [unix.IPPROTO_SCTP]
+//   - [*TimeoutPolicyDCCP] for [unix.IPPROTO_DCCP]
+//   - [*TimeoutPolicyGRE] for [unix.IPPROTO_GRE]
+//   - [*TimeoutPolicyGeneric] for [L4ProtoGeneric]
+//
+// Timeouts left zero are set to the protocol's default timeouts by the kernel.
+type TimeoutPolicy interface {
+	// fields returns pointers to the policy's timeouts in order of their
+	// attribute types, starting at 1.
+	fields() []*uint32
+}
+
+// TimeoutPolicyTCP holds the timeouts of TCP connection states.
+type TimeoutPolicyTCP struct {
+	SynSent        uint32
+	SynRecv        uint32
+	Established    uint32
+	FinWait        uint32
+	CloseWait      uint32
+	LastAck        uint32
+	TimeWait       uint32
+	Close          uint32
+	SynSent2       uint32
+	Retrans        uint32
+	Unacknowledged uint32
+}
+
+func (p *TimeoutPolicyTCP) fields() []*uint32 {
+	return []*uint32{
+		&p.SynSent, &p.SynRecv, &p.Established, &p.FinWait, &p.CloseWait, &p.LastAck,
+		&p.TimeWait, &p.Close, &p.SynSent2, &p.Retrans, &p.Unacknowledged,
+	}
+}
+
+// TimeoutPolicyUDP holds the timeouts of UDP and UDP-Lite connection states.
+type TimeoutPolicyUDP struct {
+	Unreplied uint32
+	Replied   uint32
+}
+
+func (p *TimeoutPolicyUDP) fields() []*uint32 {
+	return []*uint32{&p.Unreplied, &p.Replied}
+}
+
+// TimeoutPolicyICMP holds the timeout of ICMP and ICMPv6 connections.
+type TimeoutPolicyICMP struct {
+	Timeout uint32
+}
+
+func (p *TimeoutPolicyICMP) fields() []*uint32 {
+	return []*uint32{&p.Timeout}
+}
+
+// TimeoutPolicySCTP holds the timeouts of SCTP connection states.
+//
+// HeartbeatAcked is no longer used since Linux 6.3.
+type TimeoutPolicySCTP struct {
+	Closed          uint32
+	CookieWait      uint32
+	CookieEchoed    uint32
+	Established     uint32
+	ShutdownSent    uint32
+	ShutdownRecd    uint32
+	ShutdownAckSent uint32
+	HeartbeatSent   uint32
+	HeartbeatAcked  uint32
+}
+
+func (p *TimeoutPolicySCTP) fields() []*uint32 {
+	return []*uint32{
+		&p.Closed, &p.CookieWait, &p.CookieEchoed, &p.Established, &p.ShutdownSent,
+		&p.ShutdownRecd, &p.ShutdownAckSent, &p.HeartbeatSent, &p.HeartbeatAcked,
+	}
+}
+
+// TimeoutPolicyDCCP holds the timeouts of DCCP connection states.
+type TimeoutPolicyDCCP struct {
+	Request  uint32
+	Respond  uint32
+	PartOpen uint32
+	Open     uint32
+	CloseReq uint32
+	Closing  uint32
+	TimeWait uint32
+}
+
+func (p *TimeoutPolicyDCCP) fields() []*uint32 {
+	return []*uint32{&p.Request, &p.Respond, &p.PartOpen, &p.Open, &p.CloseReq, &p.Closing, &p.TimeWait}
+}
+
+// TimeoutPolicyGRE holds the timeouts of GRE connection states.
+type TimeoutPolicyGRE struct {
+	Unreplied uint32
+	Replied   uint32
+}
+
+func (p *TimeoutPolicyGRE) fields() []*uint32 {
+	return []*uint32{&p.Unreplied, &p.Replied}
+}
+
+// TimeoutPolicyGeneric holds the timeout of connections tracked by the
+// generic connection tracker.
+type TimeoutPolicyGeneric struct {
+	Timeout uint32
+}
+
+func (p *TimeoutPolicyGeneric) fields() []*uint32 {
+	return []*uint32{&p.Timeout}
+}
+
+// newTimeoutPolicy returns an empty TimeoutPolicy for the given layer 4
+// protocol.
+func newTimeoutPolicy(l4 uint8) TimeoutPolicy {
+	switch l4 {
+	case unix.IPPROTO_TCP:
+		return &TimeoutPolicyTCP{}
+	case unix.IPPROTO_UDP, unix.IPPROTO_UDPLITE:
+		return &TimeoutPolicyUDP{}
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		return &TimeoutPolicyICMP{}
+	case unix.IPPROTO_SCTP:
+		return &TimeoutPolicySCTP{}
+	case unix.IPPROTO_DCCP:
+		return &TimeoutPolicyDCCP{}
+	case unix.IPPROTO_GRE:
+		return &TimeoutPolicyGRE{}
+	}
+
+	return &TimeoutPolicyGeneric{}
+}
+
+// marshalTimeoutPolicy marshals a TimeoutPolicy into a CTA_TIMEOUT_DATA
+// attribute. Only non-zero timeouts are included.
+func marshalTimeoutPolicy(p TimeoutPolicy) netfilter.Attribute {
+	nfa := netfilter.Attribute{Type: uint16(ctaTimeoutData), Nested: true}
+
+	for i, v := range p.fields() {
+		if *v == 0 {
+			continue
+		}
+		nfa.Children = append(nfa.Children, netfilter.Attribute{
+			Type: uint16(i + 1), Data: netfilter.Uint32Bytes(*v),
+		})
+	}
+
+	return nfa
+}
+
+// unmarshalTimeoutPolicy unmarshals the children of a CTA_TIMEOUT_DATA
+// attribute into p. Unknown timeouts are ignored.
+func unmarshalTimeoutPolicy(p TimeoutPolicy, ad *netlink.AttributeDecoder) error {
+	fields := p.fields()
+	for ad.Next() {
+		i := int(ad.Type()) - 1
+		if i < 0 || i >= len(fields) {
+			continue
+		}
+		*fields[i] = ad.Uint32()
+	}
+
+	return ad.Err()
+}
+
+// unmarshal unmarshals a list of netfilter.Attributes into a Timeout.
+func (t *Timeout) unmarshal(ad *netlink.AttributeDecoder) error {
+	// The policy can only be decoded once the L4 protocol is known.
+	var data []byte
+
+	for ad.Next() {
+		switch timeoutType(ad.Type()) {
+		case ctaTimeoutName:
+			t.Name = ad.String()
+		case ctaTimeoutL3Proto:
+			t.L3Proto = netfilter.ProtoFamily(ad.Uint16())
+		case ctaTimeoutL4Proto:
+			t.L4Proto = ad.Uint8()
+		case ctaTimeoutUse:
+			t.Use = ad.Uint32()
+		case ctaTimeoutData:
+			data = ad.Bytes()
+		}
+	}
+
+	if err := ad.Err(); err != nil {
+		return &DecodeError{Err: err}
+	}
+
+	if data == nil {
+		return nil
+	}
+
+	dad, err := netfilter.NewAttributeDecoder(data)
+	if err != nil {
+		return decodeError(attrName(timeoutNames, ctaTimeoutData), err)
+	}
+
+	t.Policy = newTimeoutPolicy(t.L4Proto)
+	if err := unmarshalTimeoutPolicy(t.Policy, dad); err != nil {
+		return decodeError(attrName(timeoutNames, ctaTimeoutData), err)
+	}
+
+	return nil
+}
+
+// marshal marshals a Timeout into a list of netfilter.Attributes. If named is
+// true, the Timeout's Name is included.
+func (t Timeout) marshal(named bool) ([]netfilter.Attribute, error) {
+	var attrs []netfilter.Attribute
+
+	if named {
+		na, err := marshalTimeoutName(t.Name)
+		if err != nil {
+			return nil, err
+		}
+		attrs = na
+	}
+
+	if t.Policy == nil || reflect.TypeOf(t.Policy) != reflect.TypeOf(newTimeoutPolicy(t.L4Proto)) {
+		return nil, fmt.Errorf("protocol %d: %w", t.L4Proto, errTimeoutPolicy)
+	}
+
+	attrs = append(attrs,
+		netfilter.Attribute{Type: uint16(ctaTimeoutL3Proto), Data: netfilter.Uint16Bytes(uint16(t.L3Proto))},
+		netfilter.Attribute{Type: uint16(ctaTimeoutL4Proto), Data: []byte{t.L4Proto}},
+		marshalTimeoutPolicy(t.Policy),
+	)
+
+	return attrs, nil
+}
+
+// marshalTimeoutName marshals a timeout policy name used for lookups.
+func marshalTimeoutName(name string) ([]netfilter.Attribute, error) {
+	if name == "" || len(name) >= timeoutNameMax {
+		return nil, errTimeoutName
+	}
+
+	// The kernel only accepts NUL-terminated names.
+	return []netfilter.Attribute{{Type: uint16(ctaTimeoutName), Data: []byte(name + "\x00")}}, nil
+}
+
+// unmarshalTimeout unmarshals a Timeout from a netlink.Message.
+func unmarshalTimeout(nlm netlink.Message) (Timeout, error) {
+	var t Timeout
+
+	_, ad, err := netfilter.DecodeNetlink(nlm)
+	if err != nil {
+		return t, err
+	}
+
+	if err := t.unmarshal(ad); err != nil {
+		return t, err
+	}
+
+	return t, nil
+}
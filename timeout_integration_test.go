@@ -0,0 +1,108 @@
+//go:build integration
+
+package conntrack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+func TestConnTimeout(t *testing.T) {
+	if !findKsym("cttimeout_new_timeout") {
+		t.Skip("cttimeout not supported by kernel")
+	}
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	tt := Timeout{
+		Name:    "tcp-long",
+		L3Proto: netfilter.ProtoIPv4,
+		L4Proto: unix.IPPROTO_TCP,
+		Policy:  &TimeoutPolicyTCP{Established: 86400, Close: 5},
+	}
+	require.NoError(t, c.CreateTimeout(tt))
+	assert.ErrorIs(t, c.CreateTimeout(tt), unix.EEXIST)
+
+	got, err := c.GetTimeout("tcp-long")
+	require.NoError(t, err)
+	assert.Equal(t, tt.Name, got.Name)
+	assert.Equal(t, tt.L3Proto, got.L3Proto)
+	assert.Equal(t, tt.L4Proto, got.L4Proto)
+	require.IsType(t, &TimeoutPolicyTCP{}, got.Policy)
+	tcp := got.Policy.(*TimeoutPolicyTCP)
+	assert.Equal(t, uint32(86400), tcp.Established)
+	assert.Equal(t, uint32(5), tcp.Close)
+	// Other states default to the kernel's TCP timeouts.
+	assert.NotZero(t, tcp.SynSent)
+
+	// Replacing the policy resets unspecified timeouts to their defaults.
+	tt.Policy = &TimeoutPolicyTCP{Established: 3600}
+	require.NoError(t, c.UpdateTimeout(tt))
+	got, err = c.GetTimeout("tcp-long")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3600), got.Policy.(*TimeoutPolicyTCP).Established)
+	assert.NotEqual(t, uint32(5), got.Policy.(*TimeoutPolicyTCP).Close)
+
+	// The protocol of an existing policy can't be changed.
+	assert.ErrorIs(t, c.UpdateTimeout(Timeout{Name: "tcp-long", L3Proto: netfilter.ProtoIPv4,
+		L4Proto: unix.IPPROTO_UDP, Policy: &TimeoutPolicyUDP{Replied: 10}}), unix.EINVAL)
+
+	require.NoError(t, c.CreateTimeout(Timeout{Name: "udp", L3Proto: netfilter.ProtoIPv6,
+		L4Proto: unix.IPPROTO_UDP, Policy: &TimeoutPolicyUDP{Unreplied: 10, Replied: 20}}))
+	require.NoError(t, c.CreateTimeout(Timeout{Name: "generic", L3Proto: netfilter.ProtoIPv4,
+		L4Proto: L4ProtoGeneric, Policy: &TimeoutPolicyGeneric{Timeout: 30}}))
+
+	ts, err := c.DumpTimeout()
+	require.NoError(t, err)
+	require.Len(t, ts, 3)
+	byName := map[string]Timeout{}
+	for _, t := range ts {
+		byName[t.Name] = t
+	}
+	assert.Equal(t, &TimeoutPolicyUDP{Unreplied: 10, Replied: 20}, byName["udp"].Policy)
+	assert.Equal(t, &TimeoutPolicyGeneric{Timeout: 30}, byName["generic"].Policy)
+
+	require.NoError(t, c.DeleteTimeout("udp"))
+	_, err = c.GetTimeout("udp")
+	assert.ErrorIs(t, err, unix.ENOENT)
+	assert.ErrorIs(t, c.DeleteTimeout("udp"), unix.ENOENT)
+
+	require.NoError(t, c.FlushTimeout())
+	ts, err = c.DumpTimeout()
+	require.NoError(t, err)
+	assert.Empty(t, ts)
+}
+
+func TestConnDefaultTimeout(t *testing.T) {
+	if !findKsym("cttimeout_default_set") {
+		t.Skip("cttimeout not supported by kernel")
+	}
+
+	c, _, err := makeNSConn()
+	require.NoError(t, err)
+
+	def, err := c.GetDefaultTimeout(netfilter.ProtoIPv4, unix.IPPROTO_UDP)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(unix.IPPROTO_UDP), def.L4Proto)
+	require.IsType(t, &TimeoutPolicyUDP{}, def.Policy)
+	orig := *def.Policy.(*TimeoutPolicyUDP)
+	assert.NotZero(t, orig.Unreplied)
+
+	// Only the given timeouts are changed.
+	require.NoError(t, c.SetDefaultTimeout(Timeout{L3Proto: netfilter.ProtoIPv4, L4Proto: unix.IPPROTO_UDP,
+		Policy: &TimeoutPolicyUDP{Unreplied: 42}}))
+
+	def, err = c.GetDefaultTimeout(netfilter.ProtoIPv4, unix.IPPROTO_UDP)
+	require.NoError(t, err)
+	assert.Equal(t, &TimeoutPolicyUDP{Unreplied: 42, Replied: orig.Replied}, def.Policy)
+
+	def, err = c.GetDefaultTimeout(netfilter.ProtoIPv4, unix.IPPROTO_ICMP)
+	require.NoError(t, err)
+	require.IsType(t, &TimeoutPolicyICMP{}, def.Policy)
+	assert.NotZero(t, def.Policy.(*TimeoutPolicyICMP).Timeout)
+}
@@ -0,0 +1,122 @@
+package conntrack
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+func TestTimeoutMarshal(t *testing.T) {
+	tt := Timeout{
+		Name:    "foo",
+		L3Proto: netfilter.ProtoIPv6,
+		L4Proto: unix.IPPROTO_TCP,
+		Policy:  &TimeoutPolicyTCP{SynSent: 1, Established: 0x0102, Unacknowledged: 3},
+	}
+
+	attrs, err := tt.marshal(true)
+	require.NoError(t, err)
+	assert.Equal(t, []netfilter.Attribute{
+		{Type: uint16(ctaTimeoutName), Data: []byte("foo\x00")},
+		{Type: uint16(ctaTimeoutL3Proto), Data: []byte{0, 10}},
+		{Type: uint16(ctaTimeoutL4Proto), Data: []byte{6}},
+		{Type: uint16(ctaTimeoutData), Nested: true, Children: []netfilter.Attribute{
+			{Type: 1, Data: []byte{0, 0, 0, 1}},
+			{Type: 3, Data: []byte{0, 0, 1, 2}},
+			{Type: 11, Data: []byte{0, 0, 0, 3}},
+		}},
+	}, attrs)
+
+	// Default timeouts don't have a name.
+	attrs, err = tt.marshal(false)
+	require.NoError(t, err)
+	assert.Len(t, attrs, 3)
+
+	// Round-trip through a Netlink message, including the use counter.
+	attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaTimeoutUse), Data: []byte{0, 0, 0, 2}})
+	nlm, err := netfilter.MarshalNetlink(netfilter.Header{SubsystemID: netfilter.NFSubsysCTNetlinkTimeout}, attrs)
+	require.NoError(t, err)
+
+	got, err := unmarshalTimeout(nlm)
+	require.NoError(t, err)
+	tt.Name, tt.Use = "", 2
+	assert.Equal(t, tt, got)
+}
+
+func TestTimeoutUnmarshalDecodeError(t *testing.T) {
+	unmarshal := func(attrs ...netfilter.Attribute) error {
+		nlm, err := netfilter.MarshalNetlink(netfilter.Header{SubsystemID: netfilter.NFSubsysCTNetlinkTimeout}, attrs)
+		require.NoError(t, err)
+		_, err = unmarshalTimeout(nlm)
+		return err
+	}
+
+	// A timeout of the wrong size.
+	err := unmarshal(
+		netfilter.Attribute{Type: uint16(ctaTimeoutL4Proto), Data: []byte{unix.IPPROTO_UDP}},
+		netfilter.Attribute{Type: uint16(ctaTimeoutData), Nested: true, Children: []netfilter.Attribute{
+			{Type: 1, Data: []byte{0, 1}},
+		}},
+	)
+	var de *DecodeError
+	require.ErrorAs(t, err, &de)
+	assert.Equal(t, []string{"CTA_TIMEOUT_DATA"}, de.Path)
+
+	// Errors in top-level attributes have an empty Path.
+	err = unmarshal(netfilter.Attribute{Type: uint16(ctaTimeoutUse), Data: []byte{0, 1}})
+	require.ErrorAs(t, err, &de)
+	assert.Empty(t, de.Path)
+}
+
+func TestTimeoutMarshalError(t *testing.T) {
+	_, err := Timeout{L4Proto: unix.IPPROTO_UDP, Policy: &TimeoutPolicyUDP{}}.marshal(true)
+	assert.ErrorIs(t, err, errTimeoutName)
+
+	_, err = Timeout{Name: strings.Repeat("a", 32), L4Proto: unix.IPPROTO_UDP, Policy: &TimeoutPolicyUDP{}}.marshal(true)
+	assert.ErrorIs(t, err, errTimeoutName)
+
+	_, err = Timeout{Name: "foo", L4Proto: unix.IPPROTO_UDP}.marshal(true)
+	assert.ErrorIs(t, err, errTimeoutPolicy)
+
+	_, err = Timeout{L4Proto: unix.IPPROTO_UDP, Policy: &TimeoutPolicyTCP{}}.marshal(false)
+	assert.ErrorIs(t, err, errTimeoutPolicy)
+
+	_, err = marshalTimeoutName("")
+	assert.ErrorIs(t, err, errTimeoutName)
+}
+
+func TestNewTimeoutPolicy(t *testing.T) {
+	for l4, want := range map[uint8]TimeoutPolicy{
+		unix.IPPROTO_TCP:     &TimeoutPolicyTCP{},
+		unix.IPPROTO_UDP:     &TimeoutPolicyUDP{},
+		unix.IPPROTO_UDPLITE: &TimeoutPolicyUDP{},
+		unix.IPPROTO_ICMP:    &TimeoutPolicyICMP{},
+		unix.IPPROTO_ICMPV6:  &TimeoutPolicyICMP{},
+		unix.IPPROTO_SCTP:    &TimeoutPolicySCTP{},
+		unix.IPPROTO_DCCP:    &TimeoutPolicyDCCP{},
+		unix.IPPROTO_GRE:     &TimeoutPolicyGRE{},
+		L4ProtoGeneric:       &TimeoutPolicyGeneric{},
+	} {
+		assert.Equal(t, want, newTimeoutPolicy(l4))
+	}
+}
+
+func TestUnmarshalTimeoutPolicy(t *testing.T) {
+	b, err := netfilter.MarshalAttributes([]netfilter.Attribute{
+		{Type: 2, Data: []byte{0, 0, 0, 20}},
+		// Unknown timeouts from newer kernels are ignored.
+		{Type: 3, Data: []byte{0, 0, 0, 30}},
+	})
+	require.NoError(t, err)
+
+	ad, err := netfilter.NewAttributeDecoder(b)
+	require.NoError(t, err)
+
+	var p TimeoutPolicyUDP
+	require.NoError(t, unmarshalTimeoutPolicy(&p, ad))
+	assert.Equal(t, TimeoutPolicyUDP{Replied: 20}, p)
+}
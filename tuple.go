@@ -59,7 +59,7 @@ func (t *Tuple) unmarshal(ad *netlink.AttributeDecoder) error {
 		}
 
 		if err := ad.Err(); err != nil {
-			return fmt.Errorf("unmarshal %s: %w", tt, err)
+			return decodeError(attrName(tupleNames, tt), err)
 		}
 	}
 
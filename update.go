@@ -0,0 +1,142 @@
+package conntrack
+
+import (
+	"github.com/ti-mo/netfilter"
+)
+
+// FlowField is a bit mask selecting the mutable attributes of a Flow sent in a
+// [FlowUpdate].
+type FlowField uint16
+
+// Mutable attributes of a Flow, see ctnetlink_change_conntrack() in the
+// kernel.
+const (
+	// FieldTimeout selects Flow.Timeout. A zero Timeout makes the entry
+	// expire immediately.
+	FieldTimeout FlowField = 1 << iota
+
+	// FieldStatus selects Flow.Status. Only bits that don't describe the
+	// entry's lifecycle can be changed, the kernel rejects attempts to clear
+	// others.
+	FieldStatus
+
+	// FieldMark selects Flow.Mark, a zero Mark clears the connmark.
+	FieldMark
+
+	// FieldProtoInfo selects Flow.ProtoInfo, which must hold a value.
+	FieldProtoInfo
+
+	// FieldHelper selects Flow.Helper, a Helper without Name detaches the
+	// entry's helper.
+	FieldHelper
+
+	// FieldSeqAdjOrig and FieldSeqAdjReply select Flow.SeqAdjOrig and
+	// Flow.SeqAdjReply.
+	FieldSeqAdjOrig
+	FieldSeqAdjReply
+
+	// FieldSynProxy selects Flow.SynProxy.
+	FieldSynProxy
+
+	// FieldLabels selects Flow.Labels and Flow.LabelsMask. Empty Labels clear
+	// all labels.
+	FieldLabels
+
+	fieldsMutable = FieldTimeout | FieldStatus | FieldMark | FieldProtoInfo | FieldHelper |
+		FieldSeqAdjOrig | FieldSeqAdjReply | FieldSynProxy | FieldLabels
+)
+
+// FlowUpdate is an update of a Conntrack entry that sends exactly the
+// attributes selected by Fields, including zero values, unlike [Conn.Update],
+// which leaves out attributes with zero values.
+type FlowUpdate struct {
+	// Flow identifies the entry by its TupleOrig or TupleReply and its Zone,
+	// and holds the new values of the attributes selected by Fields. Other
+	// attributes are ignored, except for TupleMaster, NATSrc and NATDst,
+	// which can't be updated and are rejected.
+	Flow Flow
+
+	// Fields selects the attributes to update.
+	Fields FlowField
+}
+
+// marshal marshals a FlowUpdate into a list of netfilter.Attributes.
+func (u FlowUpdate) marshal() ([]netfilter.Attribute, error) {
+	f := u.Fields
+	if f == 0 || f&^fieldsMutable != 0 {
+		return nil, errUpdateFields
+	}
+
+	if u.Flow.TupleMaster.filled() {
+		return nil, errUpdateMaster
+	}
+
+	if u.Flow.NATSrc.filled() || u.Flow.NATDst.filled() {
+		return nil, errUpdateNAT
+	}
+
+	attrs, err := u.Flow.marshalTuples()
+	if err != nil {
+		return nil, err
+	}
+
+	// The zone identifies the entry, zero is the default zone.
+	if u.Flow.Zone != 0 {
+		a := netfilter.Attribute{Type: uint16(ctaZone)}
+		a.PutUint16(u.Flow.Zone)
+		attrs = append(attrs, a)
+	}
+
+	if f&FieldTimeout != 0 {
+		a := netfilter.Attribute{Type: uint16(ctaTimeout)}
+		a.PutUint32(u.Flow.Timeout)
+		attrs = append(attrs, a)
+	}
+
+	if f&FieldStatus != 0 {
+		attrs = append(attrs, u.Flow.Status.marshal())
+	}
+
+	if f&FieldMark != 0 {
+		a := netfilter.Attribute{Type: uint16(ctaMark)}
+		a.PutUint32(u.Flow.Mark)
+		attrs = append(attrs, a)
+	}
+
+	if f&FieldProtoInfo != 0 {
+		if !u.Flow.ProtoInfo.filled() {
+			return nil, errUpdateProtoInfo
+		}
+		attrs = append(attrs, u.Flow.ProtoInfo.marshal())
+	}
+
+	if f&FieldHelper != 0 {
+		attrs = append(attrs, u.Flow.Helper.marshal())
+	}
+
+	if f&FieldSeqAdjOrig != 0 {
+		attrs = append(attrs, u.Flow.SeqAdjOrig.marshal(false))
+	}
+
+	if f&FieldSeqAdjReply != 0 {
+		attrs = append(attrs, u.Flow.SeqAdjReply.marshal(true))
+	}
+
+	if f&FieldSynProxy != 0 {
+		attrs = append(attrs, u.Flow.SynProxy.marshal())
+	}
+
+	if f&FieldLabels != 0 {
+		labels := u.Flow.Labels
+		if len(labels) == 0 {
+			labels = make(Labels, labelsSize)
+		}
+		attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaLabels), Data: labels})
+
+		if len(u.Flow.LabelsMask) > 0 {
+			attrs = append(attrs, netfilter.Attribute{Type: uint16(ctaLabelsMask), Data: u.Flow.LabelsMask})
+		}
+	}
+
+	return attrs, nil
+}
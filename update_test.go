@@ -0,0 +1,81 @@
+package conntrack
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/netfilter"
+)
+
+func TestFlowUpdateMarshal(t *testing.T) {
+	// Zero values of selected fields are sent, unselected fields are not.
+	attrs, err := FlowUpdate{
+		Flow:   Flow{TupleOrig: flowIPPT, Zone: 2, Timeout: 120, Helper: Helper{Name: "ftp"}},
+		Fields: FieldMark | FieldStatus | FieldHelper | FieldLabels,
+	}.marshal()
+	require.NoError(t, err)
+
+	orig, err := flowIPPT.marshal(uint16(ctaTupleOrig))
+	require.NoError(t, err)
+
+	want := []netfilter.Attribute{
+		orig,
+		{Type: uint16(ctaZone), Data: []byte{0x0, 0x2}},
+		{Type: uint16(ctaStatus), Data: []byte{0x0, 0x0, 0x0, 0x0}},
+		{Type: uint16(ctaMark), Data: []byte{0x0, 0x0, 0x0, 0x0}},
+		{Type: uint16(ctaHelp), Nested: true, Children: []netfilter.Attribute{
+			{Type: uint16(ctaHelpName), Data: []byte("ftp\x00")},
+		}},
+		{Type: uint16(ctaLabels), Data: make([]byte, labelsSize)},
+	}
+	assert.Equal(t, want, attrs)
+
+	attrs, err = FlowUpdate{
+		Flow: Flow{
+			TupleReply: flowIPPT, Timeout: 0,
+			ProtoInfo: ProtoInfo{DCCP: &ProtoInfoDCCP{State: 1}},
+			Labels:    Labels{0x1}, LabelsMask: Labels{0xf},
+		},
+		Fields: FieldTimeout | FieldProtoInfo | FieldSeqAdjOrig | FieldSeqAdjReply | FieldSynProxy | FieldLabels,
+	}.marshal()
+	require.NoError(t, err)
+
+	reply, err := flowIPPT.marshal(uint16(ctaTupleReply))
+	require.NoError(t, err)
+
+	want = []netfilter.Attribute{
+		reply,
+		{Type: uint16(ctaTimeout), Data: []byte{0x0, 0x0, 0x0, 0x0}},
+		ProtoInfo{DCCP: &ProtoInfoDCCP{State: 1}}.marshal(),
+		SequenceAdjust{}.marshal(false),
+		SequenceAdjust{}.marshal(true),
+		SynProxy{}.marshal(),
+		{Type: uint16(ctaLabels), Data: []byte{0x1}},
+		{Type: uint16(ctaLabelsMask), Data: []byte{0xf}},
+	}
+	assert.Equal(t, want, attrs)
+}
+
+func TestFlowUpdateMarshalError(t *testing.T) {
+	f := Flow{TupleOrig: flowIPPT}
+
+	_, err := FlowUpdate{Flow: f}.marshal()
+	assert.ErrorIs(t, err, errUpdateFields)
+
+	_, err = FlowUpdate{Flow: f, Fields: fieldsMutable + 1}.marshal()
+	assert.ErrorIs(t, err, errUpdateFields)
+
+	_, err = FlowUpdate{Flow: f, Fields: FieldProtoInfo}.marshal()
+	assert.ErrorIs(t, err, errUpdateProtoInfo)
+
+	_, err = FlowUpdate{Flow: Flow{}, Fields: FieldMark}.marshal()
+	assert.ErrorIs(t, err, errNeedTuples)
+
+	_, err = FlowUpdate{Flow: Flow{TupleOrig: flowIPPT, TupleMaster: flowIPPT}, Fields: FieldMark}.marshal()
+	assert.ErrorIs(t, err, errUpdateMaster)
+
+	_, err = FlowUpdate{Flow: Flow{TupleOrig: flowIPPT, NATSrc: NATRange{MinAddr: flowIPPT.IP.SourceAddress}},
+		Fields: FieldMark}.marshal()
+	assert.ErrorIs(t, err, errUpdateNAT)
+}